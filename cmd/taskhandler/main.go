@@ -1,8 +1,11 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/mKaloer/TFServingCache/pkg/cachemanager"
 	"github.com/mKaloer/TFServingCache/pkg/cachemanager/modelproviders/diskmodelprovider"
@@ -11,28 +14,79 @@ import (
 	"github.com/mKaloer/TFServingCache/pkg/taskhandler/discovery/consul"
 	"github.com/mKaloer/TFServingCache/pkg/taskhandler/discovery/etcd"
 	"github.com/mKaloer/TFServingCache/pkg/taskhandler/discovery/kubernetes"
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+// Set with -ldflags "-X main.version=... -X main.commit=..."
+var (
+	version string
+	commit  string
+)
+
 func main() {
 
+	tfservingproxy.SetBuildInfo(version, commit)
 	SetConfig()
 
-	cleanup := serveCache()
-	defer cleanup()
+	coordinator := tfservingproxy.NewShutdownCoordinator()
+	serveCache(coordinator)
+	tHandler := serveProxy(coordinator)
 
-	serveProxy()
+	if err := waitForShutdown(coordinator, tHandler); err != nil {
+		log.WithError(err).Error("Could not shut down gracefully")
+	}
 
 	log.Info("Server stopped")
 }
 
-func serveCache() func() error {
+// waitForShutdown blocks until SIGINT or SIGTERM and then leaves the
+// cluster and shuts down the servers registered with coordinator, allowing
+// the shutdown grace period for requests in flight. Another signal during
+// the shutdown stops the requests left.
+func waitForShutdown(coordinator *tfservingproxy.ShutdownCoordinator, tHandler *taskhandler.TaskHandler) error {
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(received)
+
+	log.Infof("Received %v, shutting down", <-received)
+	// Leave the cluster first so that the other nodes stop routing here
+	// while the requests in flight are drained
+	if tHandler != nil {
+		if err := tHandler.DisconnectFromCluster(); err != nil {
+			log.WithError(err).Error("Could not disconnect from cluster")
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), taskhandler.ShutdownGracePeriod())
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-received:
+			log.Warnf("Received %v while shutting down, stopping requests in flight", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return coordinator.Shutdown(ctx)
+}
+
+// listenAndServe serves server in the background until it is shut down
+func listenAndServe(server *http.Server) {
+	go func() {
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Fatal("Could not listen")
+		}
+	}()
+}
+
+func serveCache(coordinator *tfservingproxy.ShutdownCoordinator) {
 
 	var (
-		restPort = viper.GetInt("cacheRestPort")
-		grpcPort = viper.GetInt("cacheGrpcPort")
+		bindAddress = viper.GetString("cacheBindAddress")
+		restPort    = viper.GetInt("cacheRestPort")
+		grpcPort    = viper.GetInt("cacheGrpcPort")
 	)
 
 	log.Infof("Cache is ready to handle requests at rest:%v and grpc:%v", restPort, grpcPort)
@@ -42,49 +96,115 @@ func serveCache() func() error {
 	cacheMux := http.NewServeMux()
 
 	cacheMux.HandleFunc("/v1/models/", cache.ServeRest())
-	go http.ListenAndServe(fmt.Sprintf(":%d", restPort), cacheMux)
-
-	go cache.GrpcProxy.Listen(grpcPort)
+	cacheServer := &http.Server{Addr: tfservingproxy.ListenAddress(bindAddress, restPort), Handler: cacheMux}
+	listenAndServe(cacheServer)
+	coordinator.AddRestProxy(cache.RestProxy, cacheServer)
 
-	return cache.GrpcProxy.Close
+	go cache.GrpcProxy.ListenAddr(tfservingproxy.ListenAddress(bindAddress, grpcPort))
+	coordinator.AddGrpcProxy(cache.GrpcProxy)
 }
 
-func serveProxy() {
+// serveProxy starts the proxy and registers its servers with coordinator.
+// It returns the TaskHandler of the proxy, or nil if it is disabled.
+func serveProxy(coordinator *tfservingproxy.ShutdownCoordinator) *taskhandler.TaskHandler {
 
 	var (
 		metricsPath = viper.GetString("metrics.metricsPath")
+		bindAddress = viper.GetString("proxyBindAddress")
 		restPort    = viper.GetInt("proxyRestPort")
 		grpcPort    = viper.GetInt("proxyGrpcPort")
 	)
 
 	proxyMux := http.NewServeMux()
+	singlePort := viper.GetBool("proxy.singlePort")
+	var tHandler *taskhandler.TaskHandler
 
 	dService := CreateDiscoveryService()
 	if dService != nil {
 
-		tHandler := taskhandler.NewTaskHandler(dService)
+		tHandler = taskhandler.NewTaskHandler(dService)
 		err := tHandler.ConnectToCluster()
 		if err != nil {
 			log.WithError(err).Fatal("Could not connect to cluster")
 		}
-		defer tHandler.DisconnectFromCluster()
 
-		go tHandler.GrpcProxy.Listen(grpcPort)
-		defer tHandler.GrpcProxy.Close()
+		if !singlePort {
+			go tHandler.GrpcProxy.ListenAddr(tfservingproxy.ListenAddress(bindAddress, grpcPort))
+			coordinator.AddGrpcProxy(tHandler.GrpcProxy)
+		}
 
 		proxyMux.HandleFunc("/v1/models/", tHandler.ServeRest())
+		if viper.IsSet("proxy.grpcWeb.allowedOrigins") {
+			grpcWeb := tHandler.GrpcProxy.GrpcWebHandler(viper.GetStringSlice("proxy.grpcWeb.allowedOrigins")...)
+			for _, service := range []string{"PredictionService", "SessionService", "ModelService"} {
+				proxyMux.Handle("/tensorflow.serving."+service+"/", grpcWeb)
+			}
+			log.Infof("gRPC-Web is available at rest:%v", restPort)
+		}
+		// The admin endpoints are only served on their own listener, never
+		// on the data path
+		if tHandler.AdminServer == nil {
+			if tHandler.MetadataCache != nil || tHandler.RoutingLog != nil || tHandler.TopModels != nil || tHandler.UpstreamDrains != nil {
+				log.Warn("The admin endpoints are not served without adminPort")
+			}
+		} else {
+			if tHandler.MetadataCache != nil {
+				tHandler.AdminServer.HandleFunc("/admin/metadata/invalidate", tHandler.MetadataCache.ServeInvalidate)
+			}
+			if tHandler.RoutingLog != nil {
+				tHandler.AdminServer.HandleFunc("/admin/debug/routing", tHandler.RoutingLog.ServeRecent)
+			}
+			if tHandler.TopModels != nil {
+				tHandler.AdminServer.HandleFunc("/admin/models/top", tHandler.TopModels.ServeTop)
+			}
+			if tHandler.UpstreamDrains != nil {
+				tHandler.AdminServer.HandleFunc("/admin/upstreams/", tHandler.UpstreamDrains.ServeDrain)
+			}
+			adminAddress := tfservingproxy.ListenAddress(viper.GetString("adminBindAddress"), viper.GetInt("adminPort"))
+			go func() {
+				if err := tHandler.AdminServer.ListenAddr(adminAddress); err != nil {
+					log.WithError(err).Error("Could not serve the admin endpoints")
+				}
+			}()
+			coordinator.AddAdminServer(tHandler.AdminServer)
+			log.Infof("Admin endpoints are available at %v", adminAddress)
+		}
 
-		log.Infof("Proxy is ready to handle requests at rest:%v and grpc:%v", restPort, grpcPort)
+		if singlePort {
+			log.Infof("Proxy is ready to handle REST and grpc requests at %v", restPort)
+		} else {
+			log.Infof("Proxy is ready to handle requests at rest:%v and grpc:%v", restPort, grpcPort)
+		}
 
 	} else {
 		log.Info("Proxy is disabled")
 	}
 
 	proxyMux.HandleFunc(metricsPath, promhttp.Handler().ServeHTTP)
+	proxyMux.HandleFunc("/version", tfservingproxy.ServeVersion)
 
 	log.Infof("Metrics is available at %v:%v", restPort, metricsPath)
 
-	http.ListenAndServe(fmt.Sprintf(":%d", restPort), proxyMux)
+	address := tfservingproxy.ListenAddress(bindAddress, restPort)
+	if singlePort && tHandler != nil {
+		combined := tfservingproxy.NewCombinedProxy(tHandler.GrpcProxy, proxyMux)
+		go func() {
+			if err := combined.ListenAddr(address); err != nil {
+				log.WithError(err).Fatal("Could not listen")
+			}
+		}()
+		coordinator.AddCombinedProxy(combined)
+		coordinator.AddRestProxy(tHandler.RestProxy, nil)
+		return tHandler
+	}
+	proxyServer := &http.Server{Addr: address, Handler: proxyMux}
+	listenAndServe(proxyServer)
+	if tHandler != nil {
+		coordinator.AddRestProxy(tHandler.RestProxy, proxyServer)
+	} else {
+		coordinator.AddCloser(proxyServer)
+	}
+	return tHandler
 }
 
 func CreateCacheManager() *cachemanager.CacheManager {
@@ -1,6 +1,6 @@
 module github.com/mKaloer/TFServingCache
 
-go 1.13
+go 1.14
 
 require (
 	github.com/aws/aws-sdk-go v1.28.6
@@ -10,10 +10,18 @@ require (
 	github.com/hashicorp/consul/api v1.3.0
 	github.com/otiai10/copy v1.0.2
 	github.com/prometheus/client_golang v1.5.0
+	github.com/prometheus/client_model v0.2.0
 	github.com/sirupsen/logrus v1.4.2
+	github.com/spf13/cast v1.3.0
 	github.com/spf13/viper v1.6.1
 	github.com/tensorflow/tensorflow/tensorflow/go/core v0.0.0-00010101000000-000000000000
 	go.etcd.io/etcd v3.3.18+incompatible
+	go.opentelemetry.io/otel v1.0.0
+	go.opentelemetry.io/otel/sdk v1.0.0
+	go.opentelemetry.io/otel/trace v1.0.0
+	golang.org/x/net v0.0.0-20191004110552-13f9640d40b9
+	golang.org/x/time v0.0.0-20190308202827-9d24e82272b4
+	google.golang.org/genproto v0.0.0-20190819201941-24fa4b261c55
 	google.golang.org/grpc v1.26.0
 	k8s.io/api v0.18.3
 	k8s.io/apimachinery v0.18.3
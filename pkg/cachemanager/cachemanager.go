@@ -200,10 +200,11 @@ func New(
 		MaxConcurrentModels:          maxConcurrentModels,
 	}
 	h.RestProxy = tfservingproxy.NewRestProxy(h.restDirector)
-	h.GrpcProxy = tfservingproxy.NewGrpcProxy(h.grpcDirector)
+	h.GrpcProxy = tfservingproxy.NewGrpcProxy(h.grpcDirector,
+		tfservingproxy.WithModelLabels(viper.GetBool("metrics.modelLabels")))
 
 	// Create new grpc client
-	localConn, err := grpc.Dial(h.localGrpcURL,
+	localConn, err := h.GrpcProxy.DialUpstream(h.localGrpcURL,
 		grpc.WithInsecure(),
 		grpc.WithTimeout(viper.GetDuration("proxy.grpcTimeout")*time.Second),
 		grpc.WithConnectParams(grpc.ConnectParams{Backoff: backoff.DefaultConfig}))
@@ -235,7 +236,6 @@ func (cache *CacheManager) restDirector(req *http.Request, modelName string, ver
 	err := cache.handleModelRequest(modelName, version)
 	if err != nil {
 		log.WithError(err).Errorf("Error handling request. Aborting: %s", req.URL.String())
-		req.Response.StatusCode = 500
 		return fmt.Errorf("Error handling request. Aborting: %s, %w", req.URL.String(), err)
 	}
 	localURL := cache.localRestURL
@@ -264,7 +264,7 @@ func (cache *CacheManager) handleModelRequest(modelName string, version string)
 	modelVersion, err := strconv.ParseInt(version, 10, 64)
 	if err != nil {
 		log.WithError(err).Errorf("Error handling request. Version must be valid integer: '%s'", version)
-		return err
+		return fmt.Errorf("Version must be valid integer: '%s': %w", version, tfservingproxy.ErrInvalidModel)
 	}
 	identifier := ModelIdentifier{ModelName: modelName, Version: modelVersion}
 	err = cache.fetchModel(identifier)
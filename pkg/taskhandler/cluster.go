@@ -45,6 +45,8 @@ type ClusterConnection struct {
 	consistent       *consistent.Consistent
 	DiscoveryService DiscoveryService
 	State            ClusterState
+	// OnUpdate is called with the members each time they change
+	OnUpdate         func(members []ServingService)
 	memberUpdateChan chan []ServingService
 }
 
@@ -109,6 +111,9 @@ func clusterUpdated(cluster *ClusterConnection, updateChan chan []ServingService
 			services[m] = memberships[m].String()
 		}
 		cluster.consistent.Set(services)
+		if cluster.OnUpdate != nil {
+			cluster.OnUpdate(memberships)
+		}
 	}
 }
 
@@ -1,32 +1,45 @@
 package taskhandler
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"net/http"
 	"net/url"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cast"
 	"github.com/spf13/viper"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/backoff"
 )
 
 // TaskHandler handles TFServing jobs. A TaskHandler is
 // usually associated with one TFServing server, e.g. as a sidecar.
 type TaskHandler struct {
-	Cluster         *ClusterConnection
-	RestProxy       *tfservingproxy.RestProxy
-	GrpcProxy       *tfservingproxy.GrpcProxy
-	grpcConnections *grpcConnMap
-}
-
-type grpcConnMap struct {
-	ConnMap map[string]*grpc.ClientConn
-	mutex   sync.RWMutex
+	Cluster   *ClusterConnection
+	RestProxy *tfservingproxy.RestProxy
+	GrpcProxy *tfservingproxy.GrpcProxy
+	// MetadataCache is shared by both proxies, or nil if disabled
+	MetadataCache *tfservingproxy.MetadataCache
+	// RoutingLog records the routing decisions of both proxies, or is nil
+	// if disabled
+	RoutingLog *tfservingproxy.RoutingLog
+	// TopModels tracks the models with the most traffic on both proxies,
+	// or is nil if disabled
+	TopModels *tfservingproxy.TopModels
+	// UpstreamDrains are the nodes both proxies avoid, or nil if draining
+	// is disabled
+	UpstreamDrains *tfservingproxy.UpstreamDrains
+	// AdminServer serves the admin endpoints on adminPort, or is nil if
+	// the admin listener is disabled
+	AdminServer *tfservingproxy.AdminServer
+	// nodeWeights are the weights of the nodes by host, 1 if not listed
+	nodeWeights map[string]int
 }
 
 // ServeRest returns a function for HTTP serving
@@ -37,28 +50,423 @@ func (handler *TaskHandler) ServeRest() func(http.ResponseWriter, *http.Request)
 // NewTaskHandler creates a new TaskHandler
 func NewTaskHandler(dService DiscoveryService) *TaskHandler {
 	h := &TaskHandler{
-		Cluster: NewClusterConnection(dService),
+		Cluster:     NewClusterConnection(dService),
+		nodeWeights: nodeWeights(),
 	}
 
 	rand.Seed(time.Now().UnixNano())
+	h.Cluster.OnUpdate = func(members []ServingService) {
+		h.GrpcProxy.SetReady(len(members) > 0)
+		// Cached REST metadata came from any node of its model
+		if h.MetadataCache != nil {
+			h.MetadataCache.InvalidateAll()
+		}
+	}
 
-	h.RestProxy = tfservingproxy.NewRestProxy(h.restDirector)
-	h.GrpcProxy = tfservingproxy.NewGrpcProxy(h.grpcDirector)
-	h.grpcConnections = &grpcConnMap{ConnMap: make(map[string]*grpc.ClientConn)}
+	grpcOpts := grpcProxyOptions()
+	restOpts := []tfservingproxy.RestProxyOption{tfservingproxy.WithRESTModelLabels(viper.GetBool("metrics.modelLabels"))}
+	if viper.IsSet("proxy.slowRequests") {
+		restOpts = append(restOpts, tfservingproxy.WithRESTSlowRequestLog(slowRequestThresholds()))
+	}
+	if viper.IsSet("proxy.rateLimits") {
+		// Both proxies share the limiter so each model has one budget
+		limiter := tfservingproxy.NewRateLimiter(rateLimits())
+		grpcOpts = append(grpcOpts, tfservingproxy.WithRateLimiter(limiter))
+		restOpts = append(restOpts, tfservingproxy.WithRESTRateLimiter(limiter))
+	}
+	if viper.IsSet("proxy.clientQuotas") {
+		// Both proxies share the quotas so each client has one budget
+		quotas := clientQuotas()
+		grpcOpts = append(grpcOpts, tfservingproxy.WithClientQuotas(quotas))
+		restOpts = append(restOpts, tfservingproxy.WithRESTClientQuotas(quotas))
+	}
+	if viper.IsSet("proxy.unavailableRetry") {
+		restOpts = append(restOpts, tfservingproxy.WithRESTUnavailableRetry(tfservingproxy.UnavailableRetry{
+			Statuses: viper.GetIntSlice("proxy.unavailableRetry.statuses"),
+			Backoff:  viper.GetDuration("proxy.unavailableRetry.backoff") * time.Millisecond,
+			MaxWait:  viper.GetDuration("proxy.unavailableRetry.maxWait") * time.Millisecond,
+		}))
+	}
+	if viper.IsSet("proxy.restTransport") {
+		perHost := make(map[string]int)
+		for host, limit := range viper.GetStringMap("proxy.restTransport.perHost") {
+			perHost[host] = cast.ToInt(limit)
+		}
+		restOpts = append(restOpts, tfservingproxy.WithRESTTransportLimits(tfservingproxy.RESTTransportConfig{
+			MaxConnsPerHost:     viper.GetInt("proxy.restTransport.maxConnsPerHost"),
+			PerHost:             perHost,
+			MaxIdleConnsPerHost: viper.GetInt("proxy.restTransport.maxIdleConnsPerHost"),
+			IdleConnTimeout:     viper.GetDuration("proxy.restTransport.idleConnTimeout") * time.Second,
+			ConnWait:            viper.GetDuration("proxy.restTransport.connWait") * time.Millisecond,
+		}))
+	}
+	if viper.IsSet("proxy.restHeaders") {
+		restOpts = append(restOpts, tfservingproxy.WithRESTHeaderFilters(tfservingproxy.HeaderFilter{
+			Allow: viper.GetStringSlice("proxy.restHeaders.request.allow"),
+			Deny:  viper.GetStringSlice("proxy.restHeaders.request.deny"),
+		}, tfservingproxy.HeaderFilter{
+			Allow: viper.GetStringSlice("proxy.restHeaders.response.allow"),
+			Deny:  viper.GetStringSlice("proxy.restHeaders.response.deny"),
+		}))
+	}
+	if viper.GetBool("proxy.coalescing.enabled") {
+		restOpts = append(restOpts, tfservingproxy.WithRESTCoalescing(tfservingproxy.CoalescingConfig{
+			Enabled: true,
+			Header:  viper.GetString("proxy.coalescing.header"),
+			MaxKeys: viper.GetInt("proxy.coalescing.maxKeys"),
+		}))
+	}
+	if viper.IsSet("proxy.egressProxies") {
+		// Both proxies tunnel to the same nodes
+		if egress, err := egressProxies(); err != nil {
+			log.WithError(err).Error("Invalid egress proxies, dialing all nodes directly")
+		} else {
+			grpcOpts = append(grpcOpts, tfservingproxy.WithEgressProxies(egress))
+			restOpts = append(restOpts, tfservingproxy.WithRESTEgressProxies(egress))
+		}
+	}
+	if viper.IsSet("proxy.fairQueue") {
+		// Both proxies share the queue so they have one capacity
+		weights := make(map[string]int)
+		for model, weight := range viper.GetStringMap("proxy.fairQueue.weights") {
+			weights[model] = cast.ToInt(weight)
+		}
+		queue := tfservingproxy.NewFairQueue(tfservingproxy.FairQueueConfig{
+			Capacity: viper.GetInt("proxy.fairQueue.capacity"),
+			Weights:  weights,
+			MaxDepth: viper.GetInt("proxy.fairQueue.maxDepth"),
+			MaxWait:  viper.GetDuration("proxy.fairQueue.maxWait") * time.Millisecond,
+		})
+		grpcOpts = append(grpcOpts, tfservingproxy.WithFairQueue(queue))
+		restOpts = append(restOpts, tfservingproxy.WithRESTFairQueue(queue))
+	}
+	if viper.IsSet("proxy.metadataCache") {
+		h.MetadataCache = tfservingproxy.NewMetadataCache(
+			time.Duration(viper.GetInt("proxy.metadataCache.ttl"))*time.Second,
+			viper.GetInt("proxy.metadataCache.maxEntries"))
+		grpcOpts = append(grpcOpts, tfservingproxy.WithMetadataCache(h.MetadataCache))
+		restOpts = append(restOpts, tfservingproxy.WithRESTMetadataCache(h.MetadataCache))
+		if viper.IsSet("proxy.metadataCache.maxAge") {
+			restOpts = append(restOpts, tfservingproxy.WithRESTMetadataMaxAge(viper.GetDuration("proxy.metadataCache.maxAge")*time.Second))
+		}
+	}
+	if viper.IsSet("proxy.routingLog") {
+		h.RoutingLog = tfservingproxy.NewRoutingLog(viper.GetInt("proxy.routingLog.size"))
+		grpcOpts = append(grpcOpts, tfservingproxy.WithRoutingLog(h.RoutingLog))
+		restOpts = append(restOpts, tfservingproxy.WithRESTRoutingLog(h.RoutingLog))
+	}
+	if viper.IsSet("proxy.experiments") {
+		// Both proxies share the experiments so a key gets one arm
+		experiments := tfservingproxy.NewExperiments(modelExperiments())
+		grpcOpts = append(grpcOpts, tfservingproxy.WithExperiments(experiments))
+		restOpts = append(restOpts, tfservingproxy.WithRESTExperiments(experiments))
+	}
+	if viper.IsSet("proxy.topModels") {
+		h.TopModels = tfservingproxy.NewTopModels(tfservingproxy.TopModelsConfig{
+			Capacity:    viper.GetInt("proxy.topModels.capacity"),
+			Window:      viper.GetDuration("proxy.topModels.window") * time.Second,
+			MetricRanks: viper.GetInt("proxy.topModels.metricRanks"),
+		})
+		prometheus.MustRegister(h.TopModels)
+		grpcOpts = append(grpcOpts, tfservingproxy.WithTopModels(h.TopModels))
+		restOpts = append(restOpts, tfservingproxy.WithRESTTopModels(h.TopModels))
+	}
+	if viper.GetBool("proxy.upstreamDrains") {
+		h.UpstreamDrains = tfservingproxy.NewUpstreamDrains()
+		grpcOpts = append(grpcOpts, tfservingproxy.WithUpstreamDrains(h.UpstreamDrains))
+		restOpts = append(restOpts, tfservingproxy.WithRESTUpstreamDrains(h.UpstreamDrains))
+	}
+	routing := tfservingproxy.HandlerFuncs{REST: h.restDirector, GRPC: tfservingproxy.ResolverFunc(h.grpcResolver)}
+	h.GrpcProxy = tfservingproxy.NewGrpcProxyWithHandler(routing, grpcOpts...)
+	if models := viper.GetStringSlice("proxy.transcoding.models"); len(models) > 0 {
+		restOpts = append(restOpts, tfservingproxy.WithTranscoding(h.GrpcProxy.Transcoder(), models...))
+	}
+	h.RestProxy = tfservingproxy.NewRestProxyWithHandler(routing, restOpts...)
+	if viper.GetInt("adminPort") > 0 {
+		h.AdminServer = tfservingproxy.NewAdminServer(h.GrpcProxy, h.RestProxy)
+	}
 	return h
 }
 
+// nodeWeights reads the weights of the nodes from the config
+func nodeWeights() map[string]int {
+	var nodes []struct {
+		Host   string
+		Weight int
+	}
+	if err := viper.UnmarshalKey("proxy.nodeWeights", &nodes); err != nil {
+		log.WithError(err).Error("Invalid node weights, balancing evenly")
+		return nil
+	}
+	weights := make(map[string]int, len(nodes))
+	for _, node := range nodes {
+		weights[node.Host] = node.Weight
+	}
+	return weights
+}
+
+// egressProxies reads the egress proxies from the config
+func egressProxies() (*tfservingproxy.EgressProxies, error) {
+	var proxies []tfservingproxy.EgressProxy
+	if err := viper.UnmarshalKey("proxy.egressProxies", &proxies); err != nil {
+		return nil, err
+	}
+	return tfservingproxy.NewEgressProxies(proxies)
+}
+
+// clientQuotas reads the per-client quotas from the config
+func clientQuotas() *tfservingproxy.ClientQuotas {
+	var key tfservingproxy.ClientKey
+	switch viper.GetString("proxy.clientQuotas.key") {
+	case "header":
+		key = tfservingproxy.ClientKeyHeader(viper.GetString("proxy.clientQuotas.header"))
+	case "peer":
+		key = tfservingproxy.ClientKeyPeer()
+	case "certificate":
+		key = tfservingproxy.ClientKeyCertificate()
+	default:
+		key = tfservingproxy.ClientKeyPrincipal()
+	}
+	perClient := make(map[string]tfservingproxy.RateLimit)
+	for client := range viper.GetStringMap("proxy.clientQuotas.perClient") {
+		perClient[client] = tfservingproxy.RateLimit{
+			PerSecond: viper.GetFloat64("proxy.clientQuotas.perClient." + client + ".perSecond"),
+			Burst:     viper.GetInt("proxy.clientQuotas.perClient." + client + ".burst"),
+		}
+	}
+	return tfservingproxy.NewClientQuotas(key, tfservingproxy.ClientQuotaConfig{
+		Default: tfservingproxy.RateLimit{
+			PerSecond: viper.GetFloat64("proxy.clientQuotas.default.perSecond"),
+			Burst:     viper.GetInt("proxy.clientQuotas.default.burst"),
+		},
+		PerClient:   perClient,
+		HashKeys:    viper.GetBool("proxy.clientQuotas.hashKeys"),
+		IdleTimeout: viper.GetDuration("proxy.clientQuotas.idleTimeout") * time.Second,
+		MaxClients:  viper.GetInt("proxy.clientQuotas.maxClients"),
+	})
+}
+
+// grpcProxyOptions reads the grpc proxy options from the config
+func grpcProxyOptions() []tfservingproxy.GrpcProxyOption {
+	opts := []tfservingproxy.GrpcProxyOption{
+		// Ready once the cluster members are known
+		tfservingproxy.WithReadinessGate(),
+		tfservingproxy.WithModelLabels(viper.GetBool("metrics.modelLabels")),
+		tfservingproxy.WithUpstreamDialOptions(
+			grpc.WithInsecure(),
+			grpc.WithTimeout(viper.GetDuration("serving.grpcPredictTimeout")*time.Second)),
+		tfservingproxy.WithUpstreamBackoff(tfservingproxy.UpstreamBackoff{
+			BaseDelay:         viper.GetDuration("proxy.upstreamBackoff.baseDelay") * time.Millisecond,
+			MaxDelay:          viper.GetDuration("proxy.upstreamBackoff.maxDelay") * time.Millisecond,
+			MinConnectTimeout: viper.GetDuration("proxy.upstreamBackoff.minConnectTimeout") * time.Millisecond,
+		}),
+	}
+	if viper.GetBool("proxy.restFallback") {
+		opts = append(opts, tfservingproxy.WithRESTFallback(nil))
+	}
+	if viper.GetBool("proxy.channelz") {
+		opts = append(opts, tfservingproxy.WithChannelz())
+	}
+	opts = append(opts, tfservingproxy.WithShutdownGracePeriod(ShutdownGracePeriod()))
+	if viper.GetBool("proxy.routingTrailers") {
+		opts = append(opts, tfservingproxy.WithRoutingTrailers())
+	}
+	if retries := viper.GetInt("proxy.upstreamRetries"); retries > 0 {
+		opts = append(opts, tfservingproxy.WithUpstreamRetries(retries))
+	}
+	if viper.IsSet("proxy.waitForReady") {
+		models := make(map[string]bool)
+		for model := range viper.GetStringMap("proxy.waitForReady.models") {
+			models[model] = viper.GetBool("proxy.waitForReady.models." + model)
+		}
+		opts = append(opts, tfservingproxy.WithWaitForReady(tfservingproxy.WaitForReady{
+			Enabled: viper.GetBool("proxy.waitForReady.enabled"),
+			Models:  models,
+		}))
+	}
+	if viper.IsSet("proxy.upstreamIdleTimeout") {
+		opts = append(opts, tfservingproxy.WithUpstreamIdleTimeout(viper.GetDuration("proxy.upstreamIdleTimeout")*time.Second))
+	}
+	if viper.IsSet("proxy.balancingPolicy") {
+		opts = append(opts, tfservingproxy.WithBalancingPolicy(viper.GetString("proxy.balancingPolicy")))
+	}
+	if viper.IsSet("proxy.modelConcurrency") {
+		perModel := make(map[string]int)
+		for model := range viper.GetStringMap("proxy.modelConcurrency.perModel") {
+			perModel[model] = viper.GetInt("proxy.modelConcurrency.perModel." + model)
+		}
+		opts = append(opts, tfservingproxy.WithModelConcurrencyLimits(tfservingproxy.ModelConcurrencyLimits{
+			Default:  viper.GetInt("proxy.modelConcurrency.default"),
+			PerModel: perModel,
+			MaxWait:  viper.GetDuration("proxy.modelConcurrency.maxWait") * time.Millisecond,
+		}))
+	}
+	if viper.IsSet("proxy.shadow.models") {
+		shadows := make(map[string]tfservingproxy.Shadow)
+		for model := range viper.GetStringMap("proxy.shadow.models") {
+			shadows[model] = tfservingproxy.Shadow{
+				Version: viper.GetInt64("proxy.shadow.models." + model + ".version"),
+				Percent: viper.GetFloat64("proxy.shadow.models." + model + ".percent"),
+			}
+		}
+		opts = append(opts, tfservingproxy.WithShadowing(shadows, viper.GetInt("proxy.shadow.maxInFlight")))
+	}
+	if viper.IsSet("proxy.timeoutOverrides") {
+		opts = append(opts, tfservingproxy.WithTimeoutOverrides(timeoutOverrides()))
+	}
+	if viper.IsSet("proxy.deadlineBudget") {
+		opts = append(opts, tfservingproxy.WithDeadlineBudget(tfservingproxy.DeadlineBudget{
+			MinRemaining: viper.GetDuration("proxy.deadlineBudget.minRemaining") * time.Millisecond,
+			Margin:       viper.GetDuration("proxy.deadlineBudget.margin") * time.Millisecond,
+		}))
+	}
+	if viper.IsSet("proxy.maxRequestBytes") {
+		limits := make(map[string]int)
+		for model := range viper.GetStringMap("proxy.maxRequestBytes") {
+			limits[model] = viper.GetInt("proxy.maxRequestBytes." + model)
+		}
+		opts = append(opts, tfservingproxy.WithModelMaxRequestSizes(limits))
+	}
+	if viper.IsSet("proxy.slowRequests") {
+		opts = append(opts, tfservingproxy.WithSlowRequestLog(slowRequestThresholds()))
+	}
+	if viper.GetBool("proxy.requestLog.enabled") {
+		opts = append(opts, tfservingproxy.WithRequestLog(tfservingproxy.RequestLogConfig{
+			Enabled:      true,
+			Metadata:     viper.GetStringSlice("proxy.requestLog.metadata"),
+			SampleRate:   viper.GetFloat64("proxy.requestLog.sampleRate"),
+			MessageSizes: viper.GetBool("proxy.requestLog.messageSizes"),
+		}))
+	}
+	if models := viper.GetStringSlice("proxy.warmModels"); len(models) > 0 {
+		opts = append(opts, tfservingproxy.WithWarmModels(warmModels(models)...))
+	}
+	if viper.IsSet("proxy.canary") {
+		opts = append(opts, tfservingproxy.WithCanaryWeights(canaryWeights()))
+	}
+	return opts
+}
+
+// timeoutOverrides reads the timeouts by method and model from the config
+func timeoutOverrides() tfservingproxy.TimeoutOverrides {
+	methodTimeouts := func(key string) map[string]time.Duration {
+		timeouts := make(map[string]time.Duration)
+		for method := range viper.GetStringMap(key) {
+			timeouts[method] = viper.GetDuration(key+"."+method) * time.Millisecond
+		}
+		return timeouts
+	}
+	models := make(map[string]tfservingproxy.ModelTimeouts)
+	for model := range viper.GetStringMap("proxy.timeoutOverrides.models") {
+		key := "proxy.timeoutOverrides.models." + model
+		models[model] = tfservingproxy.ModelTimeouts{
+			Timeout: viper.GetDuration(key+".timeout") * time.Millisecond,
+			Methods: methodTimeouts(key + ".methods"),
+		}
+	}
+	return tfservingproxy.TimeoutOverrides{
+		Methods: methodTimeouts("proxy.timeoutOverrides.methods"),
+		Models:  models,
+	}
+}
+
+// slowRequestThresholds reads the slow request thresholds from the config
+func slowRequestThresholds() tfservingproxy.SlowRequestThresholds {
+	perModel := make(map[string]time.Duration)
+	for model := range viper.GetStringMap("proxy.slowRequests.perModel") {
+		perModel[model] = viper.GetDuration("proxy.slowRequests.perModel."+model) * time.Millisecond
+	}
+	return tfservingproxy.SlowRequestThresholds{
+		Default:  viper.GetDuration("proxy.slowRequests.default") * time.Millisecond,
+		PerModel: perModel,
+	}
+}
+
+// rateLimits reads the rate limits per model from the config
+func rateLimits() map[string]tfservingproxy.RateLimit {
+	limits := make(map[string]tfservingproxy.RateLimit)
+	for model := range viper.GetStringMap("proxy.rateLimits") {
+		limits[model] = tfservingproxy.RateLimit{
+			PerSecond: viper.GetFloat64("proxy.rateLimits." + model + ".perSecond"),
+			Burst:     viper.GetInt("proxy.rateLimits." + model + ".burst"),
+		}
+	}
+	return limits
+}
+
+// warmModels parses the name:version keys of the models to keep warm
+func warmModels(models []string) []tfservingproxy.ModelKey {
+	keys := make([]tfservingproxy.ModelKey, 0, len(models))
+	for _, model := range models {
+		parts := strings.SplitN(model, ":", 2)
+		if len(parts) != 2 {
+			log.Errorf("Invalid warm model %s, expected name:version", model)
+			continue
+		}
+		keys = append(keys, tfservingproxy.ModelKey{Name: parts[0], Version: parts[1]})
+	}
+	return keys
+}
+
+// ShutdownGracePeriod returns how long to wait for calls in flight on shutdown
+func ShutdownGracePeriod() time.Duration {
+	if !viper.IsSet("proxy.shutdownGracePeriod") {
+		return 5 * time.Second
+	}
+	return viper.GetDuration("proxy.shutdownGracePeriod") * time.Second
+}
+
+// canaryWeights reads the canary version weights per model from the config
+func canaryWeights() map[string]tfservingproxy.CanaryWeights {
+	weights := make(map[string]tfservingproxy.CanaryWeights)
+	for model := range viper.GetStringMap("proxy.canary") {
+		weights[model] = make(tfservingproxy.CanaryWeights)
+		for version := range viper.GetStringMap("proxy.canary." + model) {
+			v, err := strconv.ParseInt(version, 10, 64)
+			if err != nil {
+				log.WithError(err).Errorf("Invalid canary version %s for model %s", version, model)
+				continue
+			}
+			weights[model][v] = viper.GetInt("proxy.canary." + model + "." + version)
+		}
+	}
+	return weights
+}
+
+// modelExperiments reads the experiments per model from the config
+func modelExperiments() map[string]tfservingproxy.Experiment {
+	experiments := make(map[string]tfservingproxy.Experiment)
+	for model := range viper.GetStringMap("proxy.experiments") {
+		prefix := "proxy.experiments." + model
+		arms := make(map[string]tfservingproxy.ExperimentArm)
+		for arm := range viper.GetStringMap(prefix + ".arms") {
+			arms[arm] = tfservingproxy.ExperimentArm{
+				Version: viper.GetInt64(prefix + ".arms." + arm + ".version"),
+				Weight:  viper.GetInt(prefix + ".arms." + arm + ".weight"),
+			}
+		}
+		experiments[model] = tfservingproxy.Experiment{Header: viper.GetString(prefix + ".header"), Arms: arms}
+	}
+	return experiments
+}
+
 func (handler *TaskHandler) Close() error {
 	err := handler.DisconnectFromCluster()
 	if err != nil {
 		log.WithError(err).Error("Could not disconnect from cluster")
 	}
-	err = handler.GrpcProxy.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownGracePeriod())
+	defer cancel()
+	coordinator := tfservingproxy.NewShutdownCoordinator()
+	coordinator.AddRestProxy(handler.RestProxy, nil)
+	coordinator.AddGrpcProxy(handler.GrpcProxy)
+	if handler.AdminServer != nil {
+		coordinator.AddAdminServer(handler.AdminServer)
+	}
+	err = coordinator.Shutdown(ctx)
 	if err != nil {
-		log.WithError(err).Error("Could not close grpc proxy")
+		log.WithError(err).Error("Could not shut down the proxies")
 	}
-	err = handler.grpcConnections.Close()
-
 	return err
 }
 
@@ -71,28 +479,39 @@ func (handler *TaskHandler) ConnectToCluster() error {
 // DisconnectFromCluster disconnects the TaskHandler from the
 // cluster (eventually)
 func (handler *TaskHandler) DisconnectFromCluster() error {
+	handler.GrpcProxy.SetReady(false)
 	return handler.Cluster.Disconnect()
 }
 
-// nodeForKey returns a node that can handle the given model
-func (handler *TaskHandler) nodeForKey(modelName string, version string) (ServingService, error) {
+// restTargetsForKey returns the REST endpoints of the nodes that can
+// handle the given model
+func (handler *TaskHandler) restTargetsForKey(modelName string, version string) ([]tfservingproxy.Target, error) {
 	var modelKey = modelName + "##" + version
 	nodes, err := handler.Cluster.FindNodeForKey(modelKey)
 	if err != nil {
-		return ServingService{}, err
+		return nil, fmt.Errorf("%v: %w", err, tfservingproxy.ErrUnavailable)
+	}
+	targets := make([]tfservingproxy.Target, len(nodes))
+	for i, node := range nodes {
+		targets[i] = tfservingproxy.Target{Address: fmt.Sprintf("%s:%d", node.Host, node.RestPort), Weight: handler.nodeWeights[node.Host]}
 	}
-	// Pick random node
-	return nodes[rand.Intn(len(nodes))], nil
+	return targets, nil
 }
 
 // restDirector is the director of REST requests.
 func (handler *TaskHandler) restDirector(req *http.Request, modelName string, version string) error {
-	selectedNode, err := handler.nodeForKey(modelName, version)
+	targets, err := handler.restTargetsForKey(modelName, version)
 	if err != nil {
 		log.WithError(err).Error("Error finding node for model")
 		return fmt.Errorf("Error finding node for model: %w", err)
 	}
-	selectedURL, err := url.Parse(fmt.Sprintf("http://%s:%d", selectedNode.Host, selectedNode.RestPort))
+	// Pick a node by weight
+	selected, err := tfservingproxy.PickTarget(req.Context(), targets)
+	if err != nil {
+		log.WithError(err).Error("Error finding node for model")
+		return fmt.Errorf("Error finding node for model: %w", err)
+	}
+	selectedURL, err := url.Parse("http://" + selected.Address)
 	if err != nil {
 		log.WithError(err).Error("Error parsing proxy url")
 		return fmt.Errorf("Error parsing proxy url: %w", err)
@@ -107,44 +526,23 @@ func (handler *TaskHandler) restDirector(req *http.Request, modelName string, ve
 	return nil
 }
 
-// grpcDirector is the director of GRPC requests.
-func (handler *TaskHandler) grpcDirector(modelName string, version string) (*grpc.ClientConn, error) {
-	selectedNode, err := handler.nodeForKey(modelName, version)
+// grpcResolver resolves GRPC requests to all nodes holding the model, so
+// that the proxy balances calls over them
+func (handler *TaskHandler) grpcResolver(ctx context.Context, key tfservingproxy.ModelKey) (tfservingproxy.Resolution, error) {
+	nodes, err := handler.Cluster.FindNodeForKey(key.Name + "##" + key.Version)
 	if err != nil {
 		log.WithError(err).Error("Error finding node")
-		return nil, err
+		return tfservingproxy.Resolution{}, fmt.Errorf("%v: %w", err, tfservingproxy.ErrUnavailable)
 	}
-	// grpc host is idx 0, port is idx 2 after split
-	grpcHost := fmt.Sprintf("%s:%d", selectedNode.Host, selectedNode.GrpcPort)
-	log.Infof("Forwarding to cache: %s", grpcHost)
-	// Check if connection exists - otherwise create new connection
-	handler.grpcConnections.mutex.RLock()
-	if conn, ok := handler.grpcConnections.ConnMap[grpcHost]; ok {
-		handler.grpcConnections.mutex.RUnlock()
-		return conn, nil
-	}
-	// No connection exists - swap to write lock and connect
-	handler.grpcConnections.mutex.RUnlock()
-	handler.grpcConnections.mutex.Lock()
-	defer handler.grpcConnections.mutex.Unlock()
-	conn, err := grpc.Dial(grpcHost,
-		grpc.WithInsecure(),
-		grpc.WithTimeout(viper.GetDuration("serving.grpcPredictTimeout")*time.Second),
-		grpc.WithConnectParams(grpc.ConnectParams{Backoff: backoff.DefaultConfig}))
-	if err == nil {
-		handler.grpcConnections.ConnMap[grpcHost] = conn
-	}
-	return conn, err
-
-}
-
-func (connMap *grpcConnMap) Close() error {
-	var err error = nil
-	for k := range connMap.ConnMap {
-		err = connMap.ConnMap[k].Close()
-		if err != nil {
-			log.WithError(err).Errorf("Could not close grpc connection: %s", k)
+	targets := make([]tfservingproxy.Target, len(nodes))
+	for i, node := range nodes {
+		if node.GrpcPort == 0 {
+			// Node only serves REST
+			targets[i] = tfservingproxy.Target{Address: fmt.Sprintf("%s:%d", node.Host, node.RestPort), REST: true}
+			continue
 		}
+		targets[i] = tfservingproxy.Target{Address: fmt.Sprintf("%s:%d", node.Host, node.GrpcPort), Weight: handler.nodeWeights[node.Host]}
 	}
-	return err
+	log.Debugf("Forwarding to caches: %v", targets)
+	return tfservingproxy.Resolution{Targets: targets}, nil
 }
@@ -0,0 +1,199 @@
+package tfservingproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AdminConfig configures the admin listener, which serves pprof, runtime
+// stats and the admin endpoints apart from the data path. A zero port
+// disables it.
+type AdminConfig struct {
+	BindAddress string `mapstructure:"bindAddress" yaml:"bindAddress"`
+	Port        int    `mapstructure:"port" yaml:"port"`
+}
+
+// Address returns the host:port the admin listener listens on
+func (c AdminConfig) Address() string {
+	return ListenAddress(c.BindAddress, c.Port)
+}
+
+func (c AdminConfig) validate() error {
+	if c.Port == 0 {
+		return nil
+	}
+	if err := validatePort(c.Port); err != nil {
+		return err
+	}
+	return validateBindAddress(c.BindAddress)
+}
+
+// AdminServer serves pprof under /debug/pprof/, the runtime stats of the
+// proxies under /debug/vars and the admin endpoints registered with
+// HandleFunc, on a listener of its own that can be firewalled off from
+// the data path. Nothing it serves is reachable through the proxies.
+type AdminServer struct {
+	mux       *http.ServeMux
+	server    *http.Server
+	grpcProxy *GrpcProxy
+	restProxy *RestProxy
+	started   time.Time
+	listener  net.Listener
+	mutex     sync.Mutex
+}
+
+// NewAdminServer creates an AdminServer reporting the runtime stats of
+// grpcProxy and restProxy, either of which may be nil. The upstream
+// summaries of grpcProxy are served under /debug/upstreams.
+func NewAdminServer(grpcProxy *GrpcProxy, restProxy *RestProxy) *AdminServer {
+	admin := &AdminServer{
+		mux:       http.NewServeMux(),
+		grpcProxy: grpcProxy,
+		restProxy: restProxy,
+		started:   time.Now(),
+	}
+	admin.mux.HandleFunc("/debug/pprof/", pprof.Index)
+	admin.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	admin.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	admin.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	admin.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	admin.mux.HandleFunc("/debug/vars", admin.ServeVars)
+	if grpcProxy != nil {
+		admin.mux.HandleFunc("/debug/upstreams", grpcProxy.ServeUpstreams)
+	}
+	admin.server = &http.Server{Handler: admin.mux}
+	return admin
+}
+
+// HandleFunc serves an admin endpoint on the admin listener
+func (admin *AdminServer) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	admin.mux.HandleFunc(pattern, handler)
+}
+
+// Handler returns the handler of all admin endpoints
+func (admin *AdminServer) Handler() http.Handler {
+	return admin.mux
+}
+
+// ListenAddr serves the admin endpoints on addr until the server is shut
+// down
+func (admin *AdminServer) ListenAddr(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return admin.Serve(lis)
+}
+
+// Serve serves the admin endpoints on lis until the server is shut down
+func (admin *AdminServer) Serve(lis net.Listener) error {
+	admin.mutex.Lock()
+	admin.listener = lis
+	admin.mutex.Unlock()
+	if err := admin.server.Serve(lis); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Addr returns the address the admin server listens on, or nil if it is
+// not serving yet
+func (admin *AdminServer) Addr() net.Addr {
+	admin.mutex.Lock()
+	defer admin.mutex.Unlock()
+	if admin.listener == nil {
+		return nil
+	}
+	return admin.listener.Addr()
+}
+
+// Close stops the admin server and the requests it is serving
+func (admin *AdminServer) Close() error {
+	return admin.server.Close()
+}
+
+func (admin *AdminServer) stopReady() {}
+
+func (admin *AdminServer) drain(ctx context.Context) error {
+	return nil
+}
+
+func (admin *AdminServer) closeUpstream(ctx context.Context) error {
+	if err := admin.server.Shutdown(ctx); err != nil {
+		admin.server.Close()
+		return err
+	}
+	return nil
+}
+
+// RuntimeStats are the runtime statistics served under /debug/vars
+type RuntimeStats struct {
+	Uptime     float64 `json:"uptimeSeconds"`
+	Goroutines int     `json:"goroutines"`
+	GC         GCStats `json:"gc"`
+	// InFlight are the requests being handled by protocol
+	InFlight map[string]int64 `json:"inFlight"`
+	// UpstreamConns are the upstream grpc connections by connectivity
+	// state
+	UpstreamConns map[string]int `json:"upstreamConns"`
+}
+
+// GCStats are the memory and garbage collection statistics of RuntimeStats
+type GCStats struct {
+	NumGC          uint32    `json:"numGC"`
+	PauseTotal     float64   `json:"pauseTotalSeconds"`
+	LastGC         time.Time `json:"lastGC"`
+	HeapAllocBytes uint64    `json:"heapAllocBytes"`
+	HeapObjects    uint64    `json:"heapObjects"`
+	SysBytes       uint64    `json:"sysBytes"`
+}
+
+// RuntimeStats returns the current runtime statistics
+func (admin *AdminServer) RuntimeStats() RuntimeStats {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	stats := RuntimeStats{
+		Uptime:     time.Since(admin.started).Seconds(),
+		Goroutines: runtime.NumGoroutine(),
+		GC: GCStats{
+			NumGC:          mem.NumGC,
+			PauseTotal:     time.Duration(mem.PauseTotalNs).Seconds(),
+			HeapAllocBytes: mem.HeapAlloc,
+			HeapObjects:    mem.HeapObjects,
+			SysBytes:       mem.Sys,
+		},
+		InFlight:      make(map[string]int64),
+		UpstreamConns: make(map[string]int),
+	}
+	if mem.LastGC > 0 {
+		stats.GC.LastGC = time.Unix(0, int64(mem.LastGC)).UTC()
+	}
+	if admin.grpcProxy != nil {
+		stats.InFlight["grpc"] = atomic.LoadInt64(&admin.grpcProxy.inFlight)
+		for _, summary := range admin.grpcProxy.UpstreamSummaries() {
+			stats.UpstreamConns[summary.State]++
+		}
+	}
+	if admin.restProxy != nil {
+		stats.InFlight["rest"] = atomic.LoadInt64(&admin.restProxy.inFlight)
+	}
+	return stats
+}
+
+// ServeVars writes the runtime statistics as JSON
+func (admin *AdminServer) ServeVars(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(admin.RuntimeStats()); err != nil {
+		log.WithError(err).Error("Could not write runtime stats")
+	}
+}
@@ -0,0 +1,97 @@
+package tfservingproxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	"google.golang.org/grpc"
+)
+
+func TestAdminServerServesPprofAndRuntimeStats(t *testing.T) {
+	upstream := tfservingtest.NewGRPCNode(t, "upstream")
+	grpcProxy := NewGrpcProxyWithResolver(ResolverFunc(func(ctx context.Context, key ModelKey) (Resolution, error) {
+		return Resolution{Targets: []Target{{Address: "node1:8500"}}}, nil
+	}), WithUpstreamDialer(upstream.Dialer()), WithUpstreamDialOptions(grpc.WithInsecure()))
+	client := tfservingtest.NewHarness(t).Serve(grpcProxy)
+	if _, err := client.Predict(context.Background(), predictVersion("foo", 1)); err != nil {
+		t.Fatal(err)
+	}
+	restProxy := NewRestProxy(func(req *http.Request, _ string, _ string) error {
+		req.URL.Scheme, req.URL.Host = "http", "127.0.0.1:1"
+		return nil
+	})
+	admin := NewAdminServer(grpcProxy, restProxy)
+	admin.HandleFunc("/admin/ping", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte("pong"))
+	})
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- admin.Serve(lis) }()
+	get := func(path string) (int, string) {
+		t.Helper()
+		res, err := http.Get("http://" + lis.Addr().String() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	if status, body := get("/debug/pprof/"); status != http.StatusOK || !strings.Contains(body, "goroutine") {
+		t.Errorf("Expected the pprof index but got %d %s", status, body)
+	}
+	if status, body := get("/admin/ping"); status != http.StatusOK || body != "pong" {
+		t.Errorf("Expected the registered admin endpoint but got %d %s", status, body)
+	}
+	status, body := get("/debug/vars")
+	var stats RuntimeStats
+	if err := json.Unmarshal([]byte(body), &stats); status != http.StatusOK || err != nil {
+		t.Fatalf("Expected runtime stats but got %d %s: %v", status, body, err)
+	}
+	if stats.Goroutines == 0 || stats.Uptime <= 0 || stats.GC.SysBytes == 0 {
+		t.Errorf("Expected runtime stats but got %+v", stats)
+	}
+	if _, ok := stats.InFlight["grpc"]; !ok {
+		t.Errorf("Expected the grpc requests in flight but got %v", stats.InFlight)
+	}
+	if _, ok := stats.InFlight["rest"]; !ok {
+		t.Errorf("Expected the REST requests in flight but got %v", stats.InFlight)
+	}
+	if stats.UpstreamConns["READY"] != 1 {
+		t.Errorf("Expected one ready upstream connection but got %v", stats.UpstreamConns)
+	}
+
+	// The data path does not serve the admin endpoints
+	for _, path := range []string{"/debug/pprof/", "/debug/vars", "/admin/ping"} {
+		rw := httptest.NewRecorder()
+		restProxy.Serve()(rw, httptest.NewRequest("GET", path, nil))
+		if rw.Code == http.StatusOK || strings.Contains(rw.Body.String(), "goroutine") {
+			t.Errorf("Expected the REST proxy not to serve %s but got %d %s", path, rw.Code, rw.Body)
+		}
+	}
+
+	coordinator := NewShutdownCoordinator()
+	coordinator.AddGrpcProxy(grpcProxy)
+	coordinator.AddAdminServer(admin)
+	if err := coordinator.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Expected the admin server to stop cleanly but got %v", err)
+	}
+	if _, err := http.Get("http://" + lis.Addr().String() + "/debug/vars"); err == nil {
+		t.Error("Expected the admin server to be shut down with the proxies")
+	}
+}
@@ -0,0 +1,135 @@
+package tfservingproxy
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var promAuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_auth_failures_total",
+	Help: "The total number of requests rejected by the authenticator",
+}, []string{"method"})
+
+var (
+	// ErrUnauthenticated is returned by an Authenticator when the call
+	// carries no valid credentials
+	ErrUnauthenticated = errors.New("missing or invalid credentials")
+	// ErrPermissionDenied is returned by an Authenticator when the
+	// credentials are valid but may not access the model
+	ErrPermissionDenied = errors.New("access to model denied")
+)
+
+// Authenticator decides whether a call to method for modelName may proceed.
+// The credentials of the call can be read with CredentialsFromContext and
+// its client certificate with PeerIdentityFromContext.
+// Errors wrapping ErrUnauthenticated are reported as Unauthenticated, all
+// other errors as PermissionDenied.
+type Authenticator func(ctx context.Context, method string, modelName string) error
+
+// WithAuthenticator rejects calls that authenticator does not accept before
+// they are admitted, resolved or forwarded
+func WithAuthenticator(authenticator Authenticator) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.authenticator = authenticator
+	}
+}
+
+// CredentialsFromContext returns the bearer token from the authorization
+// metadata of an incoming call, or the x-api-key metadata if no bearer
+// token is present. It returns an empty string if neither is set.
+func CredentialsFromContext(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		if len(value) > 7 && strings.EqualFold(value[:7], "bearer ") {
+			return value[7:]
+		}
+	}
+	if keys := md.Get("x-api-key"); len(keys) > 0 {
+		return keys[0]
+	}
+	return ""
+}
+
+// principalKey is the context key of the principal of an authenticated call
+type principalKey struct{}
+
+// principal holds the principal recorded by the Authenticator
+type principal struct {
+	name string
+}
+
+// SetPrincipal records the principal of the call of ctx, such as the user
+// or service owning its credentials. Authenticators call it so that
+// ClientKeyPrincipal can key quotas by principal. It does nothing outside
+// of an Authenticator.
+func SetPrincipal(ctx context.Context, name string) {
+	if p, ok := ctx.Value(principalKey{}).(*principal); ok {
+		p.name = name
+	}
+}
+
+// PrincipalFromContext returns the principal recorded by the Authenticator
+// for the call of ctx, or an empty string
+func PrincipalFromContext(ctx context.Context) string {
+	if p, ok := ctx.Value(principalKey{}).(*principal); ok {
+		return p.name
+	}
+	return ""
+}
+
+// StaticTokenAuthenticator accepts calls whose credentials are a key of
+// tokens and whose model is in the token's list of models. The model
+// "*" grants access to all models. The token is the principal of the call.
+func StaticTokenAuthenticator(tokens map[string][]string) Authenticator {
+	return func(ctx context.Context, method string, modelName string) error {
+		token := CredentialsFromContext(ctx)
+		models, ok := tokens[token]
+		if token == "" || !ok {
+			return ErrUnauthenticated
+		}
+		for _, model := range models {
+			if model == "*" || model == modelName {
+				SetPrincipal(ctx, token)
+				return nil
+			}
+		}
+		return ErrPermissionDenied
+	}
+}
+
+// modelSpecRequest is implemented by all requests carrying a ModelSpec
+type modelSpecRequest interface {
+	GetModelSpec() *pb.ModelSpec
+}
+
+func authInterceptor(authenticator Authenticator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		var modelName string
+		if specReq, ok := req.(modelSpecRequest); ok {
+			modelName = specReq.GetModelSpec().GetName()
+		}
+		ctx = context.WithValue(ctx, principalKey{}, &principal{})
+		if err := authenticator(ctx, info.FullMethod, modelName); err != nil {
+			promAuthFailures.WithLabelValues(info.FullMethod).Inc()
+			logFor(ctx, log.StandardLogger()).WithError(err).Warnf("Rejecting unauthorized call to %s for model %s", info.FullMethod, modelName)
+			if _, ok := status.FromError(err); ok {
+				return nil, err
+			}
+			if errors.Is(err, ErrUnauthenticated) {
+				return nil, status.Error(codes.Unauthenticated, err.Error())
+			}
+			return nil, status.Error(codes.PermissionDenied, err.Error())
+		}
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,200 @@
+package tfservingproxy
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer/roundrobin"
+	"google.golang.org/grpc/resolver"
+)
+
+const (
+	// RoundRobin spreads calls evenly over all targets of a model,
+	// ignoring their weights
+	RoundRobin = roundrobin.Name
+	// PickFirst sends calls to the first reachable target of a model
+	PickFirst = "pick_first"
+)
+
+// staticResolverScheme is the scheme of the connections the proxy
+// balances over the targets returned by a Resolver
+const staticResolverScheme = "tfservingcache"
+
+func init() {
+	resolver.Register(staticResolverBuilder{})
+}
+
+// WithBalancingPolicy sets the grpc load balancing policy used when a
+// Resolver returns more than one target for a model. The default is
+// WeightedRoundRobin.
+func WithBalancingPolicy(policy string) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.serverImpl.conns.balancingPolicy = policy
+	}
+}
+
+// staticResolvers holds the resolver of each balanced connection by endpoint
+var staticResolvers sync.Map
+var staticResolverID int64
+
+// staticResolver hands a fixed, updatable list of addresses and their
+// weights to a ClientConn
+type staticResolver struct {
+	endpoint  string
+	addresses []string
+	weights   []int
+	cc        resolver.ClientConn
+	mutex     sync.Mutex
+}
+
+func newStaticResolver(addresses []string, weights []int) *staticResolver {
+	r := &staticResolver{
+		endpoint:  fmt.Sprintf("balanced-%d", atomic.AddInt64(&staticResolverID, 1)),
+		addresses: addresses,
+		weights:   weights,
+	}
+	staticResolvers.Store(r.endpoint, r)
+	return r
+}
+
+// target is the dial target of the resolver
+func (r *staticResolver) target() string {
+	return staticResolverScheme + ":///" + r.endpoint
+}
+
+// update replaces the addresses, letting the balancer add and remove subconnections
+func (r *staticResolver) update(addresses []string, weights []int) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.addresses, r.weights = addresses, weights
+	r.pushState()
+}
+
+func (r *staticResolver) pushState() {
+	if r.cc == nil {
+		return
+	}
+	state := resolver.State{Addresses: make([]resolver.Address, len(r.addresses))}
+	for i, address := range r.addresses {
+		state.Addresses[i] = addressFor(address, r.weights[i])
+	}
+	r.cc.UpdateState(state)
+}
+
+func (r *staticResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (r *staticResolver) Close() {
+	staticResolvers.Delete(r.endpoint)
+}
+
+type staticResolverBuilder struct{}
+
+func (staticResolverBuilder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	value, ok := staticResolvers.Load(target.Endpoint)
+	if !ok {
+		return nil, fmt.Errorf("unknown balanced target: %s", target.Endpoint)
+	}
+	r := value.(*staticResolver)
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cc = cc
+	r.pushState()
+	return r, nil
+}
+
+func (staticResolverBuilder) Scheme() string {
+	return staticResolverScheme
+}
+
+// balancedConn is a connection balancing calls for one model over its targets
+type balancedConn struct {
+	conn      *grpc.ClientConn
+	resolver  *staticResolver
+	addresses []string
+	weights   []int
+	calls     *callCounters
+}
+
+// getBalanced returns the balanced connection for key, dialing it if needed
+// and updating its addresses if the resolver's answer changed. A new
+// connection is counted under modelLabel on the pool metrics.
+func (manager *connManager) getBalanced(key ModelKey, modelLabel string, addresses []string, weights []int) (*grpc.ClientConn, error) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if manager.closed {
+		return nil, errShuttingDown
+	}
+	if balanced, ok := manager.balanced[key]; ok {
+		if !sameAddresses(balanced.addresses, addresses) || !sameWeights(balanced.weights, weights) {
+			balanced.addresses, balanced.weights = addresses, weights
+			balanced.resolver.update(addresses, weights)
+		}
+		balanced.calls.touch()
+		return balanced.conn, nil
+	}
+	promPoolLookups.WithLabelValues(poolDialed).Inc()
+	r := newStaticResolver(addresses, weights)
+	calls := newCallCounters(r.target(), balancedPoolPrefix+modelLabel)
+	conn, err := manager.dial(r.target(),
+		grpc.WithDefaultServiceConfig(fmt.Sprintf(`{"loadBalancingPolicy":%q}`, manager.balancingPolicy)),
+		grpc.WithChainUnaryInterceptor(calls.interceptor))
+	if err != nil {
+		calls.release()
+		r.Close()
+		return nil, err
+	}
+	manager.balanced[key] = &balancedConn{conn: conn, resolver: r, addresses: addresses, weights: weights, calls: calls}
+	return conn, nil
+}
+
+// dropBalanced removes the balanced connection of key, if it has one, once
+// its resolution is down to a single target. The connection is closed as
+// soon as its calls in flight are done.
+func (manager *connManager) dropBalanced(key ModelKey) {
+	manager.mutex.RLock()
+	_, ok := manager.balanced[key]
+	manager.mutex.RUnlock()
+	if !ok {
+		return
+	}
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	balanced, ok := manager.balanced[key]
+	if !ok {
+		return
+	}
+	log.Debugf("Closing balanced grpc connection for model %s down to a single target", key)
+	delete(manager.balanced, key)
+	promPoolEvictions.WithLabelValues(evictSingleTarget).Inc()
+	balanced.calls.closeWhenIdle(func() {
+		balanced.calls.release()
+		balanced.conn.Close()
+	})
+}
+
+func sameAddresses(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameWeights(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package tfservingproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// DefaultMaxTransformBytes is the largest body buffered for a
+// BodyTransform if WithRESTBodyTransforms is given no limit
+const DefaultMaxTransformBytes = 16 << 20
+
+var promBodyTransforms = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_rest_body_transforms_total",
+	Help: "The total number of REST request bodies rewritten by a body transform",
+}, []string{"model"})
+
+// BodyTransform rewrites the body of a REST request for key before it is
+// forwarded, for example to add defaults that legacy clients leave out.
+// An error rejects the request with 400 and the message of the error.
+type BodyTransform func(key ModelKey, body []byte) ([]byte, error)
+
+// bodyTransforms are the BodyTransforms of a RestProxy by model name
+type bodyTransforms struct {
+	transforms map[string]BodyTransform
+	maxBytes   int64
+}
+
+// WithRESTBodyTransforms rewrites the bodies of REST requests for the
+// models in transforms with their BodyTransform. Their bodies are read
+// into memory, so bodies larger than maxBytes are rejected with 413. A
+// non-positive maxBytes uses DefaultMaxTransformBytes. Requests for other
+// models are streamed upstream untouched, unless a retry needs their body,
+// see WithRESTUnavailableRetry.
+func WithRESTBodyTransforms(transforms map[string]BodyTransform, maxBytes int) RestProxyOption {
+	return func(proxy *RestProxy) {
+		if len(transforms) == 0 {
+			proxy.bodyTransforms = nil
+			return
+		}
+		if maxBytes <= 0 {
+			maxBytes = DefaultMaxTransformBytes
+		}
+		proxy.bodyTransforms = &bodyTransforms{transforms: transforms, maxBytes: int64(maxBytes)}
+	}
+}
+
+// transformBody rewrites the body of req for key if its model has a
+// BodyTransform. It returns the status to answer with if the body cannot
+// be transformed.
+func (handler *RestProxy) transformBody(req *http.Request, key ModelKey) (int, error) {
+	if handler.bodyTransforms == nil || req.Body == nil || req.Body == http.NoBody {
+		return 0, nil
+	}
+	transform, ok := handler.bodyTransforms.transforms[key.Name]
+	if !ok {
+		return 0, nil
+	}
+	limit := handler.bodyTransforms.maxBytes
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, limit+1))
+	req.Body.Close()
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("could not read body: %v", err)
+	}
+	if int64(len(body)) > limit {
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("body exceeds the limit of %d bytes for model %s", limit, key.Name)
+	}
+	if body, err = transform(key, body); err != nil {
+		return http.StatusBadRequest, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	promBodyTransforms.WithLabelValues(handler.modelLabel(key.Name)).Inc()
+	return 0, nil
+}
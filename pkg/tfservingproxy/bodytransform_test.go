@@ -0,0 +1,81 @@
+package tfservingproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// defaultSignature adds the serving_default signature to predict bodies
+// without one
+func defaultSignature(_ ModelKey, body []byte) ([]byte, error) {
+	var predict map[string]interface{}
+	if err := json.Unmarshal(body, &predict); err != nil {
+		return nil, errors.New("malformed JSON body")
+	}
+	if _, ok := predict["signature_name"]; !ok {
+		predict["signature_name"] = "serving_default"
+	}
+	return json.Marshal(predict)
+}
+
+func TestRESTBodyTransform(t *testing.T) {
+	upstream := tfservingtest.NewRESTNode(t, "upstream")
+	lengths := make(chan int64, 1)
+	upstream.Handle("", "", func(rw http.ResponseWriter, req *http.Request) {
+		lengths <- req.ContentLength
+		rw.Write([]byte(`{"predictions": [1]}`))
+	})
+	proxy := NewRestProxy(func(req *http.Request, _ string, _ string) error {
+		req.URL.Scheme, req.URL.Host = "http", upstream.Address()
+		return nil
+	}, WithRESTBodyTransforms(map[string]BodyTransform{"legacy": defaultSignature}, 64))
+	serve := func(model string, body string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		proxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/"+model+"/versions/1:predict", strings.NewReader(body)))
+		return rw
+	}
+	before := testutil.ToFloat64(promBodyTransforms.WithLabelValues(allModelsLabel))
+
+	if rw := serve("legacy", `{"instances": [1]}`); rw.Code != http.StatusOK {
+		t.Fatalf("Expected the transformed request to succeed but got %d %s", rw.Code, rw.Body)
+	}
+	want := `{"instances":[1],"signature_name":"serving_default"}`
+	if got := string(upstream.Requests()[0].Body); got != want {
+		t.Errorf("Expected the upstream to receive %s but got %s", want, got)
+	}
+	if n := <-lengths; n != int64(len(want)) {
+		t.Errorf("Expected a content length of %d but got %d", len(want), n)
+	}
+
+	if rw := serve("legacy", `not json`); rw.Code != http.StatusBadRequest || !strings.Contains(rw.Body.String(), "malformed JSON body") {
+		t.Errorf("Expected a failed transform to be rejected with its message but got %d %s", rw.Code, rw.Body)
+	}
+	if rw := serve("legacy", `{"instances": [`+strings.Repeat("1,", 40)+`1]}`); rw.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected a body over the limit to be rejected but got %d %s", rw.Code, rw.Body)
+	}
+
+	if rw := serve("other", `{"instances": [1]}`); rw.Code != http.StatusOK {
+		t.Fatalf("Expected the request to succeed but got %d %s", rw.Code, rw.Body)
+	}
+	<-lengths
+	if got := string(upstream.Requests()[1].Body); got != `{"instances": [1]}` {
+		t.Errorf("Expected a model without transform to be forwarded untouched but got %s", got)
+	}
+	if n := testutil.ToFloat64(promBodyTransforms.WithLabelValues(allModelsLabel)) - before; n != 1 {
+		t.Errorf("Expected one transformed request but got %v", n)
+	}
+}
+
+func TestRESTBodyTransformStreamsOtherModels(t *testing.T) {
+	transforms := []RestProxyOption{WithRESTBodyTransforms(map[string]BodyTransform{"legacy": defaultSignature}, 0)}
+	if !streamsBody(t, transforms, 1<<10) {
+		t.Error("Expected a model without transform to be streamed upstream without buffering")
+	}
+}
@@ -0,0 +1,106 @@
+package tfservingproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var promBuildInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tfservingcache_build_info",
+	Help: "A metric with a constant '1' value labeled by the version, git commit and Go version of the build",
+}, []string{"version", "commit", "go_version"})
+
+// unknownBuild is the version and commit of builds that do not record them
+const unknownBuild = "unknown"
+
+// BuildInfo describes the build of the running binary
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"goVersion"`
+}
+
+var (
+	buildInfo      BuildInfo
+	buildInfoMutex sync.RWMutex
+)
+
+func init() {
+	setBuildInfo(readBuildInfo())
+}
+
+// readBuildInfo returns the build info the Go toolchain embedded in the
+// binary. Binaries built from a module version know their version, and
+// pseudo-versions also carry the commit.
+func readBuildInfo() BuildInfo {
+	info := BuildInfo{Version: unknownBuild, Commit: unknownBuild, GoVersion: runtime.Version()}
+	embedded, ok := debug.ReadBuildInfo()
+	if !ok || embedded.Main.Version == "" || embedded.Main.Version == "(devel)" {
+		return info
+	}
+	info.Version = embedded.Main.Version
+	if commit, ok := pseudoVersionCommit(info.Version); ok {
+		info.Commit = commit
+	}
+	return info
+}
+
+// pseudoVersionCommit returns the commit prefix at the end of a
+// pseudo-version, as in v0.0.0-20200101000000-abcdef123456
+func pseudoVersionCommit(version string) (string, bool) {
+	parts := strings.Split(strings.TrimSuffix(version, "+incompatible"), "-")
+	commit := parts[len(parts)-1]
+	if len(parts) < 3 || len(commit) != 12 {
+		return "", false
+	}
+	return commit, true
+}
+
+// SetBuildInfo sets the version and commit reported for the build, such as
+// values injected with -ldflags "-X main.version=...". Empty values keep
+// those read from the binary.
+func SetBuildInfo(version string, commit string) {
+	info := GetBuildInfo()
+	if version != "" {
+		info.Version = version
+	}
+	if commit != "" {
+		info.Commit = commit
+	}
+	setBuildInfo(info)
+}
+
+// GetBuildInfo returns the build info of the running binary
+func GetBuildInfo() BuildInfo {
+	buildInfoMutex.RLock()
+	defer buildInfoMutex.RUnlock()
+	return buildInfo
+}
+
+func setBuildInfo(info BuildInfo) {
+	buildInfoMutex.Lock()
+	defer buildInfoMutex.Unlock()
+	buildInfo = info
+	promBuildInfo.Reset()
+	promBuildInfo.WithLabelValues(info.Version, info.Commit, info.GoVersion).Set(1)
+}
+
+// ServeVersion writes the build info as JSON
+func ServeVersion(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeError(rw, http.StatusMethodNotAllowed, "Use GET to read the version")
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(GetBuildInfo()); err != nil {
+		log.WithError(err).Error("Could not write build info")
+	}
+}
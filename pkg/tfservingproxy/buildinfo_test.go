@@ -0,0 +1,55 @@
+package tfservingproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBuildInfo(t *testing.T) {
+	defer setBuildInfo(GetBuildInfo())
+	SetBuildInfo("v1.2.3", "")
+	SetBuildInfo("", "abcdef123456")
+
+	want := BuildInfo{Version: "v1.2.3", Commit: "abcdef123456", GoVersion: runtime.Version()}
+	if got := GetBuildInfo(); got != want {
+		t.Errorf("Expected %+v but got %+v", want, got)
+	}
+	if n := testutil.CollectAndCount(promBuildInfo); n != 1 {
+		t.Errorf("Expected a single build info series but got %d", n)
+	}
+	if v := testutil.ToFloat64(promBuildInfo.WithLabelValues(want.Version, want.Commit, want.GoVersion)); v != 1 {
+		t.Errorf("Expected the build info metric to be 1 but got %v", v)
+	}
+
+	rw := httptest.NewRecorder()
+	ServeVersion(rw, httptest.NewRequest("GET", "/version", nil))
+	var served BuildInfo
+	if err := json.NewDecoder(rw.Body).Decode(&served); err != nil || served != want {
+		t.Errorf("Expected %+v from the version endpoint but got %+v, %v", want, served, err)
+	}
+	rw = httptest.NewRecorder()
+	ServeVersion(rw, httptest.NewRequest("POST", "/version", nil))
+	if rw.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for POST but got %d", rw.Code)
+	}
+}
+
+func TestPseudoVersionCommit(t *testing.T) {
+	tests := map[string]string{
+		"v0.0.0-20200101000000-abcdef123456":                "abcdef123456",
+		"v1.2.4-0.20200101000000-abcdef123456":              "abcdef123456",
+		"v2.0.1-0.20200101000000-abcdef123456+incompatible": "abcdef123456",
+		"v1.2.3":      "",
+		"v1.2.3-rc.1": "",
+	}
+	for version, want := range tests {
+		if got, _ := pseudoVersionCommit(version); got != want {
+			t.Errorf("Expected commit %q for %s but got %q", want, version, got)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package tfservingproxy
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// HeaderCache is the header of REST responses telling whether the model
+// was already loaded, like TrailerCache, when WithRESTCacheHeader is used
+const HeaderCache = "Tfservingcache-Cache"
+
+var (
+	promModelCacheHits = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tfservingcache_model_cache_hits_total",
+		Help: "The total number of resolved requests whose model was already loaded",
+	}, []string{"protocol", "model"})
+	promModelCacheMisses = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "tfservingcache_model_cache_misses_total",
+		Help: "The total number of resolved requests whose model had to be loaded",
+	}, []string{"protocol", "model"})
+)
+
+// cacheReportKey is the context key of the cacheReport of a REST request
+type cacheReportKey struct{}
+
+// cacheReport holds the CacheDisposition reported while resolving a REST
+// request
+type cacheReport struct {
+	disposition int32
+}
+
+// ReportCacheDisposition records whether the model of a REST request was
+// already loaded. Handler.ResolveREST calls it with its ctx, or a REST
+// handler function with the context of its request, before returning.
+// Handlers that do not call it report nothing. Outside of resolving a
+// REST request it does nothing.
+func ReportCacheDisposition(ctx context.Context, disposition CacheDisposition) {
+	if report, ok := ctx.Value(cacheReportKey{}).(*cacheReport); ok {
+		atomic.StoreInt32(&report.disposition, int32(disposition))
+	}
+}
+
+// withCacheReport adds a cacheReport to the context of req
+func withCacheReport(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), cacheReportKey{}, &cacheReport{}))
+}
+
+// reportedCache returns the disposition reported for the REST request of
+// ctx
+func reportedCache(ctx context.Context) CacheDisposition {
+	if report, ok := ctx.Value(cacheReportKey{}).(*cacheReport); ok {
+		return CacheDisposition(atomic.LoadInt32(&report.disposition))
+	}
+	return CacheUnknown
+}
+
+// WithRESTCacheHeader sets HeaderCache on the responses of REST requests
+// whose handler reported the cache disposition
+func WithRESTCacheHeader() RestProxyOption {
+	return func(proxy *RestProxy) {
+		proxy.cacheHeader = true
+	}
+}
+
+// observeCache counts the disposition of a request for model. Unknown
+// dispositions are not counted.
+func observeCache(protocol string, model string, disposition CacheDisposition) {
+	switch disposition {
+	case CacheHit:
+		promModelCacheHits.WithLabelValues(protocol, model).Inc()
+	case CacheMiss, CacheMissQueued:
+		promModelCacheMisses.WithLabelValues(protocol, model).Inc()
+	}
+}
+
+// setCacheHeader sets HeaderCache on res if the handler reported the
+// disposition of its request
+func setCacheHeader(res *http.Response) {
+	if cache := reportedCache(res.Request.Context()).String(); cache != "" {
+		res.Header.Set(HeaderCache, cache)
+	}
+}
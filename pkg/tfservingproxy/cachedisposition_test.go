@@ -0,0 +1,75 @@
+package tfservingproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestGrpcCacheDisposition(t *testing.T) {
+	upstream := tfservingtest.NewGRPCNode(t, "upstream")
+	dispositions := map[string]CacheDisposition{"cd-hit": CacheHit, "cd-queued": CacheMissQueued}
+	client := startProxy(t, NewGrpcProxyWithResolver(ResolverFunc(func(_ context.Context, key ModelKey) (Resolution, error) {
+		return Resolution{Targets: []Target{{Address: "node1:8500"}}, Cache: dispositions[key.Name]}, nil
+	}), WithUpstreamDialOptions(upstream.DialOption(), grpc.WithInsecure()), WithRoutingTrailers(), WithModelLabels(true)))
+
+	for _, test := range []struct {
+		model   string
+		trailer []string
+		hits    float64
+		misses  float64
+	}{
+		{"cd-hit", []string{"hit"}, 1, 0},
+		{"cd-queued", []string{"miss-queued"}, 0, 1},
+		{"cd-unknown", nil, 0, 0},
+	} {
+		var trailer metadata.MD
+		if _, err := client.Predict(context.Background(), predictVersion(test.model, 1), grpc.Trailer(&trailer)); err != nil {
+			t.Fatal(err)
+		}
+		if got := trailer.Get(TrailerCache); len(got) != len(test.trailer) || (len(got) == 1 && got[0] != test.trailer[0]) {
+			t.Errorf("Expected cache trailer %v for %s but got %v", test.trailer, test.model, got)
+		}
+		hits := testutil.ToFloat64(promModelCacheHits.WithLabelValues("grpc", test.model))
+		misses := testutil.ToFloat64(promModelCacheMisses.WithLabelValues("grpc", test.model))
+		if hits != test.hits || misses != test.misses {
+			t.Errorf("Expected %v hits and %v misses of %s but got %v and %v", test.hits, test.misses, test.model, hits, misses)
+		}
+	}
+}
+
+func TestRESTCacheDisposition(t *testing.T) {
+	upstream := tfservingtest.NewRESTNode(t, "upstream")
+	upstream.Respond("", "", http.StatusOK, `{"predictions": [1]}`)
+	proxy := NewRestProxy(func(req *http.Request, model string, _ string) error {
+		if model == "cd-miss" {
+			ReportCacheDisposition(req.Context(), CacheMiss)
+		}
+		req.URL.Scheme, req.URL.Host = "http", upstream.Address()
+		return nil
+	}, WithRESTCacheHeader())
+
+	before := testutil.ToFloat64(promModelCacheMisses.WithLabelValues("rest", allModelsLabel))
+	for _, test := range []struct {
+		model  string
+		header string
+	}{
+		{"cd-miss", "miss"},
+		{"cd-unreported", ""},
+	} {
+		rw := httptest.NewRecorder()
+		proxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/"+test.model+"/versions/1:predict", nil))
+		if rw.Code != http.StatusOK || rw.Header().Get(HeaderCache) != test.header {
+			t.Errorf("Expected %s to be answered with cache header %q but got %d %v", test.model, test.header, rw.Code, rw.Header())
+		}
+	}
+	if n := testutil.ToFloat64(promModelCacheMisses.WithLabelValues("rest", allModelsLabel)) - before; n != 1 {
+		t.Errorf("Expected one miss without model labels but got %v", n)
+	}
+}
@@ -0,0 +1,120 @@
+package tfservingproxy
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var promCanaryRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_canary_requests_total",
+	Help: "The total number of unpinned grpc calls routed to each canary version",
+}, []string{"model", "version"})
+
+// CanaryWeights maps model versions to their relative share of the calls
+// that do not pin a version
+type CanaryWeights map[int64]int
+
+// WithCanaryWeights splits the calls to the models in weights that do not
+// pin a version between the weighted versions. Calls pinning a version or
+// a version label bypass the split.
+func WithCanaryWeights(weights map[string]CanaryWeights) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		for model, modelWeights := range weights {
+			proxy.tunables.canaries.set(model, modelWeights)
+		}
+	}
+}
+
+// SetCanaryWeights replaces the canary split of model until ApplyConfig
+// replaces the canary weights of the config. Empty weights remove the
+// split. It is safe to call while serving.
+func (proxy *GrpcProxy) SetCanaryWeights(model string, weights CanaryWeights) {
+	proxy.reconfigure.Lock()
+	defer proxy.reconfigure.Unlock()
+	next := *proxy.serverImpl.settings()
+	next.canaries = next.canaries.clone()
+	next.canaries.set(model, weights)
+	proxy.serverImpl.live.Store(&next)
+}
+
+// canaries holds the canary splits per model. Like the tunables they are
+// part of, they are not modified once in use.
+type canaries struct {
+	splits map[string]canarySplit
+}
+
+// canarySplit is a weighted choice between versions
+type canarySplit struct {
+	versions   []int64
+	cumulative []int
+}
+
+func newCanaries() *canaries {
+	return &canaries{splits: make(map[string]canarySplit)}
+}
+
+func (c *canaries) set(model string, weights CanaryWeights) {
+	var split canarySplit
+	for version := range weights {
+		if weights[version] > 0 {
+			split.versions = append(split.versions, version)
+		}
+	}
+	sort.Slice(split.versions, func(i, j int) bool { return split.versions[i] < split.versions[j] })
+	total := 0
+	for _, version := range split.versions {
+		total += weights[version]
+		split.cumulative = append(split.cumulative, total)
+	}
+
+	if len(split.versions) == 0 {
+		delete(c.splits, model)
+		return
+	}
+	c.splits[model] = split
+}
+
+// clone returns a copy of the splits that can be set without affecting c
+func (c *canaries) clone() *canaries {
+	next := newCanaries()
+	for model, split := range c.splits {
+		next.splits[model] = split
+	}
+	return next
+}
+
+// choose picks a version of model by weight. It returns false if the model
+// has no canary split.
+func (c *canaries) choose(model string) (int64, bool) {
+	split, ok := c.splits[model]
+	if !ok {
+		return 0, false
+	}
+	n := rand.Intn(split.cumulative[len(split.cumulative)-1])
+	i := sort.Search(len(split.cumulative), func(i int) bool { return split.cumulative[i] > n })
+	return split.versions[i], true
+}
+
+// applyCanary pins modelSpec to a canary version if it does not request a
+// version itself. The outgoing request shares modelSpec, so the upstream
+// serves the chosen version, and retries stay on it since the spec is then
+// pinned.
+func (server *proxyServiceServer) applyCanary(modelSpec *pb.ModelSpec, route *routeInfo) {
+	if modelSpec == nil || modelSpec.GetVersionChoice() != nil {
+		return
+	}
+	version, ok := server.settings().canaries.choose(modelSpec.GetName())
+	if !ok {
+		return
+	}
+	modelSpec.VersionChoice = &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: version}}
+	route.key.Version = strconv.FormatInt(version, 10)
+	route.canary = true
+	promCanaryRequests.WithLabelValues(server.modelLabel(modelSpec.GetName()), strconv.FormatInt(version, 10)).Inc()
+}
@@ -0,0 +1,129 @@
+package tfservingproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	channelzservice "google.golang.org/grpc/channelz/service"
+)
+
+// WithChannelz registers the grpc channelz service on the proxy's server,
+// exposing the proxy's server and upstream connections to tools like
+// grpcdebug. Note that grpc collects channelz data as soon as the
+// channelz package is linked, the option only controls whether it is
+// served.
+func WithChannelz() GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.channelz = true
+	}
+}
+
+// registerChannelz registers the channelz service on server if enabled
+func (proxy *GrpcProxy) registerChannelz(server *grpc.Server) {
+	if proxy.channelz {
+		channelzservice.RegisterChannelzServiceToServer(server)
+	}
+}
+
+// UpstreamSummary describes a connection the proxy keeps to TF Serving nodes
+type UpstreamSummary struct {
+	// Target is the dial target of the connection
+	Target string `json:"target"`
+	// Model is set for connections balancing one model over several nodes
+	Model string `json:"model,omitempty"`
+	// Addresses are the nodes the connection balances over
+	Addresses []string `json:"addresses,omitempty"`
+	// State is the connectivity state, e.g. READY or TRANSIENT_FAILURE
+	State          string `json:"state"`
+	CallsStarted   int64  `json:"callsStarted"`
+	CallsSucceeded int64  `json:"callsSucceeded"`
+	CallsFailed    int64  `json:"callsFailed"`
+	// Drained is set if new calls avoid the target, see UpstreamDrains
+	Drained bool `json:"drained,omitempty"`
+}
+
+// UpstreamSummaries returns a summary of the upstream connections dialed
+// by the proxy, sorted by target. Connections returned by a Resolver in
+// Target.Conn are owned by the resolver and not included.
+func (proxy *GrpcProxy) UpstreamSummaries() []UpstreamSummary {
+	summaries := proxy.serverImpl.conns.summaries()
+	for i := range summaries {
+		summaries[i].Drained = proxy.serverImpl.drains.Drained(summaries[i].Target)
+	}
+	return summaries
+}
+
+// ServeUpstreams writes the upstream summaries as JSON
+func (proxy *GrpcProxy) ServeUpstreams(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(proxy.UpstreamSummaries()); err != nil {
+		log.WithError(err).Error("Could not write upstream summaries")
+	}
+}
+
+// callCounters counts the calls made on an upstream connection
+type callCounters struct {
+	started   int64
+	succeeded int64
+	failed    int64
+	// The pool state of the connection
+	target   string
+	label    string
+	active   int
+	lastUsed time.Time
+	closed   bool
+	// onIdle closes a connection dropped from the pool once its calls are done
+	onIdle func()
+	mutex  sync.Mutex
+}
+
+// interceptor counts the calls passing through it
+func (counters *callCounters) interceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	atomic.AddInt64(&counters.started, 1)
+	counters.begin()
+	defer counters.end()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if err != nil {
+		atomic.AddInt64(&counters.failed, 1)
+	} else {
+		atomic.AddInt64(&counters.succeeded, 1)
+	}
+	return err
+}
+
+func (counters *callCounters) summary(conn *grpc.ClientConn) UpstreamSummary {
+	return UpstreamSummary{
+		Target:         conn.Target(),
+		State:          conn.GetState().String(),
+		CallsStarted:   atomic.LoadInt64(&counters.started),
+		CallsSucceeded: atomic.LoadInt64(&counters.succeeded),
+		CallsFailed:    atomic.LoadInt64(&counters.failed),
+	}
+}
+
+// summaries returns a summary of each connection of the manager
+func (manager *connManager) summaries() []UpstreamSummary {
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+	summaries := make([]UpstreamSummary, 0, len(manager.conns)+len(manager.balanced))
+	for _, conn := range manager.conns {
+		summaries = append(summaries, conn.calls.summary(conn.ClientConn))
+	}
+	for key, balanced := range manager.balanced {
+		summary := balanced.calls.summary(balanced.conn)
+		summary.Model = key.String()
+		summary.Addresses = append([]string{}, balanced.addresses...)
+		summaries = append(summaries, summary)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Target < summaries[j].Target
+	})
+	return summaries
+}
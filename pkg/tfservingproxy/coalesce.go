@@ -0,0 +1,219 @@
+package tfservingproxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const (
+	// DefaultIdempotencyHeader is the header of the key by which REST
+	// requests are coalesced
+	DefaultIdempotencyHeader = "Idempotency-Key"
+	// DefaultMaxCoalescedKeys is the default number of keys in flight
+	DefaultMaxCoalescedKeys = 10000
+)
+
+var promCoalesced = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_rest_coalesced_total",
+	Help: "The total number of REST requests answered with the response of an identical request in flight",
+}, []string{"model"})
+
+// CoalescingConfig configures the coalescing of duplicate REST requests
+type CoalescingConfig struct {
+	// Enabled enables coalescing in NewRestProxyFromConfig
+	Enabled bool `mapstructure:"enabled" yaml:"enabled"`
+	// Header is the header of the idempotency key, DefaultIdempotencyHeader
+	// if empty
+	Header string `mapstructure:"header" yaml:"header"`
+	// MaxKeys is the most keys in flight, DefaultMaxCoalescedKeys if zero.
+	// Requests with other keys are forwarded on their own meanwhile.
+	MaxKeys int `mapstructure:"maxKeys" yaml:"maxKeys"`
+}
+
+func (config CoalescingConfig) validate() error {
+	if config.MaxKeys < 0 {
+		return fmt.Errorf("max coalesced keys must not be negative, got %d", config.MaxKeys)
+	}
+	return nil
+}
+
+// WithRESTCoalescing coalesces concurrent REST requests with the same
+// idempotency key, model, version and verb. Only the first is forwarded,
+// and all get a copy of its response. Calls are forgotten as soon as they
+// complete, so later requests with the key are forwarded again. Requests
+// with bodies over 4 MiB are forwarded on their own. Hooks see the
+// forwarded request only.
+func WithRESTCoalescing(config CoalescingConfig) RestProxyOption {
+	return func(proxy *RestProxy) {
+		if config.Header == "" {
+			config.Header = DefaultIdempotencyHeader
+		}
+		if config.MaxKeys <= 0 {
+			config.MaxKeys = DefaultMaxCoalescedKeys
+		}
+		proxy.coalescer = &coalescer{
+			header:  http.CanonicalHeaderKey(config.Header),
+			maxKeys: config.MaxKeys,
+			calls:   make(map[coalesceKey]*coalescedCall),
+			label:   proxy.modelLabel,
+		}
+	}
+}
+
+// coalescer tracks the coalesced REST calls in flight
+type coalescer struct {
+	header  string
+	maxKeys int
+	calls   map[coalesceKey]*coalescedCall
+	mutex   sync.Mutex
+	// label returns the model label of the metrics
+	label func(model string) string
+}
+
+// coalesceKey scopes idempotency keys to a model version and verb
+type coalesceKey struct {
+	model ModelKey
+	path  string
+	id    string
+}
+
+// coalescedCall is a forwarded request and the requests waiting for it
+type coalescedCall struct {
+	done chan struct{}
+	res  *capturedResponse
+	// waiters are the requests still waiting, guarded by the mutex of
+	// the coalescer. The call is canceled once all of them are gone.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// serve answers req with the response of the call in flight with the same
+// key, or forwards it with forward if there is none
+func (c *coalescer) serve(rw http.ResponseWriter, req *http.Request, key ModelKey, forward http.HandlerFunc) {
+	id := req.Header.Get(c.header)
+	if id == "" {
+		forward(rw, req)
+		return
+	}
+	// The body is read before the call can outlive req, as the transport
+	// would read it anyway. Bodies too large to buffer are not coalesced.
+	body, replayable, err := replayBody(req, maxReplayBody)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, fmt.Sprintf("could not read body: %v", err))
+		return
+	}
+	if !replayable {
+		forward(rw, req)
+		return
+	}
+	k := coalesceKey{model: key, path: req.URL.Path, id: id}
+	c.mutex.Lock()
+	call, ok := c.calls[k]
+	if ok {
+		promCoalesced.WithLabelValues(c.label(key.Name)).Inc()
+	} else {
+		if len(c.calls) >= c.maxKeys {
+			c.mutex.Unlock()
+			req.Body, req.ContentLength = ioutil.NopCloser(bytes.NewReader(body)), int64(len(body))
+			forward(rw, req)
+			return
+		}
+		ctx, cancel := context.WithCancel(detachedContext{req.Context()})
+		call = &coalescedCall{done: make(chan struct{}), cancel: cancel}
+		c.calls[k] = call
+		upstream := req.Clone(ctx)
+		upstream.Body, upstream.ContentLength = ioutil.NopCloser(bytes.NewReader(body)), int64(len(body))
+		go c.forward(k, call, upstream, forward)
+	}
+	call.waiters++
+	c.mutex.Unlock()
+
+	select {
+	case <-call.done:
+		call.res.writeTo(rw)
+	case <-req.Context().Done():
+		c.mutex.Lock()
+		if call.waiters--; call.waiters == 0 {
+			c.remove(k, call)
+			call.cancel()
+		}
+		c.mutex.Unlock()
+	}
+}
+
+// forward forwards the request of call and hands its response to the
+// waiting requests
+func (c *coalescer) forward(k coalesceKey, call *coalescedCall, req *http.Request, forward http.HandlerFunc) {
+	res := &capturedResponse{header: make(http.Header)}
+	forward(res, req)
+	call.res = res
+	c.mutex.Lock()
+	c.remove(k, call)
+	c.mutex.Unlock()
+	call.cancel()
+	close(call.done)
+}
+
+// remove forgets call if it is still the call in flight for k
+func (c *coalescer) remove(k coalesceKey, call *coalescedCall) {
+	if c.calls[k] == call {
+		delete(c.calls, k)
+	}
+}
+
+// detachedContext has the values of its parent but is never canceled, so
+// a coalesced call outlives the request that started it
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)           { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}                 { return nil }
+func (detachedContext) Err() error                            { return nil }
+func (ctx detachedContext) Value(key interface{}) interface{} { return ctx.parent.Value(key) }
+
+// capturedResponse is a response recorded to be copied to each waiting
+// request
+type capturedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (res *capturedResponse) Header() http.Header {
+	return res.header
+}
+
+func (res *capturedResponse) WriteHeader(status int) {
+	if res.status == 0 {
+		res.status = status
+	}
+}
+
+func (res *capturedResponse) Write(b []byte) (int, error) {
+	if res.status == 0 {
+		res.status = http.StatusOK
+	}
+	return res.body.Write(b)
+}
+
+// writeTo writes a copy of the response to rw
+func (res *capturedResponse) writeTo(rw http.ResponseWriter) {
+	for name, values := range res.header {
+		rw.Header()[name] = append([]string(nil), values...)
+	}
+	status := res.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	rw.WriteHeader(status)
+	rw.Write(res.body.Bytes())
+}
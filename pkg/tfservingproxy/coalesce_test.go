@@ -0,0 +1,227 @@
+package tfservingproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// blockingNode is a REST node whose responses wait until release is
+// closed
+type blockingNode struct {
+	*tfservingtest.RESTNode
+	hits    int32
+	release chan struct{}
+}
+
+func newBlockingNode(t *testing.T) *blockingNode {
+	node := &blockingNode{RESTNode: tfservingtest.NewRESTNode(t, "upstream"), release: make(chan struct{})}
+	node.Handle("", "", func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&node.hits, 1)
+		select {
+		case <-node.release:
+		case <-req.Context().Done():
+			return
+		}
+		rw.Header().Set("X-Served-By", "upstream")
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write([]byte(`{"predictions": [1]}`))
+	})
+	return node
+}
+
+func newCoalescingProxy(node *blockingNode, config CoalescingConfig) *RestProxy {
+	return NewRestProxy(func(req *http.Request, _ string, _ string) error {
+		req.URL.Scheme, req.URL.Host = "http", node.Address()
+		return nil
+	}, WithRESTCoalescing(config))
+}
+
+// waiting returns the number of requests waiting for calls in flight
+func (c *coalescer) waiting() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var waiters int
+	for _, call := range c.calls {
+		waiters += call.waiters
+	}
+	return waiters
+}
+
+// waitFor polls until condition holds
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func predictWithKey(ctx context.Context, model string, key string) *http.Request {
+	req := httptest.NewRequest("POST", "/v1/models/"+model+"/versions/1:predict", strings.NewReader(`{"instances": [1]}`))
+	if key != "" {
+		req.Header.Set(DefaultIdempotencyHeader, key)
+	}
+	return req.WithContext(ctx)
+}
+
+func TestRESTCoalescesConcurrentDuplicates(t *testing.T) {
+	node := newBlockingNode(t)
+	proxy := newCoalescingProxy(node, CoalescingConfig{})
+	before := testutil.ToFloat64(promCoalesced.WithLabelValues(allModelsLabel))
+
+	const n = 8
+	responses := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	for i := range responses {
+		responses[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rw *httptest.ResponseRecorder) {
+			defer wg.Done()
+			proxy.Serve()(rw, predictWithKey(context.Background(), "foo", "user-1"))
+		}(responses[i])
+	}
+	waitFor(t, func() bool { return proxy.coalescer.waiting() == n })
+	close(node.release)
+	wg.Wait()
+
+	if hits := atomic.LoadInt32(&node.hits); hits != 1 {
+		t.Errorf("Expected exactly one upstream call for %d duplicates but got %d", n, hits)
+	}
+	for _, rw := range responses {
+		if rw.Code != http.StatusCreated || rw.Header().Get("X-Served-By") != "upstream" || rw.Body.String() != `{"predictions": [1]}` {
+			t.Errorf("Expected a copy of the upstream response but got %d %v %s", rw.Code, rw.Header(), rw.Body)
+		}
+	}
+	if coalesced := testutil.ToFloat64(promCoalesced.WithLabelValues(allModelsLabel)) - before; coalesced != n-1 {
+		t.Errorf("Expected %d coalesced requests but got %v", n-1, coalesced)
+	}
+
+	// The call is forgotten once it completed
+	proxy.Serve()(httptest.NewRecorder(), predictWithKey(context.Background(), "foo", "user-1"))
+	if hits := atomic.LoadInt32(&node.hits); hits != 2 {
+		t.Errorf("Expected a completed call not to be reused but got %d upstream calls", hits)
+	}
+}
+
+func TestRESTCoalescingScopesKeys(t *testing.T) {
+	node := newBlockingNode(t)
+	proxy := newCoalescingProxy(node, CoalescingConfig{Header: "X-Request-Key"})
+	keyed := func(model string) *http.Request {
+		req := predictWithKey(context.Background(), model, "")
+		req.Header.Set("X-Request-Key", "user-1")
+		return req
+	}
+
+	var wg sync.WaitGroup
+	for _, req := range []*http.Request{
+		keyed("foo"),
+		keyed("bar"),
+		predictWithKey(context.Background(), "foo", ""),
+		predictWithKey(context.Background(), "foo", ""),
+		// Only the configured header is a key
+		predictWithKey(context.Background(), "foo", "user-1"),
+	} {
+		wg.Add(1)
+		go func(req *http.Request) {
+			defer wg.Done()
+			proxy.Serve()(httptest.NewRecorder(), req)
+		}(req)
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&node.hits) == 5 })
+	close(node.release)
+	wg.Wait()
+}
+
+func TestRESTCoalescingRespectsCancellation(t *testing.T) {
+	node := newBlockingNode(t)
+	proxy := newCoalescingProxy(node, CoalescingConfig{})
+
+	first, cancelFirst := context.WithCancel(context.Background())
+	firstDone := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rw := httptest.NewRecorder()
+		proxy.Serve()(rw, predictWithKey(first, "foo", "user-1"))
+		firstDone <- rw
+	}()
+	waitFor(t, func() bool { return proxy.coalescer.waiting() == 1 })
+	second := httptest.NewRecorder()
+	secondDone := make(chan struct{})
+	go func() {
+		proxy.Serve()(second, predictWithKey(context.Background(), "foo", "user-1"))
+		close(secondDone)
+	}()
+	waitFor(t, func() bool { return proxy.coalescer.waiting() == 2 })
+
+	// The request that started the call leaves without cancelling it
+	cancelFirst()
+	select {
+	case rw := <-firstDone:
+		if rw.Body.Len() != 0 {
+			t.Errorf("Expected no response for a canceled request but got %s", rw.Body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a canceled request to stop waiting")
+	}
+	close(node.release)
+	<-secondDone
+	if second.Code != http.StatusCreated || atomic.LoadInt32(&node.hits) != 1 {
+		t.Errorf("Expected the remaining request to get the response but got %d after %d upstream calls", second.Code, atomic.LoadInt32(&node.hits))
+	}
+}
+
+func TestRESTCoalescingBoundsKeys(t *testing.T) {
+	node := newBlockingNode(t)
+	proxy := newCoalescingProxy(node, CoalescingConfig{MaxKeys: 1})
+
+	var wg sync.WaitGroup
+	for _, key := range []string{"user-1", "user-2", "user-2"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			proxy.Serve()(httptest.NewRecorder(), predictWithKey(context.Background(), "foo", key))
+		}(key)
+		if key == "user-1" {
+			waitFor(t, func() bool { return proxy.coalescer.waiting() == 1 })
+		}
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&node.hits) == 3 })
+	close(node.release)
+	wg.Wait()
+	if proxy.coalescer.waiting() != 0 || len(proxy.coalescer.calls) != 0 {
+		t.Error("Expected no calls in flight once all completed")
+	}
+}
+
+func TestRESTCoalescingSkipsLargeBodies(t *testing.T) {
+	node := newBlockingNode(t)
+	proxy := newCoalescingProxy(node, CoalescingConfig{})
+	body := strings.Repeat("x", maxReplayBody+1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "/v1/models/foo/versions/1:predict", strings.NewReader(body))
+			req.Header.Set(DefaultIdempotencyHeader, "user-1")
+			proxy.Serve()(httptest.NewRecorder(), req)
+		}()
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(&node.hits) == 2 })
+	if proxy.coalescer.waiting() != 0 {
+		t.Error("Expected requests with large bodies not to be coalesced")
+	}
+	close(node.release)
+	wg.Wait()
+}
@@ -0,0 +1,169 @@
+package tfservingproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// grpcContentType is the content type prefix of grpc calls
+const grpcContentType = "application/grpc"
+
+// CombinedProxy serves a GrpcProxy and a REST handler on a single port.
+// HTTP/2 requests with a grpc content type are served by the grpc server
+// of the GrpcProxy and all other requests, including gRPC-Web calls, by
+// the REST handler. Plaintext HTTP/2 is served to clients with prior
+// knowledge, as grpc clients do. The port serves TLS with the config of
+// WithServerTLS if the GrpcProxy has one.
+//
+// Grpc calls go through the same interceptors, routing and metrics as on
+// a port of their own, but grpc keepalive options do not apply.
+type CombinedProxy struct {
+	grpc   *GrpcProxy
+	rest   http.Handler
+	server *http.Server
+	conns  map[*trackedConn]struct{}
+	mutex  sync.Mutex
+}
+
+// NewCombinedProxy creates a CombinedProxy serving grpcProxy and rest. The
+// GrpcProxy must only be served through the CombinedProxy.
+func NewCombinedProxy(grpcProxy *GrpcProxy, rest http.Handler) *CombinedProxy {
+	proxy := &CombinedProxy{
+		grpc:  grpcProxy,
+		rest:  rest,
+		conns: make(map[*trackedConn]struct{}),
+	}
+	proxy.server = &http.Server{
+		Handler:   h2c.NewHandler(proxy, &http2.Server{}),
+		TLSConfig: grpcProxy.serverTLS,
+	}
+	return proxy
+}
+
+// ServeHTTP dispatches req to the grpc server or the REST handler
+func (proxy *CombinedProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	contentType := req.Header.Get("Content-Type")
+	if req.ProtoMajor == 2 && strings.HasPrefix(contentType, grpcContentType) && !strings.HasPrefix(contentType, grpcWebContentType) {
+		proxy.grpc.GrpcProxy.ServeHTTP(rw, req)
+		return
+	}
+	proxy.rest.ServeHTTP(rw, req)
+}
+
+// ListenAddr serves both protocols on addr like GrpcProxy.ListenAddr
+func (proxy *CombinedProxy) ListenAddr(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return proxy.Serve(lis)
+}
+
+// Serve serves both protocols on lis. It blocks until the proxy is closed.
+func (proxy *CombinedProxy) Serve(lis net.Listener) error {
+	if err := proxy.grpc.start(); err != nil {
+		lis.Close()
+		return err
+	}
+	lis = &trackingListener{Listener: lis, proxy: proxy}
+	var err error
+	if proxy.server.TLSConfig != nil {
+		err = proxy.server.ServeTLS(lis, "", "")
+	} else {
+		err = proxy.server.Serve(lis)
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Close stops accepting connections and waits for the requests and calls
+// in flight for the shutdown grace period of the GrpcProxy, before closing
+// the GrpcProxy like GrpcProxy.Close
+func (proxy *CombinedProxy) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), proxy.grpc.shutdownGrace)
+	defer cancel()
+	return shutdown(ctx, []shutdownStages{proxy}, nil)
+}
+
+func (proxy *CombinedProxy) stopReady() {
+	proxy.grpc.stopReady()
+}
+
+// drain shuts down the HTTP server and waits for the grpc calls in flight
+// until ctx is done, then stops the grpc server and closes the connections
+func (proxy *CombinedProxy) drain(ctx context.Context) error {
+	proxy.grpc.stopWarming()
+	err := proxy.server.Shutdown(ctx)
+	// Plaintext HTTP/2 connections are hijacked from the server, so
+	// Shutdown does not wait for their calls
+	for atomic.LoadInt64(&proxy.grpc.inFlight) > 0 && ctx.Err() == nil {
+		time.Sleep(drainPollInterval)
+	}
+	if n := atomic.LoadInt64(&proxy.grpc.inFlight); n > 0 {
+		log.Warnf("Stopping the combined server with %d grpc calls in flight", n)
+	}
+	// GracefulStop cannot drain calls served over net/http
+	proxy.grpc.GrpcProxy.Stop()
+	proxy.closeConns()
+	return err
+}
+
+func (proxy *CombinedProxy) closeUpstream(ctx context.Context) error {
+	return proxy.grpc.closeUpstream(ctx)
+}
+
+// closeConns closes the connections still open
+func (proxy *CombinedProxy) closeConns() {
+	proxy.mutex.Lock()
+	conns := make([]*trackedConn, 0, len(proxy.conns))
+	for conn := range proxy.conns {
+		conns = append(conns, conn)
+	}
+	proxy.mutex.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// trackingListener keeps the connections it accepts in the proxy until
+// they are closed. Plaintext HTTP/2 connections are hijacked from the
+// HTTP server, so it does not close them on shutdown.
+type trackingListener struct {
+	net.Listener
+	proxy *CombinedProxy
+}
+
+func (lis *trackingListener) Accept() (net.Conn, error) {
+	conn, err := lis.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tracked := &trackedConn{Conn: conn, proxy: lis.proxy}
+	lis.proxy.mutex.Lock()
+	lis.proxy.conns[tracked] = struct{}{}
+	lis.proxy.mutex.Unlock()
+	return tracked, nil
+}
+
+type trackedConn struct {
+	net.Conn
+	proxy *CombinedProxy
+}
+
+func (conn *trackedConn) Close() error {
+	conn.proxy.mutex.Lock()
+	delete(conn.proxy.conns, conn)
+	conn.proxy.mutex.Unlock()
+	return conn.Conn.Close()
+}
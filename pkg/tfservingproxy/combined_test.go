@@ -0,0 +1,179 @@
+package tfservingproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+var serveCombined = flag.Bool("combined", false, "serve the grpc proxies of the tests through a CombinedProxy")
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if *serveCombined {
+		tfservingtest.WrapServer = func(server tfservingtest.Server) tfservingtest.Server {
+			if proxy, ok := server.(*GrpcProxy); ok {
+				return NewCombinedProxy(proxy, http.NotFoundHandler())
+			}
+			return server
+		}
+	}
+	os.Exit(m.Run())
+}
+
+// serveCombinedProxy serves a CombinedProxy of a grpc proxy in front of
+// harness and a REST proxy in front of upstream on a local port
+func serveCombinedProxy(t *testing.T, harness *tfservingtest.Harness, upstream *tfservingtest.RESTNode, opts ...GrpcProxyOption) (*CombinedProxy, string, chan error) {
+	grpcProxy := NewGrpcProxy(harness.ClientProvider, opts...)
+	restProxy := NewRestProxy(func(req *http.Request, _ string, _ string) error {
+		req.URL.Scheme, req.URL.Host = upstream.URL().Scheme, upstream.URL().Host
+		return nil
+	})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/models/", restProxy.Serve())
+	proxy := NewCombinedProxy(grpcProxy, mux)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- proxy.Serve(lis) }()
+	t.Cleanup(func() { proxy.Close() })
+	return proxy, lis.Addr().String(), served
+}
+
+func predictVersion(model string, version int64) *pb.PredictRequest {
+	return &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: model, VersionChoice: &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: version}}}}
+}
+
+func TestCombinedProxyServesBothProtocolsConcurrently(t *testing.T) {
+	harness := tfservingtest.NewHarness(t)
+	upstream := tfservingtest.NewRESTNode(t, "rest")
+	upstream.Respond("foo", "1", http.StatusOK, `{"predictions": [1]}`)
+	proxy, address, served := serveCombinedProxy(t, harness, upstream)
+
+	conn, err := grpc.Dial(address, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewPredictionServiceClient(conn)
+
+	const n = 20
+	errs := make(chan error, 2*n)
+	var calls sync.WaitGroup
+	for i := 0; i < n; i++ {
+		calls.Add(2)
+		go func() {
+			defer calls.Done()
+			_, err := client.Predict(context.Background(), predictVersion("foo", 1))
+			errs <- err
+		}()
+		go func() {
+			defer calls.Done()
+			res, err := http.Post("http://"+address+"/v1/models/foo/versions/1:predict", "application/json", strings.NewReader(`{"instances": [1]}`))
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer res.Body.Close()
+			if body, _ := ioutil.ReadAll(res.Body); res.StatusCode != http.StatusOK || res.ProtoMajor != 1 {
+				errs <- fmt.Errorf("unexpected REST response %s %d: %s", res.Proto, res.StatusCode, body)
+				return
+			}
+			errs <- nil
+		}()
+	}
+	calls.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if got := tfservingtest.Received(harness.Node(), "foo", "1"); got != n {
+		t.Errorf("Expected %d grpc calls upstream but got %d", n, got)
+	}
+	if got := tfservingtest.Received(upstream, "foo", "1"); got != n {
+		t.Errorf("Expected %d REST requests upstream but got %d", n, got)
+	}
+
+	if err := proxy.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Expected Serve to return nil after Close but got %v", err)
+	}
+}
+
+func TestCombinedProxyWaitsForCallsOnClose(t *testing.T) {
+	harness := tfservingtest.NewHarness(t, tfservingtest.SlowUpstream("slow", 200*time.Millisecond))
+	proxy, address, _ := serveCombinedProxy(t, harness, tfservingtest.NewRESTNode(t, "rest"))
+	conn, err := grpc.Dial(address, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewPredictionServiceClient(conn)
+	if _, err := client.Predict(context.Background(), predictVersion("foo", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := client.Predict(context.Background(), predictVersion("slow", 1))
+		done <- err
+	}()
+	for atomic.LoadInt64(&proxy.grpc.inFlight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	proxy.Close()
+	if err := <-done; err != nil {
+		t.Errorf("Expected the call in flight to finish but got %v", err)
+	}
+	if _, err := http.Get("http://" + address + "/v1/models/foo"); err == nil {
+		t.Error("Expected the port to be closed")
+	}
+}
+
+func TestCombinedProxyServesTLS(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	harness := tfservingtest.NewHarness(t)
+	upstream := tfservingtest.NewRESTNode(t, "rest")
+	upstream.Respond("foo", "1", http.StatusOK, `{"predictions": [1]}`)
+	_, address, _ := serveCombinedProxy(t, harness, upstream, WithServerTLS(&tls.Config{Certificates: []tls.Certificate{cert}}))
+
+	conn, err := grpc.Dial(address, grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: pool, ServerName: "proxy"})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := pb.NewPredictionServiceClient(conn).Predict(context.Background(), predictVersion("foo", 1)); err != nil {
+		t.Errorf("Expected a grpc call over TLS to succeed but got %v", err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "proxy"}, ForceAttemptHTTP2: true}}
+	res, err := client.Post("https://"+address+"/v1/models/foo/versions/1:predict", "application/json", strings.NewReader(`{"instances": [1]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.ProtoMajor != 2 {
+		t.Errorf("Expected a REST request over HTTP/2 with TLS to succeed but got %s %d", res.Proto, res.StatusCode)
+	}
+}
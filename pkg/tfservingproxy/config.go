@@ -0,0 +1,485 @@
+package tfservingproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Config configures the REST and grpc proxies. Its fields can be
+// unmarshaled from YAML or with viper.
+type Config struct {
+	Rest    RestConfig    `mapstructure:"rest" yaml:"rest"`
+	Grpc    GrpcConfig    `mapstructure:"grpc" yaml:"grpc"`
+	Metrics MetricsConfig `mapstructure:"metrics" yaml:"metrics"`
+	// RateLimits are the rate limits per model, shared by both protocols
+	// when the proxies share a RateLimiter
+	RateLimits map[string]RateLimit `mapstructure:"rateLimits" yaml:"rateLimits"`
+	// DryRun are the models resolved but not forwarded, shared by both
+	// protocols when the proxies share DryRuns
+	DryRun map[string]DryRun `mapstructure:"dryRun" yaml:"dryRun"`
+	// Faults are the faults injected by model, shared by both protocols
+	// when the proxies share Faults. None are injected by default.
+	Faults map[string]Fault `mapstructure:"faults" yaml:"faults"`
+	// Experiments are the experiments by model, shared by both protocols
+	// when the proxies share Experiments
+	Experiments map[string]Experiment `mapstructure:"experiments" yaml:"experiments"`
+	// FairQueue admits requests fairly across models once the proxy is at
+	// capacity, shared by both protocols when the proxies share a FairQueue
+	FairQueue FairQueueConfig `mapstructure:"fairQueue" yaml:"fairQueue"`
+	// EgressProxies tunnel the connections of both proxies to some nodes
+	EgressProxies []EgressProxy `mapstructure:"egressProxies" yaml:"egressProxies"`
+	// Admin is the listener of the admin endpoints, disabled by default
+	Admin AdminConfig `mapstructure:"admin" yaml:"admin"`
+}
+
+// LoadConfig reads a Config from the YAML file at path
+func LoadConfig(path string) (Config, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("yaml")
+	var cfg Config
+	if err := v.ReadInConfig(); err != nil {
+		return cfg, err
+	}
+	err := v.Unmarshal(&cfg)
+	return cfg, err
+}
+
+// TLSConfig holds the paths of a PEM encoded certificate and its key
+type TLSConfig struct {
+	CertFile string `mapstructure:"certFile" yaml:"certFile"`
+	KeyFile  string `mapstructure:"keyFile" yaml:"keyFile"`
+	// ClientCAFile is the path of the PEM encoded CAs that clients must
+	// present a certificate of. Empty does not ask for one.
+	ClientCAFile string `mapstructure:"clientCAFile" yaml:"clientCAFile"`
+}
+
+// RestConfig configures the REST proxy and the HTTP server serving it
+type RestConfig struct {
+	BindAddress string    `mapstructure:"bindAddress" yaml:"bindAddress"`
+	Port        int       `mapstructure:"port" yaml:"port"`
+	TLS         TLSConfig `mapstructure:"tls" yaml:"tls"`
+	// ReadTimeout, WriteTimeout and IdleTimeout are the timeouts of the
+	// HTTP server. Zero means no timeout.
+	ReadTimeout  time.Duration `mapstructure:"readTimeout" yaml:"readTimeout"`
+	WriteTimeout time.Duration `mapstructure:"writeTimeout" yaml:"writeTimeout"`
+	IdleTimeout  time.Duration `mapstructure:"idleTimeout" yaml:"idleTimeout"`
+	// UpstreamTimeout is how long to wait for the response headers of a
+	// node. Zero means no timeout.
+	UpstreamTimeout time.Duration `mapstructure:"upstreamTimeout" yaml:"upstreamTimeout"`
+	// UnavailableRetry retries requests that nodes answer as unavailable
+	UnavailableRetry UnavailableRetry `mapstructure:"unavailableRetry" yaml:"unavailableRetry"`
+	// Transport limits the connections to each node
+	Transport RESTTransportConfig `mapstructure:"transport" yaml:"transport"`
+	// CacheHeader sets HeaderCache on responses whose handler reported
+	// the cache disposition
+	CacheHeader bool `mapstructure:"cacheHeader" yaml:"cacheHeader"`
+	// RequestHeaders filters the headers sent to the nodes and
+	// ResponseHeaders those sent back to clients
+	RequestHeaders  HeaderFilter `mapstructure:"requestHeaders" yaml:"requestHeaders"`
+	ResponseHeaders HeaderFilter `mapstructure:"responseHeaders" yaml:"responseHeaders"`
+	// Coalescing coalesces concurrent requests with the same idempotency
+	// key
+	Coalescing CoalescingConfig `mapstructure:"coalescing" yaml:"coalescing"`
+}
+
+// GrpcConfig configures the grpc proxy
+type GrpcConfig struct {
+	BindAddress string    `mapstructure:"bindAddress" yaml:"bindAddress"`
+	Port        int       `mapstructure:"port" yaml:"port"`
+	TLS         TLSConfig `mapstructure:"tls" yaml:"tls"`
+	// MaxRecvMsgSize and MaxSendMsgSize are the largest messages in bytes
+	// received and sent. Both zero keeps the grpc defaults.
+	MaxRecvMsgSize       int                      `mapstructure:"maxRecvMsgSize" yaml:"maxRecvMsgSize"`
+	MaxSendMsgSize       int                      `mapstructure:"maxSendMsgSize" yaml:"maxSendMsgSize"`
+	MaxRequestBytes      map[string]int           `mapstructure:"maxRequestBytes" yaml:"maxRequestBytes"`
+	MaxInFlight          int64                    `mapstructure:"maxInFlight" yaml:"maxInFlight"`
+	MaxConcurrentStreams uint32                   `mapstructure:"maxConcurrentStreams" yaml:"maxConcurrentStreams"`
+	DefaultTimeout       time.Duration            `mapstructure:"defaultTimeout" yaml:"defaultTimeout"`
+	TimeoutOverrides     TimeoutOverrides         `mapstructure:"timeoutOverrides" yaml:"timeoutOverrides"`
+	DeadlineBudget       DeadlineBudget           `mapstructure:"deadlineBudget" yaml:"deadlineBudget"`
+	ShutdownGracePeriod  time.Duration            `mapstructure:"shutdownGracePeriod" yaml:"shutdownGracePeriod"`
+	UpstreamRetries      int                      `mapstructure:"upstreamRetries" yaml:"upstreamRetries"`
+	WaitForReady         WaitForReady             `mapstructure:"waitForReady" yaml:"waitForReady"`
+	UpstreamBackoff      UpstreamBackoff          `mapstructure:"upstreamBackoff" yaml:"upstreamBackoff"`
+	RoutingTrailers      bool                     `mapstructure:"routingTrailers" yaml:"routingTrailers"`
+	RESTFallback         bool                     `mapstructure:"restFallback" yaml:"restFallback"`
+	Channelz             bool                     `mapstructure:"channelz" yaml:"channelz"`
+	Reflection           bool                     `mapstructure:"reflection" yaml:"reflection"`
+	ConcurrencyLimits    ModelConcurrencyLimits   `mapstructure:"concurrencyLimits" yaml:"concurrencyLimits"`
+	CanaryWeights        map[string]CanaryWeights `mapstructure:"canaryWeights" yaml:"canaryWeights"`
+	RequestLog           RequestLogConfig         `mapstructure:"requestLog" yaml:"requestLog"`
+}
+
+// MetricsConfig configures the metrics of the proxies
+type MetricsConfig struct {
+	// Path is where the application serves the metrics
+	Path string `mapstructure:"path" yaml:"path"`
+	// ModelLabels adds the model name as a label on per-model metrics
+	ModelLabels bool `mapstructure:"modelLabels" yaml:"modelLabels"`
+}
+
+// Address returns the host:port the REST proxy listens on
+func (c RestConfig) Address() string {
+	return ListenAddress(c.BindAddress, c.Port)
+}
+
+// Address returns the host:port the grpc proxy listens on
+func (c GrpcConfig) Address() string {
+	return ListenAddress(c.BindAddress, c.Port)
+}
+
+// Server returns an HTTP server for handler with the address, timeouts
+// and TLS of the config. A server with a TLSConfig must be served with
+// ListenAndServeTLS or ServeTLS and empty file names.
+func (c RestConfig) Server(handler http.Handler) (*http.Server, error) {
+	server := &http.Server{
+		Addr:         c.Address(),
+		Handler:      handler,
+		ReadTimeout:  c.ReadTimeout,
+		WriteTimeout: c.WriteTimeout,
+		IdleTimeout:  c.IdleTimeout,
+	}
+	if c.TLS.CertFile != "" {
+		tlsConfig, err := c.TLS.load()
+		if err != nil {
+			return nil, fmt.Errorf("rest: %w", err)
+		}
+		server.TLSConfig = tlsConfig
+	}
+	return server, nil
+}
+
+// Validate returns an error describing the first invalid or contradictory
+// setting of the config
+func (c Config) Validate() error {
+	if err := c.Rest.validate(); err != nil {
+		return fmt.Errorf("rest: %w", err)
+	}
+	if err := c.Grpc.validate(); err != nil {
+		return fmt.Errorf("grpc: %w", err)
+	}
+	if c.Rest.Port != 0 && c.Rest.Port == c.Grpc.Port && c.Rest.Address() == c.Grpc.Address() {
+		return fmt.Errorf("rest and grpc both listen on %s", c.Rest.Address())
+	}
+	if err := c.Admin.validate(); err != nil {
+		return fmt.Errorf("admin: %w", err)
+	}
+	if c.Admin.Port != 0 && (c.Admin.Address() == c.Rest.Address() || c.Admin.Address() == c.Grpc.Address()) {
+		return fmt.Errorf("admin listens on %s like the data path", c.Admin.Address())
+	}
+	if c.Metrics.Path != "" && !strings.HasPrefix(c.Metrics.Path, "/") {
+		return fmt.Errorf("metrics: path %q must start with /", c.Metrics.Path)
+	}
+	for model, limit := range c.RateLimits {
+		if limit.PerSecond > 0 && limit.Burst < 1 {
+			return fmt.Errorf("rate limit of model %s needs a burst of at least 1, got %d", model, limit.Burst)
+		}
+	}
+	for model, dryRun := range c.DryRun {
+		if err := dryRun.validate(); err != nil {
+			return fmt.Errorf("dry run of model %s: %w", model, err)
+		}
+	}
+	for model, fault := range c.Faults {
+		if err := fault.validate(); err != nil {
+			return fmt.Errorf("fault of model %s: %w", model, err)
+		}
+	}
+	for model, experiment := range c.Experiments {
+		if err := experiment.validate(); err != nil {
+			return fmt.Errorf("experiment of model %s: %w", model, err)
+		}
+	}
+	if err := c.FairQueue.validate(); err != nil {
+		return fmt.Errorf("fair queue: %w", err)
+	}
+	for _, egress := range c.EgressProxies {
+		if err := egress.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c RestConfig) validate() error {
+	if err := validatePort(c.Port); err != nil {
+		return err
+	}
+	if err := validateBindAddress(c.BindAddress); err != nil {
+		return err
+	}
+	if err := c.TLS.validate(); err != nil {
+		return err
+	}
+	for name, timeout := range map[string]time.Duration{
+		"read timeout":     c.ReadTimeout,
+		"write timeout":    c.WriteTimeout,
+		"idle timeout":     c.IdleTimeout,
+		"upstream timeout": c.UpstreamTimeout,
+	} {
+		if timeout < 0 {
+			return fmt.Errorf("%s must not be negative, got %v", name, timeout)
+		}
+	}
+	if err := c.UnavailableRetry.validate(); err != nil {
+		return fmt.Errorf("unavailable retry: %w", err)
+	}
+	if err := c.Transport.validate(); err != nil {
+		return fmt.Errorf("transport: %w", err)
+	}
+	if err := c.RequestHeaders.validate(); err != nil {
+		return fmt.Errorf("request headers: %w", err)
+	}
+	if err := c.ResponseHeaders.validate(); err != nil {
+		return fmt.Errorf("response headers: %w", err)
+	}
+	if err := c.Coalescing.validate(); err != nil {
+		return fmt.Errorf("coalescing: %w", err)
+	}
+	return nil
+}
+
+func (c GrpcConfig) validate() error {
+	if err := validatePort(c.Port); err != nil {
+		return err
+	}
+	if err := validateBindAddress(c.BindAddress); err != nil {
+		return err
+	}
+	if err := c.TLS.validate(); err != nil {
+		return err
+	}
+	if c.MaxRecvMsgSize < 0 || c.MaxSendMsgSize < 0 {
+		return fmt.Errorf("max message sizes must not be negative, got %d and %d", c.MaxRecvMsgSize, c.MaxSendMsgSize)
+	}
+	if (c.MaxRecvMsgSize == 0) != (c.MaxSendMsgSize == 0) {
+		return fmt.Errorf("max message sizes must both be set, got %d and %d", c.MaxRecvMsgSize, c.MaxSendMsgSize)
+	}
+	if err := c.RequestLog.validate(); err != nil {
+		return err
+	}
+	if err := c.UpstreamBackoff.validate(); err != nil {
+		return err
+	}
+	for model, limit := range c.MaxRequestBytes {
+		if limit <= 0 {
+			return fmt.Errorf("request size limit of model %s must be positive, got %d", model, limit)
+		}
+		if c.MaxRecvMsgSize > 0 && limit > c.MaxRecvMsgSize {
+			return fmt.Errorf("request size limit of %d bytes for model %s exceeds the max message size of %d bytes", limit, model, c.MaxRecvMsgSize)
+		}
+	}
+	if c.MaxInFlight < 0 || c.UpstreamRetries < 0 {
+		return fmt.Errorf("max in flight and upstream retries must not be negative, got %d and %d", c.MaxInFlight, c.UpstreamRetries)
+	}
+	if c.DefaultTimeout < 0 || c.ShutdownGracePeriod < 0 || c.DeadlineBudget.MinRemaining < 0 || c.DeadlineBudget.Margin < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	if c.ConcurrencyLimits.Default < 0 || c.ConcurrencyLimits.MaxWait < 0 {
+		return errors.New("concurrency limits must not be negative")
+	}
+	for model, limit := range c.ConcurrencyLimits.PerModel {
+		if limit < 0 {
+			return fmt.Errorf("concurrency limit of model %s must not be negative, got %d", model, limit)
+		}
+	}
+	for model, weights := range c.CanaryWeights {
+		for version, weight := range weights {
+			if weight < 0 {
+				return fmt.Errorf("canary weight of model %s version %d must not be negative, got %d", model, version, weight)
+			}
+		}
+	}
+	if c.DefaultTimeout > 0 && c.DefaultTimeout <= c.DeadlineBudget.MinRemaining {
+		return fmt.Errorf("default timeout of %v is within the minimum deadline budget of %v", c.DefaultTimeout, c.DeadlineBudget.MinRemaining)
+	}
+	if err := c.TimeoutOverrides.validate(); err != nil {
+		return err
+	}
+	if shortest := c.TimeoutOverrides.shortest(); shortest > 0 && shortest <= c.DeadlineBudget.MinRemaining {
+		return fmt.Errorf("timeout override of %v is within the minimum deadline budget of %v", shortest, c.DeadlineBudget.MinRemaining)
+	}
+	return nil
+}
+
+// load reads the certificate of the config and the client CAs
+func (c TLSConfig) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load TLS certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if c.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read TLS client CAs: %w", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in TLS client CAs %s", c.ClientCAFile)
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+func (c TLSConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return errors.New("TLS needs both a certificate and a key file")
+	}
+	if c.ClientCAFile != "" && c.CertFile == "" {
+		return errors.New("TLS client CAs need a certificate and a key file")
+	}
+	return nil
+}
+
+// validateBindAddress rejects bind addresses with a port, which is set
+// apart
+func validateBindAddress(host string) error {
+	trimmed := strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.Contains(trimmed, ":") && net.ParseIP(trimmed) == nil {
+		return fmt.Errorf("bind address %q must be a host or IP without a port", host)
+	}
+	return nil
+}
+
+func validatePort(port int) error {
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("port %d out of range", port)
+	}
+	return nil
+}
+
+// NewRestProxyFromConfig validates cfg and creates a RestProxy with its
+// REST settings, rate limits, dry runs, faults, experiments and fair
+// queue. opts are applied after the settings of cfg, so WithRESTRateLimiter
+// can share a RateLimiter with a GrpcProxy.
+func NewRestProxyFromConfig(cfg Config, handler func(req *http.Request, modelName string, version string) error, opts ...RestProxyOption) (*RestProxy, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	configOpts := []RestProxyOption{
+		WithRESTModelLabels(cfg.Metrics.ModelLabels),
+		WithRESTRateLimiter(NewRateLimiter(cfg.RateLimits)),
+		WithRESTDryRuns(NewDryRuns(cfg.DryRun)),
+		WithRESTFaults(NewFaults(cfg.Faults)),
+		WithRESTExperiments(NewExperiments(cfg.Experiments)),
+		WithRESTFairQueue(NewFairQueue(cfg.FairQueue)),
+		WithRESTUnavailableRetry(cfg.Rest.UnavailableRetry),
+		WithRESTTransportLimits(cfg.Rest.Transport),
+		WithRESTHeaderFilters(cfg.Rest.RequestHeaders, cfg.Rest.ResponseHeaders),
+	}
+	if cfg.Rest.CacheHeader {
+		configOpts = append(configOpts, WithRESTCacheHeader())
+	}
+	if cfg.Rest.Coalescing.Enabled {
+		configOpts = append(configOpts, WithRESTCoalescing(cfg.Rest.Coalescing))
+	}
+	if len(cfg.EgressProxies) > 0 {
+		egress, err := NewEgressProxies(cfg.EgressProxies)
+		if err != nil {
+			return nil, err
+		}
+		configOpts = append(configOpts, WithRESTEgressProxies(egress))
+	}
+	proxy := NewRestProxy(handler, append(configOpts, opts...)...)
+	if transport, ok := proxy.RestProxy.Transport.(*resolveErrorTransport); ok && cfg.Rest.UpstreamTimeout > 0 {
+		transport.setUpstreamTimeout(cfg.Rest.UpstreamTimeout)
+	}
+	return proxy, nil
+}
+
+// NewGrpcProxyFromConfig validates cfg and creates a GrpcProxy with its
+// grpc and metrics settings, forwarding requests to the targets found by
+// resolver. opts are applied after the settings of cfg, so WithRateLimiter
+// can share a RateLimiter with a RestProxy. Invalid opts are returned as
+// an error rather than a panic.
+func NewGrpcProxyFromConfig(cfg Config, resolver Resolver, opts ...GrpcProxyOption) (*GrpcProxy, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	c := cfg.Grpc
+	configOpts := []GrpcProxyOption{
+		WithModelLabels(cfg.Metrics.ModelLabels),
+		WithRateLimiter(NewRateLimiter(cfg.RateLimits)),
+		WithDryRuns(NewDryRuns(cfg.DryRun)),
+		WithFaults(NewFaults(cfg.Faults)),
+		WithExperiments(NewExperiments(cfg.Experiments)),
+		WithFairQueue(NewFairQueue(cfg.FairQueue)),
+		WithCanaryWeights(c.CanaryWeights),
+	}
+	if len(cfg.EgressProxies) > 0 {
+		egress, err := NewEgressProxies(cfg.EgressProxies)
+		if err != nil {
+			return nil, err
+		}
+		configOpts = append(configOpts, WithEgressProxies(egress))
+	}
+	if c.TLS.CertFile != "" {
+		tlsConfig, err := c.TLS.load()
+		if err != nil {
+			return nil, fmt.Errorf("grpc: %w", err)
+		}
+		configOpts = append(configOpts, WithServerTLS(tlsConfig))
+	}
+	if c.MaxRecvMsgSize > 0 {
+		configOpts = append(configOpts, WithMaxMessageSizes(c.MaxRecvMsgSize, c.MaxSendMsgSize))
+	}
+	if len(c.MaxRequestBytes) > 0 {
+		configOpts = append(configOpts, WithModelMaxRequestSizes(c.MaxRequestBytes))
+	}
+	if c.RequestLog.Enabled {
+		configOpts = append(configOpts, WithRequestLog(c.RequestLog))
+	}
+	if c.MaxInFlight > 0 {
+		configOpts = append(configOpts, WithMaxInFlight(c.MaxInFlight))
+	}
+	if c.MaxConcurrentStreams > 0 {
+		configOpts = append(configOpts, WithMaxConcurrentStreams(c.MaxConcurrentStreams))
+	}
+	if c.ConcurrencyLimits.Default > 0 || len(c.ConcurrencyLimits.PerModel) > 0 {
+		configOpts = append(configOpts, WithModelConcurrencyLimits(c.ConcurrencyLimits))
+	}
+	if c.DefaultTimeout > 0 {
+		configOpts = append(configOpts, WithDefaultTimeout(c.DefaultTimeout))
+	}
+	configOpts = append(configOpts, WithTimeoutOverrides(c.TimeoutOverrides))
+	if c.DeadlineBudget != (DeadlineBudget{}) {
+		configOpts = append(configOpts, WithDeadlineBudget(c.DeadlineBudget))
+	}
+	if c.ShutdownGracePeriod > 0 {
+		configOpts = append(configOpts, WithShutdownGracePeriod(c.ShutdownGracePeriod))
+	}
+	if c.UpstreamRetries > 0 {
+		configOpts = append(configOpts, WithUpstreamRetries(c.UpstreamRetries))
+	}
+	if c.WaitForReady.Enabled || len(c.WaitForReady.Models) > 0 {
+		configOpts = append(configOpts, WithWaitForReady(c.WaitForReady))
+	}
+	if c.UpstreamBackoff != (UpstreamBackoff{}) {
+		configOpts = append(configOpts, WithUpstreamBackoff(c.UpstreamBackoff))
+	}
+	if c.RoutingTrailers {
+		configOpts = append(configOpts, WithRoutingTrailers())
+	}
+	if c.RESTFallback {
+		configOpts = append(configOpts, WithRESTFallback(nil))
+	}
+	if c.Channelz {
+		configOpts = append(configOpts, WithChannelz())
+	}
+	if c.Reflection {
+		configOpts = append(configOpts, WithReflection())
+	}
+	return newGrpcProxy(resolver, append(configOpts, opts...)...)
+}
@@ -0,0 +1,237 @@
+package tfservingproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		err    string
+	}{
+		{"cert without key", func(c *Config) { c.Grpc.TLS.CertFile = "cert.pem" }, "both a certificate and a key"},
+		{"key without cert", func(c *Config) { c.Rest.TLS.KeyFile = "key.pem" }, "both a certificate and a key"},
+		{"egress proxy scheme", func(c *Config) { c.EgressProxies = []EgressProxy{{URL: "ftp://proxy:21"}} }, "http or socks5"},
+		{"negative coalesced keys", func(c *Config) { c.Rest.Coalescing.MaxKeys = -1 }, "must not be negative"},
+		{"empty header name", func(c *Config) { c.Rest.ResponseHeaders.Deny = []string{""} }, "empty header names"},
+		{"client CAs without cert", func(c *Config) { c.Grpc.TLS.ClientCAFile = "ca.pem" }, "client CAs need a certificate"},
+		{"request log sample rate", func(c *Config) { c.Grpc.RequestLog.SampleRate = 1.5 }, "between 0 and 1"},
+		{"backoff over max delay", func(c *Config) {
+			c.Grpc.UpstreamBackoff = UpstreamBackoff{BaseDelay: time.Minute, MaxDelay: time.Second}
+		}, "exceeds the max delay"},
+		{"port out of range", func(c *Config) { c.Rest.Port = 70000 }, "out of range"},
+		{"same address", func(c *Config) { c.Grpc.Port = c.Rest.Port }, "both listen on"},
+		{"same IPv6 address", func(c *Config) {
+			c.Rest.BindAddress, c.Grpc.BindAddress, c.Grpc.Port = "::1", "[::1]", c.Rest.Port
+		}, "both listen on"},
+		{"bind address with port", func(c *Config) { c.Grpc.BindAddress = "127.0.0.1:8500" }, "without a port"},
+		{"admin on the data path", func(c *Config) { c.Admin.Port = c.Grpc.Port }, "like the data path"},
+		{"zero max message size", func(c *Config) { c.Grpc.MaxSendMsgSize = 0 }, "must both be set"},
+		{"negative max message size", func(c *Config) { c.Grpc.MaxRecvMsgSize = -1 }, "must not be negative"},
+		{"request limit above message size", func(c *Config) { c.Grpc.MaxRequestBytes = map[string]int{"foo": 8192} }, "exceeds the max message size"},
+		{"zero request limit", func(c *Config) { c.Grpc.MaxRequestBytes = map[string]int{"foo": 0} }, "must be positive"},
+		{"negative timeout", func(c *Config) { c.Rest.WriteTimeout = -time.Second }, "write timeout"},
+		{"experiment without weight", func(c *Config) {
+			c.Experiments = map[string]Experiment{"foo": {Arms: map[string]ExperimentArm{"control": {Version: 1}}}}
+		}, "positive weight"},
+		{"zero fair queue weight", func(c *Config) { c.FairQueue.Weights = map[string]int{"foo": 0} }, "must be positive"},
+		{"zero host connection limit", func(c *Config) { c.Rest.Transport.PerHost = map[string]int{"node:8501": 0} }, "must be positive"},
+		{"timeout within budget", func(c *Config) { c.Grpc.DeadlineBudget.MinRemaining = c.Grpc.DefaultTimeout }, "minimum deadline budget"},
+		{"relative metrics path", func(c *Config) { c.Metrics.Path = "metrics" }, "must start with /"},
+		{"unknown fault type", func(c *Config) { c.Faults = map[string]Fault{"foo": {Type: "crash"}} }, "unknown fault type"},
+		{"fault probability over 1", func(c *Config) { c.Faults = map[string]Fault{"foo": {Type: FaultReset, Probability: 1.5}} }, "out of range"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := Config{
+				Rest: RestConfig{Port: 8093},
+				Grpc: GrpcConfig{Port: 8100, MaxRecvMsgSize: 4096, MaxSendMsgSize: 4096, DefaultTimeout: time.Second},
+			}
+			if err := cfg.Validate(); err != nil {
+				t.Fatalf("Expected the base config to be valid but got %v", err)
+			}
+			test.modify(&cfg)
+			err := cfg.Validate()
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("Expected an error containing %q but got %v", test.err, err)
+			}
+			if _, ctorErr := NewGrpcProxyFromConfig(cfg, nil); ctorErr == nil {
+				t.Error("Expected NewGrpcProxyFromConfig to reject the config")
+			}
+			if _, ctorErr := NewRestProxyFromConfig(cfg, nil); ctorErr == nil {
+				t.Error("Expected NewRestProxyFromConfig to reject the config")
+			}
+		})
+	}
+}
+
+func TestConfigMissingTLSFiles(t *testing.T) {
+	cfg := Config{Grpc: GrpcConfig{TLS: TLSConfig{CertFile: "testdata/config/missing.pem", KeyFile: "testdata/config/missing.key"}}}
+	if _, err := NewGrpcProxyFromConfig(cfg, nil); err == nil || !strings.Contains(err.Error(), "TLS certificate") {
+		t.Errorf("Expected an error loading the certificate but got %v", err)
+	}
+}
+
+func TestConfigRestTLS(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	dir, err := ioutil.TempDir("", "resttls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := RestConfig{TLS: TLSConfig{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}}
+	if err := ioutil.WriteFile(cfg.TLS.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(cfg.TLS.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := cfg.Server(http.HandlerFunc(func(rw http.ResponseWriter, _ *http.Request) {}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(lis, "", "")
+	defer server.Close()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, ServerName: "proxy"}}}
+	res, err := client.Get("https://" + lis.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.TLS == nil {
+		t.Error("Expected the server to serve TLS")
+	}
+
+	cfg.TLS.KeyFile = filepath.Join(dir, "missing.pem")
+	if _, err := cfg.Server(nil); err == nil || !strings.Contains(err.Error(), "TLS certificate") {
+		t.Errorf("Expected an error loading the certificate but got %v", err)
+	}
+}
+
+func TestConfigRejectsInvalidOptions(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "tfservingcache_proxy_validation_failures_total"}))
+	cases := map[string]GrpcProxyOption{
+		"nil registry":         WithRegistry(nil),
+		"conflicting registry": WithRegistry(registry),
+		"zero idle timeout":    WithUpstreamIdleTimeout(0),
+	}
+	for name, opt := range cases {
+		t.Run(name, func(t *testing.T) {
+			proxy, err := NewGrpcProxyFromConfig(Config{}, nil, opt)
+			if err == nil || proxy != nil {
+				t.Errorf("Expected an error but got %v", err)
+			}
+		})
+	}
+}
+
+func TestConfigRoundTrip(t *testing.T) {
+	cfg, err := LoadConfig("testdata/config/proxy.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Grpc.DeadlineBudget.MinRemaining != 10*time.Millisecond || cfg.Rest.IdleTimeout != time.Minute || cfg.Grpc.MaxRequestBytes["foo"] != 64 ||
+		cfg.Grpc.ConcurrencyLimits.PerModel["bar"] != 2 || cfg.Grpc.CanaryWeights["bar"][2] != 10 || cfg.RateLimits["bar"].Burst != 10 {
+		t.Fatalf("Config not decoded from the fixture: %+v", cfg)
+	}
+
+	grpcNode := tfservingtest.NewGRPCNode(t, "upstream")
+	grpcProxy, err := NewGrpcProxyFromConfig(cfg, ClientProviderFunc(func(string, string) (*grpc.ClientConn, error) {
+		return grpcNode.Dial(t), nil
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcLis, err := net.Listen("tcp", cfg.Grpc.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go grpcProxy.Serve(grpcLis)
+	defer grpcProxy.Close()
+
+	restNode := tfservingtest.NewRESTNode(t, "upstream")
+	restNode.Respond("foo", "", http.StatusOK, `{"predictions": [1]}`)
+	restProxy, err := NewRestProxyFromConfig(cfg, func(req *http.Request, _ string, _ string) error {
+		req.URL.Scheme, req.URL.Host = restNode.URL().Scheme, restNode.URL().Host
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := cfg.Rest.Server(http.HandlerFunc(restProxy.Serve()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.ReadTimeout != 5*time.Second || server.WriteTimeout != 10*time.Second {
+		t.Errorf("Expected the server timeouts of the config but got %v and %v", server.ReadTimeout, server.WriteTimeout)
+	}
+	restLis, err := net.Listen("tcp", cfg.Rest.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(restLis)
+	defer server.Close()
+
+	conn, err := grpc.Dial(grpcLis.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewPredictionServiceClient(conn)
+	var trailer metadata.MD
+	if _, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}, grpc.Trailer(&trailer)); err != nil {
+		t.Fatal(err)
+	}
+	if len(trailer.Get(TrailerTarget)) == 0 {
+		t.Errorf("Expected routing trailers to be enabled but got %v", trailer)
+	}
+	_, err = client.Predict(context.Background(), &pb.PredictRequest{
+		ModelSpec: &pb.ModelSpec{Name: "foo", SignatureName: strings.Repeat("x", 128)},
+	})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected the request size limit of the config to apply but got %v", err)
+	}
+	tfservingtest.AssertReached(t, grpcNode, "foo", "")
+
+	res, err := http.Post("http://"+restLis.Addr().String()+"/v1/models/foo/versions/1:predict", "application/json", strings.NewReader(`{"instances": [1]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(body) != `{"predictions": [1]}` {
+		t.Errorf("Expected the node response through the REST proxy but got %d %s", res.StatusCode, body)
+	}
+	tfservingtest.AssertReached(t, restNode, "foo", "")
+}
@@ -0,0 +1,190 @@
+package tfservingproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// shutdownStages are the steps of shutting down a proxy. Proxies shut down
+// together go through each step before any of them starts the next.
+type shutdownStages interface {
+	// stopReady fails health checks and new requests
+	stopReady()
+	// drain stops accepting requests and waits for those in flight until
+	// ctx is done, then stops them
+	drain(ctx context.Context) error
+	// closeUpstream closes the upstream connections and the Handler
+	closeUpstream(ctx context.Context) error
+}
+
+// shutdown stops proxies from being ready, drains them concurrently, closes
+// closers and finally the upstream connections of the proxies. It returns
+// the first error.
+func shutdown(ctx context.Context, proxies []shutdownStages, closers []io.Closer) error {
+	for _, proxy := range proxies {
+		proxy.stopReady()
+	}
+
+	errs := make([]error, len(proxies))
+	var draining sync.WaitGroup
+	for i, proxy := range proxies {
+		draining.Add(1)
+		go func(i int, proxy shutdownStages) {
+			defer draining.Done()
+			errs[i] = proxy.drain(ctx)
+		}(i, proxy)
+	}
+	draining.Wait()
+
+	for _, closer := range closers {
+		errs = append(errs, closer.Close())
+	}
+	for _, proxy := range proxies {
+		errs = append(errs, proxy.closeUpstream(ctx))
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ShutdownCoordinator shuts down proxies together. Shutdown first makes
+// the grpc health service report not serving and answers new REST
+// requests with 503, then waits for the requests and calls in flight on
+// all proxies until its ctx is done and stops the servers under those
+// left. Registered closers are closed next and the upstream connections
+// of the proxies last.
+//
+// Register the proxies before calling Shutdown. Shutdown only runs once,
+// later and concurrent calls wait for it.
+type ShutdownCoordinator struct {
+	proxies []shutdownStages
+	closers []io.Closer
+	mutex   sync.Mutex
+	once    sync.Once
+	done    chan struct{}
+	err     error
+}
+
+// NewShutdownCoordinator creates a ShutdownCoordinator without proxies
+func NewShutdownCoordinator() *ShutdownCoordinator {
+	return &ShutdownCoordinator{done: make(chan struct{})}
+}
+
+// AddRestProxy registers a REST proxy. If server is not nil, Shutdown also
+// shuts it down and closes it if its requests are not done in time.
+func (c *ShutdownCoordinator) AddRestProxy(proxy *RestProxy, server *http.Server) {
+	if server == nil {
+		c.add(proxy)
+		return
+	}
+	c.add(&restServerStages{RestProxy: proxy, server: server})
+}
+
+// AddGrpcProxy registers a grpc proxy served on its own port
+func (c *ShutdownCoordinator) AddGrpcProxy(proxy *GrpcProxy) {
+	c.add(proxy)
+}
+
+// AddCombinedProxy registers a CombinedProxy. Add the REST proxy it serves
+// with AddRestProxy to also wait for its requests.
+func (c *ShutdownCoordinator) AddCombinedProxy(proxy *CombinedProxy) {
+	c.add(proxy)
+}
+
+// AddAdminServer registers an admin server, which keeps serving until the
+// proxies are drained so that the shutdown can be observed
+func (c *ShutdownCoordinator) AddAdminServer(admin *AdminServer) {
+	c.add(admin)
+}
+
+// AddCloser registers closer to be closed once the proxies are drained,
+// before their upstream connections are closed
+func (c *ShutdownCoordinator) AddCloser(closer io.Closer) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closers = append(c.closers, closer)
+}
+
+func (c *ShutdownCoordinator) add(proxy shutdownStages) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.proxies = append(c.proxies, proxy)
+}
+
+// Shutdown shuts down the registered proxies and closers, allowing until
+// ctx is done for requests in flight. Concurrent and later calls wait for
+// the first one, or return ctx.Err() if their own ctx is done first.
+func (c *ShutdownCoordinator) Shutdown(ctx context.Context) error {
+	first := false
+	c.once.Do(func() {
+		first = true
+		c.mutex.Lock()
+		proxies, closers := c.proxies, c.closers
+		c.mutex.Unlock()
+		go func() {
+			c.err = shutdown(ctx, proxies, closers)
+			close(c.done)
+		}()
+	})
+	if first {
+		<-c.done
+		return c.err
+	}
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ShutdownOnSignal blocks until one of signals is received, SIGINT or
+// SIGTERM by default, and then shuts down allowing grace for requests in
+// flight. Another signal during the shutdown stops the requests left.
+func (c *ShutdownCoordinator) ShutdownOnSignal(grace time.Duration, signals ...os.Signal) error {
+	if len(signals) == 0 {
+		signals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+	}
+	received := make(chan os.Signal, 1)
+	signal.Notify(received, signals...)
+	defer signal.Stop(received)
+
+	log.Infof("Received %v, shutting down", <-received)
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	go func() {
+		select {
+		case sig := <-received:
+			log.Warnf("Received %v while shutting down, stopping requests in flight", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return c.Shutdown(ctx)
+}
+
+// restServerStages shuts down a RestProxy with the HTTP server serving it
+type restServerStages struct {
+	*RestProxy
+	server *http.Server
+}
+
+func (stages *restServerStages) drain(ctx context.Context) error {
+	if err := stages.server.Shutdown(ctx); err != nil {
+		log.Warn("REST requests did not finish within the shutdown grace period, closing the server")
+		stages.server.Close()
+		return err
+	}
+	return stages.RestProxy.drain(ctx)
+}
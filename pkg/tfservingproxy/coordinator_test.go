@@ -0,0 +1,115 @@
+package tfservingproxy
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+)
+
+// stageLog records the shutdown stages run by fakes
+type stageLog struct {
+	mutex  sync.Mutex
+	stages []string
+}
+
+func (l *stageLog) record(stage string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.stages = append(l.stages, stage)
+}
+
+type fakeStages struct {
+	name string
+	log  *stageLog
+}
+
+func (f *fakeStages) stopReady() { f.log.record("ready:" + f.name) }
+
+func (f *fakeStages) drain(context.Context) error {
+	f.log.record("drain:" + f.name)
+	// Give the other proxy time to start draining concurrently
+	time.Sleep(10 * time.Millisecond)
+	return nil
+}
+
+func (f *fakeStages) closeUpstream(context.Context) error {
+	f.log.record("upstream:" + f.name)
+	return nil
+}
+
+func (f *fakeStages) Close() error {
+	f.log.record("close:" + f.name)
+	return nil
+}
+
+func TestShutdownCoordinatorOrdersStages(t *testing.T) {
+	var log stageLog
+	coordinator := NewShutdownCoordinator()
+	coordinator.add(&fakeStages{name: "rest", log: &log})
+	coordinator.add(&fakeStages{name: "grpc", log: &log})
+	coordinator.AddCloser(&fakeStages{name: "extra", log: &log})
+
+	var signals sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		signals.Add(1)
+		go func() {
+			defer signals.Done()
+			if err := coordinator.Shutdown(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	signals.Wait()
+
+	if len(log.stages) != 7 {
+		t.Fatalf("Expected each stage to run once but got %v", log.stages)
+	}
+	order := []string{"ready:", "ready:", "drain:", "drain:", "close:extra", "upstream:rest", "upstream:grpc"}
+	for i, prefix := range order {
+		if !strings.HasPrefix(log.stages[i], prefix) {
+			t.Errorf("Expected stage %d to be %s but got %v", i, prefix, log.stages)
+		}
+	}
+}
+
+func TestShutdownCoordinatorStopsCallsAfterDeadline(t *testing.T) {
+	if *serveCombined {
+		t.Skip("the grpc proxy must be registered as a CombinedProxy")
+	}
+	harness := tfservingtest.NewHarness(t, tfservingtest.SlowUpstream("slow", 5*time.Second))
+	proxy := NewGrpcProxy(harness.ClientProvider)
+	client := harness.Serve(proxy)
+	restProxy := NewRestProxy(nil)
+
+	done := make(chan error)
+	go func() {
+		_, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "slow"}})
+		done <- err
+	}()
+	for atomic.LoadInt64(&proxy.inFlight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	coordinator := NewShutdownCoordinator()
+	coordinator.AddRestProxy(restProxy, nil)
+	coordinator.AddGrpcProxy(proxy)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	coordinator.Shutdown(ctx)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected Shutdown to stop the call in flight after its deadline but it took %v", elapsed)
+	}
+	if err := <-done; err == nil {
+		t.Error("Expected the call in flight to be stopped")
+	}
+	if err := coordinator.Shutdown(context.Background()); err != nil {
+		t.Errorf("Expected a second Shutdown to return the result of the first but got %v", err)
+	}
+}
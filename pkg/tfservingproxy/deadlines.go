@@ -0,0 +1,52 @@
+package tfservingproxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var promDeadlineRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_deadline_rejected_total",
+	Help: "The total number of calls rejected because too little of their deadline was left",
+}, []string{"protocol"})
+
+// DeadlineBudget sets how the proxy uses the deadlines of calls
+type DeadlineBudget struct {
+	// MinRemaining fails calls with DeadlineExceeded right away if less
+	// than this is left of their deadline when they reach the proxy
+	MinRemaining time.Duration `mapstructure:"minRemaining" yaml:"minRemaining"`
+	// Margin is subtracted from the deadline passed upstream, leaving
+	// time for the response to make it back to the caller
+	Margin time.Duration `mapstructure:"margin" yaml:"margin"`
+}
+
+// WithDeadlineBudget applies budget to calls that have a deadline
+func WithDeadlineBudget(budget DeadlineBudget) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.tunables.deadlineBudget = budget
+	}
+}
+
+// belowMinimum returns whether less than the minimum budget is left of the
+// deadline of ctx, and how much is left
+func (budget DeadlineBudget) belowMinimum(ctx context.Context) (bool, time.Duration) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return false, 0
+	}
+	remaining := time.Until(deadline)
+	return remaining < budget.MinRemaining, remaining
+}
+
+// upstreamContext returns the context for the upstream call of a call with
+// ctx, with its deadline moved forward by the margin
+func (budget DeadlineBudget) upstreamContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, ok := ctx.Deadline()
+	if !ok || budget.Margin <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithDeadline(ctx, deadline.Add(-budget.Margin))
+}
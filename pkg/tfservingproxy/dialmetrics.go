@@ -0,0 +1,106 @@
+package tfservingproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+var promDialAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_upstream_dial_attempts_total",
+	Help: "The total number of attempts to connect to upstream nodes",
+}, []string{"target"})
+var promDialFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_upstream_dial_failures_total",
+	Help: "The total number of failed attempts to connect to upstream nodes",
+}, []string{"target", "error"})
+var promDialDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "tfservingcache_proxy_upstream_dial_duration_seconds",
+	Help:    "The time taken to connect to upstream nodes",
+	Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+}, []string{"target"})
+var promUpstreamConns = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tfservingcache_proxy_upstream_connections",
+	Help: "The number of upstream connections by connectivity state",
+}, []string{"state"})
+
+// WithUpstreamDialer sets the function DialUpstream uses to connect to
+// nodes. Dial metrics are only recorded for this dialer, so use it rather
+// than grpc.WithContextDialer to customize connecting.
+func WithUpstreamDialer(dialer func(ctx context.Context, address string) (net.Conn, error)) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.upstreamDialer = dialer
+	}
+}
+
+// dialNetwork connects to a node over tcp
+func dialNetwork(ctx context.Context, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// instrumentedDialer returns a context dialer recording the dial metrics
+func (proxy *GrpcProxy) instrumentedDialer() grpc.DialOption {
+	dial := proxy.upstreamDialer
+	if dial == nil {
+		dial = dialNetwork
+	}
+	return grpc.WithContextDialer(instrumentDial(proxy.egress.dialer(dial)))
+}
+
+// instrumentDial returns dial recording the dial metrics
+func instrumentDial(dial func(ctx context.Context, address string) (net.Conn, error)) func(ctx context.Context, address string) (net.Conn, error) {
+	return func(ctx context.Context, address string) (net.Conn, error) {
+		promDialAttempts.WithLabelValues(address).Inc()
+		start := time.Now()
+		conn, err := dial(ctx, address)
+		promDialDuration.WithLabelValues(address).Observe(time.Since(start).Seconds())
+		if err != nil {
+			promDialFailures.WithLabelValues(address, dialErrorClass(err)).Inc()
+		}
+		return conn, err
+	}
+}
+
+// dialErrorClass returns a coarse class of a dial error suitable as a
+// label. Failures to connect through an egress proxy are "tunnel".
+func dialErrorClass(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var tunnelErr *tunnelError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &tunnelErr):
+		return "tunnel"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "other"
+}
+
+// trackConnState keeps the connections gauge up to date with the state of
+// conn until it is shut down
+func trackConnState(conn *grpc.ClientConn) {
+	state := conn.GetState()
+	promUpstreamConns.WithLabelValues(state.String()).Inc()
+	for state != connectivity.Shutdown && conn.WaitForStateChange(context.Background(), state) {
+		promUpstreamConns.WithLabelValues(state.String()).Dec()
+		state = conn.GetState()
+		promUpstreamConns.WithLabelValues(state.String()).Inc()
+	}
+	promUpstreamConns.WithLabelValues(state.String()).Dec()
+}
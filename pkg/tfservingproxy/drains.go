@@ -0,0 +1,176 @@
+package tfservingproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+// drainedResolveAttempts is how often a REST request resolved to a
+// drained node is resolved again looking for another node
+const drainedResolveAttempts = 3
+
+var promDrainedUpstreams = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tfservingcache_proxy_drained_upstreams",
+	Help: "The upstream nodes drained by an operator, 1 while drained",
+}, []string{"target"})
+
+// UpstreamDrains is the set of upstream nodes, by host:port, that new
+// requests avoid while they are drained, for example before the node is
+// taken down for maintenance. Requests in flight to a drained node
+// finish. A request for a model only served by drained nodes is still
+// forwarded to one of them. UpstreamDrains may be shared by a GrpcProxy
+// and a RestProxy.
+type UpstreamDrains struct {
+	targets map[string]bool
+	mutex   sync.RWMutex
+}
+
+// NewUpstreamDrains creates an UpstreamDrains without drained nodes
+func NewUpstreamDrains() *UpstreamDrains {
+	return &UpstreamDrains{targets: make(map[string]bool)}
+}
+
+// WithUpstreamDrains makes grpc calls avoid the nodes drained in drains
+func WithUpstreamDrains(drains *UpstreamDrains) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.serverImpl.drains = drains
+	}
+}
+
+// WithRESTUpstreamDrains makes REST requests avoid the nodes drained in
+// drains
+func WithRESTUpstreamDrains(drains *UpstreamDrains) RestProxyOption {
+	return func(proxy *RestProxy) {
+		if transport, ok := proxy.RestProxy.Transport.(*resolveErrorTransport); ok {
+			transport.drains = drains
+		}
+	}
+}
+
+// Drain makes new requests avoid target
+func (drains *UpstreamDrains) Drain(target string) {
+	drains.mutex.Lock()
+	defer drains.mutex.Unlock()
+	drains.targets[target] = true
+	promDrainedUpstreams.WithLabelValues(target).Set(1)
+	log.Warnf("Drained upstream %s", target)
+}
+
+// Undrain lets new requests use target again. It returns false if target
+// was not drained.
+func (drains *UpstreamDrains) Undrain(target string) bool {
+	drains.mutex.Lock()
+	defer drains.mutex.Unlock()
+	if !drains.targets[target] {
+		return false
+	}
+	delete(drains.targets, target)
+	promDrainedUpstreams.DeleteLabelValues(target)
+	log.Infof("Undrained upstream %s", target)
+	return true
+}
+
+// Drained returns whether target is drained
+func (drains *UpstreamDrains) Drained(target string) bool {
+	if drains == nil {
+		return false
+	}
+	drains.mutex.RLock()
+	defer drains.mutex.RUnlock()
+	return drains.targets[target]
+}
+
+// List returns the drained nodes, sorted
+func (drains *UpstreamDrains) List() []string {
+	drains.mutex.RLock()
+	defer drains.mutex.RUnlock()
+	targets := make([]string, 0, len(drains.targets))
+	for target := range drains.targets {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// ServeDrain drains the node in a POST to .../{host:port}/drain and
+// undrains it with .../{host:port}/undrain. It writes the drained nodes
+// as JSON.
+func (drains *UpstreamDrains) ServeDrain(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(rw, http.StatusMethodNotAllowed, "Use POST to drain or undrain an upstream")
+		return
+	}
+	target := path.Base(path.Dir(req.URL.Path))
+	if target == "" || target == "." || target == "/" {
+		writeError(rw, http.StatusBadRequest, "Missing upstream host:port")
+		return
+	}
+	switch path.Base(req.URL.Path) {
+	case "drain":
+		drains.Drain(target)
+	case "undrain":
+		if !drains.Undrain(target) {
+			writeError(rw, http.StatusNotFound, "Upstream "+target+" is not drained")
+			return
+		}
+	default:
+		writeError(rw, http.StatusNotFound, "Use .../drain or .../undrain")
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(drains.List()); err != nil {
+		log.WithError(err).Error("Could not write drained upstreams")
+	}
+}
+
+// filter returns the targets of key that are not drained. If all of them
+// are, it returns them all rather than failing the call.
+func (drains *UpstreamDrains) filter(key ModelKey, targets []Target) []Target {
+	if drains == nil || len(targets) == 0 {
+		return targets
+	}
+	available := make([]Target, 0, len(targets))
+	for _, target := range targets {
+		if !drains.Drained(targetAddress(target)) {
+			available = append(available, target)
+		}
+	}
+	if len(available) == 0 {
+		log.Errorf("All upstreams of model %s are drained, forwarding to a drained upstream", key)
+		return targets
+	}
+	return available
+}
+
+// targetAddress returns the host:port of target
+func targetAddress(target Target) string {
+	if target.Conn != nil {
+		return target.Conn.Target()
+	}
+	return target.Address
+}
+
+// avoidDrained resolves req, which the director pointed at a drained
+// node, again until the handler picks another node. It returns req if the
+// handler only picks drained nodes.
+func (transport *resolveErrorTransport) avoidDrained(req *http.Request) *http.Request {
+	for attempt := 0; attempt < drainedResolveAttempts; attempt++ {
+		next := transport.resolveAgain(req)
+		if next == nil {
+			break
+		}
+		if !transport.drains.Drained(next.URL.Host) {
+			restLogger(req).Debugf("Skipping drained upstream %s for %s", req.URL.Host, next.URL.Host)
+			return next
+		}
+	}
+	restLogger(req).Errorf("Could not find an upstream that is not drained, forwarding to drained upstream %s", req.URL.Host)
+	return req
+}
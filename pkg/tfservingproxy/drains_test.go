@@ -0,0 +1,84 @@
+package tfservingproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+)
+
+func TestGrpcProxyAvoidsDrainedUpstreams(t *testing.T) {
+	dialer, calls := startNodes(t, "node1:8500", "node2:8500")
+	drains := NewUpstreamDrains()
+	client := startProxy(t, NewGrpcProxyWithResolver(ResolverFunc(func(context.Context, ModelKey) (Resolution, error) {
+		return Resolution{Targets: []Target{{Address: "node1:8500"}, {Address: "node2:8500"}}}, nil
+	}), WithUpstreamDrains(drains), WithUpstreamDialOptions(dialer, grpc.WithInsecure())))
+
+	drains.Drain("node1:8500")
+	for i := 0; i < 10; i++ {
+		if _, err := client.Predict(context.Background(), predictVersion("foo", 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := calls(); n["node1:8500"] != 0 || n["node2:8500"] != 10 {
+		t.Errorf("Expected all calls to avoid the drained node but got %v", n)
+	}
+
+	// Draining every node keeps serving
+	drains.Drain("node2:8500")
+	if _, err := client.Predict(context.Background(), predictVersion("foo", 1)); err != nil {
+		t.Errorf("Expected the call to be served by a drained node but got %v", err)
+	}
+}
+
+func TestRESTProxyAvoidsDrainedUpstreams(t *testing.T) {
+	nodes := []*tfservingtest.RESTNode{tfservingtest.NewRESTNode(t, "node1"), tfservingtest.NewRESTNode(t, "node2")}
+	for _, node := range nodes {
+		node.Respond("foo", "1", http.StatusOK, `{"predictions": [1]}`)
+	}
+	var next int32
+	drains := NewUpstreamDrains()
+	proxy := NewRestProxy(func(req *http.Request, _ string, _ string) error {
+		node := nodes[atomic.AddInt32(&next, 1)%2]
+		req.URL.Scheme, req.URL.Host = "http", node.Address()
+		return nil
+	}, WithRESTUpstreamDrains(drains))
+	drained := nodes[0].Address()
+	admin := func(action string) int {
+		rw := httptest.NewRecorder()
+		drains.ServeDrain(rw, httptest.NewRequest("POST", "/admin/upstreams/"+drained+"/"+action, nil))
+		return rw.Code
+	}
+
+	if code := admin("drain"); code != http.StatusOK {
+		t.Fatalf("Expected the node to be drained but got %d", code)
+	}
+	if n := testutil.ToFloat64(promDrainedUpstreams.WithLabelValues(drained)); n != 1 {
+		t.Errorf("Expected the drained node in the gauge but got %v", n)
+	}
+	for i := 0; i < 6; i++ {
+		rw := httptest.NewRecorder()
+		proxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/foo/versions/1:predict", nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("Expected the request to succeed but got %d", rw.Code)
+		}
+	}
+	if n := len(nodes[0].Requests()); n != 0 {
+		t.Errorf("Expected no requests to the drained node but got %d", n)
+	}
+
+	if code := admin("undrain"); code != http.StatusOK {
+		t.Fatalf("Expected the node to be undrained but got %d", code)
+	}
+	if code := admin("undrain"); code != http.StatusNotFound {
+		t.Errorf("Expected undraining a node that is not drained to fail but got %d", code)
+	}
+	if drains.Drained(drained) || len(drains.List()) != 0 {
+		t.Errorf("Expected no drained nodes but got %v", drains.List())
+	}
+}
@@ -0,0 +1,161 @@
+package tfservingproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var promDryRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_dry_runs_total",
+	Help: "The total number of requests resolved in dry-run mode without being forwarded",
+}, []string{"protocol"})
+
+// DryRun answers the requests for a model once they are resolved instead
+// of forwarding them, so that routing can be tried out without sending
+// traffic upstream. The zero value answers with Unimplemented and 501.
+type DryRun struct {
+	// Code is the grpc status code of calls. OK is not an answer without a
+	// response, so it means Unimplemented.
+	Code codes.Code `mapstructure:"code" yaml:"code"`
+	// Status and Body are the HTTP status and JSON body of REST responses,
+	// 501 and an error message if not set
+	Status int    `mapstructure:"status" yaml:"status"`
+	Body   string `mapstructure:"body" yaml:"body"`
+}
+
+// DryRuns holds the models in dry-run mode. DryRuns shared by a GrpcProxy
+// and a RestProxy switch a model for both protocols at once.
+type DryRuns struct {
+	models map[string]DryRun
+	mutex  sync.RWMutex
+}
+
+// NewDryRuns creates DryRuns with the models in models in dry-run mode
+func NewDryRuns(models map[string]DryRun) *DryRuns {
+	dryRuns := &DryRuns{}
+	dryRuns.Set(models)
+	return dryRuns
+}
+
+// Set replaces the models in dry-run mode with those in models. It is
+// safe to call while serving.
+func (dryRuns *DryRuns) Set(models map[string]DryRun) {
+	copied := make(map[string]DryRun, len(models))
+	for model, dryRun := range models {
+		copied[model] = dryRun
+	}
+	dryRuns.mutex.Lock()
+	defer dryRuns.mutex.Unlock()
+	dryRuns.models = copied
+}
+
+// get returns the dry run of model, if it is in dry-run mode
+func (dryRuns *DryRuns) get(model string) (DryRun, bool) {
+	if dryRuns == nil {
+		return DryRun{}, false
+	}
+	dryRuns.mutex.RLock()
+	defer dryRuns.mutex.RUnlock()
+	dryRun, ok := dryRuns.models[model]
+	return dryRun, ok
+}
+
+// WithDryRuns resolves calls for the models in dry-run mode and answers
+// them without forwarding them
+func WithDryRuns(dryRuns *DryRuns) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.serverImpl.dryRuns = dryRuns
+	}
+}
+
+// WithRESTDryRuns resolves requests for the models in dry-run mode and
+// answers them without forwarding them
+func WithRESTDryRuns(dryRuns *DryRuns) RestProxyOption {
+	return func(proxy *RestProxy) {
+		proxy.dryRuns = dryRuns
+	}
+}
+
+// validate returns an error if the REST status is not a valid status
+func (dryRun DryRun) validate() error {
+	if dryRun.Status != 0 && (dryRun.Status < 100 || dryRun.Status > 599) {
+		return fmt.Errorf("status %d out of range", dryRun.Status)
+	}
+	return nil
+}
+
+// dryRunTarget returns the target a call would be forwarded to. It does
+// not connect to it.
+func dryRunTarget(resolution Resolution) string {
+	if len(resolution.Targets) == 0 {
+		return ""
+	}
+	if target := resolution.Targets[0]; target.Conn != nil {
+		return target.Conn.Target()
+	}
+	return resolution.Targets[0].Address
+}
+
+// dryRun resolves a grpc call for modelSpec and answers it with dryRun
+func (server *proxyServiceServer) dryRun(ctx context.Context, modelSpec *pb.ModelSpec, route *routeInfo, hooks *requestHooks, dryRun DryRun) error {
+	server.applyExperiment(ctx, modelSpec, route)
+	server.applyCanary(modelSpec, route)
+	resolution, err := server.resolveTargets(ctx, route.key)
+	if err == nil && len(resolution.Targets) == 0 {
+		err = fmt.Errorf("no targets for model %s: %w", route.key, ErrUnavailable)
+	}
+	if err != nil {
+		server.loggerFor(ctx).WithError(err).Error("Could not resolve dry run")
+		countGrpcFailure(ctx)
+		hooks.fail(ctx, resolveFailure(err), err)
+		return proxyStatus(grpcCode(err), modelSpec, "", err).Err()
+	}
+	route.target, route.cache, route.dryRun = dryRunTarget(resolution), resolution.Cache, true
+	addLogFields(ctx, log.Fields{logFieldVersion: route.key.Version, logFieldTarget: route.target})
+	server.loggerFor(ctx).Infof("Dry run of model %s would be forwarded to %s", route.key, route.target)
+	promDryRuns.WithLabelValues("grpc").Inc()
+	code := dryRun.Code
+	if code == codes.OK {
+		code = codes.Unimplemented
+	}
+	return status.Errorf(code, "dry run: model %s would be forwarded to %s", route.key, route.target)
+}
+
+// serveDryRun resolves a REST request for key and answers it with dryRun
+func (handler *RestProxy) serveDryRun(rw http.ResponseWriter, req *http.Request, key ModelKey, dryRun DryRun) {
+	// Resolve a copy, as the handler points the request at the target
+	target := req.Clone(req.Context())
+	err := handler.resolveREST(target, key)
+	if err != nil {
+		restLogger(req).WithError(err).Error("Could not resolve dry run")
+		promRequestsFailed.WithLabelValues("rest").Inc()
+		writeError(rw, httpStatus(err), err.Error())
+		restHooks(req).fail(req.Context(), resolveFailure(err), err)
+		return
+	}
+	if route, ok := req.Context().Value(routeKey{}).(*routeInfo); ok {
+		route.target, route.dryRun = target.URL.Host, true
+	}
+	addLogFields(req.Context(), log.Fields{logFieldTarget: target.URL.Host})
+	restLogger(req).Infof("Dry run of model %s would be forwarded to %s", key, target.URL.Host)
+	promDryRuns.WithLabelValues("rest").Inc()
+	if dryRun.Status == 0 && dryRun.Body == "" {
+		writeError(rw, http.StatusNotImplemented, fmt.Sprintf("dry run: model %s would be forwarded to %s", key, target.URL.Host))
+		return
+	}
+	if dryRun.Status == 0 {
+		dryRun.Status = http.StatusNotImplemented
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(dryRun.Status)
+	rw.Write([]byte(dryRun.Body))
+}
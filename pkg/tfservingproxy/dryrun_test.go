@@ -0,0 +1,103 @@
+package tfservingproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGrpcDryRunDoesNotConnectUpstream(t *testing.T) {
+	upstream := tfservingtest.NewGRPCNode(t, "upstream")
+	var dials int32
+	dialer := func(ctx context.Context, address string) (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return upstream.Dialer()(ctx, address)
+	}
+	routingLog := NewRoutingLog(10)
+	dryRuns := NewDryRuns(map[string]DryRun{"foo": {Code: codes.FailedPrecondition}})
+	proxy := NewGrpcProxyWithResolver(ResolverFunc(func(ctx context.Context, key ModelKey) (Resolution, error) {
+		return Resolution{Targets: []Target{{Address: "node1:8500"}}}, nil
+	}), WithUpstreamDialer(dialer), WithUpstreamDialOptions(grpc.WithInsecure()), WithDryRuns(dryRuns), WithRoutingLog(routingLog))
+	client := startProxy(t, proxy)
+
+	_, err := client.Predict(context.Background(), predictVersion("foo", 1))
+	if st := status.Convert(err); st.Code() != codes.FailedPrecondition || !strings.Contains(st.Message(), "node1:8500") {
+		t.Errorf("Expected the dry run answer naming the target but got %v", err)
+	}
+	if d := routingLog.Recent("foo", 1); len(d) != 1 || !d[0].DryRun || d[0].Target != "node1:8500" {
+		t.Errorf("Expected the dry run to be recorded with its target but got %+v", d)
+	}
+	if n := atomic.LoadInt32(&dials); n != 0 {
+		t.Errorf("Expected no upstream connection in dry run but got %d dials", n)
+	}
+
+	dryRuns.Set(nil)
+	if _, err := client.Predict(context.Background(), predictVersion("foo", 1)); err != nil {
+		t.Errorf("Expected the model to be forwarded once out of dry run but got %v", err)
+	}
+	if n := atomic.LoadInt32(&dials); n == 0 {
+		t.Error("Expected the model to be forwarded once out of dry run")
+	}
+}
+
+func TestRESTDryRunDoesNotConnectUpstream(t *testing.T) {
+	var conns int32
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`{"predictions": [1]}`))
+	}))
+	upstream.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	upstream.Start()
+	defer upstream.Close()
+
+	cfg := Config{DryRun: map[string]DryRun{"foo": {Status: http.StatusOK, Body: `{"predictions": []}`}}}
+	proxy, err := NewRestProxyFromConfig(cfg, func(req *http.Request, _ string, _ string) error {
+		req.URL.Scheme, req.URL.Host = "http", upstream.Listener.Addr().String()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func(model string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		proxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/"+model+"/versions/1:predict", nil))
+		return rw
+	}
+
+	if rw := serve("foo"); rw.Code != http.StatusOK || rw.Body.String() != `{"predictions": []}` {
+		t.Errorf("Expected the canned dry run response but got %d %s", rw.Code, rw.Body)
+	}
+	if rw := serve("bar"); rw.Code != http.StatusOK {
+		t.Errorf("Expected models out of dry run to be forwarded but got %d", rw.Code)
+	}
+	forwarded := atomic.LoadInt32(&conns)
+	if forwarded != 1 {
+		t.Errorf("Expected a connection only for the forwarded model but got %d", forwarded)
+	}
+
+	cfg.DryRun = map[string]DryRun{"bar": {}}
+	if err := proxy.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	rw := serve("bar")
+	body, _ := ioutil.ReadAll(rw.Body)
+	if rw.Code != http.StatusNotImplemented || !strings.Contains(string(body), upstream.Listener.Addr().String()) {
+		t.Errorf("Expected the default dry run answer naming the target but got %d %s", rw.Code, body)
+	}
+	if n := atomic.LoadInt32(&conns); n != forwarded {
+		t.Errorf("Expected no new upstream connection in dry run but got %d", n-forwarded)
+	}
+}
@@ -0,0 +1,259 @@
+package tfservingproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// EgressProxy is an HTTP CONNECT or SOCKS5 proxy through which the
+// connections to some nodes are tunneled
+type EgressProxy struct {
+	// URL is the proxy, as http://host:port or socks5://host:port with
+	// optional user:password@ credentials
+	URL string `mapstructure:"url" yaml:"url"`
+	// Targets are the patterns of the nodes reached through the proxy,
+	// matched against their host or host:port like path.Match, such as
+	// *.remote.example.com. Empty matches all nodes.
+	Targets []string `mapstructure:"targets" yaml:"targets"`
+}
+
+func (config EgressProxy) validate() error {
+	if _, err := parseEgressURL(config.URL); err != nil {
+		return err
+	}
+	for _, pattern := range config.Targets {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid target pattern %q of egress proxy", pattern)
+		}
+	}
+	return nil
+}
+
+func parseEgressURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid egress proxy URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "socks5" {
+		return nil, fmt.Errorf("egress proxy URL must be http or socks5, got %q", raw)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("egress proxy URL %q has no host", raw)
+	}
+	return u, nil
+}
+
+// EgressProxies dials the nodes matching the targets of an EgressProxy
+// through it, and all other nodes directly. The first matching proxy is
+// used. EgressProxies may be shared by a GrpcProxy and a RestProxy.
+type EgressProxies struct {
+	routes []egressRoute
+}
+
+type egressRoute struct {
+	url     *url.URL
+	targets []string
+}
+
+// NewEgressProxies creates EgressProxies tunneling through proxies
+func NewEgressProxies(proxies []EgressProxy) (*EgressProxies, error) {
+	egress := &EgressProxies{}
+	for _, config := range proxies {
+		if err := config.validate(); err != nil {
+			return nil, err
+		}
+		u, _ := parseEgressURL(config.URL)
+		egress.routes = append(egress.routes, egressRoute{url: u, targets: config.Targets})
+	}
+	return egress, nil
+}
+
+// WithEgressProxies dials upstream grpc connections through egress. The
+// connection to the proxy and to nodes reached directly are made with
+// the WithUpstreamDialer dialer, if any.
+func WithEgressProxies(egress *EgressProxies) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.egress = egress
+	}
+}
+
+// WithRESTEgressProxies dials the connections of REST requests to the
+// nodes through egress. HTTP proxies are used with CONNECT, so the
+// requests are tunneled like grpc calls.
+func WithRESTEgressProxies(egress *EgressProxies) RestProxyOption {
+	return func(proxy *RestProxy) {
+		if transport, ok := proxy.RestProxy.Transport.(*resolveErrorTransport); ok {
+			transport.setDialer(instrumentDial(egress.dialer(dialNetwork)))
+		}
+	}
+}
+
+// tunnelError is the error of a connection through an egress proxy
+type tunnelError struct {
+	proxy string
+	err   error
+}
+
+func (e *tunnelError) Error() string {
+	return fmt.Sprintf("egress proxy %s: %v", e.proxy, e.err)
+}
+
+func (e *tunnelError) Unwrap() error { return e.err }
+
+// route returns the proxy of the node at address, or nil to dial it
+// directly
+func (egress *EgressProxies) route(address string) *egressRoute {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	for i, route := range egress.routes {
+		if len(route.targets) == 0 {
+			return &egress.routes[i]
+		}
+		for _, pattern := range route.targets {
+			if matched, _ := path.Match(pattern, host); matched {
+				return &egress.routes[i]
+			}
+			if matched, _ := path.Match(pattern, address); matched {
+				return &egress.routes[i]
+			}
+		}
+	}
+	return nil
+}
+
+// dialer returns a dialer tunneling through the egress proxies, which
+// dials the proxies and other nodes with forward
+func (egress *EgressProxies) dialer(forward func(ctx context.Context, address string) (net.Conn, error)) func(ctx context.Context, address string) (net.Conn, error) {
+	if egress == nil {
+		return forward
+	}
+	return func(ctx context.Context, address string) (net.Conn, error) {
+		route := egress.route(address)
+		if route == nil {
+			return forward(ctx, address)
+		}
+		var conn net.Conn
+		var err error
+		if route.url.Scheme == "socks5" {
+			conn, err = route.dialSOCKS5(ctx, forward, address)
+		} else {
+			conn, err = route.dialConnect(ctx, forward, address)
+		}
+		if err != nil {
+			return nil, &tunnelError{proxy: route.url.Host, err: err}
+		}
+		return conn, nil
+	}
+}
+
+// contextDialer adapts a dial function to the dialers of
+// golang.org/x/net/proxy
+type contextDialer func(ctx context.Context, address string) (net.Conn, error)
+
+func (dial contextDialer) Dial(network string, address string) (net.Conn, error) {
+	return dial(context.Background(), address)
+}
+
+func (dial contextDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	return dial(ctx, address)
+}
+
+// dialSOCKS5 connects to address through the SOCKS5 proxy of route
+func (route *egressRoute) dialSOCKS5(ctx context.Context, forward func(ctx context.Context, address string) (net.Conn, error), address string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if user := route.url.User; user != nil {
+		password, _ := user.Password()
+		auth = &proxy.Auth{User: user.Username(), Password: password}
+	}
+	dialer, err := proxy.SOCKS5("tcp", route.url.Host, auth, contextDialer(forward))
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", address)
+}
+
+// dialConnect connects to address through a tunnel opened with CONNECT on
+// the HTTP proxy of route
+func (route *egressRoute) dialConnect(ctx context.Context, forward func(ctx context.Context, address string) (net.Conn, error), address string) (net.Conn, error) {
+	conn, err := forward(ctx, route.url.Host)
+	if err != nil {
+		return nil, err
+	}
+	// Abort the handshake when ctx is done
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	br, err := route.connect(conn, address)
+	close(stop)
+	<-stopped
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return &bufferedConn{Conn: conn, reader: br}, nil
+}
+
+// connect asks the proxy on conn for a tunnel to address
+func (route *egressRoute) connect(conn net.Conn, address string) (*bufio.Reader, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if user := route.url.User; user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, errors.New("CONNECT to " + address + " failed: " + res.Status)
+	}
+	return br, nil
+}
+
+// bufferedConn reads what the proxy sent after its CONNECT response
+// before reading from the connection
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
@@ -0,0 +1,141 @@
+package tfservingproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+)
+
+// startConnectProxy serves an HTTP CONNECT proxy accepting user:secret,
+// which connects to the targets with dial. It returns the address of the
+// proxy and a function returning the targets tunneled to.
+func startConnectProxy(t *testing.T, dial func(address string) (net.Conn, error)) (string, func() []string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lis.Close() })
+	var mutex sync.Mutex
+	var tunneled []string
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != auth {
+					io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+					return
+				}
+				upstream, err := dial(req.Host)
+				if err != nil {
+					io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer upstream.Close()
+				mutex.Lock()
+				tunneled = append(tunneled, req.Host)
+				mutex.Unlock()
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(upstream, conn)
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return lis.Addr().String(), func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string(nil), tunneled...)
+	}
+}
+
+func TestGrpcProxyDialsThroughEgressProxy(t *testing.T) {
+	remote, local := tfservingtest.NewGRPCNode(t, "remote-node:8500"), tfservingtest.NewGRPCNode(t, "local-node:8500")
+	address, tunneled := startConnectProxy(t, func(address string) (net.Conn, error) {
+		return remote.Dialer()(context.Background(), address)
+	})
+	egress, err := NewEgressProxies([]EgressProxy{
+		{URL: "http://user:secret@" + address, Targets: []string{"remote-*"}},
+		{URL: "http://user:wrong@" + address, Targets: []string{"denied-node:8500"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := startProxy(t, NewGrpcProxyWithResolver(ResolverFunc(func(_ context.Context, key ModelKey) (Resolution, error) {
+		return Resolution{Targets: []Target{{Address: key.Name + "-node:8500"}}}, nil
+	}), WithEgressProxies(egress), WithUpstreamDialer(func(ctx context.Context, address string) (net.Conn, error) {
+		if address == local.Address() {
+			return local.Dialer()(ctx, address)
+		}
+		return dialNetwork(ctx, address)
+	}), WithUpstreamDialOptions(grpc.WithInsecure())))
+
+	for _, model := range []string{"remote", "local"} {
+		if _, err := client.Predict(context.Background(), predictVersion(model, 1)); err != nil {
+			t.Fatalf("Expected the call to %s to succeed but got %v", model, err)
+		}
+	}
+	if got := tunneled(); len(got) != 1 || got[0] != "remote-node:8500" {
+		t.Errorf("Expected only the remote node to be tunneled to but got %v", got)
+	}
+	if len(remote.Requests()) != 1 || len(local.Requests()) != 1 {
+		t.Errorf("Expected a call to each node but got %d and %d", len(remote.Requests()), len(local.Requests()))
+	}
+
+	if _, err := client.Predict(context.Background(), predictVersion("denied", 1)); err == nil {
+		t.Error("Expected a call through a proxy rejecting the credentials to fail")
+	}
+	if n := testutil.ToFloat64(promDialFailures.WithLabelValues("denied-node:8500", "tunnel")); n == 0 {
+		t.Error("Expected the failed tunnel to be counted")
+	}
+}
+
+func TestRESTProxyDialsThroughEgressProxy(t *testing.T) {
+	upstream := tfservingtest.NewRESTNode(t, "upstream")
+	upstream.Respond("", "", http.StatusOK, `{"predictions": [1]}`)
+	address, tunneled := startConnectProxy(t, func(string) (net.Conn, error) {
+		return net.Dial("tcp", upstream.Address())
+	})
+	egress, err := NewEgressProxies([]EgressProxy{{URL: "http://user:secret@" + address, Targets: []string{"*.remote"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := NewRestProxy(func(req *http.Request, model string, _ string) error {
+		req.URL.Scheme, req.URL.Host = "http", upstream.Address()
+		if model == "remote" {
+			req.URL.Host = "node.remote:8501"
+		}
+		return nil
+	}, WithRESTEgressProxies(egress))
+
+	for _, model := range []string{"remote", "local"} {
+		rw := httptest.NewRecorder()
+		proxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/"+model+"/versions/1:predict", nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("Expected the request for %s to succeed but got %d %s", model, rw.Code, rw.Body)
+		}
+	}
+	if got := tunneled(); len(got) != 1 || got[0] != "node.remote:8501" {
+		t.Errorf("Expected only the remote node to be tunneled to but got %v", got)
+	}
+	if n := len(upstream.Requests()); n != 2 {
+		t.Errorf("Expected both requests upstream but got %d", n)
+	}
+}
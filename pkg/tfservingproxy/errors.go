@@ -0,0 +1,198 @@
+package tfservingproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Errors that REST handlers and resolvers can return (possibly wrapped)
+// to tell the proxy why a model could not be routed. Both proxies map them
+// to the same protocol status, see grpcCode and httpStatus.
+var (
+	// ErrModelNotFound means that no node can serve the requested model
+	ErrModelNotFound = errors.New("model not found")
+	// ErrInvalidModel means that the requested model name or version is malformed
+	ErrInvalidModel = errors.New("invalid model")
+	// ErrUnavailable means that the model exists but no node can take
+	// the request right now. The request may succeed if retried.
+	ErrUnavailable = errors.New("no upstream available")
+)
+
+// grpcCode returns the status code for a routing error
+func grpcCode(err error) codes.Code {
+	if st, ok := status.FromError(err); ok && st.Code() != codes.Unknown {
+		return st.Code()
+	}
+	switch {
+	case errors.Is(err, ErrModelNotFound):
+		return codes.NotFound
+	case errors.Is(err, ErrInvalidModel):
+		return codes.InvalidArgument
+	case errors.Is(err, context.DeadlineExceeded):
+		return codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		return codes.Canceled
+	}
+	return codes.Unavailable
+}
+
+// httpStatus returns the HTTP status code for a routing error
+func httpStatus(err error) int {
+	switch grpcCode(err) {
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	}
+	return http.StatusServiceUnavailable
+}
+
+// writeError writes a JSON error response for a request the proxy rejected
+func writeError(rw http.ResponseWriter, statusCode int, message string) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(statusCode)
+	json.NewEncoder(rw).Encode(struct {
+		Status  string
+		Message string
+	}{
+		Status:  "Error",
+		Message: message,
+	})
+}
+
+// resolveErrorKey is the request context key of a REST handler error
+type resolveErrorKey struct{}
+
+// resolveErrorTransport fails requests whose handler returned an error
+// instead of sending them upstream. It sends requests once more if their
+// node does not have the model and the handler is an Invalidator, or, with
+// UnavailableRetry, if it is unavailable. Only then are request bodies
+// buffered, up to maxReplayBody bytes; larger bodies are streamed and not
+// retried.
+type resolveErrorTransport struct {
+	base http.RoundTripper
+	// resolve points a request at a node again to retry it elsewhere
+	resolve func(req *http.Request, key ModelKey) error
+	// invalidate drops the cached resolution of a model, if the handler
+	// caches
+	invalidate  func(key ModelKey)
+	unavailable UnavailableRetry
+	limits      *hostLimits
+	// drains are the nodes requests avoid
+	drains *UpstreamDrains
+	// dial connects to the nodes, or is nil to use the default dialer
+	dial  func(ctx context.Context, address string) (net.Conn, error)
+	mutex sync.RWMutex
+}
+
+func (transport *resolveErrorTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err, ok := req.Context().Value(resolveErrorKey{}).(error); ok {
+		return nil, &resolveError{err: err}
+	}
+	if err := injectRESTFault(req); err != nil {
+		return nil, err
+	}
+	retry := transport.unavailableRetry()
+	var body []byte
+	var replayable bool
+	if transport.invalidate != nil || len(retry.Statuses) > 0 {
+		var err error
+		if body, replayable, err = replayBody(req, maxReplayBody); err != nil {
+			return nil, err
+		}
+	}
+	res, err := transport.send(req, body)
+	if err != nil || !replayable {
+		return res, err
+	}
+	if transport.invalidate != nil && isStaleREST(res) {
+		return transport.retryStale(req, res, body)
+	}
+	if retry.handles(res.StatusCode) {
+		return transport.retryUnavailable(req, res, body, retry)
+	}
+	return res, nil
+}
+
+// roundTripper returns the transport requests are sent upstream with
+func (transport *resolveErrorTransport) roundTripper() http.RoundTripper {
+	transport.mutex.RLock()
+	defer transport.mutex.RUnlock()
+	return transport.base
+}
+
+// hostLimits returns the connection limits of requests sent upstream
+func (transport *resolveErrorTransport) hostLimits() *hostLimits {
+	transport.mutex.RLock()
+	defer transport.mutex.RUnlock()
+	return transport.limits
+}
+
+// setUpstreamTimeout replaces the upstream transport with one waiting at
+// most timeout for response headers. Requests in flight keep the old
+// transport, whose idle connections are closed.
+func (transport *resolveErrorTransport) setUpstreamTimeout(timeout time.Duration) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	old, ok := transport.base.(*http.Transport)
+	if !ok || old.ResponseHeaderTimeout == timeout {
+		return
+	}
+	base := old.Clone()
+	base.ResponseHeaderTimeout = timeout
+	transport.base = base
+	old.CloseIdleConnections()
+}
+
+// resolveError marks an error as coming from the REST handler rather than upstream
+type resolveError struct {
+	err error
+}
+
+func (e *resolveError) Error() string { return e.err.Error() }
+
+func (e *resolveError) Unwrap() error { return e.err }
+
+// restErrorHandler reports handler errors with the status matching the
+// error and upstream errors as a bad gateway. Injected faults are not
+// counted as failures.
+func restErrorHandler(rw http.ResponseWriter, req *http.Request, err error) {
+	var injected *injectedError
+	if errors.As(err, &injected) {
+		writeInjected(rw, req, injected)
+		return
+	}
+	promRequestsFailed.WithLabelValues("rest").Inc()
+	var resolveErr *resolveError
+	if errors.As(err, &resolveErr) {
+		restLogger(req).WithError(err).Errorf("Could not route request: %s", req.URL.String())
+		writeError(rw, httpStatus(resolveErr.err), resolveErr.err.Error())
+		restHooks(req).fail(req.Context(), resolveFailure(resolveErr.err), resolveErr.err)
+		return
+	}
+	if errors.Is(err, errConnLimit) {
+		restLogger(req).WithError(err).Warn("Rejecting request at the upstream connection limit")
+		writeError(rw, http.StatusServiceUnavailable, err.Error())
+		restHooks(req).fail(req.Context(), FailureRejected, err)
+		return
+	}
+	restLogger(req).WithError(err).Errorf("Upstream request failed: %s", req.URL.String())
+	rw.WriteHeader(http.StatusBadGateway)
+	restHooks(req).fail(req.Context(), FailureUpstream, err)
+}
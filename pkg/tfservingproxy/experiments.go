@@ -0,0 +1,220 @@
+package tfservingproxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+var promExperimentRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_experiment_requests_total",
+	Help: "The total number of unpinned requests assigned to each arm of a model experiment",
+}, []string{"model", "arm"})
+
+// TrailerExperimentArm is the trailer of grpc calls, and HeaderExperimentArm
+// the header of REST responses, naming the experiment arm the request was
+// assigned to
+const (
+	TrailerExperimentArm = "tfservingcache-experiment-arm"
+	HeaderExperimentArm  = "Tfservingcache-Experiment-Arm"
+)
+
+// Experiment assigns the requests for a model that do not pin a version
+// to arms, each serving a version. A request is assigned by the key in
+// Header, so a client sending the same key always gets the same arm.
+// Requests without the key are assigned by their request id, or at random
+// without one. Arms are chosen by weighted rendezvous hashing, so changing
+// the weights only moves keys to or from the arms whose weight changed.
+// Experiments take precedence over canary weights.
+type Experiment struct {
+	// Header is the REST header and grpc metadata key with the assignment
+	// key
+	Header string `mapstructure:"header" yaml:"header"`
+	// Arms are the arms of the experiment by name
+	Arms map[string]ExperimentArm `mapstructure:"arms" yaml:"arms"`
+}
+
+// ExperimentArm is a version of the model and its relative share of the
+// assignment keys
+type ExperimentArm struct {
+	Version int64 `mapstructure:"version" yaml:"version"`
+	Weight  int   `mapstructure:"weight" yaml:"weight"`
+}
+
+func (experiment Experiment) validate() error {
+	total := 0
+	for name, arm := range experiment.Arms {
+		if arm.Weight < 0 || arm.Version < 0 {
+			return fmt.Errorf("arm %s needs a version and weight that are not negative, got %d and %d", name, arm.Version, arm.Weight)
+		}
+		total += arm.Weight
+	}
+	if total == 0 {
+		return errors.New("needs an arm with a positive weight")
+	}
+	return nil
+}
+
+// Experiments holds the experiments by model. Experiments shared by a
+// GrpcProxy and a RestProxy assign a key to the same arm for both
+// protocols.
+type Experiments struct {
+	models map[string]Experiment
+	mutex  sync.RWMutex
+}
+
+// NewExperiments creates Experiments running experiments
+func NewExperiments(experiments map[string]Experiment) *Experiments {
+	e := &Experiments{}
+	e.Set(experiments)
+	return e
+}
+
+// Set replaces the experiments with experiments. Keys stay on their arm
+// unless its weight changed. It is safe to call while serving.
+func (e *Experiments) Set(experiments map[string]Experiment) {
+	copied := make(map[string]Experiment, len(experiments))
+	for model, experiment := range experiments {
+		copied[model] = experiment
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.models = copied
+}
+
+// WithExperiments assigns grpc calls that do not pin a version to the
+// arms of the experiment of their model
+func WithExperiments(experiments *Experiments) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.serverImpl.experiments = experiments
+	}
+}
+
+// WithRESTExperiments assigns REST requests that do not pin a version to
+// the arms of the experiment of their model
+func WithRESTExperiments(experiments *Experiments) RestProxyOption {
+	return func(proxy *RestProxy) {
+		proxy.experiments = experiments
+	}
+}
+
+// get returns the experiment of model, if it has one
+func (e *Experiments) get(model string) (Experiment, bool) {
+	if e == nil {
+		return Experiment{}, false
+	}
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	experiment, ok := e.models[model]
+	return experiment, ok
+}
+
+// assign returns the name of the arm of key. An empty key gets a random
+// arm.
+func (experiment Experiment) assign(key string) (string, ExperimentArm) {
+	if key == "" {
+		key = strconv.FormatUint(rand.Uint64(), 16)
+	}
+	names := make([]string, 0, len(experiment.Arms))
+	for name := range experiment.Arms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	best, bestScore := "", math.Inf(-1)
+	for _, name := range names {
+		weight := experiment.Arms[name].Weight
+		if weight <= 0 {
+			continue
+		}
+		if score := rendezvousScore(key, name, weight); score > bestScore {
+			best, bestScore = name, score
+		}
+	}
+	return best, experiment.Arms[best]
+}
+
+// rendezvousScore is the weighted rendezvous hashing score of arm for key.
+// The arm with the highest score wins.
+func rendezvousScore(key string, arm string, weight int) float64 {
+	sum := sha256.Sum256([]byte(key + "\x00" + arm))
+	// A uniform value in (0, 1) from the top 53 bits of the hash
+	u := (float64(binary.BigEndian.Uint64(sum[:8])>>11) + 0.5) / (1 << 53)
+	return -float64(weight) / math.Log(u)
+}
+
+// applyExperiment pins modelSpec to the version of its experiment arm if
+// it does not request a version itself, like applyCanary
+func (server *proxyServiceServer) applyExperiment(ctx context.Context, modelSpec *pb.ModelSpec, route *routeInfo) {
+	if modelSpec == nil || modelSpec.GetVersionChoice() != nil {
+		return
+	}
+	experiment, ok := server.experiments.get(modelSpec.GetName())
+	if !ok {
+		return
+	}
+	var key string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(experiment.Header); len(values) > 0 {
+			key = values[0]
+		}
+	}
+	if key == "" {
+		key = requestID(ctx)
+	}
+	name, arm := experiment.assign(key)
+	modelSpec.VersionChoice = &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: arm.Version}}
+	route.key.Version = strconv.FormatInt(arm.Version, 10)
+	route.arm = name
+	addLogFields(ctx, log.Fields{logFieldVersion: route.key.Version})
+	promExperimentRequests.WithLabelValues(modelSpec.GetName(), name).Inc()
+	if err := grpc.SetTrailer(ctx, metadata.Pairs(TrailerExperimentArm, name)); err != nil {
+		server.loggerFor(ctx).WithError(err).Debug("Could not set the experiment arm trailer")
+	}
+}
+
+// applyRESTExperiment points a REST request for key that does not pin a
+// version at the version of its experiment arm. It returns the request
+// and key with the version.
+func (handler *RestProxy) applyRESTExperiment(rw http.ResponseWriter, req *http.Request, key ModelKey) (*http.Request, ModelKey) {
+	if key.Version != "" || key.Label != "" {
+		return req, key
+	}
+	experiment, ok := handler.experiments.get(key.Name)
+	if !ok {
+		return req, key
+	}
+	assignmentKey := req.Header.Get(experiment.Header)
+	if assignmentKey == "" {
+		assignmentKey = restRequestID(req)
+	}
+	name, arm := experiment.assign(assignmentKey)
+	key.Version = strconv.FormatInt(arm.Version, 10)
+	// The path parsed, so the model name is right after /v1/models/
+	prefix := len("/v1/models/") + len(key.Name)
+	req = req.Clone(req.Context())
+	req.URL.Path = req.URL.Path[:prefix] + "/versions/" + key.Version + req.URL.Path[prefix:]
+	req.URL.RawPath = ""
+	if route, ok := req.Context().Value(routeKey{}).(*routeInfo); ok {
+		route.key, route.arm = key, name
+	}
+	addLogFields(req.Context(), log.Fields{logFieldVersion: key.Version})
+	promExperimentRequests.WithLabelValues(key.Name, name).Inc()
+	rw.Header().Set(HeaderExperimentArm, name)
+	return req, key
+}
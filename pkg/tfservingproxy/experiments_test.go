@@ -0,0 +1,114 @@
+package tfservingproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestExperimentAssignmentMovesKeysProportionally(t *testing.T) {
+	experiment := Experiment{Arms: map[string]ExperimentArm{"control": {Version: 1, Weight: 1}, "treatment": {Version: 2, Weight: 1}}}
+	const keys = 10000
+	before := make([]string, keys)
+	for i := range before {
+		before[i], _ = experiment.assign("user-" + strconv.Itoa(i))
+		if again, _ := experiment.assign("user-" + strconv.Itoa(i)); again != before[i] {
+			t.Fatalf("Expected key %d to keep its arm but it moved from %s to %s", i, before[i], again)
+		}
+	}
+
+	experiment.Arms["treatment"] = ExperimentArm{Version: 2, Weight: 3}
+	moved, treatment := 0, 0
+	for i := range before {
+		arm, _ := experiment.assign("user-" + strconv.Itoa(i))
+		if arm == "treatment" {
+			treatment++
+		}
+		if arm != before[i] {
+			moved++
+			if before[i] != "control" {
+				t.Fatalf("Expected keys to move only to the arm whose weight grew but key %d left %s", i, before[i])
+			}
+		}
+	}
+	// A quarter of the keys move from half to three quarters in treatment
+	if share := float64(treatment) / keys; share < 0.72 || share > 0.78 {
+		t.Errorf("Expected three quarters of the keys in treatment but got %v", share)
+	}
+	if share := float64(moved) / keys; share > 0.28 {
+		t.Errorf("Expected about a quarter of the keys to move but got %v", share)
+	}
+}
+
+func TestGrpcExperimentIsSticky(t *testing.T) {
+	harness := tfservingtest.NewHarness(t)
+	experiments := NewExperiments(map[string]Experiment{"foo": {
+		Header: "x-user",
+		Arms:   map[string]ExperimentArm{"control": {Version: 1, Weight: 1}, "treatment": {Version: 2, Weight: 1}},
+	}})
+	client := harness.Serve(NewGrpcProxy(harness.ClientProvider, WithExperiments(experiments)))
+	arm, _ := experiments.models["foo"].assign("alice")
+	before := testutil.ToFloat64(promExperimentRequests.WithLabelValues("foo", arm))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-user", "alice")
+	for i := 0; i < 5; i++ {
+		var trailer metadata.MD
+		if _, err := client.Predict(ctx, &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}, grpc.Trailer(&trailer)); err != nil {
+			t.Fatal(err)
+		}
+		if got := trailer.Get(TrailerExperimentArm); len(got) != 1 || got[0] != arm {
+			t.Errorf("Expected the arm %s in the trailer but got %v", arm, got)
+		}
+	}
+	version := strconv.FormatInt(experiments.models["foo"].Arms[arm].Version, 10)
+	if n := tfservingtest.Received(harness.Node(), "foo", version); n != 5 {
+		t.Errorf("Expected all calls to reach version %s but got %d of them", version, n)
+	}
+	if n := testutil.ToFloat64(promExperimentRequests.WithLabelValues("foo", arm)) - before; n != 5 {
+		t.Errorf("Expected the calls to be counted for arm %s but got %v", arm, n)
+	}
+
+	// Pinned calls bypass the experiment
+	if _, err := client.Predict(ctx, predictVersion("foo", 7)); err != nil {
+		t.Fatal(err)
+	}
+	tfservingtest.AssertReached(t, harness.Node(), "foo", "7")
+}
+
+func TestRESTExperimentIsSticky(t *testing.T) {
+	upstream := tfservingtest.NewRESTNode(t, "upstream")
+	upstream.Respond("foo", "", http.StatusOK, `{"predictions": [1]}`)
+	experiments := NewExperiments(map[string]Experiment{"foo": {
+		Header: "X-User",
+		Arms:   map[string]ExperimentArm{"control": {Version: 1, Weight: 1}, "treatment": {Version: 2, Weight: 1}},
+	}})
+	proxy := NewRestProxy(func(req *http.Request, _ string, _ string) error {
+		req.URL.Scheme, req.URL.Host = "http", upstream.Address()
+		return nil
+	}, WithRESTExperiments(experiments))
+	arm, _ := experiments.models["foo"].assign("bob")
+	version := strconv.FormatInt(experiments.models["foo"].Arms[arm].Version, 10)
+
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest("POST", "/v1/models/foo:predict", nil)
+		req.Header.Set("X-User", "bob")
+		rw := httptest.NewRecorder()
+		proxy.Serve()(rw, req)
+		if rw.Code != http.StatusOK || rw.Header().Get(HeaderExperimentArm) != arm {
+			t.Errorf("Expected the request to be served by arm %s but got %d %v", arm, rw.Code, rw.Header())
+		}
+	}
+	for _, req := range upstream.Requests() {
+		if req.Path != "/v1/models/foo/versions/"+version+":predict" {
+			t.Errorf("Expected requests for version %s but got %s", version, req.Path)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package tfservingproxy
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Defaults of FairQueueConfig
+const (
+	defaultFairQueueDepth   = 100
+	defaultFairQueueMaxWait = time.Second
+)
+
+var promFairQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tfservingcache_proxy_fair_queue_depth",
+	Help: "The number of requests waiting in the fair queue of each model",
+}, []string{"model"})
+var promFairQueueShed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_fair_queue_shed_total",
+	Help: "The total number of requests shed by the fair queue because the queue of their model was full or they waited too long",
+}, []string{"protocol", "model"})
+
+// errFairQueue is the error of requests shed by the fair queue
+var errFairQueue = errors.New("proxy is at capacity")
+
+// FairQueueConfig configures the admission of requests once the proxy is
+// at capacity. Zero values are replaced by the defaults.
+type FairQueueConfig struct {
+	// Capacity is the number of requests handled at once across all
+	// models. Zero disables the queue.
+	Capacity int `mapstructure:"capacity" yaml:"capacity"`
+	// Weights are the relative shares of the capacity by model, 1 for
+	// models not in Weights
+	Weights map[string]int `mapstructure:"weights" yaml:"weights"`
+	// MaxDepth is the number of requests that may wait per model, 100 by
+	// default
+	MaxDepth int `mapstructure:"maxDepth" yaml:"maxDepth"`
+	// MaxWait is how long a request waits before it is shed, 1 second by
+	// default
+	MaxWait time.Duration `mapstructure:"maxWait" yaml:"maxWait"`
+}
+
+func (config FairQueueConfig) validate() error {
+	if config.Capacity < 0 || config.MaxDepth < 0 || config.MaxWait < 0 {
+		return errors.New("capacity, depth and wait must not be negative")
+	}
+	for model, weight := range config.Weights {
+		if weight <= 0 {
+			return fmt.Errorf("weight of model %s must be positive, got %d", model, weight)
+		}
+	}
+	return nil
+}
+
+func (config FairQueueConfig) withDefaults() FairQueueConfig {
+	if config.MaxDepth == 0 {
+		config.MaxDepth = defaultFairQueueDepth
+	}
+	if config.MaxWait == 0 {
+		config.MaxWait = defaultFairQueueMaxWait
+	}
+	return config
+}
+
+func (config FairQueueConfig) weight(model string) float64 {
+	if weight, ok := config.Weights[model]; ok {
+		return float64(weight)
+	}
+	return 1
+}
+
+// FairQueue admits requests up to a capacity. Once it is reached, requests
+// wait in a queue per model and freed capacity is handed to the queues in
+// proportion to their weights, so a model flooding the proxy does not
+// starve the others. It uses start-time fair queuing: each admission
+// advances the virtual time of its model by the inverse of its weight and
+// the waiting model furthest behind goes next. A FairQueue shared by a
+// GrpcProxy and a RestProxy enforces a single capacity across both
+// protocols.
+type FairQueue struct {
+	config FairQueueConfig
+	queues map[string]*modelQueue
+	inUse  int
+	// now is the virtual time of the last admission. Models that were
+	// idle start from it rather than from where they left off.
+	now   float64
+	mutex sync.Mutex
+}
+
+// modelQueue holds the requests of a model waiting for capacity
+type modelQueue struct {
+	waiters *list.List
+	finish  float64
+}
+
+// fairWaiter is a request waiting for capacity. ready is closed when it
+// is admitted.
+type fairWaiter struct {
+	ready    chan struct{}
+	admitted bool
+	// label is the model label of the request on the queue metrics
+	label string
+}
+
+// NewFairQueue creates a FairQueue admitting requests as configured by
+// config
+func NewFairQueue(config FairQueueConfig) *FairQueue {
+	queue := &FairQueue{queues: make(map[string]*modelQueue)}
+	queue.Set(config)
+	return queue
+}
+
+// Set replaces the configuration of the queue. Waiting requests keep
+// their place. It is safe to call while serving.
+func (queue *FairQueue) Set(config FairQueueConfig) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	queue.config = config.withDefaults()
+	queue.dispatch()
+}
+
+// WithFairQueue admits grpc calls through queue, failing calls it sheds
+// with ResourceExhausted
+func WithFairQueue(queue *FairQueue) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.serverImpl.fairQueue = queue
+	}
+}
+
+// WithRESTFairQueue admits REST requests through queue, answering
+// requests it sheds with 429 Too Many Requests
+func WithRESTFairQueue(queue *FairQueue) RestProxyOption {
+	return func(proxy *RestProxy) {
+		proxy.fairQueue = queue
+	}
+}
+
+// acquire admits a request for model, waiting in the queue of the model
+// while the proxy is at capacity. The request is counted under label on
+// the queue metrics. The returned function frees the capacity. It fails
+// with errFairQueue if the request is shed, or with the error of ctx.
+func (queue *FairQueue) acquire(ctx context.Context, protocol string, model string, label string) (func(), error) {
+	if queue == nil {
+		return func() {}, nil
+	}
+	queue.mutex.Lock()
+	if queue.config.Capacity <= 0 {
+		queue.mutex.Unlock()
+		return func() {}, nil
+	}
+	if queue.inUse < queue.config.Capacity {
+		queue.admit(model, queue.queue(model))
+		queue.mutex.Unlock()
+		return queue.releaser(), nil
+	}
+	q := queue.queue(model)
+	if q.waiters.Len() >= queue.config.MaxDepth {
+		queue.mutex.Unlock()
+		promFairQueueShed.WithLabelValues(protocol, label).Inc()
+		return nil, fmt.Errorf("%d requests for model %s are waiting: %w", queue.config.MaxDepth, model, errFairQueue)
+	}
+	waiter := &fairWaiter{ready: make(chan struct{}), label: label}
+	elem := q.waiters.PushBack(waiter)
+	promFairQueueDepth.WithLabelValues(label).Inc()
+	maxWait := queue.config.MaxWait
+	queue.mutex.Unlock()
+
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-waiter.ready:
+		return queue.releaser(), nil
+	case <-timer.C:
+		err = fmt.Errorf("waited %v for model %s: %w", maxWait, model, errFairQueue)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	if waiter.admitted {
+		// Admitted while giving up, so the capacity is ours to use
+		return queue.releaser(), nil
+	}
+	q.waiters.Remove(elem)
+	promFairQueueDepth.WithLabelValues(label).Dec()
+	if errors.Is(err, errFairQueue) {
+		promFairQueueShed.WithLabelValues(protocol, label).Inc()
+	}
+	return nil, err
+}
+
+// queue returns the queue of model. The caller must hold the lock.
+func (queue *FairQueue) queue(model string) *modelQueue {
+	q, ok := queue.queues[model]
+	if !ok {
+		q = &modelQueue{waiters: list.New()}
+		queue.queues[model] = q
+	}
+	return q
+}
+
+// admit takes capacity for a request of model and advances its virtual
+// time. The caller must hold the lock.
+func (queue *FairQueue) admit(model string, q *modelQueue) {
+	start := q.start(queue.now)
+	queue.now = start
+	q.finish = start + 1/queue.config.weight(model)
+	queue.inUse++
+}
+
+// start is the virtual time the next request of q would start at
+func (q *modelQueue) start(now float64) float64 {
+	if q.finish > now {
+		return q.finish
+	}
+	return now
+}
+
+// releaser returns the function freeing the capacity of an admitted
+// request
+func (queue *FairQueue) releaser() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			queue.mutex.Lock()
+			defer queue.mutex.Unlock()
+			queue.inUse--
+			queue.dispatch()
+		})
+	}
+}
+
+// dispatch admits waiting requests while there is capacity, starting with
+// the model furthest behind. The caller must hold the lock.
+func (queue *FairQueue) dispatch() {
+	for queue.config.Capacity <= 0 || queue.inUse < queue.config.Capacity {
+		var next string
+		var nextQueue *modelQueue
+		for model, q := range queue.queues {
+			if q.waiters.Len() == 0 {
+				// Forget idle models, they start from now when they return
+				if q.finish <= queue.now {
+					delete(queue.queues, model)
+				}
+				continue
+			}
+			if nextQueue == nil || q.start(queue.now) < nextQueue.start(queue.now) ||
+				(q.start(queue.now) == nextQueue.start(queue.now) && model < next) {
+				next, nextQueue = model, q
+			}
+		}
+		if nextQueue == nil {
+			return
+		}
+		waiter := nextQueue.waiters.Remove(nextQueue.waiters.Front()).(*fairWaiter)
+		promFairQueueDepth.WithLabelValues(waiter.label).Dec()
+		queue.admit(next, nextQueue)
+		waiter.admitted = true
+		close(waiter.ready)
+	}
+}
+
+// retryDelay is how long a shed request should wait before it is retried
+func (queue *FairQueue) retryDelay() time.Duration {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return queue.config.MaxWait
+}
@@ -0,0 +1,138 @@
+package tfservingproxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// queueWaiters queues n requests for model on queue, in order. Once
+// admitted, each sends its model on admitted and its release function on
+// releases.
+func queueWaiters(t *testing.T, queue *FairQueue, model string, n int, admitted chan<- string, releases chan<- func()) {
+	depth := promFairQueueDepth.WithLabelValues(model)
+	for i := 0; i < n; i++ {
+		queued := testutil.ToFloat64(depth)
+		go func() {
+			release, err := queue.acquire(context.Background(), "grpc", model, model)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			admitted <- model
+			releases <- release
+		}()
+		for testutil.ToFloat64(depth) == queued {
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+// admissionOrder releases the request holding the capacity of queue n
+// times and returns the models admitted in turn
+func admissionOrder(release func(), n int, admitted <-chan string, releases <-chan func()) []string {
+	order := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		release()
+		order = append(order, <-admitted)
+		release = <-releases
+	}
+	release()
+	return order
+}
+
+func TestFairQueueFloodDoesNotStarveTrickle(t *testing.T) {
+	queue := NewFairQueue(FairQueueConfig{Capacity: 1, MaxWait: 10 * time.Second})
+	release, err := queue.acquire(context.Background(), "grpc", "fq-flood", "fq-flood")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admitted, releases := make(chan string, 1), make(chan func(), 1)
+	queueWaiters(t, queue, "fq-flood", 20, admitted, releases)
+	queueWaiters(t, queue, "fq-trickle", 1, admitted, releases)
+
+	order := admissionOrder(release, 21, admitted, releases)
+	if order[0] != "fq-trickle" {
+		t.Errorf("Expected the trickle to go before the rest of the flood but got %v", order)
+	}
+}
+
+func TestFairQueueSharesCapacityByWeight(t *testing.T) {
+	queue := NewFairQueue(FairQueueConfig{Capacity: 1, Weights: map[string]int{"fq-heavy": 3}, MaxWait: 10 * time.Second})
+	release, err := queue.acquire(context.Background(), "grpc", "fq-holder", "fq-holder")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admitted, releases := make(chan string, 1), make(chan func(), 1)
+	queueWaiters(t, queue, "fq-heavy", 8, admitted, releases)
+	queueWaiters(t, queue, "fq-light", 8, admitted, releases)
+
+	order := admissionOrder(release, 16, admitted, releases)
+	counts := make(map[string]int)
+	for _, model := range order[:8] {
+		counts[model]++
+	}
+	if counts["fq-heavy"] != 6 || counts["fq-light"] != 2 {
+		t.Errorf("Expected three heavy requests for each light one but got %v", order)
+	}
+}
+
+func TestFairQueueShedsOverflow(t *testing.T) {
+	queue := NewFairQueue(FairQueueConfig{Capacity: 1, MaxDepth: 1, MaxWait: 50 * time.Millisecond})
+	before := testutil.ToFloat64(promFairQueueShed.WithLabelValues("grpc", "fq-shed"))
+	release, err := queue.acquire(context.Background(), "grpc", "fq-shed", "fq-shed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	waited := make(chan error)
+	go func() {
+		_, err := queue.acquire(context.Background(), "grpc", "fq-shed", "fq-shed")
+		waited <- err
+	}()
+	for testutil.ToFloat64(promFairQueueDepth.WithLabelValues("fq-shed")) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := queue.acquire(context.Background(), "grpc", "fq-shed", "fq-shed"); !errors.Is(err, errFairQueue) {
+		t.Errorf("Expected a request over the depth to be shed but got %v", err)
+	}
+	if err := <-waited; !errors.Is(err, errFairQueue) {
+		t.Errorf("Expected a request waiting too long to be shed but got %v", err)
+	}
+	if n := testutil.ToFloat64(promFairQueueShed.WithLabelValues("grpc", "fq-shed")) - before; n != 2 {
+		t.Errorf("Expected two requests to be counted as shed but got %v", n)
+	}
+	if n := testutil.ToFloat64(promFairQueueDepth.WithLabelValues("fq-shed")); n != 0 {
+		t.Errorf("Expected the queue to be empty but got %v", n)
+	}
+}
+
+func TestRESTFairQueueAnswersTooManyRequests(t *testing.T) {
+	queue := NewFairQueue(FairQueueConfig{Capacity: 1, MaxWait: 20 * time.Millisecond})
+	proxy := NewRestProxy(func(req *http.Request, _ string, _ string) error {
+		t.Error("Expected the shed request not to be resolved")
+		return nil
+	}, WithRESTFairQueue(queue))
+	release, err := queue.acquire(context.Background(), "rest", "foo", "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+
+	shed := promFairQueueShed.WithLabelValues("rest", allModelsLabel)
+	before := testutil.ToFloat64(shed)
+	rw := httptest.NewRecorder()
+	proxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/foo/versions/1:predict", nil))
+	if rw.Code != http.StatusTooManyRequests || rw.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected 429 with Retry-After but got %d %v", rw.Code, rw.Header())
+	}
+	if n := testutil.ToFloat64(shed) - before; n != 1 {
+		t.Errorf("Expected the shed request counted without its model label but got %v", n)
+	}
+}
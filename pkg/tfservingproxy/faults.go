@@ -0,0 +1,282 @@
+package tfservingproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var promInjectedFaults = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_injected_faults_total",
+	Help: "The total number of faults injected into requests by type. Requests failed by an injected fault are not counted as failures.",
+}, []string{"protocol", "model", "fault"})
+
+// FaultType is the kind of failure a Fault injects
+type FaultType string
+
+const (
+	// FaultDelay delays requests before forwarding them
+	FaultDelay FaultType = "delay"
+	// FaultAbort answers requests with an error instead of forwarding them
+	FaultAbort FaultType = "abort"
+	// FaultReset fails requests like a node closing the connection
+	FaultReset FaultType = "reset"
+)
+
+// Fault is injected into a share of the requests for a model once they are
+// routed to a node, to test how clients cope with failing nodes.
+type Fault struct {
+	Type FaultType `mapstructure:"type" yaml:"type"`
+	// Probability is the share of requests the fault is injected into,
+	// from 0 for none to 1 for all
+	Probability float64 `mapstructure:"probability" yaml:"probability"`
+	// Delay and Jitter delay requests by Delay plus up to Jitter
+	Delay  time.Duration `mapstructure:"delay" yaml:"delay"`
+	Jitter time.Duration `mapstructure:"jitter" yaml:"jitter"`
+	// Code and Status are the grpc status code and HTTP status of aborted
+	// requests. Either is derived from the other if not set, or they are
+	// Unavailable and 503 if neither is.
+	Code   codes.Code `mapstructure:"code" yaml:"code"`
+	Status int        `mapstructure:"status" yaml:"status"`
+}
+
+// validate returns an error if the fault cannot be injected
+func (fault Fault) validate() error {
+	switch fault.Type {
+	case FaultDelay:
+		if fault.Delay <= 0 && fault.Jitter <= 0 {
+			return errors.New("delay fault needs a delay or jitter")
+		}
+	case FaultAbort, FaultReset:
+	default:
+		return fmt.Errorf("unknown fault type %q", fault.Type)
+	}
+	if fault.Probability < 0 || fault.Probability > 1 {
+		return fmt.Errorf("probability %v out of range", fault.Probability)
+	}
+	if fault.Delay < 0 || fault.Jitter < 0 {
+		return fmt.Errorf("delay must not be negative, got %v and jitter %v", fault.Delay, fault.Jitter)
+	}
+	if fault.Code > codes.Unauthenticated {
+		return fmt.Errorf("unknown grpc code %d", fault.Code)
+	}
+	if fault.Status != 0 && (fault.Status < 100 || fault.Status > 599) {
+		return fmt.Errorf("status %d out of range", fault.Status)
+	}
+	return nil
+}
+
+// delay returns the delay of a request
+func (fault Fault) delay() time.Duration {
+	if fault.Jitter <= 0 {
+		return fault.Delay
+	}
+	return fault.Delay + time.Duration(rand.Int63n(int64(fault.Jitter)))
+}
+
+// abortCode returns the grpc status code of aborted calls
+func (fault Fault) abortCode() codes.Code {
+	switch {
+	case fault.Code != codes.OK:
+		return fault.Code
+	case fault.Status != 0:
+		return grpcCodeForHTTPStatus(fault.Status)
+	}
+	return codes.Unavailable
+}
+
+// abortStatus returns the HTTP status of aborted REST requests
+func (fault Fault) abortStatus() int {
+	switch {
+	case fault.Status != 0:
+		return fault.Status
+	case fault.Code != codes.OK:
+		return httpStatus(status.Error(fault.Code, ""))
+	}
+	return http.StatusServiceUnavailable
+}
+
+// Faults holds the faults injected by model. Faults shared by a GrpcProxy
+// and a RestProxy inject into both protocols at once.
+type Faults struct {
+	models map[string]Fault
+	mutex  sync.RWMutex
+}
+
+// NewFaults creates Faults injecting the faults in models
+func NewFaults(models map[string]Fault) *Faults {
+	faults := &Faults{}
+	faults.Set(models)
+	return faults
+}
+
+// Set replaces the injected faults with those in models. It is safe to
+// call while serving.
+func (faults *Faults) Set(models map[string]Fault) {
+	copied := make(map[string]Fault, len(models))
+	for model, fault := range models {
+		copied[model] = fault
+	}
+	faults.mutex.Lock()
+	defer faults.mutex.Unlock()
+	faults.models = copied
+}
+
+// roll returns the fault of model if one is injected into the request
+func (faults *Faults) roll(model string) (Fault, bool) {
+	if faults == nil {
+		return Fault{}, false
+	}
+	faults.mutex.RLock()
+	fault, ok := faults.models[model]
+	faults.mutex.RUnlock()
+	if !ok || rand.Float64() >= fault.Probability {
+		return Fault{}, false
+	}
+	return fault, true
+}
+
+// WithFaults injects faults into the calls for their models once they are
+// routed. Calls failed by a fault are not retried.
+func WithFaults(faults *Faults) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.serverImpl.faults = faults
+	}
+}
+
+// WithRESTFaults injects faults into the requests for their models once
+// they are routed
+func WithRESTFaults(faults *Faults) RestProxyOption {
+	return func(proxy *RestProxy) {
+		proxy.faults = faults
+	}
+}
+
+// markFault marks the request of ctx as fault-injected in its logs,
+// routing decision and metrics
+func markFault(ctx context.Context, logger log.FieldLogger, protocol string, model string, label string, fault Fault) {
+	if route, ok := ctx.Value(routeKey{}).(*routeInfo); ok {
+		route.fault = fault.Type
+	}
+	addLogFields(ctx, log.Fields{logFieldFault: string(fault.Type)})
+	promInjectedFaults.WithLabelValues(protocol, label, string(fault.Type)).Inc()
+	logger.Warnf("Injecting %s fault into request for model %s", fault.Type, model)
+}
+
+// sleepFor waits for d or until ctx is done
+func sleepFor(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// injectFault injects fault into a grpc call routed to target. It returns
+// nil once a delay is over, so that the call is forwarded.
+func (server *proxyServiceServer) injectFault(ctx context.Context, modelSpec *pb.ModelSpec, route *routeInfo, hooks *requestHooks, target string, fault Fault) error {
+	markFault(ctx, server.loggerFor(ctx), "grpc", route.key.Name, server.modelLabel(route.key.Name), fault)
+	var err error
+	switch fault.Type {
+	case FaultDelay:
+		if err = sleepFor(ctx, fault.delay()); err == nil {
+			return nil
+		}
+		err = proxyStatus(grpcCode(err), modelSpec, target, fmt.Errorf("injected delay: %w", err)).Err()
+	case FaultAbort:
+		err = proxyStatus(fault.abortCode(), modelSpec, target, errors.New("injected fault")).Err()
+	case FaultReset:
+		err = proxyStatus(codes.Unavailable, modelSpec, target, errors.New("injected fault: connection reset by peer")).Err()
+	}
+	hooks.fail(ctx, FailureInjected, err)
+	return err
+}
+
+// faultKey is the request context key of the fault to inject into a REST
+// request once it is routed
+type faultKey struct{}
+
+// pendingFault is a fault to inject into a REST request for model, whose
+// metrics have the model label label
+type pendingFault struct {
+	fault Fault
+	model string
+	label string
+}
+
+// withFault returns req carrying the fault to inject once it is routed, if
+// one is injected into requests for key
+func (handler *RestProxy) withFault(req *http.Request, key ModelKey) *http.Request {
+	fault, ok := handler.faults.roll(key.Name)
+	if !ok {
+		return req
+	}
+	pending := pendingFault{fault: fault, model: key.Name, label: handler.modelLabel(key.Name)}
+	return req.WithContext(context.WithValue(req.Context(), faultKey{}, pending))
+}
+
+// injectedError is the error of a REST request failed by an injected fault
+type injectedError struct {
+	fault Fault
+	err   error
+}
+
+func (e *injectedError) Error() string { return "injected fault: " + e.err.Error() }
+
+func (e *injectedError) Unwrap() error { return e.err }
+
+// injectRESTFault injects the pending fault of a routed REST request, if
+// it has one. It returns nil once a delay is over, so that the request is
+// forwarded.
+func injectRESTFault(req *http.Request) error {
+	pending, ok := req.Context().Value(faultKey{}).(pendingFault)
+	if !ok {
+		return nil
+	}
+	markFault(req.Context(), restLogger(req), "rest", pending.model, pending.label, pending.fault)
+	switch pending.fault.Type {
+	case FaultDelay:
+		if err := sleepFor(req.Context(), pending.fault.delay()); err != nil {
+			return &injectedError{fault: pending.fault, err: fmt.Errorf("delay: %w", err)}
+		}
+		return nil
+	case FaultReset:
+		return &injectedError{fault: pending.fault, err: errors.New("connection reset by peer")}
+	}
+	return &injectedError{fault: pending.fault, err: fmt.Errorf("abort with status %d", pending.fault.abortStatus())}
+}
+
+// writeInjected answers a REST request failed by an injected fault. A
+// reset closes the connection without an answer where it can be taken
+// over, and answers 502 otherwise, such as for coalesced requests.
+func writeInjected(rw http.ResponseWriter, req *http.Request, injected *injectedError) {
+	restHooks(req).fail(req.Context(), FailureInjected, injected)
+	switch injected.fault.Type {
+	case FaultDelay:
+		writeError(rw, httpStatus(injected.err), injected.Error())
+	case FaultAbort:
+		writeError(rw, injected.fault.abortStatus(), injected.Error())
+	case FaultReset:
+		if hijacker, ok := rw.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				conn.Close()
+				return
+			}
+		}
+		writeError(rw, http.StatusBadGateway, injected.Error())
+	}
+}
@@ -0,0 +1,199 @@
+package tfservingproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestFaultsRollByProbability(t *testing.T) {
+	faults := NewFaults(map[string]Fault{
+		"never":     {Type: FaultAbort},
+		"always":    {Type: FaultAbort, Probability: 1},
+		"sometimes": {Type: FaultAbort, Probability: 0.3},
+	})
+	const n = 20000
+	rolled := make(map[string]int)
+	for i := 0; i < n; i++ {
+		for _, model := range []string{"never", "always", "sometimes", "other"} {
+			if _, ok := faults.roll(model); ok {
+				rolled[model]++
+			}
+		}
+	}
+	if rolled["never"] != 0 || rolled["other"] != 0 || rolled["always"] != n {
+		t.Errorf("Expected faults by probability but got %v", rolled)
+	}
+	if !withinShare(rolled["sometimes"], n, 0.3, 0.02) {
+		t.Errorf("Expected a fault in 30%% of %d requests but got %d", n, rolled["sometimes"])
+	}
+	if _, ok := (*Faults)(nil).roll("always"); ok {
+		t.Error("Expected no faults without Faults")
+	}
+}
+
+func TestGrpcFaultInjection(t *testing.T) {
+	upstream := tfservingtest.NewGRPCNode(t, "upstream")
+	routingLog := NewRoutingLog(10)
+	faults := NewFaults(nil)
+	client := startProxy(t, NewGrpcProxyWithResolver(ResolverFunc(func(ctx context.Context, key ModelKey) (Resolution, error) {
+		return Resolution{Targets: []Target{{Address: "node1:8500"}}}, nil
+	}), WithUpstreamDialer(upstream.Dialer()), WithUpstreamDialOptions(grpc.WithInsecure()),
+		WithFaults(faults), WithUpstreamRetries(2), WithRoutingLog(routingLog)))
+
+	tests := []struct {
+		name      string
+		fault     Fault
+		timeout   time.Duration
+		code      codes.Code
+		minTook   time.Duration
+		forwarded int
+	}{
+		{"abort with code", Fault{Type: FaultAbort, Code: codes.PermissionDenied}, 0, codes.PermissionDenied, 0, 0},
+		{"abort with status", Fault{Type: FaultAbort, Status: http.StatusNotFound}, 0, codes.NotFound, 0, 0},
+		{"reset", Fault{Type: FaultReset}, 0, codes.Unavailable, 0, 0},
+		{"delay", Fault{Type: FaultDelay, Delay: 50 * time.Millisecond, Jitter: 50 * time.Millisecond}, 0, codes.OK, 50 * time.Millisecond, 1},
+		{"delay past the deadline", Fault{Type: FaultDelay, Delay: time.Minute}, 100 * time.Millisecond, codes.DeadlineExceeded, 100 * time.Millisecond, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fault.Probability = 1
+			faults.Set(map[string]Fault{"foo": tt.fault})
+			failed := testutil.ToFloat64(promRequestsFailed.WithLabelValues("grpc"))
+			injected := testutil.ToFloat64(promInjectedFaults.WithLabelValues("grpc", allModelsLabel, string(tt.fault.Type)))
+			forwarded := len(upstream.Requests())
+
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+			start := time.Now()
+			_, err := client.Predict(ctx, predictVersion("foo", 1))
+			if status.Code(err) != tt.code || time.Since(start) < tt.minTook {
+				t.Errorf("Expected %v after at least %v but got %v after %v", tt.code, tt.minTook, err, time.Since(start))
+			}
+			if n := len(upstream.Requests()) - forwarded; n != tt.forwarded {
+				t.Errorf("Expected %d forwarded calls but got %d", tt.forwarded, n)
+			}
+			if n := testutil.ToFloat64(promInjectedFaults.WithLabelValues("grpc", allModelsLabel, string(tt.fault.Type))) - injected; n != 1 {
+				t.Errorf("Expected one injected fault to be counted but got %v", n)
+			}
+			if n := testutil.ToFloat64(promRequestsFailed.WithLabelValues("grpc")) - failed; n != 0 {
+				t.Errorf("Expected injected faults not to be counted as failures but got %v", n)
+			}
+			if d := routingLog.Recent("foo", 1); len(d) != 1 || d[0].Fault != string(tt.fault.Type) || d[0].Target != "node1:8500" {
+				t.Errorf("Expected the routing decision to be marked as fault-injected but got %+v", d)
+			}
+		})
+	}
+
+	// Other models and calls after the faults are removed are forwarded
+	forwarded := len(upstream.Requests())
+	if _, err := client.Predict(context.Background(), predictVersion("bar", 1)); err != nil {
+		t.Errorf("Expected calls for other models to be forwarded but got %v", err)
+	}
+	faults.Set(nil)
+	if _, err := client.Predict(context.Background(), predictVersion("foo", 1)); err != nil {
+		t.Errorf("Expected calls to be forwarded without faults but got %v", err)
+	}
+	if n := len(upstream.Requests()) - forwarded; n != 2 {
+		t.Errorf("Expected 2 forwarded calls but got %d", n)
+	}
+}
+
+func TestRESTFaultInjection(t *testing.T) {
+	var forwarded int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&forwarded, 1)
+		rw.Write([]byte(`{"predictions": [1]}`))
+	}))
+	defer upstream.Close()
+	routingLog := NewRoutingLog(10)
+	proxy, err := NewRestProxyFromConfig(Config{}, func(req *http.Request, _ string, _ string) error {
+		req.URL.Scheme, req.URL.Host = "http", upstream.Listener.Addr().String()
+		return nil
+	}, WithRESTRoutingLog(routingLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(proxy.Serve()))
+	defer server.Close()
+	post := func(model string) (*http.Response, error) {
+		res, err := http.Post(server.URL+"/v1/models/"+model+"/versions/1:predict", "application/json", strings.NewReader(`{"instances": [1]}`))
+		if err == nil {
+			res.Body.Close()
+		}
+		return res, err
+	}
+
+	tests := []struct {
+		name      string
+		fault     Fault
+		status    int
+		minTook   time.Duration
+		forwarded int32
+	}{
+		{"abort with status", Fault{Type: FaultAbort, Status: http.StatusTooManyRequests}, http.StatusTooManyRequests, 0, 0},
+		{"abort with code", Fault{Type: FaultAbort, Code: codes.PermissionDenied}, http.StatusForbidden, 0, 0},
+		{"reset", Fault{Type: FaultReset}, 0, 0, 0},
+		{"delay", Fault{Type: FaultDelay, Delay: 50 * time.Millisecond, Jitter: 50 * time.Millisecond}, http.StatusOK, 50 * time.Millisecond, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fault.Probability = 1
+			cfg := Config{Faults: map[string]Fault{"foo": tt.fault}}
+			if err := proxy.ApplyConfig(cfg); err != nil {
+				t.Fatal(err)
+			}
+			failed := testutil.ToFloat64(promRequestsFailed.WithLabelValues("rest"))
+			injected := testutil.ToFloat64(promInjectedFaults.WithLabelValues("rest", allModelsLabel, string(tt.fault.Type)))
+			before := atomic.LoadInt32(&forwarded)
+
+			start := time.Now()
+			res, err := post("foo")
+			if tt.status == 0 {
+				if err == nil {
+					t.Errorf("Expected the connection to be reset but got %d", res.StatusCode)
+				}
+			} else if err != nil || res.StatusCode != tt.status || time.Since(start) < tt.minTook {
+				t.Errorf("Expected %d after at least %v but got %v %v after %v", tt.status, tt.minTook, res, err, time.Since(start))
+			}
+			if n := atomic.LoadInt32(&forwarded) - before; n != tt.forwarded {
+				t.Errorf("Expected %d forwarded requests but got %d", tt.forwarded, n)
+			}
+			if n := testutil.ToFloat64(promInjectedFaults.WithLabelValues("rest", allModelsLabel, string(tt.fault.Type))) - injected; n != 1 {
+				t.Errorf("Expected one injected fault to be counted but got %v", n)
+			}
+			if n := testutil.ToFloat64(promRequestsFailed.WithLabelValues("rest")) - failed; n != 0 {
+				t.Errorf("Expected injected faults not to be counted as failures but got %v", n)
+			}
+			// The decision is recorded once the handler returns
+			waitFor(t, func() bool {
+				d := routingLog.Recent("foo", 1)
+				return len(d) == 1 && !d[0].Time.Before(start)
+			})
+			if d := routingLog.Recent("foo", 1); d[0].Fault != string(tt.fault.Type) || d[0].Target == "" {
+				t.Errorf("Expected the routing decision to be marked as fault-injected but got %+v", d)
+			}
+		})
+	}
+
+	if err := proxy.ApplyConfig(Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if res, err := post("foo"); err != nil || res.StatusCode != http.StatusOK {
+		t.Errorf("Expected requests to be forwarded without faults but got %v %v", res, err)
+	}
+}
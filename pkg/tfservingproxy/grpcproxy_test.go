@@ -0,0 +1,1334 @@
+package tfservingproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/tensorflow/tensorflow/tensorflow/go/core/framework"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	channelzpb "google.golang.org/grpc/channelz/grpc_channelz_v1"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/stats"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func bufDial(lis *bufconn.Listener) grpc.DialOption {
+	return grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return lis.Dial()
+	})
+}
+
+// startProxy serves a GrpcProxy on an in-memory listener and returns a client for it.
+func startProxy(t *testing.T, proxy *GrpcProxy) pb.PredictionServiceClient {
+	return tfservingtest.NewHarness(t).Serve(proxy)
+}
+
+func TestGrpcProxyPassesUpstreamStatusDetails(t *testing.T) {
+	upstreamStatus, err := status.New(codes.FailedPrecondition, "Servable not found").WithDetails(
+		&errdetails.DebugInfo{Detail: "from upstream"},
+		&errdetails.ResourceInfo{ResourceType: "servable", ResourceName: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	harness := tfservingtest.NewHarness(t, tfservingtest.UpstreamError("foo", upstreamStatus.Err()))
+	client := harness.Serve(NewGrpcProxy(harness.ClientProvider))
+
+	_, err = client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}})
+	got := status.Convert(err)
+	if !proto.Equal(got.Proto(), upstreamStatus.Proto()) {
+		t.Errorf("Expected upstream status %v but got %v", upstreamStatus.Proto(), got.Proto())
+	}
+}
+
+func TestGrpcProxyProviderFailureHasProxyDetail(t *testing.T) {
+	harness := tfservingtest.NewHarness(t, tfservingtest.ProviderError("foo", errors.New("no nodes")))
+	client := harness.Serve(NewGrpcProxy(harness.ClientProvider))
+
+	_, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}})
+	st := status.Convert(err)
+	if st.Code() != codes.Unavailable {
+		t.Errorf("Expected code %v but got %v", codes.Unavailable, st.Code())
+	}
+	details := st.Details()
+	if len(details) != 1 {
+		t.Fatalf("Expected one detail but got %d", len(details))
+	}
+	info, ok := details[0].(*errdetails.ResourceInfo)
+	if !ok || info.ResourceType != ProxyResourceType || info.ResourceName != "foo:0" {
+		t.Errorf("Unexpected proxy detail: %v", details[0])
+	}
+}
+
+func TestGrpcProxyTracingSpanParentage(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	propagator := propagation.TraceContext{}
+
+	var upstreamParent trace.SpanContext
+	upstream := tfservingtest.NewGRPCNode(t, "upstream", tfservingtest.WithPredict(func(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		upstreamParent = trace.SpanContextFromContext(propagator.Extract(ctx, metadataCarrier(md)))
+		return &pb.PredictResponse{}, nil
+	})).Dial(t)
+	client := startProxy(t, NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return upstream, nil
+	}, WithTracerProvider(tp), WithTextMapPropagator(propagator)))
+
+	ctx, clientSpan := tp.Tracer("test").Start(context.Background(), "client")
+	md := metadata.MD{}
+	propagator.Inject(ctx, metadataCarrier(md))
+	_, err := client.Predict(metadata.NewOutgoingContext(ctx, md), &pb.PredictRequest{
+		ModelSpec: &pb.ModelSpec{Name: "foo", VersionChoice: &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: 2}}},
+	})
+	clientSpan.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := map[string]tracetest.SpanStub{}
+	for _, s := range exporter.GetSpans() {
+		spans[s.Name] = s
+	}
+	serverSpan, ok := spans["/tensorflow.serving.PredictionService/Predict"]
+	if !ok {
+		t.Fatalf("No server span recorded: %v", spans)
+	}
+	if serverSpan.Parent.SpanID() != clientSpan.SpanContext().SpanID() {
+		t.Errorf("Server span is not a child of the client span")
+	}
+	resolveSpan, ok := spans["tfservingcache.resolve"]
+	if !ok || resolveSpan.Parent.SpanID() != serverSpan.SpanContext.SpanID() {
+		t.Errorf("Resolve span is not a child of the server span")
+	}
+	if upstreamParent.SpanID() != serverSpan.SpanContext.SpanID() {
+		t.Errorf("Upstream did not receive the server span context")
+	}
+	attrs := map[attribute.Key]string{}
+	for _, kv := range serverSpan.Attributes {
+		attrs[kv.Key] = kv.Value.Emit()
+	}
+	if attrs[attrModel] != "foo" || attrs[attrVersion] != "2" || attrs[attrTarget] != "upstream" {
+		t.Errorf("Unexpected server span attributes: %v", attrs)
+	}
+}
+
+// recordingStatsHandler counts the RPC Begin and End events it observes.
+type recordingStatsHandler struct {
+	mu     sync.Mutex
+	begins int
+	ends   int
+}
+
+func (h *recordingStatsHandler) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (h *recordingStatsHandler) HandleRPC(_ context.Context, s stats.RPCStats) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch s.(type) {
+	case *stats.Begin:
+		h.begins++
+	case *stats.End:
+		h.ends++
+	}
+}
+
+func (h *recordingStatsHandler) TagConn(ctx context.Context, _ *stats.ConnTagInfo) context.Context {
+	return ctx
+}
+
+func (h *recordingStatsHandler) HandleConn(context.Context, stats.ConnStats) {}
+
+func (h *recordingStatsHandler) counts() (int, int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.begins, h.ends
+}
+
+func TestGrpcProxyStatsHandlers(t *testing.T) {
+	upstream := tfservingtest.NewGRPCNode(t, "upstream")
+
+	serverStats := &recordingStatsHandler{}
+	upstreamStats := &recordingStatsHandler{}
+	var proxy *GrpcProxy
+	var conns []*grpc.ClientConn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	proxy = NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		conn, err := proxy.DialUpstream(upstream.Name(), upstream.DialOption(), grpc.WithInsecure())
+		conns = append(conns, conn)
+		return conn, err
+	}, WithServerStatsHandler(serverStats), WithUpstreamStatsHandler(upstreamStats))
+	client := startProxy(t, proxy)
+
+	if _, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}); err != nil {
+		t.Fatal(err)
+	}
+	for name, h := range map[string]*recordingStatsHandler{"server": serverStats, "upstream": upstreamStats} {
+		// The server reports End after the response is written, so allow it a moment
+		deadline := time.Now().Add(time.Second)
+		begins, ends := h.counts()
+		for ends == 0 && time.Now().Before(deadline) {
+			time.Sleep(5 * time.Millisecond)
+			begins, ends = h.counts()
+		}
+		if begins != 1 || ends != 1 {
+			t.Errorf("Expected one Begin and End on %s handler but got %d and %d", name, begins, ends)
+		}
+	}
+}
+
+func TestGrpcProxyShedsAboveMaxInFlight(t *testing.T) {
+	release := make(chan struct{})
+	upstream := tfservingtest.NewGRPCNode(t, "upstream", tfservingtest.WithPredict(func(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+		<-release
+		return &pb.PredictResponse{}, nil
+	})).Dial(t)
+	proxy := NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return upstream, nil
+	}, WithMaxInFlight(2))
+	client := startProxy(t, proxy)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}); err != nil {
+				t.Errorf("Admitted call failed: %v", err)
+			}
+		}()
+	}
+	for atomic.LoadInt64(&proxy.inFlight) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	_, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected %v but got %v", codes.ResourceExhausted, err)
+	}
+	if time.Since(start) > 500*time.Millisecond {
+		t.Errorf("Shedding took %v", time.Since(start))
+	}
+	close(release)
+	wg.Wait()
+	if n := atomic.LoadInt64(&proxy.inFlight); n != 0 {
+		t.Errorf("Expected no requests in flight but got %d", n)
+	}
+}
+
+func TestGrpcProxyModelConcurrencyLimits(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan string, 10)
+	upstream := tfservingtest.NewGRPCNode(t, "upstream", tfservingtest.WithPredict(func(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+		started <- req.GetModelSpec().GetName()
+		<-release
+		return &pb.PredictResponse{}, nil
+	})).Dial(t)
+	client := startProxy(t, NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return upstream, nil
+	}, WithModelConcurrencyLimits(ModelConcurrencyLimits{Default: 1, PerModel: map[string]int{"b": 2}})))
+
+	predict := func(model string) error {
+		_, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: model}})
+		return err
+	}
+	var wg sync.WaitGroup
+	for _, model := range []string{"a", "b", "b"} {
+		wg.Add(1)
+		go func(model string) {
+			defer wg.Done()
+			if err := predict(model); err != nil {
+				t.Errorf("Call for %s failed: %v", model, err)
+			}
+		}(model)
+		<-started
+	}
+
+	for _, model := range []string{"a", "b"} {
+		err := predict(model)
+		if status.Code(err) != codes.ResourceExhausted || !strings.Contains(status.Convert(err).Message(), model) {
+			t.Errorf("Expected %v naming model %s but got %v", codes.ResourceExhausted, model, err)
+		}
+	}
+	close(release)
+	wg.Wait()
+	if err := predict("a"); err != nil {
+		t.Errorf("Call after release failed: %v", err)
+	}
+}
+
+func TestModelLimiterDropsIdleSemaphores(t *testing.T) {
+	limiter := newModelLimiter(ModelConcurrencyLimits{Default: 1})
+	release, err := limiter.acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limiter.acquire(context.Background(), "a"); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected %v but got %v", codes.ResourceExhausted, err)
+	}
+	for i := 0; i < 100; i++ {
+		done, err := limiter.acquire(context.Background(), fmt.Sprintf("invented-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		done()
+	}
+	if n := len(limiter.semaphores); n != 1 {
+		t.Errorf("Expected only the semaphore in use to be kept but got %d", n)
+	}
+	release()
+	if n := len(limiter.semaphores); n != 0 {
+		t.Errorf("Expected idle semaphores to be dropped but got %d", n)
+	}
+}
+
+func TestGrpcProxyAuthenticator(t *testing.T) {
+	upstream := tfservingtest.NewGRPCNode(t, "upstream").Dial(t)
+	resolved := 0
+	proxy := NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		resolved++
+		return upstream, nil
+	}, WithAuthenticator(StaticTokenAuthenticator(map[string][]string{"secret": {"foo"}})))
+	client := startProxy(t, proxy)
+
+	tests := []struct {
+		name     string
+		md       metadata.MD
+		model    string
+		expected codes.Code
+	}{
+		{"allowed", metadata.Pairs("authorization", "Bearer secret"), "foo", codes.OK},
+		{"api key", metadata.Pairs("x-api-key", "secret"), "foo", codes.OK},
+		{"denied", metadata.Pairs("authorization", "Bearer secret"), "bar", codes.PermissionDenied},
+		{"wrong token", metadata.Pairs("authorization", "Bearer guess"), "foo", codes.Unauthenticated},
+		{"missing", metadata.MD{}, "foo", codes.Unauthenticated},
+	}
+	for _, test := range tests {
+		ctx := metadata.NewOutgoingContext(context.Background(), test.md)
+		_, err := client.Predict(ctx, &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: test.model}})
+		if status.Code(err) != test.expected {
+			t.Errorf("%s: expected %v but got %v", test.name, test.expected, err)
+		}
+	}
+	if resolved != 2 {
+		t.Errorf("Expected only authorized calls to be resolved but got %d resolutions", resolved)
+	}
+
+	// Unauthenticated calls are rejected before the proxy admits them
+	proxy.SetReady(false)
+	if _, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected %v before readiness is checked but got %v", codes.Unauthenticated, err)
+	}
+	ctx := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("authorization", "Bearer secret"))
+	if _, err := client.Predict(ctx, &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}); status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected authenticated calls to be rejected by readiness with %v but got %v", codes.Unavailable, err)
+	}
+}
+
+func TestGrpcProxyResolverDialsAddress(t *testing.T) {
+	upstream := tfservingtest.NewGRPCNode(t, "upstream")
+
+	var keys []ModelKey
+	proxy := NewGrpcProxyWithResolver(ResolverFunc(func(ctx context.Context, key ModelKey) (Resolution, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Errorf("Resolver did not get the caller deadline")
+		}
+		keys = append(keys, key)
+		return Resolution{Targets: []Target{{Address: "node1:8500"}}}, nil
+	}), WithUpstreamDialOptions(upstream.DialOption(), grpc.WithInsecure()))
+	client := startProxy(t, proxy)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for i := 0; i < 2; i++ {
+		if _, err := client.Predict(ctx, &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(keys) != 2 || keys[0] != (ModelKey{Name: "foo", Version: "0"}) {
+		t.Errorf("Unexpected resolved keys: %v", keys)
+	}
+	if len(proxy.serverImpl.conns.conns) != 1 {
+		t.Errorf("Expected the dialed connection to be reused")
+	}
+}
+
+func TestGrpcProxyTypedResolverErrors(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected codes.Code
+	}{
+		{fmt.Errorf("no such model: %w", ErrModelNotFound), codes.NotFound},
+		{fmt.Errorf("bad version: %w", ErrInvalidModel), codes.InvalidArgument},
+		{fmt.Errorf("cluster empty: %w", ErrUnavailable), codes.Unavailable},
+		{errors.New("something else"), codes.Unavailable},
+		{status.Error(codes.PermissionDenied, "nope"), codes.PermissionDenied},
+	}
+	for _, test := range tests {
+		client := startProxy(t, NewGrpcProxyWithResolver(ResolverFunc(func(context.Context, ModelKey) (Resolution, error) {
+			return Resolution{}, test.err
+		})))
+		_, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}})
+		if status.Code(err) != test.expected {
+			t.Errorf("%v: expected %v but got %v", test.err, test.expected, err)
+		}
+	}
+}
+
+func TestGrpcProxyClientProviderWithoutConn(t *testing.T) {
+	client := startProxy(t, NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return nil, nil
+	}))
+	_, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected %v but got %v", codes.Unavailable, err)
+	}
+}
+
+func TestGrpcProxyValidatesModelSpec(t *testing.T) {
+	var resolved []ModelKey
+	client := startProxy(t, NewGrpcProxyWithResolver(ResolverFunc(func(_ context.Context, key ModelKey) (Resolution, error) {
+		resolved = append(resolved, key)
+		return Resolution{}, ErrUnavailable
+	})))
+	version := func(v int64) *pb.ModelSpec_Version {
+		return &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: v}}
+	}
+
+	tests := []struct {
+		name  string
+		spec  *pb.ModelSpec
+		field string
+	}{
+		{"missing spec", nil, "model_spec.name"},
+		{"empty name", &pb.ModelSpec{}, "model_spec.name"},
+		{"long name", &pb.ModelSpec{Name: strings.Repeat("a", maxModelNameLength+1)}, "model_spec.name"},
+		{"slash", &pb.ModelSpec{Name: "../etc"}, "model_spec.name"},
+		{"whitespace", &pb.ModelSpec{Name: "my model"}, "model_spec.name"},
+		{"negative version", &pb.ModelSpec{Name: "foo", VersionChoice: version(-1)}, "model_spec.version"},
+	}
+	for _, test := range tests {
+		_, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: test.spec})
+		st := status.Convert(err)
+		if st.Code() != codes.InvalidArgument || !strings.Contains(st.Message(), test.field) {
+			t.Errorf("%s: expected %v naming %s but got %v", test.name, codes.InvalidArgument, test.field, err)
+			continue
+		}
+		badRequest, ok := st.Details()[0].(*errdetails.BadRequest)
+		if !ok || badRequest.FieldViolations[0].Field != test.field {
+			t.Errorf("%s: missing field violation detail: %v", test.name, st.Details())
+		}
+	}
+	if len(resolved) != 0 {
+		t.Errorf("Invalid specs reached the resolver: %v", resolved)
+	}
+
+	_, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "my-model_1.0", VersionChoice: version(3)}})
+	if status.Code(err) != codes.Unavailable || len(resolved) != 1 || resolved[0] != (ModelKey{Name: "my-model_1.0", Version: "3"}) {
+		t.Errorf("Valid spec was not passed through untouched: %v, %v", err, resolved)
+	}
+}
+
+func TestGrpcProxyRegistersConfiguredServices(t *testing.T) {
+	proxy := NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return nil, ErrUnavailable
+	}, WithServices(PredictionService), WithReflection())
+	lis := bufconn.Listen(1024 * 1024)
+	go proxy.Serve(lis)
+	defer proxy.Close()
+	conn, err := grpc.Dial("bufnet", bufDial(lis), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = pb.NewSessionServiceClient(conn).SessionRun(context.Background(), &pb.SessionRunRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}})
+	if status.Code(err) != codes.Unimplemented || !strings.Contains(status.Convert(err).Message(), "unknown service") {
+		t.Errorf("Expected unknown service error but got %v", err)
+	}
+
+	stream, err := rpb.NewServerReflectionClient(conn).ServerReflectionInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = stream.Send(&rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_ListServices{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var services []string
+	for _, service := range res.GetListServicesResponse().GetService() {
+		services = append(services, service.GetName())
+	}
+	sort.Strings(services)
+	expected := []string{"grpc.reflection.v1alpha.ServerReflection", "tensorflow.serving.PredictionService"}
+	if strings.Join(services, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected services %v but got %v", expected, services)
+	}
+}
+
+// startNodes starts a fake node per address and returns a dial option
+// routing each address to its node, and the number of calls each node
+// received.
+func startNodes(t *testing.T, addresses ...string) (grpc.DialOption, func() map[string]int) {
+	var nodes []*tfservingtest.GRPCNode
+	for _, address := range addresses {
+		nodes = append(nodes, tfservingtest.NewGRPCNode(t, address))
+	}
+	return tfservingtest.DialNodes(nodes...), func() map[string]int {
+		calls := make(map[string]int)
+		for _, node := range nodes {
+			calls[node.Name()] = len(node.Requests())
+		}
+		return calls
+	}
+}
+
+func TestGrpcProxyBalancesOverTargets(t *testing.T) {
+	dialer, calls := startNodes(t, "node1:8500", "node2:8500")
+	var mutex sync.Mutex
+	targets := []Target{{Address: "node1:8500"}, {Address: "node2:8500"}}
+	proxy := NewGrpcProxyWithResolver(ResolverFunc(func(context.Context, ModelKey) (Resolution, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return Resolution{Targets: targets}, nil
+	}), WithUpstreamDialOptions(dialer, grpc.WithInsecure()), WithModelLabels(true))
+	client := startProxy(t, proxy)
+
+	predict := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Wait for both subconnections to be ready before counting
+	deadline := time.Now().Add(5 * time.Second)
+	for calls()["node2:8500"] == 0 && time.Now().Before(deadline) {
+		predict(1)
+	}
+	before := calls()
+	predict(20)
+	after := calls()
+	for _, node := range []string{"node1:8500", "node2:8500"} {
+		if after[node]-before[node] != 10 {
+			t.Errorf("Expected 10 calls on %s but got %d", node, after[node]-before[node])
+		}
+	}
+
+	if v, _ := poolConnSeries(balancedPoolPrefix + "foo"); v != 1 {
+		t.Errorf("Expected the balanced connection counted by model but got %v", v)
+	}
+
+	// Rebalancing moves the model away from node1
+	mutex.Lock()
+	targets = []Target{{Address: "node2:8500"}}
+	mutex.Unlock()
+	predict(1)
+	time.Sleep(50 * time.Millisecond)
+	before = calls()
+	predict(10)
+	after = calls()
+	if after["node1:8500"] != before["node1:8500"] || after["node2:8500"]-before["node2:8500"] != 10 {
+		t.Errorf("Expected all calls on node2 after update but got %v -> %v", before, after)
+	}
+	proxy.serverImpl.conns.mutex.RLock()
+	balanced := len(proxy.serverImpl.conns.balanced)
+	proxy.serverImpl.conns.mutex.RUnlock()
+	if balanced != 0 {
+		t.Errorf("Expected the balanced connection to be dropped with a single target left but got %d", balanced)
+	}
+	if v, ok := poolConnSeries(balancedPoolPrefix + "foo"); ok {
+		t.Errorf("Expected the series of the dropped connection to be deleted but got %v", v)
+	}
+}
+
+func TestGrpcProxySplitsMixedResolutions(t *testing.T) {
+	upstream := tfservingtest.NewGRPCNode(t, "upstream").Dial(t)
+	proxy := NewGrpcProxyWithResolver(ResolverFunc(func(context.Context, ModelKey) (Resolution, error) {
+		return Resolution{}, ErrUnavailable
+	}), WithUpstreamDialOptions(grpc.WithInsecure()))
+	defer proxy.Close()
+	server := proxy.serverImpl
+	key := ModelKey{Name: "foo", Version: "1"}
+	mixed := Resolution{Targets: []Target{
+		{Address: "node1:8500"},
+		{Address: "node2:8501", REST: true},
+		{Address: "node3:8500"},
+		{Address: "node4:8500", Conn: upstream},
+	}}
+	targets := func() map[string]int {
+		seen := make(map[string]int)
+		for i := 0; i < 200; i++ {
+			conn, err := server.connForResolution(key, mixed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen[conn.Target()]++
+		}
+		return seen
+	}
+	balancedAddresses := func() []string {
+		server.conns.mutex.RLock()
+		defer server.conns.mutex.RUnlock()
+		return server.conns.balanced[key].addresses
+	}
+
+	// Without REST fallback the REST target is left out
+	seen := targets()
+	if len(seen) != 2 || seen[upstream.Target()] == 0 {
+		t.Errorf("Expected calls on the balanced targets and the own connection but got %v", seen)
+	}
+	if addresses := balancedAddresses(); !sameAddresses(addresses, []string{"node1:8500", "node3:8500"}) {
+		t.Errorf("Expected only the grpc addresses to be balanced but got %v", addresses)
+	}
+
+	server.conns.restClient = http.DefaultClient
+	seen = targets()
+	if len(seen) != 3 || seen[upstream.Target()] == 0 || seen["passthrough:///rest:node2:8501"] == 0 {
+		t.Errorf("Expected calls on the balanced targets, the own connection and the REST bridge but got %v", seen)
+	}
+	if addresses := balancedAddresses(); !sameAddresses(addresses, []string{"node1:8500", "node3:8500"}) {
+		t.Errorf("Expected the REST target to stay out of the balanced connection but got %v", addresses)
+	}
+}
+
+func TestGrpcProxyChannelzAndUpstreamSummaries(t *testing.T) {
+	dialer, _ := startNodes(t, "node1:8500")
+	proxy := NewGrpcProxyWithResolver(ResolverFunc(func(context.Context, ModelKey) (Resolution, error) {
+		return Resolution{Targets: []Target{{Address: "node1:8500"}}}, nil
+	}), WithUpstreamDialOptions(dialer, grpc.WithInsecure()), WithChannelz())
+	lis := bufconn.Listen(1024 * 1024)
+	go proxy.Serve(lis)
+	defer proxy.Close()
+	conn, err := grpc.Dial("bufnet", bufDial(lis), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = pb.NewPredictionServiceClient(conn).Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	proxy.ServeUpstreams(rec, httptest.NewRequest(http.MethodGet, "/debug/upstreams", nil))
+	var summaries []UpstreamSummary
+	if err := json.NewDecoder(rec.Body).Decode(&summaries); err != nil {
+		t.Fatal(err)
+	}
+	if len(summaries) != 1 || summaries[0].Target != "node1:8500" || summaries[0].State != "READY" ||
+		summaries[0].CallsStarted != 1 || summaries[0].CallsSucceeded != 1 || summaries[0].CallsFailed != 0 {
+		t.Errorf("Unexpected upstream summaries: %+v", summaries)
+	}
+
+	channels, err := channelzpb.NewChannelzClient(conn).GetTopChannels(context.Background(), &channelzpb.GetTopChannelsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, channel := range channels.GetChannel() {
+		if channel.GetData().GetTarget() == "node1:8500" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Upstream connection not listed by channelz: %v", channels)
+	}
+}
+
+func TestGrpcProxyRoutingTrailers(t *testing.T) {
+	var calls int32
+	upstream := tfservingtest.NewGRPCNode(t, "upstream", tfservingtest.WithPredict(func(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+		if req.GetModelSpec().GetName() == "flaky" && atomic.AddInt32(&calls, 1) == 1 {
+			return nil, status.Error(codes.Unavailable, "node restarting")
+		}
+		return &pb.PredictResponse{}, nil
+	}))
+
+	client := startProxy(t, NewGrpcProxyWithResolver(ResolverFunc(func(context.Context, ModelKey) (Resolution, error) {
+		return Resolution{Targets: []Target{{Address: "node1:8500"}}, Cache: CacheHit}, nil
+	}), WithUpstreamDialOptions(upstream.DialOption(), grpc.WithInsecure()), WithRoutingTrailers(), WithUpstreamRetries(1)))
+
+	var trailer metadata.MD
+	_, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{
+		Name:          "foo",
+		VersionChoice: &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: 3}},
+	}}, grpc.Trailer(&trailer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{TrailerTarget: "node1:8500", TrailerModel: "foo:3", TrailerCache: "hit", TrailerRetries: "0"}
+	for key, value := range expected {
+		if got := trailer.Get(key); len(got) != 1 || got[0] != value {
+			t.Errorf("Expected trailer %s=%s but got %v", key, value, got)
+		}
+	}
+
+	_, err = client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "flaky"}}, grpc.Trailer(&trailer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := trailer.Get(TrailerRetries); len(got) != 1 || got[0] != "1" || atomic.LoadInt32(&calls) != 2 {
+		t.Errorf("Expected one retry but got trailer %v after %d calls", got, calls)
+	}
+}
+
+func TestGrpcProxyRoutingTrailersOffByDefault(t *testing.T) {
+	upstream := tfservingtest.NewGRPCNode(t, "upstream").Dial(t)
+	client := startProxy(t, NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return upstream, nil
+	}))
+	var trailer metadata.MD
+	if _, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}, grpc.Trailer(&trailer)); err != nil {
+		t.Fatal(err)
+	}
+	if len(trailer.Get(TrailerTarget)) != 0 {
+		t.Errorf("Routing trailers set without the option: %v", trailer)
+	}
+}
+
+func TestGrpcProxyShadowsPredict(t *testing.T) {
+	shadowCalls := make(chan int64, 4)
+	release := make(chan struct{})
+	upstream := tfservingtest.NewGRPCNode(t, "upstream", tfservingtest.WithPredict(func(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+		version := req.GetModelSpec().GetVersion().GetValue()
+		if version == 2 {
+			shadowCalls <- version
+			<-release
+			return nil, status.Error(codes.Internal, "shadow version is broken")
+		}
+		return &pb.PredictResponse{}, nil
+	})).Dial(t)
+	client := startProxy(t, NewGrpcProxyWithResolver(ResolverFunc(func(context.Context, ModelKey) (Resolution, error) {
+		return Resolution{Targets: []Target{{Conn: upstream}}}, nil
+	}), WithShadowing(map[string]Shadow{"shadowed": {Version: 2, Percent: 100}}, 1)))
+
+	spec := &pb.ModelSpec{Name: "shadowed", VersionChoice: &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: 1}}}
+	dropped := testutil.ToFloat64(promShadowDropped.WithLabelValues(allModelsLabel))
+	failed := testutil.ToFloat64(promShadowRequests.WithLabelValues(allModelsLabel, codes.Internal.String()))
+	// The shadow call is still blocked when the primary call returns
+	for i := 0; i < 2; i++ {
+		if _, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: spec}); err != nil {
+			t.Fatalf("Primary call failed: %v", err)
+		}
+	}
+	if version := <-shadowCalls; version != 2 {
+		t.Errorf("Expected shadow call to version 2 but got %d", version)
+	}
+	if got := testutil.ToFloat64(promShadowDropped.WithLabelValues(allModelsLabel)) - dropped; got != 1 {
+		t.Errorf("Expected the second shadow call to be dropped but %v were", got)
+	}
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(promShadowRequests.WithLabelValues(allModelsLabel, codes.Internal.String())) == failed {
+		if time.Now().After(deadline) {
+			t.Fatal("Shadow failure was not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(shadowCalls) != 0 {
+		t.Errorf("Expected a single shadow call")
+	}
+}
+
+func TestGrpcProxyShadowsOnlyAdmittedCalls(t *testing.T) {
+	var mutex sync.Mutex
+	shadowed := make(map[string]int)
+	upstream := tfservingtest.NewGRPCNode(t, "upstream", tfservingtest.WithPredict(func(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+		if req.GetModelSpec().GetVersion().GetValue() == 2 {
+			mutex.Lock()
+			shadowed[req.GetModelSpec().GetName()]++
+			mutex.Unlock()
+		}
+		return &pb.PredictResponse{}, nil
+	})).Dial(t)
+	client := startProxy(t, NewGrpcProxyWithResolver(ResolverFunc(func(context.Context, ModelKey) (Resolution, error) {
+		return Resolution{Targets: []Target{{Conn: upstream}}}, nil
+	}), WithShadowing(map[string]Shadow{"dry": {Version: 2, Percent: 100}, "limited": {Version: 2, Percent: 100}}, 10),
+		WithDryRuns(NewDryRuns(map[string]DryRun{"dry": {}})),
+		WithRateLimiter(NewRateLimiter(map[string]RateLimit{"limited": {PerSecond: 0.001, Burst: 1}}))))
+	shadowedCalls := func(model string) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return shadowed[model]
+	}
+
+	if _, err := client.Predict(context.Background(), predictVersion("dry", 1)); status.Code(err) != codes.Unimplemented {
+		t.Fatalf("Expected the dry run answer but got %v", err)
+	}
+	for i, code := range []codes.Code{codes.OK, codes.ResourceExhausted} {
+		if _, err := client.Predict(context.Background(), predictVersion("limited", 1)); status.Code(err) != code {
+			t.Fatalf("Expected call %d to return %v but got %v", i, code, err)
+		}
+	}
+	// The admitted call is shadowed, give the others time to show up
+	waitFor(t, func() bool { return shadowedCalls("limited") > 0 })
+	time.Sleep(50 * time.Millisecond)
+	if n := shadowedCalls("limited"); n != 1 {
+		t.Errorf("Expected only the admitted call to be shadowed but got %d shadow calls", n)
+	}
+	if n := shadowedCalls("dry"); n != 0 {
+		t.Errorf("Expected no shadow calls in dry run but got %d", n)
+	}
+}
+
+func TestGrpcProxyCanaryWeights(t *testing.T) {
+	var mutex sync.Mutex
+	var versions []int64
+	upstream := tfservingtest.NewGRPCNode(t, "upstream", tfservingtest.WithPredict(func(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		versions = append(versions, req.GetModelSpec().GetVersion().GetValue())
+		if len(versions) == 1 {
+			return nil, status.Error(codes.Unavailable, "node restarting")
+		}
+		return &pb.PredictResponse{}, nil
+	})).Dial(t)
+	proxy := NewGrpcProxyWithResolver(ResolverFunc(func(context.Context, ModelKey) (Resolution, error) {
+		return Resolution{Targets: []Target{{Conn: upstream}}}, nil
+	}), WithCanaryWeights(map[string]CanaryWeights{"foo": {1: 1, 2: 1}}), WithUpstreamRetries(1), WithRoutingTrailers())
+	client := startProxy(t, proxy)
+	lastVersion := func() int64 {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return versions[len(versions)-1]
+	}
+
+	// The canary choice sticks to the retry
+	var trailer metadata.MD
+	if _, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}, grpc.Trailer(&trailer)); err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0] != versions[1] || versions[0] == 0 {
+		t.Errorf("Expected the retry on the chosen canary version but got versions %v", versions)
+	}
+	if model := fmt.Sprintf("foo:%d", versions[0]); trailer.Get(TrailerModel)[0] != model || trailer.Get(TrailerCanary)[0] != "true" {
+		t.Errorf("Expected trailers for canary %s but got %v", model, trailer)
+	}
+
+	before := proxy.serverImpl.settings()
+	proxy.SetCanaryWeights("foo", CanaryWeights{2: 1})
+	if len(before.canaries.splits["foo"].versions) != 2 {
+		t.Errorf("Expected the tunables in use to keep their split but got %+v", before.canaries.splits["foo"])
+	}
+	if _, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}); err != nil {
+		t.Fatal(err)
+	}
+	if version := lastVersion(); version != 2 {
+		t.Errorf("Expected reloaded weights to pick version 2 but got %d", version)
+	}
+	pinned := &pb.ModelSpec{Name: "foo", VersionChoice: &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: 1}}}
+	if _, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: pinned}); err != nil {
+		t.Fatal(err)
+	}
+	if version := lastVersion(); version != 1 {
+		t.Errorf("Expected pinned call to bypass the canary but got version %d", version)
+	}
+	proxy.SetCanaryWeights("foo", nil)
+	if _, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}); err != nil {
+		t.Fatal(err)
+	}
+	if version := lastVersion(); version != 0 {
+		t.Errorf("Expected no version without canary but got %d", version)
+	}
+}
+
+func TestGrpcProxyDialMetrics(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := tfservingtest.NewGRPCNode(t, "upstream", tfservingtest.WithListener(lis))
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddress := dead.Addr().String()
+	dead.Close()
+
+	liveAddress := upstream.Address()
+	client := startProxy(t, NewGrpcProxyWithResolver(ResolverFunc(func(ctx context.Context, key ModelKey) (Resolution, error) {
+		if key.Name == "dead" {
+			return Resolution{Targets: []Target{{Address: deadAddress}}}, nil
+		}
+		return Resolution{Targets: []Target{{Address: liveAddress}}}, nil
+	}), WithUpstreamDialOptions(grpc.WithInsecure())))
+
+	readyBefore := testutil.ToFloat64(promUpstreamConns.WithLabelValues("READY"))
+	if _, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "live"}}); err != nil {
+		t.Fatal(err)
+	}
+	if attempts := testutil.ToFloat64(promDialAttempts.WithLabelValues(liveAddress)); attempts != 1 {
+		t.Errorf("Expected one dial attempt to the live node but got %v", attempts)
+	}
+	duration := &dto.Metric{}
+	promDialDuration.WithLabelValues(liveAddress).(prometheus.Histogram).Write(duration)
+	if count := duration.GetHistogram().GetSampleCount(); count != 1 {
+		t.Errorf("Expected one dial duration observation for the live node but got %d", count)
+	}
+	// The state gauge follows the connection asynchronously
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(promUpstreamConns.WithLabelValues("READY")) != readyBefore+1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected one more ready connection than %v", readyBefore)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = client.Predict(ctx, &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "dead"}})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected Unavailable from the dead node but got %v", err)
+	}
+	if failures := testutil.ToFloat64(promDialFailures.WithLabelValues(deadAddress, "refused")); failures < 1 {
+		t.Errorf("Expected refused dial failures to the dead node but got %v", failures)
+	}
+}
+
+// upstreamConnCount returns the number of upstream connections in any state
+func upstreamConnCount() float64 {
+	metrics := make(chan prometheus.Metric, 16)
+	go func() {
+		promUpstreamConns.Collect(metrics)
+		close(metrics)
+	}()
+	var total float64
+	for metric := range metrics {
+		m := &dto.Metric{}
+		metric.Write(m)
+		total += m.GetGauge().GetValue()
+	}
+	return total
+}
+
+func waitForUpstreamConnCount(t *testing.T, expected float64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for upstreamConnCount() != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %v upstream connections but got %v", expected, upstreamConnCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGrpcProxyCloseDrainsUpstreamConnections(t *testing.T) {
+	var shadowDone int32
+	release := make(chan struct{})
+	upstream := tfservingtest.NewGRPCNode(t, "upstream", tfservingtest.WithPredict(func(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+		if req.GetModelSpec().GetVersion().GetValue() == 2 {
+			<-release
+			atomic.StoreInt32(&shadowDone, 1)
+		}
+		return &pb.PredictResponse{}, nil
+	}))
+
+	// Connections of earlier tests are counted down asynchronously
+	waitForUpstreamConnCount(t, 0)
+	proxy := NewGrpcProxyWithResolver(ResolverFunc(func(ctx context.Context, key ModelKey) (Resolution, error) {
+		if key.Name == "balanced" {
+			return Resolution{Targets: []Target{{Address: "node1:8500"}, {Address: "node2:8500"}}}, nil
+		}
+		return Resolution{Targets: []Target{{Address: "node1:8500"}}}, nil
+	}), WithUpstreamDialer(upstream.Dialer()), WithUpstreamDialOptions(grpc.WithInsecure()),
+		WithShadowing(map[string]Shadow{"foo": {Version: 2, Percent: 100}}, 1),
+		WithShutdownGracePeriod(5*time.Second))
+	client := startProxy(t, proxy)
+
+	for _, model := range []string{"foo", "balanced"} {
+		spec := &pb.ModelSpec{Name: model, VersionChoice: &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: 1}}}
+		if _, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: spec}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The shadow call is still running on the upstream connection
+	time.AfterFunc(100*time.Millisecond, func() { close(release) })
+	if err := proxy.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if atomic.LoadInt32(&shadowDone) != 1 {
+		t.Error("Close did not wait for the call in flight upstream")
+	}
+	if _, err := proxy.serverImpl.conns.get("node1:8500"); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Expected no connections after Close but got %v", err)
+	}
+	waitForUpstreamConnCount(t, 0)
+}
+
+func TestGrpcProxyWarmsConnections(t *testing.T) {
+	upstream := tfservingtest.NewGRPCNode(t, "upstream")
+
+	var resolutions int32
+	proxy := NewGrpcProxyWithResolver(ResolverFunc(func(ctx context.Context, key ModelKey) (Resolution, error) {
+		// The cluster is not ready on the first attempt
+		if atomic.AddInt32(&resolutions, 1) == 1 {
+			return Resolution{}, fmt.Errorf("no nodes yet: %w", ErrUnavailable)
+		}
+		return Resolution{Targets: []Target{{Address: "node1:8500"}}}, nil
+	}), WithUpstreamDialer(upstream.Dialer()), WithUpstreamDialOptions(grpc.WithInsecure()), WithWarmModels(ModelKey{Name: "hot", Version: "1"}))
+	proxy.warmBackoff = warmBackoff{base: 10 * time.Millisecond, max: 10 * time.Millisecond}
+
+	readyBefore := testutil.ToFloat64(promWarmReady)
+	startProxy(t, proxy)
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(promWarmReady) != readyBefore+1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Warm connection did not become ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	summaries := proxy.UpstreamSummaries()
+	if len(summaries) != 1 || summaries[0].Target != "node1:8500" || summaries[0].State != "READY" || summaries[0].CallsStarted != 0 {
+		t.Errorf("Expected a ready connection without calls but got %+v", summaries)
+	}
+	if atomic.LoadInt32(&resolutions) < 2 {
+		t.Errorf("Expected the failed warmup to be retried")
+	}
+
+	proxy.Close()
+	deadline = time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(promWarmReady) != readyBefore {
+		if time.Now().After(deadline) {
+			t.Fatal("Warm connection still counted as ready after Close")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// captureLogs records the entries logged by the standard logger during the test
+func captureLogs(t *testing.T) *logtest.Hook {
+	hook := logtest.NewGlobal()
+	t.Cleanup(func() {
+		log.StandardLogger().ReplaceHooks(make(log.LevelHooks))
+	})
+	return hook
+}
+
+// slowCallEntries returns the slow call warnings among the entries of hook
+func slowCallEntries(hook *logtest.Hook) []*log.Entry {
+	var entries []*log.Entry
+	for _, entry := range hook.AllEntries() {
+		if strings.HasPrefix(entry.Message, "Slow call") {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+func TestGrpcProxySlowRequestLog(t *testing.T) {
+	upstream := tfservingtest.NewGRPCNode(t, "upstream", tfservingtest.WithPredict(func(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+		delay := time.Duration(req.GetModelSpec().GetVersion().GetValue()) * time.Millisecond
+		select {
+		case <-time.After(delay):
+			return &pb.PredictResponse{}, nil
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+	})).Dial(t)
+	client := startProxy(t, NewGrpcProxyWithResolver(ResolverFunc(func(context.Context, ModelKey) (Resolution, error) {
+		return Resolution{Targets: []Target{{Conn: upstream}}}, nil
+	}), WithSlowRequestLog(SlowRequestThresholds{
+		Default:  50 * time.Millisecond,
+		PerModel: map[string]time.Duration{"llm": time.Second},
+	})))
+	hook := captureLogs(t)
+	predict := func(ctx context.Context, model string, delay int64) error {
+		_, err := client.Predict(ctx, &pb.PredictRequest{ModelSpec: &pb.ModelSpec{
+			Name:          model,
+			VersionChoice: &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: delay}},
+		}})
+		return err
+	}
+
+	if err := predict(context.Background(), "embedding", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := predict(context.Background(), "llm", 100); err != nil {
+		t.Fatal(err)
+	}
+	if entries := slowCallEntries(hook); len(entries) != 0 {
+		t.Errorf("Expected no slow call logs under the thresholds but got %v", entries[0].Data)
+	}
+
+	if err := predict(context.Background(), "embedding", 100); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 80*time.Millisecond)
+	defer cancel()
+	if err := predict(ctx, "embedding", 1000); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Expected the call to time out but got %v", err)
+	}
+	// The proxy may still be handling the timed out call
+	deadline := time.Now().Add(5 * time.Second)
+	entries := slowCallEntries(hook)
+	for len(entries) < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		entries = slowCallEntries(hook)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected two slow call logs but got %d", len(entries))
+	}
+	slow := entries[0]
+	if slow.Level != log.WarnLevel || slow.Data["method"] != "/tensorflow.serving.PredictionService/Predict" ||
+		slow.Data["model"] != "embedding" || slow.Data["version"] != "100" || slow.Data["target"] != "upstream" ||
+		slow.Data["code"] != codes.OK.String() || slow.Data["duration"].(time.Duration) < 50*time.Millisecond {
+		t.Errorf("Unexpected slow call log: %v", slow.Data)
+	}
+	if _, ok := slow.Data["deadline"]; ok || slow.Data["timeout_rule"] != timeoutRuleNone {
+		t.Errorf("Expected no deadline for a call without one: %v", slow.Data)
+	}
+	timedOut := entries[1]
+	if timedOut.Data["code"] != codes.DeadlineExceeded.String() || timedOut.Data["deadline"].(time.Duration) > 80*time.Millisecond ||
+		timedOut.Data["timeout_rule"] != timeoutRuleCaller {
+		t.Errorf("Unexpected slow call log for the timed out call: %v", timedOut.Data)
+	}
+}
+
+// histogramSample returns the sample count and sum of a histogram
+func histogramSample(observer prometheus.Observer) (uint64, float64) {
+	m := &dto.Metric{}
+	observer.(prometheus.Histogram).Write(m)
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+func TestGrpcProxyPayloadSizes(t *testing.T) {
+	var upstreamCalls int32
+	response := &pb.PredictResponse{Outputs: map[string]*framework.TensorProto{
+		"y": {Dtype: framework.DataType_DT_FLOAT, FloatVal: []float32{1, 2, 3}},
+	}}
+	upstream := tfservingtest.NewGRPCNode(t, "upstream", tfservingtest.WithPredict(func(context.Context, *pb.PredictRequest) (*pb.PredictResponse, error) {
+		atomic.AddInt32(&upstreamCalls, 1)
+		return response, nil
+	})).Dial(t)
+	request := func(model string) *pb.PredictRequest {
+		return &pb.PredictRequest{
+			ModelSpec: &pb.ModelSpec{Name: model},
+			Inputs: map[string]*framework.TensorProto{
+				"x": {Dtype: framework.DataType_DT_STRING, StringVal: [][]byte{make([]byte, 1000)}},
+			},
+		}
+	}
+	requestSize := proto.Size(request("capped"))
+	client := startProxy(t, NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return upstream, nil
+	}, WithModelMaxRequestSizes(map[string]int{"capped": requestSize - 1, "roomy": requestSize})))
+
+	method := "/tensorflow.serving.PredictionService/Predict"
+	requestsBefore, requestBytesBefore := histogramSample(promRequestSize.WithLabelValues(method))
+	responsesBefore, responseBytesBefore := histogramSample(promResponseSize.WithLabelValues(method))
+	if _, err := client.Predict(context.Background(), request("roomy")); err != nil {
+		t.Fatal(err)
+	}
+	requests, requestBytes := histogramSample(promRequestSize.WithLabelValues(method))
+	responses, responseBytes := histogramSample(promResponseSize.WithLabelValues(method))
+	if requests != requestsBefore+1 || requestBytes-requestBytesBefore != float64(proto.Size(request("roomy"))) {
+		t.Errorf("Expected one request of %d bytes but got %d requests of %v bytes", proto.Size(request("roomy")), requests-requestsBefore, requestBytes-requestBytesBefore)
+	}
+	if responses != responsesBefore+1 || responseBytes-responseBytesBefore != float64(proto.Size(response)) {
+		t.Errorf("Expected one response of %d bytes but got %d responses of %v bytes", proto.Size(response), responses-responsesBefore, responseBytes-responseBytesBefore)
+	}
+
+	_, err := client.Predict(context.Background(), request("capped"))
+	if status.Code(err) != codes.ResourceExhausted || !strings.Contains(status.Convert(err).Message(), fmt.Sprintf("limit of %d bytes", requestSize-1)) {
+		t.Errorf("Expected ResourceExhausted naming the limit but got %v", err)
+	}
+	if calls := atomic.LoadInt32(&upstreamCalls); calls != 1 {
+		t.Errorf("Expected the oversized request not to reach upstream but got %d upstream calls", calls)
+	}
+}
+
+func TestGrpcProxyReadinessGate(t *testing.T) {
+	upstream := tfservingtest.NewGRPCNode(t, "upstream").Dial(t)
+	proxy := NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return upstream, nil
+	}, WithReadinessGate())
+	lis := bufconn.Listen(1024 * 1024)
+	go proxy.Serve(lis)
+	defer proxy.Close()
+	conn, err := grpc.Dial("bufnet", bufDial(lis), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewPredictionServiceClient(conn)
+	healthClient := healthpb.NewHealthClient(conn)
+
+	res, err := healthClient.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil || res.GetStatus() != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("Expected NOT_SERVING before ready but got %v, %v", res, err)
+	}
+	gated := testutil.ToFloat64(promNotReady.WithLabelValues("grpc"))
+
+	var flipped int32
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	stop := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				afterFlip := atomic.LoadInt32(&flipped) == 1
+				_, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}})
+				if err != nil && (afterFlip || status.Code(err) != codes.Unavailable || status.Convert(err).Message() != "proxy warming up") {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	proxy.SetReady(true)
+	atomic.StoreInt32(&flipped, 1)
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Unexpected error around the readiness flip: %v", err)
+	}
+
+	if testutil.ToFloat64(promNotReady.WithLabelValues("grpc")) == gated {
+		t.Errorf("Expected calls before ready to be counted as gated")
+	}
+	res, err = healthClient.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	if err != nil || res.GetStatus() != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Expected SERVING once ready but got %v, %v", res, err)
+	}
+}
+
+func TestGrpcProxyDeadlineBudget(t *testing.T) {
+	var upstreamCalls int32
+	remaining := make(chan time.Duration, 1)
+	upstream := tfservingtest.NewGRPCNode(t, "upstream", tfservingtest.WithPredict(func(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+		atomic.AddInt32(&upstreamCalls, 1)
+		deadline, _ := ctx.Deadline()
+		remaining <- time.Until(deadline)
+		return &pb.PredictResponse{}, nil
+	})).Dial(t)
+	client := startProxy(t, NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return upstream, nil
+	}, WithDeadlineBudget(DeadlineBudget{MinRemaining: 500 * time.Millisecond, Margin: 300 * time.Millisecond})))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := client.Predict(ctx, &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}); err != nil {
+		t.Fatal(err)
+	}
+	if upstreamRemaining := <-remaining; upstreamRemaining > 1700*time.Millisecond || upstreamRemaining < time.Second {
+		t.Errorf("Expected the upstream deadline to be shortened by the margin but %v was left", upstreamRemaining)
+	}
+
+	rejected := testutil.ToFloat64(promDeadlineRejected.WithLabelValues("grpc"))
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	_, err := client.Predict(ctx, &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}})
+	if status.Code(err) != codes.DeadlineExceeded || ctx.Err() != nil {
+		t.Errorf("Expected an immediate DeadlineExceeded below the minimum budget but got %v", err)
+	}
+	if got := testutil.ToFloat64(promDeadlineRejected.WithLabelValues("grpc")) - rejected; got != 1 {
+		t.Errorf("Expected one budget rejection but got %v", got)
+	}
+	if calls := atomic.LoadInt32(&upstreamCalls); calls != 1 {
+		t.Errorf("Expected the rejected call not to reach upstream but got %d upstream calls", calls)
+	}
+}
+
+func TestDeadlineBudgetMargin(t *testing.T) {
+	budget := DeadlineBudget{Margin: 100 * time.Millisecond}
+	deadline := time.Now().Add(time.Hour)
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	upstreamCtx, upstreamCancel := budget.upstreamContext(ctx)
+	defer upstreamCancel()
+	if upstreamDeadline, _ := upstreamCtx.Deadline(); !upstreamDeadline.Equal(deadline.Add(-100 * time.Millisecond)) {
+		t.Errorf("Expected the deadline %v to be moved by the margin but got %v", deadline, upstreamDeadline)
+	}
+	if upstreamCtx, _ := budget.upstreamContext(context.Background()); upstreamCtx != context.Background() {
+		t.Errorf("Expected calls without a deadline to keep having none")
+	}
+}
+
+func TestGrpcProxyCountsResponseCodes(t *testing.T) {
+	upstream := tfservingtest.NewGRPCNode(t, "upstream", tfservingtest.WithPredict(func(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+		if req.GetModelSpec().GetName() == "missing" {
+			return nil, status.Error(codes.NotFound, "Servable not found")
+		}
+		return &pb.PredictResponse{}, nil
+	})).Dial(t)
+	client := startProxy(t, NewGrpcProxy(func(modelName string, _ string) (*grpc.ClientConn, error) {
+		if modelName == "down" {
+			return nil, ErrUnavailable
+		}
+		return upstream, nil
+	}))
+
+	method := "/tensorflow.serving.PredictionService/Predict"
+	tests := []struct {
+		model string
+		code  codes.Code
+	}{
+		{"foo", codes.OK},
+		{"missing", codes.NotFound},
+		{"down", codes.Unavailable},
+		// Rejected by the proxy's validation
+		{"", codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		before := testutil.ToFloat64(promResponseCodes.WithLabelValues(method, test.code.String()))
+		_, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: test.model}})
+		if status.Code(err) != test.code {
+			t.Fatalf("Expected %v for model %q but got %v", test.code, test.model, err)
+		}
+		if got := testutil.ToFloat64(promResponseCodes.WithLabelValues(method, test.code.String())) - before; got != 1 {
+			t.Errorf("Expected one call counted under %v but got %v", test.code, got)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package tfservingproxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+	// grpcWebTrailerFlag marks the frame holding the trailers of a response
+	grpcWebTrailerFlag = 0x80
+)
+
+// grpcWebTrailers are the trailers the grpc server declares for a status
+var grpcWebTrailers = []string{"Grpc-Status", "Grpc-Message", "Grpc-Status-Details-Bin"}
+
+// GrpcWebHandler returns a handler serving gRPC-Web requests, both binary
+// (application/grpc-web+proto) and text (application/grpc-web-text+proto),
+// by translating them to grpc calls on the proxy's server. Calls therefore
+// go through the same interceptors, routing and metrics as native grpc
+// calls. Cross-origin requests are allowed from allowedOrigins, where "*"
+// allows any origin. Only unary methods are supported.
+func (proxy *GrpcProxy) GrpcWebHandler(allowedOrigins ...string) http.Handler {
+	return &grpcWebHandler{proxy: proxy, allowedOrigins: allowedOrigins}
+}
+
+// IsGrpcWebRequest returns whether req is a gRPC-Web call or its CORS preflight
+func IsGrpcWebRequest(req *http.Request) bool {
+	if req.Method == http.MethodOptions {
+		return strings.Contains(strings.ToLower(req.Header.Get("Access-Control-Request-Headers")), "x-grpc-web")
+	}
+	return req.Method == http.MethodPost && strings.HasPrefix(req.Header.Get("Content-Type"), grpcWebContentType)
+}
+
+type grpcWebHandler struct {
+	proxy          *GrpcProxy
+	allowedOrigins []string
+}
+
+func (handler *grpcWebHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	origin := req.Header.Get("Origin")
+	if origin != "" {
+		if !handler.originAllowed(origin) {
+			log.Warnf("Rejecting grpc-web request from origin: %s", origin)
+			http.Error(rw, "Origin not allowed", http.StatusForbidden)
+			return
+		}
+		rw.Header().Set("Access-Control-Allow-Origin", origin)
+		rw.Header().Add("Vary", "Origin")
+		rw.Header().Set("Access-Control-Expose-Headers", strings.Join(grpcWebTrailers, ", "))
+	}
+	if req.Method == http.MethodOptions {
+		rw.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+		rw.Header().Set("Access-Control-Allow-Headers", req.Header.Get("Access-Control-Request-Headers"))
+		rw.Header().Set("Access-Control-Max-Age", "600")
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+	contentType := req.Header.Get("Content-Type")
+	if req.Method != http.MethodPost || !strings.HasPrefix(contentType, grpcWebContentType) {
+		http.Error(rw, "Expected a grpc-web request", http.StatusUnsupportedMediaType)
+		return
+	}
+	text := strings.HasPrefix(contentType, grpcWebTextContentType)
+
+	grpcReq := req.Clone(req.Context())
+	grpcReq.ProtoMajor, grpcReq.ProtoMinor, grpcReq.Proto = 2, 0, "HTTP/2.0"
+	grpcReq.Header.Set("Content-Type", "application/grpc+proto")
+	grpcReq.Header.Del("Content-Length")
+	grpcReq.ContentLength = -1
+	if text {
+		grpcReq.Body = ioutil.NopCloser(base64.NewDecoder(base64.StdEncoding, req.Body))
+	}
+
+	webRw := newGrpcWebResponseWriter(rw, text)
+	handler.proxy.GrpcProxy.ServeHTTP(webRw, grpcReq)
+	if err := webRw.finish(); err != nil {
+		log.WithError(err).Error("Could not write grpc-web trailers")
+	}
+}
+
+func (handler *grpcWebHandler) originAllowed(origin string) bool {
+	for _, allowed := range handler.allowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// grpcWebResponseWriter turns the HTTP/2 response of the grpc server into a
+// gRPC-Web response, sending trailers as the last frame of the body
+type grpcWebResponseWriter struct {
+	rw          http.ResponseWriter
+	header      http.Header
+	body        io.Writer
+	encoder     io.WriteCloser
+	contentType string
+	wroteHeader bool
+}
+
+func newGrpcWebResponseWriter(rw http.ResponseWriter, text bool) *grpcWebResponseWriter {
+	w := &grpcWebResponseWriter{
+		rw:          rw,
+		header:      make(http.Header),
+		body:        rw,
+		contentType: grpcWebContentType + "+proto",
+	}
+	if text {
+		w.encoder = base64.NewEncoder(base64.StdEncoding, rw)
+		w.body = w.encoder
+		w.contentType = grpcWebTextContentType + "+proto"
+	}
+	return w
+}
+
+func (w *grpcWebResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *grpcWebResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	header := w.rw.Header()
+	for key, values := range w.header {
+		if key == "Trailer" || isGrpcWebTrailer(key) {
+			continue
+		}
+		header[key] = values
+	}
+	header.Set("Content-Type", w.contentType)
+	w.rw.WriteHeader(statusCode)
+}
+
+func (w *grpcWebResponseWriter) Write(data []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(data)
+}
+
+func (w *grpcWebResponseWriter) Flush() {
+	w.WriteHeader(http.StatusOK)
+	if flusher, ok := w.rw.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// finish writes the trailers set by the grpc server as a trailer frame
+func (w *grpcWebResponseWriter) finish() error {
+	w.WriteHeader(http.StatusOK)
+	var trailers bytes.Buffer
+	for key, values := range w.header {
+		name := strings.TrimPrefix(key, http.TrailerPrefix)
+		if name == key && !isGrpcWebTrailer(key) {
+			continue
+		}
+		for _, value := range values {
+			trailers.WriteString(strings.ToLower(name) + ": " + value + "\r\n")
+		}
+	}
+	frame := make([]byte, 5, 5+trailers.Len())
+	frame[0] = grpcWebTrailerFlag
+	binary.BigEndian.PutUint32(frame[1:], uint32(trailers.Len()))
+	if _, err := w.body.Write(append(frame, trailers.Bytes()...)); err != nil {
+		return err
+	}
+	if w.encoder != nil {
+		return w.encoder.Close()
+	}
+	return nil
+}
+
+func isGrpcWebTrailer(key string) bool {
+	for _, trailer := range grpcWebTrailers {
+		if key == trailer {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package tfservingproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"google.golang.org/grpc"
+)
+
+// grpcWebCall posts msg the way a browser client does and returns the
+// response message frame and the trailers
+func grpcWebCall(t *testing.T, url string, contentType string, msg proto.Message) (*http.Response, []byte, string) {
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := append([]byte{0, 0, 0, 0, 0}, data...)
+	binary.BigEndian.PutUint32(body[1:], uint32(len(data)))
+	if strings.HasPrefix(contentType, grpcWebTextContentType) {
+		body = []byte(base64.StdEncoding.EncodeToString(body))
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Grpc-Web", "1")
+	req.Header.Set("Origin", "http://demo.example.com")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(contentType, grpcWebTextContentType) {
+		if resBody, err = base64.StdEncoding.DecodeString(string(resBody)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var message []byte
+	var trailers string
+	for len(resBody) >= 5 {
+		length := binary.BigEndian.Uint32(resBody[1:5])
+		frame := resBody[5 : 5+length]
+		if resBody[0]&grpcWebTrailerFlag != 0 {
+			trailers = string(frame)
+		} else {
+			message = frame
+		}
+		resBody = resBody[5+length:]
+	}
+	return res, message, trailers
+}
+
+func TestGrpcWebRoundTrip(t *testing.T) {
+	upstream := tfservingtest.NewGRPCNode(t, "upstream", tfservingtest.WithPredict(func(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+		return &pb.PredictResponse{ModelSpec: req.GetModelSpec()}, nil
+	})).Dial(t)
+	proxy := NewGrpcProxy(func(modelName string, version string) (*grpc.ClientConn, error) {
+		if modelName != "foo" {
+			return nil, ErrModelNotFound
+		}
+		return upstream, nil
+	})
+	defer proxy.Close()
+	server := httptest.NewServer(proxy.GrpcWebHandler("http://demo.example.com"))
+	defer server.Close()
+	url := server.URL + "/tensorflow.serving.PredictionService/Predict"
+
+	for _, contentType := range []string{"application/grpc-web+proto", "application/grpc-web-text+proto"} {
+		res, message, trailers := grpcWebCall(t, url, contentType, &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}})
+		if res.Header.Get("Content-Type") != contentType {
+			t.Errorf("Expected content type %s but got %s", contentType, res.Header.Get("Content-Type"))
+		}
+		if res.Header.Get("Access-Control-Allow-Origin") != "http://demo.example.com" {
+			t.Errorf("Missing CORS header for %s", contentType)
+		}
+		var predictRes pb.PredictResponse
+		if err := proto.Unmarshal(message, &predictRes); err != nil {
+			t.Fatal(err)
+		}
+		if predictRes.GetModelSpec().GetName() != "foo" {
+			t.Errorf("Unexpected response for %s: %v", contentType, &predictRes)
+		}
+		if !strings.Contains(trailers, "grpc-status: 0\r\n") {
+			t.Errorf("Expected OK status trailer for %s but got %q", contentType, trailers)
+		}
+	}
+
+	_, message, trailers := grpcWebCall(t, url, "application/grpc-web+proto", &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "bar"}})
+	if len(message) != 0 || !strings.Contains(trailers, "grpc-status: 5\r\n") {
+		t.Errorf("Expected NotFound trailer only but got %q, %q", message, trailers)
+	}
+}
+
+func TestGrpcWebPreflight(t *testing.T) {
+	proxy := NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return nil, ErrUnavailable
+	})
+	defer proxy.Close()
+	handler := proxy.GrpcWebHandler("http://demo.example.com")
+
+	req := httptest.NewRequest(http.MethodOptions, "/tensorflow.serving.PredictionService/Predict", nil)
+	req.Header.Set("Origin", "http://demo.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web")
+	if !IsGrpcWebRequest(req) {
+		t.Errorf("Preflight not detected as grpc-web request")
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Access-Control-Allow-Headers") != "content-type,x-grpc-web" {
+		t.Errorf("Unexpected preflight response: %d %v", rec.Code, rec.Header())
+	}
+
+	req.Header.Set("Origin", "http://evil.example.com")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("Expected forbidden origin but got %d", rec.Code)
+	}
+}
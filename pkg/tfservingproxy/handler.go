@@ -0,0 +1,108 @@
+package tfservingproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// Handler routes the requests of both proxies to upstream nodes, so that
+// one type holds the routing logic for REST and grpc.
+//
+// ResolveREST points req at a node that can serve key by setting
+// req.URL.Scheme and req.URL.Host. It may also change the path and
+// headers of req, and report whether the model was already loaded with
+// ReportCacheDisposition.
+//
+// ResolveGRPC returns the candidate nodes for key in order of preference.
+// The proxy balances calls over the candidates and retries on the next
+// one if a call fails before reaching a node, see Resolution and Target.
+//
+// Both should honor the deadline of ctx and return an error wrapping
+// ErrModelNotFound, ErrInvalidModel or ErrUnavailable to control the
+// status returned to the caller. Other errors are reported as unavailable.
+//
+// A Handler may also implement Starter and io.Closer. The grpc proxy
+// calls Start when it starts serving and RestProxy.Start calls it for the
+// REST proxy. Close is called once the proxy is closed or shut down and
+// its requests are done. A Handler shared by both proxies is started and
+// closed by each of them. A Handler that caches where models are should
+// implement Invalidator.
+type Handler interface {
+	ResolveREST(ctx context.Context, key ModelKey, req *http.Request) error
+	ResolveGRPC(ctx context.Context, key ModelKey) (Resolution, error)
+}
+
+// Starter is implemented by a Handler that must be started before it can
+// route requests. The grpc proxy passes a ctx that is done when it is
+// closed.
+type Starter interface {
+	Start(ctx context.Context) error
+}
+
+// HandlerFuncs adapts the REST handler function and grpc Resolver taken by
+// NewRestProxy and NewGrpcProxyWithResolver to the Handler interface.
+// Wrap a client provider with ClientProviderFunc or a function with
+// ResolverFunc. Requests of a protocol without a function fail as
+// unavailable.
+type HandlerFuncs struct {
+	REST func(req *http.Request, modelName string, version string) error
+	GRPC Resolver
+}
+
+// ResolveREST calls the REST handler function
+func (funcs HandlerFuncs) ResolveREST(ctx context.Context, key ModelKey, req *http.Request) error {
+	if funcs.REST == nil {
+		return fmt.Errorf("no REST handler: %w", ErrUnavailable)
+	}
+	return funcs.REST(req, key.Name, key.Version)
+}
+
+// ResolveGRPC calls the grpc Resolver
+func (funcs HandlerFuncs) ResolveGRPC(ctx context.Context, key ModelKey) (Resolution, error) {
+	if funcs.GRPC == nil {
+		return Resolution{}, fmt.Errorf("no grpc resolver: %w", ErrUnavailable)
+	}
+	return funcs.GRPC.Resolve(ctx, key)
+}
+
+// lifecycle starts and closes the Handler of a proxy at most once each
+type lifecycle struct {
+	handler   Handler
+	startOnce sync.Once
+	startErr  error
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func newLifecycle(handler Handler) *lifecycle {
+	return &lifecycle{handler: handler}
+}
+
+// start starts the handler if it is a Starter
+func (l *lifecycle) start(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	l.startOnce.Do(func() {
+		if starter, ok := l.handler.(Starter); ok {
+			l.startErr = starter.Start(ctx)
+		}
+	})
+	return l.startErr
+}
+
+// close closes the handler if it is an io.Closer
+func (l *lifecycle) close() error {
+	if l == nil {
+		return nil
+	}
+	l.closeOnce.Do(func() {
+		if closer, ok := l.handler.(io.Closer); ok {
+			l.closeErr = closer.Close()
+		}
+	})
+	return l.closeErr
+}
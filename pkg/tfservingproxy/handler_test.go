@@ -0,0 +1,116 @@
+package tfservingproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"google.golang.org/grpc"
+)
+
+// testHandler routes REST requests to rest and grpc calls to conn and
+// counts its lifecycle calls
+type testHandler struct {
+	rest     *tfservingtest.RESTNode
+	conn     *grpc.ClientConn
+	startErr error
+	started  int32
+	closed   int32
+}
+
+func (h *testHandler) ResolveREST(ctx context.Context, key ModelKey, req *http.Request) error {
+	if key.Name != "foo" {
+		return ErrModelNotFound
+	}
+	req.URL.Scheme, req.URL.Host = h.rest.URL().Scheme, h.rest.URL().Host
+	return nil
+}
+
+func (h *testHandler) ResolveGRPC(ctx context.Context, key ModelKey) (Resolution, error) {
+	if key.Name != "foo" {
+		return Resolution{}, ErrModelNotFound
+	}
+	return Resolution{Targets: []Target{{Address: h.conn.Target(), Conn: h.conn}}}, nil
+}
+
+func (h *testHandler) Start(ctx context.Context) error {
+	atomic.AddInt32(&h.started, 1)
+	return h.startErr
+}
+
+func (h *testHandler) Close() error {
+	atomic.AddInt32(&h.closed, 1)
+	return nil
+}
+
+func TestHandlerRoutesBothProxies(t *testing.T) {
+	upstream := tfservingtest.NewGRPCNode(t, "upstream")
+	handler := &testHandler{rest: tfservingtest.NewRESTNode(t, "rest"), conn: upstream.Dial(t)}
+	handler.rest.Respond("foo", "1", http.StatusOK, `{"predictions": [1]}`)
+
+	harness := tfservingtest.NewHarness(t)
+	grpcProxy := NewGrpcProxyWithHandler(handler)
+	client := harness.Serve(grpcProxy)
+	restProxy := NewRestProxyWithHandler(handler)
+	if err := restProxy.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spec := &pb.ModelSpec{Name: "foo", VersionChoice: &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: 1}}}
+	if _, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: spec}); err != nil {
+		t.Fatal(err)
+	}
+	tfservingtest.AssertReached(t, upstream, "foo", "1")
+	rw := httptest.NewRecorder()
+	restProxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/foo/versions/1:predict", nil))
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected 200 but got %d", rw.Code)
+	}
+	tfservingtest.AssertReached(t, handler.rest, "foo", "1")
+	rw = httptest.NewRecorder()
+	restProxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/bar/versions/1:predict", nil))
+	if rw.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown model but got %d", rw.Code)
+	}
+
+	if n := atomic.LoadInt32(&handler.started); n != 2 {
+		t.Errorf("Expected the handler to be started by each proxy but got %d starts", n)
+	}
+	if err := restProxy.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := harness.Close(); err != nil {
+		t.Fatal(err)
+	}
+	grpcProxy.Close()
+	if n := atomic.LoadInt32(&handler.closed); n != 2 {
+		t.Errorf("Expected the handler to be closed once by each proxy but got %d closes", n)
+	}
+}
+
+func TestHandlerStartErrorStopsServing(t *testing.T) {
+	handler := &testHandler{startErr: errors.New("no cluster")}
+	proxy := NewGrpcProxyWithHandler(handler)
+	defer proxy.Close()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := proxy.Serve(lis); !errors.Is(err, handler.startErr) {
+		t.Errorf("Expected the start error but got %v", err)
+	}
+}
+
+func TestHandlerFuncsWithoutFunction(t *testing.T) {
+	_, err := HandlerFuncs{}.ResolveGRPC(context.Background(), ModelKey{Name: "foo"})
+	if !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Expected unavailable without a resolver but got %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package tfservingproxy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// hopByHopHeaders are the headers of RFC 7230 that only apply to a single
+// connection and are never forwarded
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers from header,
+// including those named in its Connection header
+func removeHopByHopHeaders(header http.Header) {
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		header.Del(name)
+	}
+}
+
+// HeaderFilter selects the headers passed between clients and nodes.
+// Names are case insensitive and may end in * to match all headers
+// starting with the rest of the name, like X-Forwarded-*. Hop-by-hop
+// headers are never passed.
+type HeaderFilter struct {
+	// Allow are the only headers passed. Empty passes all headers.
+	Allow []string `mapstructure:"allow" yaml:"allow"`
+	// Deny are the headers removed, even if allowed
+	Deny []string `mapstructure:"deny" yaml:"deny"`
+}
+
+func (filter HeaderFilter) validate() error {
+	for _, name := range append(append([]string(nil), filter.Allow...), filter.Deny...) {
+		if name == "" {
+			return errors.New("header filters cannot have empty header names")
+		}
+	}
+	return nil
+}
+
+// headerMatcher matches header names against a list of names and
+// prefixes
+type headerMatcher struct {
+	names    map[string]bool
+	prefixes []string
+	all      bool
+}
+
+func newHeaderMatcher(names []string) headerMatcher {
+	matcher := headerMatcher{names: make(map[string]bool)}
+	for _, name := range names {
+		switch {
+		case name == "*":
+			matcher.all = true
+		case strings.HasSuffix(name, "*"):
+			matcher.prefixes = append(matcher.prefixes, http.CanonicalHeaderKey(strings.TrimSuffix(name, "*")))
+		default:
+			matcher.names[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	return matcher
+}
+
+// match returns whether the canonical header name is in the list
+func (matcher headerMatcher) match(name string) bool {
+	if matcher.all || matcher.names[name] {
+		return true
+	}
+	for _, prefix := range matcher.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerFilter applies a HeaderFilter
+type headerFilter struct {
+	allow headerMatcher
+	deny  headerMatcher
+	// allowAll is set if the filter has no allowlist
+	allowAll bool
+}
+
+// newHeaderFilter returns the filter applying config, or nil if config
+// passes all headers
+func newHeaderFilter(config HeaderFilter) *headerFilter {
+	if len(config.Allow) == 0 && len(config.Deny) == 0 {
+		return nil
+	}
+	return &headerFilter{
+		allow:    newHeaderMatcher(config.Allow),
+		deny:     newHeaderMatcher(config.Deny),
+		allowAll: len(config.Allow) == 0,
+	}
+}
+
+// apply removes the headers that filter does not pass from header. A nil
+// filter passes all headers.
+func (filter *headerFilter) apply(header http.Header) {
+	if filter == nil {
+		return
+	}
+	for name := range header {
+		canonical := http.CanonicalHeaderKey(name)
+		if (!filter.allowAll && !filter.allow.match(canonical)) || filter.deny.match(canonical) {
+			delete(header, name)
+		}
+	}
+}
+
+// WithRESTHeaderFilters filters the headers of REST requests sent to the
+// nodes with request, and the headers of their responses sent back to
+// clients with response. Request headers are filtered before the handler
+// resolves the request, so the headers it sets are always sent.
+func WithRESTHeaderFilters(request HeaderFilter, response HeaderFilter) RestProxyOption {
+	return func(proxy *RestProxy) {
+		proxy.requestHeaders, proxy.responseHeaders = newHeaderFilter(request), newHeaderFilter(response)
+	}
+}
+
+// filterResponseHeaders removes the hop-by-hop headers and those the
+// response filter does not pass from the upstream response res
+func (handler *RestProxy) filterResponseHeaders(res *http.Response) {
+	removeHopByHopHeaders(res.Header)
+	handler.responseHeaders.apply(res.Header)
+}
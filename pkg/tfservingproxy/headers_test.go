@@ -0,0 +1,74 @@
+package tfservingproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+)
+
+func TestRESTHeaderFilters(t *testing.T) {
+	upstream := tfservingtest.NewRESTNode(t, "upstream")
+	received := make(chan http.Header, 1)
+	upstream.Handle("", "", func(rw http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Clone()
+		rw.Header().Set("Server", "TensorFlow Serving")
+		rw.Header().Set("X-Internal-Node", "node1")
+		rw.Header().Set("Connection", "X-Hop")
+		rw.Header().Set("X-Hop", "1")
+		rw.Header().Set("X-Model-Version", "1")
+		rw.Write([]byte(`{"predictions": [1]}`))
+	})
+	serve := func(request HeaderFilter, response HeaderFilter) (http.Header, http.Header) {
+		proxy := NewRestProxy(func(req *http.Request, _ string, _ string) error {
+			req.URL.Scheme, req.URL.Host = "http", upstream.Address()
+			req.Header.Set("X-Internal-Route", "set by the handler")
+			return nil
+		}, WithRESTHeaderFilters(request, response))
+		req := httptest.NewRequest("POST", "/v1/models/foo/versions/1:predict", nil)
+		for name, value := range map[string]string{
+			"Connection":          "Keep-Alive, X-Client-Hop",
+			"Keep-Alive":          "timeout=5",
+			"X-Client-Hop":        "1",
+			"Proxy-Authorization": "Basic c2VjcmV0",
+			"X-Forwarded-Host":    "spoofed.example.com",
+			"X-Internal-Token":    "spoofed",
+			"X-Request-Id":        "req-1",
+		} {
+			req.Header.Set(name, value)
+		}
+		rw := httptest.NewRecorder()
+		proxy.Serve()(rw, req)
+		if rw.Code != http.StatusOK {
+			t.Fatalf("Expected the request to succeed but got %d %s", rw.Code, rw.Body)
+		}
+		return <-received, rw.Header()
+	}
+
+	sent, answered := serve(HeaderFilter{Deny: []string{"x-forwarded-*", "X-Internal-Token"}}, HeaderFilter{Deny: []string{"Server", "X-Internal-*"}})
+	for _, name := range []string{"Connection", "Keep-Alive", "X-Client-Hop", "Proxy-Authorization", "X-Forwarded-Host", "X-Internal-Token"} {
+		if value, ok := sent[name]; ok {
+			t.Errorf("Expected the upstream not to see %s but got %v", name, value)
+		}
+	}
+	if sent.Get("X-Request-Id") != "req-1" || sent.Get("X-Internal-Route") != "set by the handler" {
+		t.Errorf("Expected the upstream to see the other headers but got %v", sent)
+	}
+	for _, name := range []string{"Server", "X-Internal-Node", "X-Hop"} {
+		if value, ok := answered[name]; ok {
+			t.Errorf("Expected the client not to see %s but got %v", name, value)
+		}
+	}
+	if answered.Get("X-Model-Version") != "1" {
+		t.Errorf("Expected the client to see the other headers but got %v", answered)
+	}
+
+	sent, answered = serve(HeaderFilter{Allow: []string{"Content-Type"}}, HeaderFilter{Allow: []string{"Content-Type"}})
+	if _, ok := sent["X-Request-Id"]; ok {
+		t.Errorf("Expected only allowed headers to be sent but got %v", sent)
+	}
+	if _, ok := answered["X-Model-Version"]; ok || answered.Get("Content-Type") == "" {
+		t.Errorf("Expected only allowed headers to be answered but got %v", answered)
+	}
+}
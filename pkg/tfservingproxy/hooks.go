@@ -0,0 +1,231 @@
+package tfservingproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var promHookPanics = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_hook_panics_total",
+	Help: "The total number of panics recovered from request hooks",
+}, []string{"hook"})
+
+// FailureReason classifies why a request failed
+type FailureReason string
+
+const (
+	// FailureInvalid means that the request did not name a valid model version
+	FailureInvalid FailureReason = "invalid"
+	// FailureRejected means that the proxy refused the request, such as
+	// when rate limiting it or when too little of its deadline was left
+	FailureRejected FailureReason = "rejected"
+	// FailureNotFound means that no node can serve the model
+	FailureNotFound FailureReason = "not_found"
+	// FailureUnavailable means that the request could not be routed to a node
+	FailureUnavailable FailureReason = "unavailable"
+	// FailureUpstream means that the node failed the request or could not
+	// be reached
+	FailureUpstream FailureReason = "upstream"
+	// FailureInjected means that the request was failed by an injected
+	// fault, see Fault
+	FailureInjected FailureReason = "injected"
+)
+
+// RequestInfo describes the request passed to Hooks
+type RequestInfo struct {
+	// Protocol is "grpc" or "rest"
+	Protocol string
+	// Method is the full grpc method or the HTTP method
+	Method string
+	// Model is the requested model version. OnForward and later hooks see
+	// the version chosen by canary routing.
+	Model     ModelKey
+	RequestID string
+	// Peer is the client of the request
+	Peer PeerIdentity
+}
+
+// Hooks observes the requests of both proxies. The proxy calls them
+// synchronously in this order:
+//
+// OnResolve once the model and version of the request are known.
+//
+// OnForward when the request was routed to target and is sent upstream.
+//
+// OnComplete when target answered, with the grpc code or HTTP status and
+// how long the upstream call took. Retried grpc calls get an OnForward and
+// OnComplete for each attempt.
+//
+// OnError if the request failed, including when the upstream answer was
+// an error. Invalid requests only get OnError.
+//
+// Hooks only get copies of the request details and cannot change the
+// response. A panicking hook is logged and the request goes on. Requests
+// answered without an upstream call, such as cached metadata, get no
+// OnForward or OnComplete. Embed NopHooks to implement only some of them.
+type Hooks interface {
+	OnResolve(ctx context.Context, info RequestInfo)
+	OnForward(ctx context.Context, info RequestInfo, target string)
+	OnComplete(ctx context.Context, info RequestInfo, status string, duration time.Duration)
+	OnError(ctx context.Context, info RequestInfo, reason FailureReason, err error)
+}
+
+// NopHooks implements Hooks with methods that do nothing
+type NopHooks struct{}
+
+// OnResolve does nothing
+func (NopHooks) OnResolve(context.Context, RequestInfo) {}
+
+// OnForward does nothing
+func (NopHooks) OnForward(context.Context, RequestInfo, string) {}
+
+// OnComplete does nothing
+func (NopHooks) OnComplete(context.Context, RequestInfo, string, time.Duration) {}
+
+// OnError does nothing
+func (NopHooks) OnError(context.Context, RequestInfo, FailureReason, error) {}
+
+// WithHooks calls hooks for each grpc call
+func WithHooks(hooks Hooks) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.serverImpl.hooks = hooks
+	}
+}
+
+// WithRESTHooks calls hooks for each REST request
+func WithRESTHooks(hooks Hooks) RestProxyOption {
+	return func(proxy *RestProxy) {
+		proxy.hooks = hooks
+	}
+}
+
+// hooksKey is the request context key of the hooks of a REST request
+type hooksKey struct{}
+
+// requestHooks calls the hooks of one request. A nil *requestHooks does
+// nothing, so that requests without hooks need no checks.
+type requestHooks struct {
+	hooks     Hooks
+	info      RequestInfo
+	forwarded time.Time
+}
+
+// newGrpcHooks returns the hooks of a grpc call for modelSpec, or nil if
+// the proxy has none
+func (server *proxyServiceServer) newGrpcHooks(ctx context.Context, modelSpec *pb.ModelSpec) *requestHooks {
+	if server.hooks == nil {
+		return nil
+	}
+	method, _ := grpc.Method(ctx)
+	return &requestHooks{hooks: server.hooks, info: RequestInfo{
+		Protocol:  "grpc",
+		Method:    method,
+		Model:     modelKeyForSpec(modelSpec),
+		RequestID: requestID(ctx),
+		Peer:      PeerIdentityFromContext(ctx),
+	}}
+}
+
+// newRESTHooks returns the hooks of a REST request for model and adds them
+// to the context of req, or returns nil if the proxy has none
+func (handler *RestProxy) newRESTHooks(req *http.Request, model ModelKey) (*http.Request, *requestHooks) {
+	if handler.hooks == nil {
+		return req, nil
+	}
+	hooks := &requestHooks{hooks: handler.hooks, info: RequestInfo{
+		Protocol:  "rest",
+		Method:    req.Method,
+		Model:     model,
+		RequestID: restRequestID(req),
+		Peer:      restPeerIdentity(req),
+	}}
+	return req.WithContext(context.WithValue(req.Context(), hooksKey{}, hooks)), hooks
+}
+
+// restHooks returns the hooks of a REST request, or nil
+func restHooks(req *http.Request) *requestHooks {
+	hooks, _ := req.Context().Value(hooksKey{}).(*requestHooks)
+	return hooks
+}
+
+func (r *requestHooks) resolve(ctx context.Context) {
+	if r == nil {
+		return
+	}
+	r.call(ctx, "OnResolve", func() { r.hooks.OnResolve(ctx, r.info) })
+}
+
+func (r *requestHooks) forward(ctx context.Context, model ModelKey, target string) {
+	if r == nil {
+		return
+	}
+	r.info.Model, r.forwarded = model, time.Now()
+	r.call(ctx, "OnForward", func() { r.hooks.OnForward(ctx, r.info, target) })
+}
+
+func (r *requestHooks) complete(ctx context.Context, status string) {
+	if r == nil {
+		return
+	}
+	duration := time.Since(r.forwarded)
+	r.call(ctx, "OnComplete", func() { r.hooks.OnComplete(ctx, r.info, status, duration) })
+}
+
+func (r *requestHooks) fail(ctx context.Context, reason FailureReason, err error) {
+	if r == nil {
+		return
+	}
+	r.call(ctx, "OnError", func() { r.hooks.OnError(ctx, r.info, reason, err) })
+}
+
+// call runs hook, recovering from panics in it
+func (r *requestHooks) call(ctx context.Context, name string, hook func()) {
+	defer func() {
+		if p := recover(); p != nil {
+			promHookPanics.WithLabelValues(name).Inc()
+			logFor(ctx, log.StandardLogger()).WithField("stack", string(debug.Stack())).Errorf("Request hook %s panicked for model %s: %v", name, r.info.Model, p)
+		}
+	}()
+	hook()
+}
+
+// resolveFailure classifies an error returned by a resolver or REST handler
+func resolveFailure(err error) FailureReason {
+	switch grpcCode(err) {
+	case codes.NotFound:
+		return FailureNotFound
+	case codes.InvalidArgument:
+		return FailureInvalid
+	}
+	return FailureUnavailable
+}
+
+// completeREST reports the upstream response of a REST request
+func completeREST(res *http.Response) {
+	hooks := restHooks(res.Request)
+	if hooks == nil {
+		return
+	}
+	ctx := res.Request.Context()
+	hooks.complete(ctx, fmt.Sprint(res.StatusCode))
+	if res.StatusCode >= http.StatusBadRequest {
+		hooks.fail(ctx, FailureUpstream, errors.New(res.Status))
+	}
+}
+
+// completeGrpc reports the upstream answer of a grpc call
+func (r *requestHooks) completeGrpc(ctx context.Context, err error) {
+	r.complete(ctx, status.Code(err).String())
+}
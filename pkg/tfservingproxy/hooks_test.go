@@ -0,0 +1,157 @@
+package tfservingproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// recordingHooks records the hooks called, panicking in panicIn
+type recordingHooks struct {
+	panicIn string
+	calls   []string
+	mutex   sync.Mutex
+}
+
+func (h *recordingHooks) add(hook string, format string, args ...interface{}) {
+	h.mutex.Lock()
+	h.calls = append(h.calls, hook+" "+fmt.Sprintf(format, args...))
+	h.mutex.Unlock()
+	if hook == h.panicIn {
+		panic("hook failed")
+	}
+}
+
+func (h *recordingHooks) OnResolve(ctx context.Context, info RequestInfo) {
+	h.add("OnResolve", "%s %s", info.Protocol, info.Model)
+}
+
+func (h *recordingHooks) OnForward(ctx context.Context, info RequestInfo, target string) {
+	h.add("OnForward", "%s", target)
+}
+
+func (h *recordingHooks) OnComplete(ctx context.Context, info RequestInfo, status string, duration time.Duration) {
+	h.add("OnComplete", "%s", status)
+}
+
+func (h *recordingHooks) OnError(ctx context.Context, info RequestInfo, reason FailureReason, err error) {
+	h.add("OnError", "%s", reason)
+}
+
+func (h *recordingHooks) recorded() []string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]string(nil), h.calls...)
+}
+
+func TestGrpcHooksOrder(t *testing.T) {
+	hooks := &recordingHooks{}
+	harness := tfservingtest.NewHarness(t,
+		tfservingtest.ProviderError("missing", ErrModelNotFound),
+		tfservingtest.ProviderError("down", errors.New("no nodes")),
+		tfservingtest.UpstreamError("broken", status.Error(codes.Internal, "servable failed")))
+	client := harness.Serve(NewGrpcProxy(harness.ClientProvider, WithHooks(hooks),
+		WithDeadlineBudget(DeadlineBudget{MinRemaining: time.Hour})))
+
+	tests := []struct {
+		model string
+		ctx   func() (context.Context, context.CancelFunc)
+		want  []string
+	}{
+		{"foo", nil, []string{"OnResolve grpc foo:1", "OnForward upstream", "OnComplete OK"}},
+		{"", nil, []string{"OnError invalid"}},
+		{"foo", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), time.Minute)
+		},
+			[]string{"OnResolve grpc foo:1", "OnError rejected"}},
+		{"missing", nil, []string{"OnResolve grpc missing:1", "OnError not_found"}},
+		{"down", nil, []string{"OnResolve grpc down:1", "OnError unavailable"}},
+		{"broken", nil, []string{"OnResolve grpc broken:1", "OnForward upstream", "OnComplete Internal", "OnError upstream"}},
+	}
+	for _, test := range tests {
+		hooks.calls = nil
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if test.ctx != nil {
+			ctx, cancel = test.ctx()
+		}
+		client.Predict(ctx, &pb.PredictRequest{ModelSpec: &pb.ModelSpec{
+			Name: test.model, VersionChoice: &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: 1}}}})
+		cancel()
+		if got := hooks.recorded(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Expected hooks %v for model %q but got %v", test.want, test.model, got)
+		}
+	}
+}
+
+func TestRESTHooksOrder(t *testing.T) {
+	hooks := &recordingHooks{}
+	upstream := tfservingtest.NewRESTNode(t, "upstream")
+	upstream.Respond("foo", "1", http.StatusOK, `{"predictions": [1]}`)
+	upstream.Respond("broken", "1", http.StatusInternalServerError, `{"error": "servable failed"}`)
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddress := dead.Addr().String()
+	dead.Close()
+	proxy := NewRestProxy(func(req *http.Request, model string, _ string) error {
+		req.URL.Scheme, req.URL.Host = "http", upstream.URL().Host
+		switch model {
+		case "missing":
+			return ErrModelNotFound
+		case "dead":
+			req.URL.Host = deadAddress
+		}
+		return nil
+	}, WithRESTHooks(hooks))
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/v1/models/foo/versions/1:predict", []string{"OnResolve rest foo:1", "OnForward " + upstream.URL().Host, "OnComplete 200"}},
+		{"/v1/models/foo:predict", []string{"OnError invalid"}},
+		{"/v1/models/missing/versions/1:predict", []string{"OnResolve rest missing:1", "OnError not_found"}},
+		{"/v1/models/broken/versions/1:predict", []string{"OnResolve rest broken:1", "OnForward " + upstream.URL().Host, "OnComplete 500", "OnError upstream"}},
+		{"/v1/models/dead/versions/1:predict", []string{"OnResolve rest dead:1", "OnForward " + deadAddress, "OnError upstream"}},
+	}
+	for _, test := range tests {
+		hooks.calls = nil
+		proxy.Serve()(httptest.NewRecorder(), httptest.NewRequest("POST", test.path, nil))
+		if got := hooks.recorded(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Expected hooks %v for %s but got %v", test.want, test.path, got)
+		}
+	}
+}
+
+func TestHooksRecoverFromPanics(t *testing.T) {
+	hooks := &recordingHooks{panicIn: "OnForward"}
+	harness := tfservingtest.NewHarness(t)
+	client := harness.Serve(NewGrpcProxy(harness.ClientProvider, WithHooks(hooks)))
+	panicsBefore := testutil.ToFloat64(promHookPanics.WithLabelValues("OnForward"))
+
+	if _, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}); err != nil {
+		t.Fatalf("Expected the call to succeed despite the panicking hook but got %v", err)
+	}
+	want := []string{"OnResolve grpc foo:0", "OnForward upstream", "OnComplete OK"}
+	if got := hooks.recorded(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected hooks %v but got %v", want, got)
+	}
+	if n := testutil.ToFloat64(promHookPanics.WithLabelValues("OnForward")) - panicsBefore; n != 1 {
+		t.Errorf("Expected one recovered panic but got %v", n)
+	}
+}
@@ -0,0 +1,67 @@
+package tfservingproxy
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"google.golang.org/grpc"
+)
+
+func TestListenAddress(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"", ":8500"},
+		{"127.0.0.1", "127.0.0.1:8500"},
+		{"::1", "[::1]:8500"},
+		{"[::1]", "[::1]:8500"},
+	}
+	for _, test := range tests {
+		if addr := ListenAddress(test.host, 8500); addr != test.expected {
+			t.Errorf("Expected %s for host %q but got %s", test.expected, test.host, addr)
+		}
+	}
+}
+
+func TestGrpcProxyListenAddr(t *testing.T) {
+	for _, test := range []struct{ host, other string }{{"127.0.0.1", "::1"}, {"::1", "127.0.0.1"}} {
+		t.Run(test.host, func(t *testing.T) {
+			if lis, err := net.Listen("tcp", ListenAddress(test.host, 0)); err != nil {
+				t.Skipf("Cannot listen on %s: %v", test.host, err)
+			} else {
+				lis.Close()
+			}
+			harness := tfservingtest.NewHarness(t)
+			proxy := NewGrpcProxy(harness.ClientProvider)
+			defer proxy.Close()
+			go proxy.ListenAddr(ListenAddress(test.host, 0))
+			for start := time.Now(); proxy.Addr() == nil; time.Sleep(time.Millisecond) {
+				if time.Since(start) > 5*time.Second {
+					t.Fatal("Proxy did not start listening")
+				}
+			}
+			port := proxy.Addr().(*net.TCPAddr).Port
+
+			conn, err := grpc.Dial(ListenAddress(test.host, port), grpc.WithInsecure())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if _, err := pb.NewPredictionServiceClient(conn).Predict(ctx, predictVersion("foo", 1)); err != nil {
+				t.Errorf("Expected the proxy to be reachable on %s but got %v", test.host, err)
+			}
+			if other, err := net.DialTimeout("tcp", net.JoinHostPort(test.other, strconv.Itoa(port)), time.Second); err == nil {
+				other.Close()
+				t.Errorf("Expected the proxy not to be reachable on %s", test.other)
+			}
+		})
+	}
+}
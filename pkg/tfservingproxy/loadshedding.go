@@ -0,0 +1,70 @@
+package tfservingproxy
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var promInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tfservingcache_proxy_inflight_requests",
+	Help: "The number of requests currently being handled",
+}, []string{"protocol"})
+var promShed = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_shed_total",
+	Help: "The total number of requests rejected because the proxy was at capacity",
+}, []string{"protocol"})
+
+// WithMaxConcurrentStreams limits the number of concurrent streams
+// each client connection may open to the proxy.
+func WithMaxConcurrentStreams(n uint32) GrpcProxyOption {
+	return WithServerOptions(grpc.MaxConcurrentStreams(n))
+}
+
+// WithMaxInFlight sheds new RPCs with ResourceExhausted once n RPCs are
+// in flight across all connections.
+//
+// The check runs first in the interceptor chain, before any resolution or
+// upstream work. It is not a tap.ServerInHandle: with the grpc version
+// used here a tap error resets the stream with REFUSED_STREAM, which
+// clients see as Unavailable and transparently retry.
+func WithMaxInFlight(n int64) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.tunables.maxInFlight = n
+	}
+}
+
+// inFlightInterceptor keeps track of the number of RPCs being handled and
+// sheds RPCs exceeding the in-flight ceiling
+func (proxy *GrpcProxy) inFlightInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	maxInFlight := proxy.serverImpl.settings().maxInFlight
+	if !proxy.admit(maxInFlight) {
+		promShed.WithLabelValues("grpc").Inc()
+		proxy.serverImpl.loggerFor(ctx).Warnf("Shedding %s: %d requests in flight", info.FullMethod, maxInFlight)
+		return nil, status.Errorf(codes.ResourceExhausted, "proxy is at capacity (%d requests in flight)", maxInFlight)
+	}
+	promInFlight.WithLabelValues("grpc").Inc()
+	defer func() {
+		atomic.AddInt64(&proxy.inFlight, -1)
+		promInFlight.WithLabelValues("grpc").Dec()
+	}()
+	return handler(ctx, req)
+}
+
+// admit reserves an in-flight slot, failing if maxInFlight is reached
+func (proxy *GrpcProxy) admit(maxInFlight int64) bool {
+	for {
+		current := atomic.LoadInt64(&proxy.inFlight)
+		if maxInFlight > 0 && current >= maxInFlight {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&proxy.inFlight, current, current+1) {
+			return true
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package tfservingproxy
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Fields of the log lines of a request
+const (
+	logFieldRequestID   = "request_id"
+	logFieldProtocol    = "protocol"
+	logFieldMethod      = "method"
+	logFieldVerb        = "verb"
+	logFieldModel       = "model"
+	logFieldVersion     = "version"
+	logFieldTarget      = "target"
+	logFieldAttempt     = "attempt"
+	logFieldPeer        = "peer"
+	logFieldPeerSubject = "peer_subject"
+	logFieldPeerSANs    = "peer_san"
+	logFieldFault       = "fault"
+)
+
+// WithRESTLogger logs the events of REST requests to logger instead of the
+// standard logger
+func WithRESTLogger(logger log.FieldLogger) RestProxyOption {
+	return func(proxy *RestProxy) {
+		if logger != nil {
+			proxy.logger = logger
+		}
+	}
+}
+
+// requestLoggerKey is the context key of the logger of a request
+type requestLoggerKey struct{}
+
+// requestLogger is the logger of one request. Fields added as the request
+// is routed show up on all later log lines of the request, including those
+// logged from other goroutines holding its context.
+type requestLogger struct {
+	mutex  sync.Mutex
+	logger log.FieldLogger
+}
+
+// withRequestLogger adds a request logger with fields to ctx
+func withRequestLogger(ctx context.Context, logger log.FieldLogger, fields log.Fields) context.Context {
+	return context.WithValue(ctx, requestLoggerKey{}, &requestLogger{logger: logger.WithFields(fields)})
+}
+
+// addLogFields adds fields to the logger of the request of ctx, if any
+func addLogFields(ctx context.Context, fields log.Fields) {
+	if l, ok := ctx.Value(requestLoggerKey{}).(*requestLogger); ok {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		l.logger = l.logger.WithFields(fields)
+	}
+}
+
+// logFor returns the logger of the request of ctx, or fallback outside of
+// a request
+func logFor(ctx context.Context, fallback log.FieldLogger) log.FieldLogger {
+	if l, ok := ctx.Value(requestLoggerKey{}).(*requestLogger); ok {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		return l.logger
+	}
+	return fallback
+}
+
+// loggerFor returns the logger of the grpc call of ctx
+func (server *proxyServiceServer) loggerFor(ctx context.Context) log.FieldLogger {
+	return logFor(ctx, server.logger)
+}
+
+// logFieldsInterceptor adds a request logger to the context of each call,
+// with the address of the peer and its verified client certificate, if
+// any. It runs first, so the request id is only known if the caller sent
+// one; forward adds it once the trace id is known.
+func (server *proxyServiceServer) logFieldsInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	fields := PeerIdentityFromContext(ctx).logFields()
+	fields[logFieldProtocol] = "grpc"
+	if isTranscoded(ctx) {
+		fields[logFieldProtocol] = "rest"
+	}
+	fields[logFieldMethod] = info.FullMethod
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(requestIDHeader); len(ids) > 0 {
+			fields[logFieldRequestID] = ids[0]
+		}
+	}
+	if specReq, ok := req.(modelSpecRequest); ok {
+		key := modelKeyForSpec(specReq.GetModelSpec())
+		fields[logFieldModel], fields[logFieldVersion] = key.Name, key.Version
+	}
+	return handler(withRequestLogger(ctx, server.logger, fields), req)
+}
+
+// withRESTLogger adds a request logger for req to its context
+func (handler *RestProxy) withRESTLogger(req *http.Request) *http.Request {
+	ctx := withRequestLogger(req.Context(), handler.logger, log.Fields{
+		logFieldRequestID: restRequestID(req),
+		logFieldProtocol:  "rest",
+		logFieldMethod:    req.Method,
+	})
+	return req.WithContext(ctx)
+}
+
+// restLogger returns the logger of a REST request
+func restLogger(req *http.Request) log.FieldLogger {
+	return logFor(req.Context(), log.StandardLogger())
+}
@@ -0,0 +1,102 @@
+package tfservingproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// checkLogFields fails unless each entry has the fields of want
+func checkLogFields(t *testing.T, entries []*log.Entry, want log.Fields) {
+	t.Helper()
+	for _, entry := range entries {
+		for name, value := range want {
+			if entry.Data[name] != value {
+				t.Errorf("Expected %s=%v on %q but got %v", name, value, entry.Message, entry.Data)
+			}
+		}
+	}
+}
+
+func TestGrpcLogLinesCarryRequestFields(t *testing.T) {
+	logger, logs := logtest.NewNullLogger()
+	harness := tfservingtest.NewHarness(t, tfservingtest.UpstreamError("flaky", status.Error(codes.Unavailable, "node restarting")))
+	client := harness.Serve(NewGrpcProxy(harness.ClientProvider, WithLogger(logger), WithUpstreamRetries(1),
+		WithHooks(&recordingHooks{panicIn: "OnError"})))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), requestIDHeader, "req-1")
+	client.Predict(ctx, predictVersion("flaky", 3))
+
+	entries := logs.AllEntries()
+	if len(entries) != 2 {
+		t.Fatalf("Expected a retry and a hook panic to be logged but got %d entries", len(entries))
+	}
+	checkLogFields(t, entries, log.Fields{
+		logFieldRequestID: "req-1",
+		logFieldProtocol:  "grpc",
+		logFieldMethod:    "/tensorflow.serving.PredictionService/Predict",
+		logFieldModel:     "flaky",
+		logFieldVersion:   "3",
+		logFieldTarget:    "upstream",
+		logFieldPeer:      "bufconn",
+	})
+	if retry, failed := entries[0].Data[logFieldAttempt], entries[1].Data[logFieldAttempt]; retry != 1 || failed != 2 {
+		t.Errorf("Expected attempts 1 and 2 but got %v and %v", retry, failed)
+	}
+}
+
+func TestRESTLogLinesCarryRequestFields(t *testing.T) {
+	logger, logs := logtest.NewNullLogger()
+	logger.SetLevel(log.DebugLevel)
+	upstream := tfservingtest.NewRESTNode(t, "upstream")
+	upstream.Respond("foo", "1", http.StatusOK, `{"predictions": [1]}`)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	proxy := NewRestProxy(func(req *http.Request, model string, _ string) error {
+		target := upstream.URL()
+		if model == "down" {
+			req.URL.Scheme, req.URL.Host = "http", down.Listener.Addr().String()
+			return nil
+		}
+		req.URL.Scheme, req.URL.Host = target.Scheme, target.Host
+		return nil
+	}, WithRESTLogger(logger), WithRESTHooks(&recordingHooks{panicIn: "OnComplete"}))
+
+	for _, test := range []struct {
+		model  string
+		target string
+	}{
+		{"foo", upstream.URL().Host},
+		{"down", down.Listener.Addr().String()},
+	} {
+		logs.Reset()
+		req := httptest.NewRequest("POST", "/v1/models/"+test.model+"/versions/1:predict", nil)
+		req.Header.Set(requestIDHeader, "req-"+test.model)
+		proxy.Serve()(httptest.NewRecorder(), req)
+
+		entries := logs.AllEntries()
+		// Handling URL, model name and a hook panic in ModifyResponse or
+		// the upstream error in ErrorHandler
+		if len(entries) != 3 {
+			t.Fatalf("Expected three log entries for %s but got %d", test.model, len(entries))
+		}
+		checkLogFields(t, entries[:1], log.Fields{logFieldRequestID: "req-" + test.model, logFieldProtocol: "rest", logFieldMethod: "POST"})
+		checkLogFields(t, entries[1:], log.Fields{
+			logFieldRequestID: "req-" + test.model,
+			logFieldProtocol:  "rest",
+			logFieldMethod:    "POST",
+			logFieldModel:     test.model,
+			logFieldVersion:   "1",
+			logFieldVerb:      "predict",
+		})
+		checkLogFields(t, entries[2:], log.Fields{logFieldTarget: test.target})
+	}
+}
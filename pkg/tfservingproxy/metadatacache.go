@@ -0,0 +1,295 @@
+package tfservingproxy
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var promMetadataCache = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_metadata_cache_total",
+	Help: "The total number of model metadata lookups in the metadata cache by result",
+}, []string{"protocol", "result"})
+
+// MetadataCache caches model metadata responses, which do not change for
+// a model version. A MetadataCache shared by a GrpcProxy and a RestProxy
+// is invalidated for both at once.
+type MetadataCache struct {
+	ttl        time.Duration
+	maxEntries int
+	entries    map[metadataKey]*list.Element
+	// order has the most recently used entries first
+	order *list.List
+	now   func() time.Time
+	mutex sync.Mutex
+}
+
+// metadataKey identifies a cached response. The REST and grpc responses
+// are cached separately as they have different representations.
+type metadataKey struct {
+	protocol string
+	model    ModelKey
+	fields   string
+}
+
+type metadataEntry struct {
+	key     metadataKey
+	target  string
+	value   interface{}
+	expires time.Time
+}
+
+// NewMetadataCache creates a MetadataCache keeping responses for ttl and
+// holding at most maxEntries responses
+func NewMetadataCache(ttl time.Duration, maxEntries int) *MetadataCache {
+	return &MetadataCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[metadataKey]*list.Element),
+		order:      list.New(),
+		now:        time.Now,
+	}
+}
+
+// WithMetadataCache serves GetModelMetadata calls for pinned model
+// versions from cache while the model is routed to the same target
+func WithMetadataCache(cache *MetadataCache) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.serverImpl.metadataCache = cache
+	}
+}
+
+// WithRESTMetadataCache serves REST metadata requests from cache
+func WithRESTMetadataCache(cache *MetadataCache) RestProxyOption {
+	return func(proxy *RestProxy) {
+		proxy.metadataCache = cache
+		proxy.RestProxy.ModifyResponse = proxy.cacheRESTMetadata
+	}
+}
+
+// get returns the cached value of key if it has not expired and was
+// fetched from target
+func (cache *MetadataCache) get(key metadataKey, target string) (interface{}, bool) {
+	entry, ok := cache.lookup(key, target)
+	if !ok {
+		return nil, false
+	}
+	return entry.value, true
+}
+
+// lookup returns the cached entry of key if it has not expired and was
+// fetched from target
+func (cache *MetadataCache) lookup(key metadataKey, target string) (*metadataEntry, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	element, ok := cache.entries[key]
+	if !ok {
+		promMetadataCache.WithLabelValues(key.protocol, "miss").Inc()
+		return nil, false
+	}
+	entry := element.Value.(*metadataEntry)
+	if entry.target != target || !cache.now().Before(entry.expires) {
+		cache.remove(element)
+		promMetadataCache.WithLabelValues(key.protocol, "miss").Inc()
+		return nil, false
+	}
+	cache.order.MoveToFront(element)
+	promMetadataCache.WithLabelValues(key.protocol, "hit").Inc()
+	return entry, true
+}
+
+// put caches value for key, evicting the least recently used entry if the
+// cache is full. It returns when the entry expires.
+func (cache *MetadataCache) put(key metadataKey, target string, value interface{}) time.Time {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if element, ok := cache.entries[key]; ok {
+		cache.remove(element)
+	}
+	for cache.maxEntries > 0 && cache.order.Len() >= cache.maxEntries {
+		cache.remove(cache.order.Back())
+	}
+	expires := cache.now().Add(cache.ttl)
+	cache.entries[key] = cache.order.PushFront(&metadataEntry{
+		key:     key,
+		target:  target,
+		value:   value,
+		expires: expires,
+	})
+	return expires
+}
+
+func (cache *MetadataCache) remove(element *list.Element) {
+	cache.order.Remove(element)
+	delete(cache.entries, element.Value.(*metadataEntry).key)
+}
+
+// Invalidate removes the cached metadata of a model version, or of all
+// versions of the model if version is empty
+func (cache *MetadataCache) Invalidate(model string, version string) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for key, element := range cache.entries {
+		if key.model.Name == model && (version == "" || key.model.Version == version) {
+			cache.remove(element)
+		}
+	}
+}
+
+// InvalidateAll removes all cached metadata, such as when the nodes
+// serving the models change
+func (cache *MetadataCache) InvalidateAll() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	for _, element := range cache.entries {
+		cache.remove(element)
+	}
+}
+
+// ServeInvalidate invalidates the metadata of the model and optional
+// version given in the query of a POST request
+func (cache *MetadataCache) ServeInvalidate(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		writeError(rw, http.StatusMethodNotAllowed, "Use POST to invalidate metadata")
+		return
+	}
+	model := req.URL.Query().Get("model")
+	if model == "" {
+		writeError(rw, http.StatusBadRequest, "Model must be provided")
+		return
+	}
+	cache.Invalidate(model, req.URL.Query().Get("version"))
+	log.Infof("Invalidated cached metadata of model %s", model)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// grpcMetadataKey returns the cache key of a GetModelMetadata request. Only
+// requests for a version number are cached, as the latest version or the
+// version behind a label may change.
+func grpcMetadataKey(req *pb.GetModelMetadataRequest) (metadataKey, bool) {
+	if req.GetModelSpec().GetVersion() == nil {
+		return metadataKey{}, false
+	}
+	fields := append([]string{}, req.GetMetadataField()...)
+	sort.Strings(fields)
+	return metadataKey{
+		protocol: "grpc",
+		model:    modelKeyForSpec(req.GetModelSpec()),
+		fields:   strings.Join(fields, ","),
+	}, true
+}
+
+// cachedRESTMetadata is a cached REST metadata response
+type cachedRESTMetadata struct {
+	body []byte
+	// etag is the strong entity tag of body
+	etag string
+}
+
+func newCachedRESTMetadata(body []byte) cachedRESTMetadata {
+	sum := sha256.Sum256(body)
+	return cachedRESTMetadata{body: body, etag: `"` + hex.EncodeToString(sum[:16]) + `"`}
+}
+
+// WithRESTMetadataMaxAge limits the max-age of the Cache-Control header of
+// cached REST metadata responses to maxAge. By default it is the time
+// left until the cached entry expires, so clients never keep a response
+// longer than the proxy.
+func WithRESTMetadataMaxAge(maxAge time.Duration) RestProxyOption {
+	return func(proxy *RestProxy) {
+		proxy.metadataMaxAge = maxAge
+	}
+}
+
+// setMetadataCaching sets the ETag and Cache-Control headers of a cached
+// REST metadata response expiring at expires
+func (handler *RestProxy) setMetadataCaching(header http.Header, metadata cachedRESTMetadata, expires time.Time) {
+	maxAge := expires.Sub(handler.metadataCache.now())
+	if handler.metadataMaxAge > 0 && handler.metadataMaxAge < maxAge {
+		maxAge = handler.metadataMaxAge
+	}
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	header.Set("ETag", metadata.etag)
+	header.Set("Cache-Control", "max-age="+strconv.Itoa(int(maxAge/time.Second)))
+}
+
+// etagMatches returns whether the If-None-Match header value matches etag,
+// comparing weakly as RFC 7232 requires for If-None-Match
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// restMetadataRequestKey is the request context key of the cache key of a
+// REST metadata request that missed the cache
+type restMetadataRequestKey struct{}
+
+// serveRESTMetadata answers a REST metadata request from cache, with 304
+// if the client has the cached response already. REST requests are routed
+// to one of the nodes of a model at random, so entries are kept by model
+// version only and dropped with InvalidateAll when the nodes change. On a
+// miss it returns the request to forward, marked to have its response
+// cached.
+func (handler *RestProxy) serveRESTMetadata(rw http.ResponseWriter, req *http.Request, model ModelKey) (*http.Request, bool) {
+	key := metadataKey{protocol: "rest", model: model}
+	if entry, ok := handler.metadataCache.lookup(key, ""); ok {
+		metadata := entry.value.(cachedRESTMetadata)
+		handler.setMetadataCaching(rw.Header(), metadata, entry.expires)
+		if etagMatches(req.Header.Get("If-None-Match"), metadata.etag) {
+			rw.WriteHeader(http.StatusNotModified)
+			return nil, true
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Write(metadata.body)
+		return nil, true
+	}
+	return req.WithContext(context.WithValue(req.Context(), restMetadataRequestKey{}, key)), false
+}
+
+// cacheRESTMetadata caches successful responses to REST metadata requests
+// that missed the cache. If the client already has the fetched response,
+// it is answered with 304 instead.
+func (handler *RestProxy) cacheRESTMetadata(res *http.Response) error {
+	key, ok := res.Request.Context().Value(restMetadataRequestKey{}).(metadataKey)
+	if !ok || res.StatusCode != http.StatusOK {
+		return nil
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	metadata := newCachedRESTMetadata(body)
+	expires := handler.metadataCache.put(key, "", metadata)
+	handler.setMetadataCaching(res.Header, metadata, expires)
+	if etagMatches(res.Request.Header.Get("If-None-Match"), metadata.etag) {
+		res.StatusCode, res.Status = http.StatusNotModified, http.StatusText(http.StatusNotModified)
+		res.Body, res.ContentLength = http.NoBody, 0
+		res.Header.Del("Content-Length")
+		res.Header.Del("Content-Type")
+		return nil
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return nil
+}
@@ -0,0 +1,250 @@
+package tfservingproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"google.golang.org/grpc"
+)
+
+func TestMetadataCacheGrpc(t *testing.T) {
+	now := time.Now()
+	cache := NewMetadataCache(time.Minute, 10)
+	cache.now = func() time.Time { return now }
+	nodeA, nodeB := tfservingtest.NewGRPCNode(t, "node-a"), tfservingtest.NewGRPCNode(t, "node-b")
+	connA, connB := nodeA.Dial(t), nodeB.Dial(t)
+	var target atomic.Value
+	target.Store(connA)
+	client := startProxy(t, NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return target.Load().(*grpc.ClientConn), nil
+	}, WithMetadataCache(cache)))
+	getMetadata := func(fields ...string) {
+		t.Helper()
+		_, err := client.GetModelMetadata(context.Background(), &pb.GetModelMetadataRequest{
+			ModelSpec: &pb.ModelSpec{
+				Name:          "foo",
+				VersionChoice: &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: 1}},
+			},
+			MetadataField: fields,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	getMetadata("signature_def")
+	getMetadata("signature_def")
+	if n := tfservingtest.Received(nodeA, "foo", ""); n != 1 {
+		t.Errorf("Expected the second call to be served from cache but got %d upstream calls", n)
+	}
+	getMetadata()
+	if n := tfservingtest.Received(nodeA, "foo", ""); n != 2 {
+		t.Errorf("Expected other metadata fields to miss the cache but got %d upstream calls", n)
+	}
+
+	now = now.Add(time.Minute)
+	getMetadata("signature_def")
+	if n := tfservingtest.Received(nodeA, "foo", ""); n != 3 {
+		t.Errorf("Expected the expired entry to be fetched again but got %d upstream calls", n)
+	}
+
+	target.Store(connB)
+	getMetadata("signature_def")
+	if n := tfservingtest.Received(nodeB, "foo", ""); n != 1 {
+		t.Errorf("Expected a new target to miss the cache but got %d upstream calls", n)
+	}
+
+	cache.Invalidate("foo", "1")
+	getMetadata("signature_def")
+	if n := tfservingtest.Received(nodeB, "foo", ""); n != 2 {
+		t.Errorf("Expected an invalidated entry to be fetched again but got %d upstream calls", n)
+	}
+
+	// Unpinned versions may change and are never cached
+	for i := 0; i < 2; i++ {
+		if _, err := client.GetModelMetadata(context.Background(), &pb.GetModelMetadataRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := tfservingtest.Received(nodeB, "foo", ""); n != 4 {
+		t.Errorf("Expected calls for the latest version to pass through but got %d upstream calls", n)
+	}
+}
+
+func TestMetadataCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewMetadataCache(time.Minute, 2)
+	key := func(version string) metadataKey {
+		return metadataKey{protocol: "rest", model: ModelKey{Name: "foo", Version: version}}
+	}
+	cache.put(key("1"), "", 1)
+	cache.put(key("2"), "", 2)
+	cache.get(key("1"), "")
+	cache.put(key("3"), "", 3)
+	if _, ok := cache.get(key("2"), ""); ok {
+		t.Error("Expected the least recently used entry to be evicted")
+	}
+	for _, version := range []string{"1", "3"} {
+		if _, ok := cache.get(key(version), ""); !ok {
+			t.Errorf("Expected version %s to be cached", version)
+		}
+	}
+}
+
+func TestMetadataCacheRest(t *testing.T) {
+	now := time.Now()
+	cache := NewMetadataCache(time.Minute, 10)
+	cache.now = func() time.Time { return now }
+	upstream := tfservingtest.NewRESTNode(t, "upstream")
+	upstream.Respond("foo", "1", http.StatusOK, `{"model_spec": {"name": "foo"}}`)
+	upstreamURL := upstream.URL()
+	proxy := NewRestProxy(func(req *http.Request, _ string, _ string) error {
+		req.URL.Scheme, req.URL.Host = upstreamURL.Scheme, upstreamURL.Host
+		return nil
+	}, WithRESTMetadataCache(cache))
+	getMetadata := func() *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		proxy.Serve()(rw, httptest.NewRequest("GET", "/v1/models/foo/versions/1/metadata", nil))
+		return rw
+	}
+
+	first, second := getMetadata(), getMetadata()
+	if n := len(upstream.Requests()); n != 1 {
+		t.Errorf("Expected the second request to be served from cache but got %d upstream calls", n)
+	}
+	if first.Body.String() != second.Body.String() {
+		t.Errorf("Expected the cached body %q but got %q", first.Body.String(), second.Body.String())
+	}
+
+	now = now.Add(time.Minute)
+	getMetadata()
+	if n := len(upstream.Requests()); n != 2 {
+		t.Errorf("Expected the expired entry to be fetched again but got %d upstream calls", n)
+	}
+
+	rw := httptest.NewRecorder()
+	cache.ServeInvalidate(rw, httptest.NewRequest("POST", "/admin/metadata/invalidate?model=foo", nil))
+	if rw.Code != http.StatusNoContent {
+		t.Fatalf("Expected the invalidation to succeed but got %d", rw.Code)
+	}
+	getMetadata()
+	if n := len(upstream.Requests()); n != 3 {
+		t.Errorf("Expected an invalidated entry to be fetched again but got %d upstream calls", n)
+	}
+}
+
+func TestMetadataCacheRestMembershipChange(t *testing.T) {
+	cache := NewMetadataCache(time.Minute, 10)
+	nodeA, nodeB := tfservingtest.NewRESTNode(t, "node-a"), tfservingtest.NewRESTNode(t, "node-b")
+	nodeA.Respond("foo", "1", http.StatusOK, `{"model_spec": {"name": "foo", "node": "a"}}`)
+	nodeB.Respond("foo", "1", http.StatusOK, `{"model_spec": {"name": "foo", "node": "b"}}`)
+	var target atomic.Value
+	target.Store(nodeA.URL())
+	var resolved int32
+	proxy := NewRestProxy(func(req *http.Request, _ string, _ string) error {
+		atomic.AddInt32(&resolved, 1)
+		u := target.Load().(*url.URL)
+		req.URL.Scheme, req.URL.Host = u.Scheme, u.Host
+		return nil
+	}, WithRESTMetadataCache(cache))
+	getMetadata := func() string {
+		rw := httptest.NewRecorder()
+		proxy.Serve()(rw, httptest.NewRequest("GET", "/v1/models/foo/versions/1/metadata", nil))
+		return rw.Body.String()
+	}
+
+	getMetadata()
+	getMetadata()
+	if n := len(nodeA.Requests()); n != 1 {
+		t.Errorf("Expected the second request to be served from cache but got %d upstream calls", n)
+	}
+	if n := atomic.LoadInt32(&resolved); n != 1 {
+		t.Errorf("Expected only the miss to be resolved, once, but got %d resolutions", n)
+	}
+	// Another node of the model answers from the same cache
+	target.Store(nodeB.URL())
+	if body := getMetadata(); !strings.Contains(body, `"a"`) || len(nodeB.Requests()) != 0 {
+		t.Errorf("Expected another node to be served from cache but got %s with %d upstream calls", body, len(nodeB.Requests()))
+	}
+	cache.InvalidateAll()
+	if body := getMetadata(); !strings.Contains(body, `"b"`) || len(nodeB.Requests()) != 1 {
+		t.Errorf("Expected a membership change to miss the cache but got %s with %d upstream calls", body, len(nodeB.Requests()))
+	}
+	getMetadata()
+	if n := len(nodeB.Requests()); n != 1 {
+		t.Errorf("Expected the refetched entry to be cached but got %d upstream calls", n)
+	}
+}
+
+func TestMetadataCacheRestConditionalRequests(t *testing.T) {
+	now := time.Now()
+	cache := NewMetadataCache(time.Minute, 10)
+	cache.now = func() time.Time { return now }
+	upstream := tfservingtest.NewRESTNode(t, "upstream")
+	upstream.Respond("foo", "1", http.StatusOK, `{"model_spec": {"name": "foo"}}`)
+	upstream.Respond("bar", "1", http.StatusNotFound, `{"error": "not found"}`)
+	upstreamURL := upstream.URL()
+	proxy := NewRestProxy(func(req *http.Request, _ string, _ string) error {
+		req.URL.Scheme, req.URL.Host = upstreamURL.Scheme, upstreamURL.Host
+		return nil
+	}, WithRESTMetadataCache(cache), WithRESTMetadataMaxAge(30*time.Second))
+	getMetadata := func(model string, etag string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/v1/models/"+model+"/versions/1/metadata", nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		proxy.Serve()(rw, req)
+		return rw
+	}
+
+	first := getMetadata("foo", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" || strings.HasPrefix(etag, "W/") {
+		t.Fatalf("Expected a strong ETag on the fetched response but got %d with %q", first.Code, etag)
+	}
+	if cc := first.Header().Get("Cache-Control"); cc != "max-age=30" {
+		t.Errorf("Expected max-age capped at 30s but got %q", cc)
+	}
+
+	matched := getMetadata("foo", etag)
+	if matched.Code != http.StatusNotModified || matched.Body.Len() != 0 {
+		t.Errorf("Expected 304 without a body for a matching ETag but got %d with %q", matched.Code, matched.Body.String())
+	}
+	if matched.Header().Get("ETag") != etag {
+		t.Errorf("Expected the ETag %s on the 304 but got %q", etag, matched.Header().Get("ETag"))
+	}
+
+	mismatched := getMetadata("foo", `"stale"`)
+	if mismatched.Code != http.StatusOK || mismatched.Body.String() != first.Body.String() {
+		t.Errorf("Expected the cached body for a stale ETag but got %d with %q", mismatched.Code, mismatched.Body.String())
+	}
+
+	now = now.Add(50 * time.Second)
+	if cc := getMetadata("foo", "").Header().Get("Cache-Control"); cc != "max-age=10" {
+		t.Errorf("Expected max-age to end with the cached entry but got %q", cc)
+	}
+
+	// The refreshed response is unchanged, so the client keeps its copy
+	now = now.Add(time.Minute)
+	refreshed := getMetadata("foo", etag)
+	if n := len(upstream.Requests()); n != 2 {
+		t.Errorf("Expected the expired entry to be fetched again but got %d upstream calls", n)
+	}
+	if refreshed.Code != http.StatusNotModified || refreshed.Body.Len() != 0 || refreshed.Header().Get("ETag") != etag {
+		t.Errorf("Expected 304 with the same ETag after the refresh but got %d with %q", refreshed.Code, refreshed.Header().Get("ETag"))
+	}
+
+	failed := getMetadata("bar", "")
+	if failed.Code != http.StatusNotFound || failed.Header().Get("ETag") != "" || failed.Header().Get("Cache-Control") != "" {
+		t.Errorf("Expected no caching headers on an error but got %d with %v", failed.Code, failed.Header())
+	}
+}
@@ -0,0 +1,96 @@
+package tfservingproxy
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var promResponseCodes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_grpc_responses_total",
+	Help: "The total number of grpc calls by method and returned status code",
+}, []string{"method", "code"})
+
+// allModelsLabel is the model label value used when model labels are disabled
+const allModelsLabel = "all_models"
+
+// WithModelLabels adds the model name as a label on per-model metrics.
+// It is disabled by default since clients can make up any number of
+// model names; all models then share the "all_models" label value.
+func WithModelLabels(enabled bool) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.serverImpl.modelLabels = enabled
+	}
+}
+
+// WithRESTModelLabels adds the model name as a label on per-model metrics
+// of REST requests, like WithModelLabels
+func WithRESTModelLabels(enabled bool) RestProxyOption {
+	return func(proxy *RestProxy) {
+		proxy.modelLabels = enabled
+	}
+}
+
+// modelLabel returns the label value to use for modelName on per-model metrics
+func (server *proxyServiceServer) modelLabel(modelName string) string {
+	return modelLabel(server.modelLabels, modelName)
+}
+
+// modelLabel returns the label value to use for modelName on per-model
+// metrics of REST requests
+func (handler *RestProxy) modelLabel(modelName string) string {
+	return modelLabel(handler.modelLabels, modelName)
+}
+
+func modelLabel(enabled bool, modelName string) string {
+	if !enabled {
+		return allModelsLabel
+	}
+	return modelName
+}
+
+// codeInterceptor counts the calls by the status code returned to the
+// caller. It is the outermost interceptor so calls rejected by the proxy
+// are counted too.
+func codeInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	res, err := handler(ctx, req)
+	promResponseCodes.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return res, err
+}
+
+// collectors are the metrics of the proxies
+var collectors = []prometheus.Collector{
+	promRequestsTotal, promRequestsFailed, promResponseCodes, promInFlight, promShed,
+	promModelInFlight, promValidationFailures, promAuthFailures, promRateLimited, promQuotaRejected, promQuotaClients,
+	promNotReady, promDeadlineRejected, promRequestSize, promResponseSize,
+	promCanaryRequests, promShadowRequests, promShadowDropped, promShadowDuration,
+	promDialAttempts, promDialFailures, promDialDuration, promUpstreamConns,
+	promWarmReady, promWarmFailures, promMetadataCache, promBuildInfo,
+	promPoolConns, promPoolUsage, promPoolLookups, promPoolEvictions, promRESTConns,
+	promHookPanics, promResolveDuration, promDryRuns, promInjectedFaults, promUnavailable, promStaleRetries,
+	promExperimentRequests,
+	promFairQueueDepth,
+	promFairQueueShed,
+	promSlowRequests,
+	promDrainedUpstreams,
+	promModelCacheHits,
+	promModelCacheMisses,
+	promBodyTransforms,
+	promCoalesced,
+	promTimeouts,
+}
+
+// registerMetrics registers the metrics of the proxies with registry
+func registerMetrics(registry prometheus.Registerer) error {
+	for _, collector := range collectors {
+		if err := registry.Register(collector); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package tfservingproxy
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+)
+
+// ModelKey identifies the model version a request is for. Both proxies,
+// the resolvers and the features rewriting the requested version work on
+// it, so that a request routes the same way whatever its protocol.
+type ModelKey struct {
+	Name string
+	// Version is the requested version. Grpc calls without a version get
+	// version 0, REST requests without one an empty version.
+	Version string
+	// Label is the requested version label, which TF Serving maps to a
+	// version
+	Label string
+	// Tenant is the tenant the request is for. The parsers leave it empty
+	// for the routing layer to fill in.
+	Tenant string
+}
+
+func (key ModelKey) String() string {
+	if key.Label != "" && key.Version == "" {
+		return key.Name + "@" + key.Label
+	}
+	return key.Name + ":" + key.Version
+}
+
+// Verb is what a TF Serving REST request asks of a model
+type Verb string
+
+const (
+	// VerbStatus reads the status of the model versions
+	VerbStatus Verb = "status"
+	// VerbMetadata reads the metadata of a model version
+	VerbMetadata Verb = "metadata"
+	// VerbPredict, VerbClassify and VerbRegress run inference
+	VerbPredict  Verb = "predict"
+	VerbClassify Verb = "classify"
+	VerbRegress  Verb = "regress"
+)
+
+// restPathMatch matches the paths of the TF Serving REST api
+var restPathMatch = regexp.MustCompile(`(?i)^/v1/models/([^/:]+)(?:/versions/([0-9]+)|/labels/([^/:]+))?(?:/(metadata)|:(predict|classify|regress))?$`)
+
+// ParseRESTPath returns the model key and verb of a TF Serving REST
+// request path, such as /v1/models/foo/versions/1:predict. The error
+// wraps ErrInvalidModel if path is not a TF Serving REST path or names an
+// invalid model.
+func ParseRESTPath(path string) (ModelKey, Verb, error) {
+	matches := restPathMatch.FindStringSubmatch(path)
+	if matches == nil {
+		return ModelKey{}, "", &specViolation{"invalid_path", "path", fmt.Sprintf("%q is not a TF Serving REST path", path)}
+	}
+	if violation := validateModelName(matches[1], "path"); violation != nil {
+		return ModelKey{}, "", violation
+	}
+	key := ModelKey{Name: matches[1], Version: matches[2], Label: matches[3]}
+	switch {
+	case matches[4] != "":
+		return key, VerbMetadata, nil
+	case matches[5] != "":
+		return key, Verb(matches[5]), nil
+	}
+	return key, VerbStatus, nil
+}
+
+// FromModelSpec returns the model key of a grpc model spec. The error
+// wraps ErrInvalidModel if modelSpec names an invalid model.
+func FromModelSpec(modelSpec *pb.ModelSpec) (ModelKey, error) {
+	if violation := validateModelSpec(modelSpec); violation != nil {
+		return ModelKey{}, violation
+	}
+	return modelKeyForSpec(modelSpec), nil
+}
+
+// modelKeyForSpec returns the key of the model version requested by
+// modelSpec without validating it
+func modelKeyForSpec(modelSpec *pb.ModelSpec) ModelKey {
+	return ModelKey{
+		Name:    modelSpec.GetName(),
+		Version: strconv.FormatInt(modelSpec.GetVersion().GetValue(), 10),
+		Label:   modelSpec.GetVersionLabel(),
+	}
+}
+
+// modelSpec returns the grpc model spec requesting key
+func (key ModelKey) modelSpec() (*pb.ModelSpec, error) {
+	spec := &pb.ModelSpec{Name: key.Name}
+	switch {
+	case key.Version != "":
+		version, err := strconv.ParseInt(key.Version, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid model version %q: %w", key.Version, ErrInvalidModel)
+		}
+		spec.VersionChoice = &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: version}}
+	case key.Label != "":
+		spec.VersionChoice = &pb.ModelSpec_VersionLabel{VersionLabel: key.Label}
+	}
+	return spec, nil
+}
@@ -0,0 +1,113 @@
+package tfservingproxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+)
+
+func TestParseRESTPath(t *testing.T) {
+	tests := []struct {
+		path string
+		key  ModelKey
+		verb Verb
+	}{
+		{"/v1/models/foo", ModelKey{Name: "foo"}, VerbStatus},
+		{"/v1/models/foo/versions/2", ModelKey{Name: "foo", Version: "2"}, VerbStatus},
+		{"/v1/models/foo/labels/stable", ModelKey{Name: "foo", Label: "stable"}, VerbStatus},
+		{"/v1/models/foo/metadata", ModelKey{Name: "foo"}, VerbMetadata},
+		{"/v1/models/foo/versions/2/metadata", ModelKey{Name: "foo", Version: "2"}, VerbMetadata},
+		{"/v1/models/foo:predict", ModelKey{Name: "foo"}, VerbPredict},
+		{"/v1/models/foo/versions/2:predict", ModelKey{Name: "foo", Version: "2"}, VerbPredict},
+		{"/v1/models/foo/labels/canary:classify", ModelKey{Name: "foo", Label: "canary"}, VerbClassify},
+		{"/v1/models/my-model_1.0/versions/10:regress", ModelKey{Name: "my-model_1.0", Version: "10"}, VerbRegress},
+		{"/V1/Models/Foo/Versions/2:predict", ModelKey{Name: "Foo", Version: "2"}, VerbPredict},
+	}
+	for _, test := range tests {
+		key, verb, err := ParseRESTPath(test.path)
+		if err != nil || key != test.key || verb != test.verb {
+			t.Errorf("%s: expected %+v and %s but got %+v, %s, %v", test.path, test.key, test.verb, key, verb, err)
+		}
+	}
+
+	invalid := []string{
+		"/v1/models/",
+		"/v1/models/foo/versions/latest:predict",
+		"/v1/models/foo/versions/-1",
+		"/v1/models/foo:explain",
+		"/v1/models/foo/versions/2/metadata:predict",
+		"/v1/models/foo/bar",
+		"/v1/models/..:predict",
+		"/v1/models/" + strings.Repeat("a", maxModelNameLength+1),
+		"/v2/models/foo",
+	}
+	for _, path := range invalid {
+		if key, verb, err := ParseRESTPath(path); !errors.Is(err, ErrInvalidModel) {
+			t.Errorf("%s: expected an invalid model error but got %+v, %s, %v", path, key, verb, err)
+		}
+	}
+}
+
+func TestFromModelSpec(t *testing.T) {
+	version := func(v int64) *pb.ModelSpec_Version {
+		return &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: v}}
+	}
+	tests := []struct {
+		spec *pb.ModelSpec
+		key  ModelKey
+	}{
+		{&pb.ModelSpec{Name: "foo"}, ModelKey{Name: "foo", Version: "0"}},
+		{&pb.ModelSpec{Name: "foo", VersionChoice: version(3)}, ModelKey{Name: "foo", Version: "3"}},
+		{&pb.ModelSpec{Name: "foo", VersionChoice: &pb.ModelSpec_VersionLabel{VersionLabel: "stable"}}, ModelKey{Name: "foo", Version: "0", Label: "stable"}},
+	}
+	for _, test := range tests {
+		if key, err := FromModelSpec(test.spec); err != nil || key != test.key {
+			t.Errorf("%v: expected %+v but got %+v, %v", test.spec, test.key, key, err)
+		}
+	}
+
+	for _, spec := range []*pb.ModelSpec{nil, {Name: "my model"}, {Name: "foo", VersionChoice: version(-1)}} {
+		if key, err := FromModelSpec(spec); !errors.Is(err, ErrInvalidModel) {
+			t.Errorf("%v: expected an invalid model error but got %+v, %v", spec, key, err)
+		}
+	}
+}
+
+func TestModelKeyRoundTripsThroughModelSpec(t *testing.T) {
+	for _, key := range []ModelKey{{Name: "foo", Version: "3"}, {Name: "foo", Label: "stable"}} {
+		spec, err := key.modelSpec()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := modelKeyForSpec(spec)
+		if got.Name != key.Name || got.Label != key.Label || (key.Version != "" && got.Version != key.Version) {
+			t.Errorf("Expected %+v back from its model spec but got %+v", key, got)
+		}
+	}
+	if _, err := (ModelKey{Name: "foo", Version: "latest"}).modelSpec(); !errors.Is(err, ErrInvalidModel) {
+		t.Errorf("Expected an invalid model error for a non-numeric version but got %v", err)
+	}
+}
+
+func TestRestProxyRejectsInvalidPaths(t *testing.T) {
+	var routed int
+	proxy := NewRestProxy(func(req *http.Request, model string, version string) error {
+		routed++
+		return ErrUnavailable
+	})
+	for _, path := range []string{"/v1/models/foo:predict", "/v1/models/foo/versions/1:explain", "/v1/models/my%20model/versions/1:predict"} {
+		rw := httptest.NewRecorder()
+		proxy.Serve()(rw, httptest.NewRequest("POST", path, nil))
+		if rw.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400 but got %d", path, rw.Code)
+		}
+	}
+	if routed != 0 {
+		t.Errorf("Expected invalid paths not to be routed but %d were", routed)
+	}
+}
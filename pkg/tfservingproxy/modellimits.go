@@ -0,0 +1,126 @@
+package tfservingproxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var promModelInFlight = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tfservingcache_proxy_model_inflight_requests",
+	Help: "The number of requests currently being handled per model",
+}, []string{"protocol", "model"})
+
+// ModelConcurrencyLimits caps the number of simultaneous requests per model
+type ModelConcurrencyLimits struct {
+	// Default is the limit for models not in PerModel. Zero means unlimited.
+	Default int `mapstructure:"default" yaml:"default"`
+	// PerModel overrides the default limit for specific models
+	PerModel map[string]int `mapstructure:"perModel" yaml:"perModel"`
+	// MaxWait is how long a request may wait for a free slot before it is
+	// rejected. Zero rejects immediately.
+	MaxWait time.Duration `mapstructure:"maxWait" yaml:"maxWait"`
+}
+
+func (limits *ModelConcurrencyLimits) limitFor(modelName string) int {
+	if limit, ok := limits.PerModel[modelName]; ok {
+		return limit
+	}
+	return limits.Default
+}
+
+// WithModelConcurrencyLimits limits the number of concurrent calls per model.
+// Calls over the limit fail with ResourceExhausted.
+func WithModelConcurrencyLimits(limits ModelConcurrencyLimits) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.tunables.modelLimiter = newModelLimiter(limits)
+	}
+}
+
+// modelLimiter holds a semaphore per model while it has calls holding or
+// waiting for a slot. Idle semaphores are dropped, so that calls for
+// unknown model names do not grow the limiter.
+type modelLimiter struct {
+	limits     ModelConcurrencyLimits
+	semaphores map[string]*modelSemaphore
+	mutex      sync.Mutex
+}
+
+// modelSemaphore holds the slots of a model and counts the calls using it
+type modelSemaphore struct {
+	slots chan struct{}
+	users int
+}
+
+func newModelLimiter(limits ModelConcurrencyLimits) *modelLimiter {
+	return &modelLimiter{
+		limits:     limits,
+		semaphores: make(map[string]*modelSemaphore),
+	}
+}
+
+// semaphore returns the semaphore of modelName, or nil if it is unlimited.
+// It must be returned with done.
+func (limiter *modelLimiter) semaphore(modelName string) *modelSemaphore {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	sem, ok := limiter.semaphores[modelName]
+	if !ok {
+		limit := limiter.limits.limitFor(modelName)
+		if limit <= 0 {
+			return nil
+		}
+		sem = &modelSemaphore{slots: make(chan struct{}, limit)}
+		limiter.semaphores[modelName] = sem
+	}
+	sem.users++
+	return sem
+}
+
+// done returns the semaphore of modelName, dropping it once it is unused
+func (limiter *modelLimiter) done(modelName string, sem *modelSemaphore) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	sem.users--
+	if sem.users == 0 {
+		delete(limiter.semaphores, modelName)
+	}
+}
+
+// acquire reserves a slot for modelName. The returned function must be
+// called to release it.
+func (limiter *modelLimiter) acquire(ctx context.Context, modelName string) (func(), error) {
+	sem := limiter.semaphore(modelName)
+	if sem == nil {
+		return func() {}, nil
+	}
+	release := func() {
+		<-sem.slots
+		limiter.done(modelName, sem)
+	}
+	select {
+	case sem.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if limiter.limits.MaxWait > 0 {
+		timer := time.NewTimer(limiter.limits.MaxWait)
+		defer timer.Stop()
+		select {
+		case sem.slots <- struct{}{}:
+			return release, nil
+		case <-ctx.Done():
+			limiter.done(modelName, sem)
+			return nil, status.FromContextError(ctx.Err()).Err()
+		case <-timer.C:
+		}
+	}
+	limiter.done(modelName, sem)
+	return nil, status.Errorf(codes.ResourceExhausted,
+		"too many concurrent requests for model %q (limit %d)", modelName, cap(sem.slots))
+}
@@ -0,0 +1,117 @@
+package tfservingproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/stats"
+)
+
+// GrpcProxyOption configures optional behavior of a GrpcProxy
+type GrpcProxyOption func(*GrpcProxy)
+
+// RestProxyOption configures optional behavior of a RestProxy
+type RestProxyOption func(*RestProxy)
+
+// WithServerOptions passes additional options to the grpc server
+// created by Listen and Serve.
+func WithServerOptions(opts ...grpc.ServerOption) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.serverOptions = append(proxy.serverOptions, opts...)
+	}
+}
+
+// WithServerStatsHandler attaches a stats.Handler to the proxy's grpc server.
+// It sees every RPC received by the proxy.
+func WithServerStatsHandler(h stats.Handler) GrpcProxyOption {
+	return WithServerOptions(grpc.StatsHandler(h))
+}
+
+// WithUpstreamDialOptions adds dial options used by DialUpstream when
+// connecting to TF Serving nodes.
+func WithUpstreamDialOptions(opts ...grpc.DialOption) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.upstreamDialOptions = append(proxy.upstreamDialOptions, opts...)
+	}
+}
+
+// WithUpstreamStatsHandler attaches a stats.Handler to every upstream
+// connection created through DialUpstream.
+func WithUpstreamStatsHandler(h stats.Handler) GrpcProxyOption {
+	return WithUpstreamDialOptions(grpc.WithStatsHandler(h))
+}
+
+// WithServerTLS serves grpc over TLS with config, which must carry a
+// certificate for the proxy
+func WithServerTLS(config *tls.Config) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.serverTLS = config
+	}
+}
+
+// WithMaxMessageSizes sets the largest messages in bytes the proxy
+// receives from callers and sends back to them. Responses from the nodes
+// are received with the same limit as they are sent back with.
+func WithMaxMessageSizes(recv int, send int) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		if recv <= 0 || send <= 0 {
+			proxy.optionErrors = append(proxy.optionErrors, fmt.Errorf("max message sizes must be positive, got %d and %d", recv, send))
+			return
+		}
+		proxy.maxRecvMsgSize, proxy.maxSendMsgSize = recv, send
+	}
+}
+
+// WithDefaultTimeout sets a deadline of timeout on calls that arrive
+// without one
+func WithDefaultTimeout(timeout time.Duration) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		if timeout <= 0 {
+			proxy.optionErrors = append(proxy.optionErrors, fmt.Errorf("default timeout must be positive, got %v", timeout))
+			return
+		}
+		proxy.tunables.defaultTimeout = timeout
+	}
+}
+
+// WithRegistry registers the proxy metrics with registry as well as with
+// the default registry
+func WithRegistry(registry prometheus.Registerer) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		if registry == nil {
+			proxy.optionErrors = append(proxy.optionErrors, errors.New("registry must not be nil"))
+			return
+		}
+		proxy.registry = registry
+	}
+}
+
+// WithLogger logs the events of grpc calls to logger instead of the
+// standard logger
+func WithLogger(logger log.FieldLogger) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		if logger == nil {
+			proxy.optionErrors = append(proxy.optionErrors, errors.New("logger must not be nil"))
+			return
+		}
+		proxy.serverImpl.logger = logger
+	}
+}
+
+// validate returns the first invalid option, or an error if the options
+// of the proxy contradict each other
+func (proxy *GrpcProxy) validate() error {
+	if len(proxy.optionErrors) > 0 {
+		return proxy.optionErrors[0]
+	}
+	if proxy.serverTLS != nil && len(proxy.serverTLS.Certificates) == 0 &&
+		proxy.serverTLS.GetCertificate == nil && proxy.serverTLS.GetConfigForClient == nil {
+		return errors.New("server TLS config has no certificate")
+	}
+	return proxy.tunables.validate(proxy.maxRecvMsgSize)
+}
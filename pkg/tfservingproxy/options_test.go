@@ -0,0 +1,193 @@
+package tfservingproxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/prometheus/client_golang/prometheus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// selfSignedCert creates a certificate for the host name "proxy"
+func selfSignedCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "proxy"},
+		DNSNames:     []string{"proxy"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestGrpcProxyServerTLS(t *testing.T) {
+	cert, pool := selfSignedCert(t)
+	upstream := tfservingtest.NewGRPCNode(t, "upstream").Dial(t)
+	proxy := NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return upstream, nil
+	}, WithServerTLS(&tls.Config{Certificates: []tls.Certificate{cert}}))
+	lis := bufconn.Listen(1024 * 1024)
+	go proxy.Serve(lis)
+	defer proxy.Close()
+
+	dial := func(opt grpc.DialOption) error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		conn, err := grpc.DialContext(ctx, "proxy", bufDial(lis), opt)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = pb.NewPredictionServiceClient(conn).Predict(ctx, &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}})
+		return err
+	}
+	if err := dial(grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: pool, ServerName: "proxy"}))); err != nil {
+		t.Errorf("Expected the TLS call to succeed but got %v", err)
+	}
+	if err := dial(grpc.WithInsecure()); err == nil {
+		t.Error("Expected a plaintext call to a TLS proxy to fail")
+	}
+}
+
+func TestGrpcProxyMaxMessageSizes(t *testing.T) {
+	upstream := tfservingtest.NewGRPCNode(t, "upstream", tfservingtest.WithPredict(func(_ context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+		return &pb.PredictResponse{ModelSpec: &pb.ModelSpec{Name: strings.Repeat("x", len(req.GetOutputFilter()[0]))}}, nil
+	})).Dial(t)
+	client := startProxy(t, NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return upstream, nil
+	}, WithMaxMessageSizes(4096, 1024)))
+	predict := func(requestPadding, responseSize int) error {
+		_, err := client.Predict(context.Background(), &pb.PredictRequest{
+			ModelSpec:    &pb.ModelSpec{Name: "foo", SignatureName: strings.Repeat("x", requestPadding)},
+			OutputFilter: []string{strings.Repeat("x", responseSize)},
+		})
+		return err
+	}
+
+	if err := predict(0, 100); err != nil {
+		t.Fatalf("Expected a small call to pass but got %v", err)
+	}
+	if err := predict(5000, 100); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected a request over the receive limit to fail with ResourceExhausted but got %v", err)
+	}
+	if err := predict(0, 800); err != nil {
+		t.Errorf("Expected a response under the send limit to pass but got %v", err)
+	}
+	if err := predict(0, 2000); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected a response over the send limit to fail with ResourceExhausted but got %v", err)
+	}
+}
+
+func TestGrpcProxyDefaultTimeout(t *testing.T) {
+	deadlines := make(chan time.Duration, 2)
+	upstream := tfservingtest.NewGRPCNode(t, "upstream", tfservingtest.WithPredict(func(ctx context.Context, _ *pb.PredictRequest) (*pb.PredictResponse, error) {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			deadlines <- 0
+		} else {
+			deadlines <- time.Until(deadline)
+		}
+		return &pb.PredictResponse{}, nil
+	})).Dial(t)
+	client := startProxy(t, NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return upstream, nil
+	}, WithDefaultTimeout(5*time.Second)))
+
+	if _, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}); err != nil {
+		t.Fatal(err)
+	}
+	if remaining := <-deadlines; remaining <= 0 || remaining > 5*time.Second {
+		t.Errorf("Expected the default timeout on a call without deadline but got %v", remaining)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := client.Predict(ctx, &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}); err != nil {
+		t.Fatal(err)
+	}
+	if remaining := <-deadlines; remaining <= 5*time.Second {
+		t.Errorf("Expected the deadline of the caller to be kept but got %v", remaining)
+	}
+}
+
+func TestGrpcProxyRegistryAndLogger(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	logger, hook := logtest.NewNullLogger()
+	client := startProxy(t, NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return nil, nil
+	}, WithRegistry(registry), WithLogger(logger)))
+
+	_, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo/bar"}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Expected InvalidArgument but got %v", err)
+	}
+	if entry := hook.LastEntry(); entry == nil || !strings.Contains(entry.Message, "Rejecting invalid model spec") {
+		t.Errorf("Expected the rejection to be logged to the logger but got %v", entry)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, family := range families {
+		found = found || family.GetName() == "tfservingcache_proxy_validation_failures_total"
+	}
+	if !found {
+		t.Error("Expected the proxy metrics in the registry")
+	}
+}
+
+func TestGrpcProxyRejectsContradictoryOptions(t *testing.T) {
+	cases := map[string][]GrpcProxyOption{
+		"zero message size":      {WithMaxMessageSizes(0, 1024)},
+		"negative timeout":       {WithDefaultTimeout(-time.Second)},
+		"nil registry":           {WithRegistry(nil)},
+		"nil logger":             {WithLogger(nil)},
+		"TLS without cert":       {WithServerTLS(&tls.Config{})},
+		"model limit over max":   {WithMaxMessageSizes(1024, 1024), WithModelMaxRequestSizes(map[string]int{"foo": 2048})},
+		"timeout within minimum": {WithDefaultTimeout(time.Second), WithDeadlineBudget(DeadlineBudget{MinRemaining: time.Second})},
+		"zero idle timeout":      {WithUpstreamIdleTimeout(0)},
+		"negative sample rate":   {WithRequestLog(RequestLogConfig{SampleRate: -0.5})},
+		"negative backoff":       {WithUpstreamBackoff(UpstreamBackoff{BaseDelay: -time.Second})},
+		"backoff over max delay": {WithUpstreamBackoff(UpstreamBackoff{BaseDelay: time.Minute, MaxDelay: time.Second})},
+	}
+	for name, opts := range cases {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("Expected the options to be rejected")
+				}
+			}()
+			NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) { return nil, nil }, opts...)
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package tfservingproxy
+
+import (
+	"context"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// payloadBuckets range from 64 bytes to 256 MiB
+var payloadBuckets = prometheus.ExponentialBuckets(64, 4, 12)
+
+var promRequestSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "tfservingcache_proxy_request_size_bytes",
+	Help:    "The size of grpc request messages",
+	Buckets: payloadBuckets,
+}, []string{"method"})
+var promResponseSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "tfservingcache_proxy_response_size_bytes",
+	Help:    "The size of grpc response messages",
+	Buckets: payloadBuckets,
+}, []string{"method"})
+
+// WithModelMaxRequestSizes rejects calls to the models in limits whose
+// request is larger than the model's limit in bytes, before they are
+// forwarded. Other models are only bound by the server's maximum message
+// size.
+func WithModelMaxRequestSizes(limits map[string]int) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.tunables.maxRequestSizes = limits
+	}
+}
+
+// payloadInterceptor records the size of the messages of each call and
+// enforces the request size limit of the model
+func (server *proxyServiceServer) payloadInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var size int
+	if msg, ok := req.(proto.Message); ok {
+		size = proto.Size(msg)
+		promRequestSize.WithLabelValues(info.FullMethod).Observe(float64(size))
+	}
+	if specReq, ok := req.(modelSpecRequest); ok {
+		modelName := specReq.GetModelSpec().GetName()
+		if limit, ok := server.settings().maxRequestSizes[modelName]; ok && size > limit {
+			server.loggerFor(ctx).Warnf("Rejecting request of %d bytes to model %s", size, modelName)
+			return nil, status.Errorf(codes.ResourceExhausted, "request of %d bytes exceeds the limit of %d bytes for model %s", size, limit, modelName)
+		}
+	}
+	res, err := handler(ctx, req)
+	if msg, ok := res.(proto.Message); ok && err == nil {
+		promResponseSize.WithLabelValues(info.FullMethod).Observe(float64(proto.Size(msg)))
+	}
+	return res, err
+}
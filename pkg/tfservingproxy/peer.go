@@ -0,0 +1,103 @@
+package tfservingproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// PeerIdentity is who a request comes from, as far as the connection
+// tells
+type PeerIdentity struct {
+	// Address is the address of the client, empty if unknown
+	Address string
+	// Subject is the subject of the verified client certificate. It is
+	// empty unless the server runs with TLS client auth.
+	Subject string
+	// SANs are the DNS names, IP addresses, URIs and email addresses of
+	// the verified client certificate
+	SANs []string
+}
+
+// PeerIdentityFromContext returns the identity of the client of the grpc
+// call of ctx. Authenticators and ClientKeys can key off it. Calls without
+// a peer return an empty PeerIdentity.
+func PeerIdentityFromContext(ctx context.Context) PeerIdentity {
+	var identity PeerIdentity
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return identity
+	}
+	if p.Addr != nil {
+		identity.Address = p.Addr.String()
+	}
+	if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+		identity.Subject, identity.SANs = verifiedIdentity(info.State)
+	}
+	return identity
+}
+
+// restPeerIdentity returns the identity of the client of req
+func restPeerIdentity(req *http.Request) PeerIdentity {
+	identity := PeerIdentity{Address: req.RemoteAddr}
+	if req.TLS != nil {
+		identity.Subject, identity.SANs = verifiedIdentity(*req.TLS)
+	}
+	return identity
+}
+
+// verifiedIdentity returns the subject and SANs of the client certificate
+// of state, if it was verified
+func verifiedIdentity(state tls.ConnectionState) (string, []string) {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", nil
+	}
+	return state.VerifiedChains[0][0].Subject.String(), certificateSANs(state.VerifiedChains[0][0])
+}
+
+func certificateSANs(cert *x509.Certificate) []string {
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	return append(sans, cert.EmailAddresses...)
+}
+
+// logFields returns the log fields of identity, leaving out those that
+// are unknown
+func (identity PeerIdentity) logFields() log.Fields {
+	fields := log.Fields{}
+	if identity.Address != "" {
+		fields[logFieldPeer] = identity.Address
+	}
+	if identity.Subject != "" {
+		fields[logFieldPeerSubject] = identity.Subject
+	}
+	if len(identity.SANs) > 0 {
+		fields[logFieldPeerSANs] = strings.Join(identity.SANs, ",")
+	}
+	return fields
+}
+
+// ClientKeyCertificate keys clients by the subject of their verified TLS
+// client certificate. Clients without one share a quota.
+func ClientKeyCertificate() ClientKey {
+	return ClientKey{
+		GRPC: func(ctx context.Context) string {
+			return PeerIdentityFromContext(ctx).Subject
+		},
+		REST: func(req *http.Request) string {
+			return restPeerIdentity(req).Subject
+		},
+	}
+}
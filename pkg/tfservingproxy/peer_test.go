@@ -0,0 +1,163 @@
+package tfservingproxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// peerHooks records the peer of the resolved calls
+type peerHooks struct {
+	NopHooks
+	peers chan PeerIdentity
+}
+
+func (h *peerHooks) OnResolve(ctx context.Context, info RequestInfo) {
+	h.peers <- info.Peer
+}
+
+// clientCert creates a CA and a client certificate for "client-a" signed
+// by it
+func clientCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "clients"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "client-a", Organization: []string{"batch"}},
+		DNSNames:     []string{"client-a.internal"},
+		URIs:         []*url.URL{{Scheme: "spiffe", Host: "cluster", Path: "/client-a"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestPeerIdentityWithoutPeer(t *testing.T) {
+	identity := PeerIdentityFromContext(context.Background())
+	if !reflect.DeepEqual(identity, PeerIdentity{}) || len(identity.logFields()) != 0 {
+		t.Errorf("Expected no identity without a peer but got %+v", identity)
+	}
+	if key := ClientKeyCertificate().GRPC(context.Background()); key != "" {
+		t.Errorf("Expected no client key without a peer but got %q", key)
+	}
+}
+
+func TestPeerIdentityWithoutTLS(t *testing.T) {
+	hooks := &peerHooks{peers: make(chan PeerIdentity, 1)}
+	harness := tfservingtest.NewHarness(t)
+	client := harness.Serve(NewGrpcProxy(harness.ClientProvider, WithHooks(hooks)))
+	if _, err := client.Predict(context.Background(), predictVersion("foo", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if identity := <-hooks.peers; identity.Address != "bufconn" || identity.Subject != "" || identity.SANs != nil {
+		t.Errorf("Expected only the address of a plaintext peer but got %+v", identity)
+	}
+}
+
+func TestPeerIdentityFromClientCertificate(t *testing.T) {
+	serverCert, serverPool := selfSignedCert(t)
+	cert, clientCAs := clientCert(t)
+	upstream := tfservingtest.NewGRPCNode(t, "upstream").Dial(t)
+	logger, logs := logtest.NewNullLogger()
+	hooks := &peerHooks{peers: make(chan PeerIdentity, 1)}
+	keys := make(chan string, 1)
+	proxy := NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return upstream, nil
+	}, WithServerTLS(&tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}), WithHooks(hooks), WithLogger(logger), WithAuthenticator(func(ctx context.Context, _ string, modelName string) error {
+		keys <- ClientKeyCertificate().GRPC(ctx)
+		if modelName == "secret" {
+			return ErrUnauthenticated
+		}
+		return nil
+	}))
+	lis := bufconn.Listen(1024 * 1024)
+	go proxy.Serve(lis)
+	defer proxy.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, "proxy", bufDial(lis), grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+		RootCAs:      serverPool,
+		ServerName:   "proxy",
+		Certificates: []tls.Certificate{cert},
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := pb.NewPredictionServiceClient(conn)
+	subject, sans := "CN=client-a,O=batch", []string{"client-a.internal", "spiffe://cluster/client-a"}
+	if _, err := client.Predict(ctx, predictVersion("foo", 1)); err != nil {
+		t.Fatal(err)
+	}
+	if key := <-keys; key != subject {
+		t.Errorf("Expected the authenticator to see subject %q but got %q", subject, key)
+	}
+	if identity := <-hooks.peers; identity.Address != "bufconn" || identity.Subject != subject || !reflect.DeepEqual(identity.SANs, sans) {
+		t.Errorf("Expected the hooks to see the client certificate but got %+v", identity)
+	}
+
+	if _, err := client.Predict(ctx, predictVersion("secret", 1)); err == nil {
+		t.Fatal("Expected the authenticator to reject the call")
+	}
+	<-keys
+	entries := logs.AllEntries()
+	if len(entries) != 1 {
+		t.Fatalf("Expected the rejection to be logged but got %d entries", len(entries))
+	}
+	checkLogFields(t, entries, map[string]interface{}{
+		logFieldPeer:        "bufconn",
+		logFieldPeerSubject: subject,
+		logFieldPeerSANs:    "client-a.internal,spiffe://cluster/client-a",
+	})
+}
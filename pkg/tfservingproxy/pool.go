@@ -0,0 +1,224 @@
+package tfservingproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var promPoolConns = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tfservingcache_proxy_upstream_pool_connections",
+	Help: "The number of pooled upstream grpc connections per node address, or per model for connections balancing over nodes",
+}, []string{"target"})
+var promPoolUsage = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "tfservingcache_proxy_upstream_pool_usage_connections",
+	Help: "The number of pooled upstream grpc connections that are idle or have calls in flight",
+}, []string{"use"})
+var promPoolLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_upstream_pool_lookups_total",
+	Help: "The total number of times a pooled upstream grpc connection was reused or had to be dialed",
+}, []string{"result"})
+var promPoolEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_upstream_pool_evictions_total",
+	Help: "The total number of pooled upstream grpc connections closed before shutdown",
+}, []string{"reason"})
+var promRESTConns = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_rest_upstream_connections_total",
+	Help: "The total number of REST requests sent upstream on a reused or new connection, or rejected at the connection limit of their node",
+}, []string{"result"})
+
+// Label values of the pool metrics
+const (
+	poolIdle          = "idle"
+	poolInUse         = "in_use"
+	poolReused        = "reused"
+	poolDialed        = "dialed"
+	evictIdle         = "idle"
+	evictSingleTarget = "single_target"
+	restReused        = "reused"
+	restNewConn       = "new"
+	restRejected      = "rejected"
+)
+
+// balancedPoolPrefix prefixes the model label of balanced connections on
+// promPoolConns
+const balancedPoolPrefix = "balanced:"
+
+// poolConns counts the pooled connections per label of promPoolConns, so
+// the series of a label is deleted with its last connection
+var poolConns = struct {
+	counts map[string]int
+	mutex  sync.Mutex
+}{counts: make(map[string]int)}
+
+// countPoolConn adds delta to the pooled connections of label
+func countPoolConn(label string, delta int) {
+	poolConns.mutex.Lock()
+	defer poolConns.mutex.Unlock()
+	count := poolConns.counts[label] + delta
+	if count <= 0 {
+		delete(poolConns.counts, label)
+		promPoolConns.DeleteLabelValues(label)
+		return
+	}
+	poolConns.counts[label] = count
+	promPoolConns.WithLabelValues(label).Set(float64(count))
+}
+
+// defaultUpstreamIdleTimeout is how long pooled upstream connections stay
+// open without calls by default
+const defaultUpstreamIdleTimeout = 10 * time.Minute
+
+// WithUpstreamIdleTimeout closes pooled upstream connections that have had
+// no calls for timeout. They are dialed again when needed. The default is
+// 10 minutes.
+func WithUpstreamIdleTimeout(timeout time.Duration) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		if timeout <= 0 {
+			proxy.optionErrors = append(proxy.optionErrors, fmt.Errorf("upstream idle timeout must be positive, got %v", timeout))
+			return
+		}
+		proxy.serverImpl.conns.idleTimeout = timeout
+	}
+}
+
+// newCallCounters creates the counters of a new pooled connection to
+// target, counted under label on promPoolConns
+func newCallCounters(target string, label string) *callCounters {
+	countPoolConn(label, 1)
+	promPoolUsage.WithLabelValues(poolIdle).Inc()
+	return &callCounters{target: target, label: label, lastUsed: time.Now()}
+}
+
+// begin marks a call as started on the connection
+func (counters *callCounters) begin() {
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+	counters.active++
+	if counters.active == 1 && !counters.closed {
+		promPoolUsage.WithLabelValues(poolIdle).Dec()
+		promPoolUsage.WithLabelValues(poolInUse).Inc()
+	}
+}
+
+// end marks a call as done on the connection
+func (counters *callCounters) end() {
+	counters.mutex.Lock()
+	counters.active--
+	counters.lastUsed = time.Now()
+	var onIdle func()
+	if counters.active == 0 && !counters.closed {
+		promPoolUsage.WithLabelValues(poolInUse).Dec()
+		promPoolUsage.WithLabelValues(poolIdle).Inc()
+		onIdle, counters.onIdle = counters.onIdle, nil
+	}
+	counters.mutex.Unlock()
+	if onIdle != nil {
+		onIdle()
+	}
+}
+
+// touch marks the connection as used, so it is not evicted right after
+// being handed out
+func (counters *callCounters) touch() {
+	promPoolLookups.WithLabelValues(poolReused).Inc()
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+	counters.lastUsed = time.Now()
+}
+
+// closeWhenIdle calls close once the connection has no calls in flight
+func (counters *callCounters) closeWhenIdle(close func()) {
+	counters.mutex.Lock()
+	if counters.active > 0 {
+		counters.onIdle = close
+		counters.mutex.Unlock()
+		return
+	}
+	counters.mutex.Unlock()
+	close()
+}
+
+// idleFor returns for how long the connection has had no calls at now, or
+// false if it has calls in flight
+func (counters *callCounters) idleFor(now time.Time) (time.Duration, bool) {
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+	return now.Sub(counters.lastUsed), counters.active == 0
+}
+
+// release removes the connection from the pool metrics when it is closed
+func (counters *callCounters) release() {
+	counters.mutex.Lock()
+	defer counters.mutex.Unlock()
+	if counters.closed {
+		return
+	}
+	counters.closed = true
+	countPoolConn(counters.label, -1)
+	if counters.active > 0 {
+		promPoolUsage.WithLabelValues(poolInUse).Dec()
+	} else {
+		promPoolUsage.WithLabelValues(poolIdle).Dec()
+	}
+}
+
+// evictIdle closes the connections that have had no calls for the idle
+// timeout at now
+func (manager *connManager) evictIdle(now time.Time) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	for address, conn := range manager.conns {
+		if idle, ok := conn.calls.idleFor(now); ok && idle >= manager.idleTimeout {
+			log.Debugf("Closing grpc connection %s after %v idle", address, idle)
+			delete(manager.conns, address)
+			conn.calls.release()
+			conn.Close()
+			promPoolEvictions.WithLabelValues(evictIdle).Inc()
+		}
+	}
+	for key, balanced := range manager.balanced {
+		if idle, ok := balanced.calls.idleFor(now); ok && idle >= manager.idleTimeout {
+			log.Debugf("Closing balanced grpc connection for model %s after %v idle", key, idle)
+			delete(manager.balanced, key)
+			balanced.calls.release()
+			balanced.conn.Close()
+			promPoolEvictions.WithLabelValues(evictIdle).Inc()
+		}
+	}
+}
+
+// evictIdleLoop evicts idle connections until the manager is closed
+func (manager *connManager) evictIdleLoop() {
+	ticker := time.NewTicker(manager.idleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-manager.stopEvicting:
+			return
+		case now := <-ticker.C:
+			manager.evictIdle(now)
+		}
+	}
+}
+
+// traceConnReuse counts whether REST requests to upstream nodes reuse a
+// connection
+func traceConnReuse(req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				promRESTConns.WithLabelValues(restReused).Inc()
+			} else {
+				promRESTConns.WithLabelValues(restNewConn).Inc()
+			}
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
@@ -0,0 +1,158 @@
+package tfservingproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/grpc"
+)
+
+// poolConnSeries returns the pooled connections of label, or false if the
+// label has no series
+func poolConnSeries(label string) (float64, bool) {
+	metrics := make(chan prometheus.Metric, 16)
+	go func() {
+		promPoolConns.Collect(metrics)
+		close(metrics)
+	}()
+	var value float64
+	var found bool
+	for metric := range metrics {
+		m := &dto.Metric{}
+		metric.Write(m)
+		for _, pair := range m.GetLabel() {
+			if pair.GetValue() == label {
+				value, found = m.GetGauge().GetValue(), true
+			}
+		}
+	}
+	return value, found
+}
+
+func TestUpstreamPoolMetrics(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	upstream := tfservingtest.NewGRPCNode(t, "pool-node", tfservingtest.WithPredict(func(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+		if req.GetModelSpec().GetName() == "slow" {
+			started <- struct{}{}
+			<-release
+		}
+		return &pb.PredictResponse{}, nil
+	}))
+	proxy := NewGrpcProxyWithResolver(ResolverFunc(func(ctx context.Context, key ModelKey) (Resolution, error) {
+		return Resolution{Targets: []Target{{Address: upstream.Address()}}}, nil
+	}), WithUpstreamDialOptions(upstream.DialOption(), grpc.WithInsecure()), WithUpstreamIdleTimeout(time.Minute))
+	client := startProxy(t, proxy)
+
+	idle, inUse := promPoolUsage.WithLabelValues(poolIdle), promPoolUsage.WithLabelValues(poolInUse)
+	dialed, reused := promPoolLookups.WithLabelValues(poolDialed), promPoolLookups.WithLabelValues(poolReused)
+	idleBefore, inUseBefore := testutil.ToFloat64(idle), testutil.ToFloat64(inUse)
+	dialedBefore, reusedBefore := testutil.ToFloat64(dialed), testutil.ToFloat64(reused)
+	evictionsBefore := testutil.ToFloat64(promPoolEvictions.WithLabelValues(evictIdle))
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, _ := poolConnSeries(upstream.Address()); v != 1 {
+		t.Errorf("Expected one pooled connection to the node but got %v", v)
+	}
+	if d, r := testutil.ToFloat64(dialed)-dialedBefore, testutil.ToFloat64(reused)-reusedBefore; d != 1 || r != 1 {
+		t.Errorf("Expected one dialed and one reused lookup but got %v and %v", d, r)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "slow"}})
+		done <- err
+	}()
+	<-started
+	if i, u := testutil.ToFloat64(idle)-idleBefore, testutil.ToFloat64(inUse)-inUseBefore; i != 0 || u != 1 {
+		t.Errorf("Expected the connection to be in use during a call but got idle %+v, in use %+v", i, u)
+	}
+	proxy.serverImpl.conns.evictIdle(time.Now().Add(time.Hour))
+	if v, _ := poolConnSeries(upstream.Address()); v != 1 {
+		t.Errorf("Expected a connection with calls in flight to be kept but got %v connections", v)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if i, u := testutil.ToFloat64(idle)-idleBefore, testutil.ToFloat64(inUse)-inUseBefore; i != 1 || u != 0 {
+		t.Errorf("Expected the connection to be idle after the call but got idle %+v, in use %+v", i, u)
+	}
+
+	proxy.serverImpl.conns.evictIdle(time.Now().Add(time.Hour))
+	if v, ok := poolConnSeries(upstream.Address()); ok {
+		t.Errorf("Expected the idle connection to be evicted with its series but got %v connections", v)
+	}
+	if e := testutil.ToFloat64(promPoolEvictions.WithLabelValues(evictIdle)) - evictionsBefore; e != 1 {
+		t.Errorf("Expected one idle eviction but got %v", e)
+	}
+	if i := testutil.ToFloat64(idle) - idleBefore; i != 0 {
+		t.Errorf("Expected the evicted connection to leave the idle gauge but got %v", i)
+	}
+
+	if _, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}); err != nil {
+		t.Fatal(err)
+	}
+	if d := testutil.ToFloat64(dialed) - dialedBefore; d != 2 {
+		t.Errorf("Expected the evicted connection to be dialed again but got %v dials", d)
+	}
+	proxy.Close()
+	if v, ok := poolConnSeries(upstream.Address()); ok {
+		t.Errorf("Expected closing the proxy to delete the series of the node but got %v connections", v)
+	}
+	if i := testutil.ToFloat64(idle) - idleBefore; i != 0 {
+		t.Errorf("Expected closing the proxy to empty the idle gauge but got %v", i)
+	}
+}
+
+func TestRESTUpstreamConnectionReuse(t *testing.T) {
+	upstream := tfservingtest.NewRESTNode(t, "upstream")
+	upstream.Respond("foo", "1", http.StatusOK, `{"predictions": [1]}`)
+	proxy := NewRestProxy(func(req *http.Request, model string, _ string) error {
+		req.URL.Scheme, req.URL.Host = upstream.URL().Scheme, upstream.URL().Host
+		return nil
+	})
+	reused, fresh := promRESTConns.WithLabelValues(restReused), promRESTConns.WithLabelValues(restNewConn)
+	reusedBefore, freshBefore := testutil.ToFloat64(reused), testutil.ToFloat64(fresh)
+
+	for i := 0; i < 3; i++ {
+		rw := httptest.NewRecorder()
+		proxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/foo/versions/1:predict", nil))
+		if rw.Code != http.StatusOK {
+			t.Fatalf("Expected 200 but got %d", rw.Code)
+		}
+	}
+	if r, n := testutil.ToFloat64(reused)-reusedBefore, testutil.ToFloat64(fresh)-freshBefore; r+n != 3 || r < 1 {
+		t.Errorf("Expected three upstream requests with connections reused but got %v reused, %v new", r, n)
+	}
+}
+
+func TestDroppedConnectionClosesOnceIdle(t *testing.T) {
+	counters := newCallCounters("dropped", "dropped")
+	defer counters.release()
+	counters.begin()
+	closed := 0
+	counters.closeWhenIdle(func() { closed++ })
+	if closed != 0 {
+		t.Fatal("Expected a connection with calls in flight to stay open")
+	}
+	counters.end()
+	if closed != 1 {
+		t.Errorf("Expected the connection to be closed once idle but got %d closes", closed)
+	}
+	counters.closeWhenIdle(func() { closed++ })
+	if closed != 2 {
+		t.Errorf("Expected an idle connection to be closed right away but got %d closes", closed)
+	}
+}
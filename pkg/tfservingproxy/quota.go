@@ -0,0 +1,261 @@
+package tfservingproxy
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+var promQuotaRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_client_quota_rejected_total",
+	Help: "The total number of requests rejected by the per-client quota, by client for clients with their own limit and other for the rest",
+}, []string{"protocol", "client"})
+var promQuotaClients = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "tfservingcache_proxy_client_quota_clients",
+	Help: "The number of clients whose quota is tracked",
+})
+
+// errClientQuota is the error of requests over the client quota
+var errClientQuota = errors.New("client quota exceeded")
+
+// quotaOtherClients is the client label of clients without their own limit
+const quotaOtherClients = "other"
+
+// Defaults of ClientQuotaConfig
+const (
+	defaultQuotaIdleTimeout = 10 * time.Minute
+	defaultQuotaMaxClients  = 10000
+)
+
+// ClientKey extracts the key identifying the client of a grpc call or a
+// REST request. Requests with an empty key share a single quota.
+type ClientKey struct {
+	GRPC func(ctx context.Context) string
+	REST func(req *http.Request) string
+}
+
+// ClientKeyPrincipal keys grpc calls by the principal that the
+// Authenticator recorded with SetPrincipal. REST requests are not
+// authenticated by the proxy and are keyed by their credentials, read
+// like CredentialsFromContext from the Authorization and X-Api-Key
+// headers.
+func ClientKeyPrincipal() ClientKey {
+	return ClientKey{
+		GRPC: PrincipalFromContext,
+		REST: func(req *http.Request) string {
+			return CredentialsFromContext(metadata.NewIncomingContext(req.Context(), metadata.MD{
+				"authorization": req.Header["Authorization"],
+				"x-api-key":     req.Header["X-Api-Key"],
+			}))
+		},
+	}
+}
+
+// ClientKeyHeader keys clients by the header name, read from the grpc
+// metadata of calls
+func ClientKeyHeader(name string) ClientKey {
+	return ClientKey{
+		GRPC: func(ctx context.Context) string {
+			md, _ := metadata.FromIncomingContext(ctx)
+			if values := md.Get(name); len(values) > 0 {
+				return values[0]
+			}
+			return ""
+		},
+		REST: func(req *http.Request) string {
+			return req.Header.Get(name)
+		},
+	}
+}
+
+// ClientKeyPeer keys clients by the IP address they connect from.
+// Forwarding headers are ignored, so clients behind a shared proxy share
+// a quota.
+func ClientKeyPeer() ClientKey {
+	return ClientKey{
+		GRPC: func(ctx context.Context) string {
+			if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+				return hostOf(p.Addr.String())
+			}
+			return ""
+		},
+		REST: func(req *http.Request) string {
+			return hostOf(req.RemoteAddr)
+		},
+	}
+}
+
+// hostOf strips the port from address
+func hostOf(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+// ClientQuotaConfig configures ClientQuotas
+type ClientQuotaConfig struct {
+	// Default is the limit of clients without their own. A non-positive
+	// PerSecond leaves them unlimited.
+	Default RateLimit
+	// PerClient are the limits of clients by key
+	PerClient map[string]RateLimit
+	// HashKeys logs client keys as a hash instead of as is, for keys that
+	// are credentials
+	HashKeys bool
+	// IdleTimeout forgets clients without requests for this long, 10
+	// minutes by default. It should exceed the time to refill a bucket.
+	IdleTimeout time.Duration
+	// MaxClients is the number of clients tracked at most, 10000 by
+	// default. The least recently seen clients are forgotten first.
+	MaxClients int
+}
+
+// ClientQuotas limits the rate of requests per client across all models.
+// ClientQuotas shared by a GrpcProxy and a RestProxy enforce a single
+// budget per client across both protocols.
+type ClientQuotas struct {
+	key     ClientKey
+	config  ClientQuotaConfig
+	clients map[string]*list.Element
+	// order has the most recently seen clients first
+	order *list.List
+	now   func() time.Time
+	mutex sync.Mutex
+}
+
+type clientBucket struct {
+	key      string
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// NewClientQuotas creates ClientQuotas for the clients identified by key
+func NewClientQuotas(key ClientKey, config ClientQuotaConfig) *ClientQuotas {
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = defaultQuotaIdleTimeout
+	}
+	if config.MaxClients <= 0 {
+		config.MaxClients = defaultQuotaMaxClients
+	}
+	return &ClientQuotas{
+		key:     key,
+		config:  config,
+		clients: make(map[string]*list.Element),
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+// WithClientQuotas rejects calls of clients over their quota with
+// ResourceExhausted and a RetryInfo detail
+func WithClientQuotas(quotas *ClientQuotas) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.serverImpl.clientQuotas = quotas
+	}
+}
+
+// WithRESTClientQuotas rejects requests of clients over their quota with
+// 429 Too Many Requests and a Retry-After header
+func WithRESTClientQuotas(quotas *ClientQuotas) RestProxyOption {
+	return func(proxy *RestProxy) {
+		proxy.clientQuotas = quotas
+	}
+}
+
+// allowGrpc takes a token for a grpc call. If none is left it returns
+// false, the client as it may be logged and how long until a token is
+// available.
+func (quotas *ClientQuotas) allowGrpc(ctx context.Context) (bool, string, time.Duration) {
+	if quotas.key.GRPC == nil {
+		return true, "", 0
+	}
+	return quotas.allow("grpc", quotas.key.GRPC(ctx))
+}
+
+// allowREST takes a token for a REST request like allowGrpc
+func (quotas *ClientQuotas) allowREST(req *http.Request) (bool, string, time.Duration) {
+	if quotas.key.REST == nil {
+		return true, "", 0
+	}
+	return quotas.allow("rest", quotas.key.REST(req))
+}
+
+func (quotas *ClientQuotas) allow(protocol string, client string) (bool, string, time.Duration) {
+	limit, own := quotas.config.PerClient[client]
+	if !own {
+		limit = quotas.config.Default
+	}
+	if limit.PerSecond <= 0 {
+		return true, "", 0
+	}
+	reservation := quotas.bucket(client, limit).Reserve()
+	delay := time.Second
+	if reservation.OK() {
+		if delay = reservation.Delay(); delay == 0 {
+			return true, "", 0
+		}
+		reservation.Cancel()
+	}
+	logged := quotas.loggedKey(client)
+	label := quotaOtherClients
+	if own {
+		label = logged
+	}
+	promQuotaRejected.WithLabelValues(protocol, label).Inc()
+	return false, logged, delay
+}
+
+// bucket returns the bucket of client, creating it with limit if the
+// client is new and forgetting idle clients
+func (quotas *ClientQuotas) bucket(client string, limit RateLimit) *rate.Limiter {
+	quotas.mutex.Lock()
+	defer quotas.mutex.Unlock()
+	now := quotas.now()
+	for back := quotas.order.Back(); back != nil; back = quotas.order.Back() {
+		if now.Sub(back.Value.(*clientBucket).lastSeen) < quotas.config.IdleTimeout {
+			break
+		}
+		quotas.remove(back)
+	}
+	if element, ok := quotas.clients[client]; ok {
+		bucket := element.Value.(*clientBucket)
+		bucket.lastSeen = now
+		quotas.order.MoveToFront(element)
+		return bucket.limiter
+	}
+	for quotas.order.Len() >= quotas.config.MaxClients {
+		quotas.remove(quotas.order.Back())
+	}
+	bucket := &clientBucket{key: client, limiter: rate.NewLimiter(rate.Limit(limit.PerSecond), limit.Burst), lastSeen: now}
+	quotas.clients[client] = quotas.order.PushFront(bucket)
+	promQuotaClients.Inc()
+	return bucket.limiter
+}
+
+func (quotas *ClientQuotas) remove(element *list.Element) {
+	quotas.order.Remove(element)
+	delete(quotas.clients, element.Value.(*clientBucket).key)
+	promQuotaClients.Dec()
+}
+
+// loggedKey returns client as it may appear in logs and metrics
+func (quotas *ClientQuotas) loggedKey(client string) string {
+	if !quotas.config.HashKeys {
+		return client
+	}
+	sum := sha256.Sum256([]byte(client))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,114 @@
+package tfservingproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestClientQuotasForgetIdleClients(t *testing.T) {
+	quotas := NewClientQuotas(ClientKey{}, ClientQuotaConfig{
+		Default:     RateLimit{PerSecond: 1, Burst: 1},
+		IdleTimeout: time.Minute,
+		MaxClients:  2,
+	})
+	now := time.Now()
+	quotas.now = func() time.Time { return now }
+
+	if ok, _, _ := quotas.allow("rest", "a"); !ok {
+		t.Fatal("Expected the first request of a client to be allowed")
+	}
+	if ok, _, delay := quotas.allow("rest", "a"); ok || delay <= 0 {
+		t.Errorf("Expected a client over its quota to be rejected with a delay but got %v, %v", ok, delay)
+	}
+	quotas.allow("rest", "b")
+	quotas.allow("rest", "c")
+	if len(quotas.clients) != 2 || quotas.clients["a"] != nil {
+		t.Errorf("Expected the least recently seen client to be forgotten at the limit but got %v", quotas.clients)
+	}
+
+	now = now.Add(2 * time.Minute)
+	quotas.allow("rest", "d")
+	if len(quotas.clients) != 1 || quotas.clients["d"] == nil {
+		t.Errorf("Expected idle clients to be forgotten but got %v", quotas.clients)
+	}
+}
+
+func TestRESTClientQuotas(t *testing.T) {
+	upstream := tfservingtest.NewRESTNode(t, "upstream")
+	upstream.Respond("foo", "1", http.StatusOK, `{"predictions": [1]}`)
+	quotas := NewClientQuotas(ClientKeyHeader("X-Client"), ClientQuotaConfig{
+		Default:   RateLimit{PerSecond: 0.001, Burst: 1},
+		PerClient: map[string]RateLimit{"vip": {PerSecond: 1000, Burst: 10}},
+	})
+	proxy := NewRestProxy(func(req *http.Request, _ string, _ string) error {
+		req.URL.Scheme, req.URL.Host = upstream.URL().Scheme, upstream.URL().Host
+		return nil
+	}, WithRESTClientQuotas(quotas))
+	otherBefore := testutil.ToFloat64(promQuotaRejected.WithLabelValues("rest", quotaOtherClients))
+
+	tests := []struct {
+		client   string
+		expected int
+	}{
+		{"a", http.StatusOK},
+		{"a", http.StatusTooManyRequests},
+		{"b", http.StatusOK},
+		{"vip", http.StatusOK},
+		{"vip", http.StatusOK},
+	}
+	for i, test := range tests {
+		req := httptest.NewRequest("POST", "/v1/models/foo/versions/1:predict", nil)
+		req.Header.Set("X-Client", test.client)
+		rw := httptest.NewRecorder()
+		proxy.Serve()(rw, req)
+		if rw.Code != test.expected {
+			t.Errorf("%d: expected %d for client %s but got %d", i, test.expected, test.client, rw.Code)
+		}
+		if rw.Code == http.StatusTooManyRequests && rw.Header().Get("Retry-After") == "" {
+			t.Errorf("%d: expected a Retry-After header", i)
+		}
+	}
+	if n := testutil.ToFloat64(promQuotaRejected.WithLabelValues("rest", quotaOtherClients)) - otherBefore; n != 1 {
+		t.Errorf("Expected clients without their own limit to share a label but got %v rejections", n)
+	}
+}
+
+func TestGrpcClientQuotasByPrincipal(t *testing.T) {
+	logger, logs := logtest.NewNullLogger()
+	harness := tfservingtest.NewHarness(t)
+	quotas := NewClientQuotas(ClientKeyPrincipal(), ClientQuotaConfig{
+		Default:  RateLimit{PerSecond: 0.001, Burst: 1},
+		HashKeys: true,
+	})
+	client := harness.Serve(NewGrpcProxy(harness.ClientProvider, WithLogger(logger), WithClientQuotas(quotas),
+		WithAuthenticator(StaticTokenAuthenticator(map[string][]string{"alice": {"*"}, "bob": {"*"}}))))
+
+	call := func(token string) error {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", token)
+		_, err := client.Predict(ctx, predictVersion("foo", 1))
+		return err
+	}
+	if err := call("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := call("alice"); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected a principal over its quota to get ResourceExhausted but got %v", err)
+	}
+	if err := call("bob"); err != nil {
+		t.Errorf("Expected other principals to have their own quota but got %v", err)
+	}
+	entry := logs.LastEntry()
+	if entry == nil || entry.Data["client"] != quotas.loggedKey("alice") || entry.Data["client"] == "alice" {
+		t.Errorf("Expected the rejection to be logged with the hashed principal but got %+v", entry)
+	}
+}
@@ -0,0 +1,150 @@
+package tfservingproxy
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/time/rate"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var promRateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_ratelimited_total",
+	Help: "The total number of requests rejected by the per-model rate limit",
+}, []string{"protocol", "model"})
+
+// RateLimit is a token bucket refilled with PerSecond tokens per second
+// and holding at most Burst tokens
+type RateLimit struct {
+	PerSecond float64 `mapstructure:"perSecond" yaml:"perSecond"`
+	Burst     int     `mapstructure:"burst" yaml:"burst"`
+}
+
+// RateLimiter limits the rate of calls per model. A RateLimiter shared by
+// a GrpcProxy and a RestProxy enforces a single budget per model across
+// both protocols.
+type RateLimiter struct {
+	buckets map[string]*rate.Limiter
+	mutex   sync.RWMutex
+}
+
+// NewRateLimiter creates a RateLimiter with the limits of the models in
+// limits. Models without a limit are not limited.
+func NewRateLimiter(limits map[string]RateLimit) *RateLimiter {
+	limiter := &RateLimiter{buckets: make(map[string]*rate.Limiter)}
+	for model, limit := range limits {
+		limiter.SetLimit(model, limit)
+	}
+	return limiter
+}
+
+// SetLimit changes the limit of model. A limit with a non-positive
+// PerSecond removes it. It is safe to call while serving.
+func (limiter *RateLimiter) SetLimit(model string, limit RateLimit) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.setLimit(model, limit)
+}
+
+// SetLimits replaces the limits of all models with limits. Models without
+// a limit in limits are no longer limited. It is safe to call while
+// serving.
+func (limiter *RateLimiter) SetLimits(limits map[string]RateLimit) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	for model := range limiter.buckets {
+		if _, ok := limits[model]; !ok {
+			delete(limiter.buckets, model)
+		}
+	}
+	for model, limit := range limits {
+		limiter.setLimit(model, limit)
+	}
+}
+
+// setLimit changes the limit of model. The caller must hold the lock.
+func (limiter *RateLimiter) setLimit(model string, limit RateLimit) {
+	if limit.PerSecond <= 0 {
+		delete(limiter.buckets, model)
+		return
+	}
+	if bucket, ok := limiter.buckets[model]; ok && bucket.Burst() == limit.Burst {
+		// Keep the tokens the model has left
+		bucket.SetLimit(rate.Limit(limit.PerSecond))
+		return
+	}
+	limiter.buckets[model] = rate.NewLimiter(rate.Limit(limit.PerSecond), limit.Burst)
+}
+
+// allow takes a token for a call to model. If none is left it returns
+// false and how long until one is.
+func (limiter *RateLimiter) allow(model string) (bool, time.Duration) {
+	limiter.mutex.RLock()
+	bucket, ok := limiter.buckets[model]
+	limiter.mutex.RUnlock()
+	if !ok {
+		return true, 0
+	}
+	reservation := bucket.Reserve()
+	if !reservation.OK() {
+		return false, time.Second
+	}
+	if delay := reservation.Delay(); delay > 0 {
+		reservation.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+// WithRateLimiter rejects calls over the rate limit of their model with
+// ResourceExhausted and a RetryInfo detail
+func WithRateLimiter(limiter *RateLimiter) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.serverImpl.rateLimiter = limiter
+	}
+}
+
+// WithRESTRateLimiter rejects requests over the rate limit of their model
+// with 429 Too Many Requests and a Retry-After header
+func WithRESTRateLimiter(limiter *RateLimiter) RestProxyOption {
+	return func(proxy *RestProxy) {
+		proxy.rateLimiter = limiter
+	}
+}
+
+// rateLimitStatus is the status of a call rejected by the rate limit
+func rateLimitStatus(model string, retryDelay time.Duration) error {
+	return exhaustedStatus(fmt.Sprintf("rate limit of model %s exceeded", model), retryDelay)
+}
+
+// exhaustedStatus is a ResourceExhausted status telling the caller to
+// retry after retryDelay
+func exhaustedStatus(message string, retryDelay time.Duration) error {
+	st := status.New(codes.ResourceExhausted, message)
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: ptypes.DurationProto(retryDelay)})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+// writeRateLimited answers a REST request rejected by the rate limit
+func writeRateLimited(rw http.ResponseWriter, model string, retryDelay time.Duration) {
+	writeTooManyRequests(rw, fmt.Sprintf("rate limit of model %s exceeded", model), retryDelay)
+}
+
+// writeTooManyRequests answers a REST request with 429 and a Retry-After
+// header
+func writeTooManyRequests(rw http.ResponseWriter, message string, retryDelay time.Duration) {
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryDelay.Seconds()))))
+	writeError(rw, http.StatusTooManyRequests, message)
+}
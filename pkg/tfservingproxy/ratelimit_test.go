@@ -0,0 +1,103 @@
+package tfservingproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes"
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRateLimiterSharedAcrossProtocols(t *testing.T) {
+	limiter := NewRateLimiter(map[string]RateLimit{"foo": {PerSecond: 0.01, Burst: 2}})
+	upstream := tfservingtest.NewGRPCNode(t, "upstream").Dial(t)
+	client := startProxy(t, NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return upstream, nil
+	}, WithRateLimiter(limiter)))
+	restUpstream := tfservingtest.NewRESTNode(t, "upstream")
+	restUpstream.Respond("", "", http.StatusOK, `{"predictions": []}`)
+	restURL := restUpstream.URL()
+	restProxy := NewRestProxy(func(req *http.Request, _ string, _ string) error {
+		req.URL.Scheme, req.URL.Host = restURL.Scheme, restURL.Host
+		return nil
+	}, WithRESTRateLimiter(limiter))
+	restPredict := func(model string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		restProxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/"+model+"/versions/1:predict", nil))
+		return rw
+	}
+
+	limited := testutil.ToFloat64(promRateLimited.WithLabelValues("grpc", "foo"))
+	if _, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}); err != nil {
+		t.Fatal(err)
+	}
+	if rw := restPredict("foo"); rw.Code != http.StatusOK {
+		t.Fatalf("Expected the REST call within the budget to pass but got %d", rw.Code)
+	}
+
+	// The budget of foo is used up by both calls
+	_, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expected ResourceExhausted over the limit but got %v", err)
+	}
+	var retryInfo *errdetails.RetryInfo
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			retryInfo = info
+		}
+	}
+	if delay, err := ptypes.Duration(retryInfo.GetRetryDelay()); err != nil || delay <= 0 {
+		t.Errorf("Expected a retry delay hint but got %v", retryInfo)
+	}
+	if got := testutil.ToFloat64(promRateLimited.WithLabelValues("grpc", "foo")) - limited; got != 1 {
+		t.Errorf("Expected one rate limited grpc call but got %v", got)
+	}
+	rw := restPredict("foo")
+	if rw.Code != http.StatusTooManyRequests || rw.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected 429 with Retry-After but got %d %v", rw.Code, rw.Header())
+	}
+	if rw := restPredict("bar"); rw.Code != http.StatusOK {
+		t.Errorf("Expected a model without limit to pass but got %d", rw.Code)
+	}
+
+	limiter.SetLimit("foo", RateLimit{PerSecond: 0.01, Burst: 1})
+	if _, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}); err != nil {
+		t.Errorf("Expected the call to pass with the updated limit but got %v", err)
+	}
+	limiter.SetLimit("foo", RateLimit{})
+	if rw := restPredict("foo"); rw.Code != http.StatusOK {
+		t.Errorf("Expected the call to pass with the limit removed but got %d", rw.Code)
+	}
+}
+
+func TestRateLimiterConcurrentCalls(t *testing.T) {
+	limiter := NewRateLimiter(map[string]RateLimit{"foo": {PerSecond: 0.01, Burst: 50}})
+	var allowed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i%50 == 0 {
+				limiter.SetLimit("foo", RateLimit{PerSecond: 0.01, Burst: 50})
+			}
+			if ok, _ := limiter.allow("foo"); ok {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if allowed != 50 {
+		t.Errorf("Expected the burst of 50 calls to be allowed but got %d", allowed)
+	}
+}
@@ -0,0 +1,81 @@
+package tfservingproxy
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+var promNotReady = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_not_ready_total",
+	Help: "The total number of calls rejected because the proxy was not ready",
+}, []string{"protocol"})
+
+// readiness is the ready flag of the proxy together with the health
+// service reporting it
+type readiness struct {
+	ready  int32
+	health *health.Server
+	mutex  sync.Mutex
+}
+
+func newReadiness() *readiness {
+	return &readiness{ready: 1, health: health.NewServer()}
+}
+
+// set flips the flag and the health status together
+func (r *readiness) set(ready bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	servingStatus := healthpb.HealthCheckResponse_NOT_SERVING
+	if ready {
+		atomic.StoreInt32(&r.ready, 1)
+		servingStatus = healthpb.HealthCheckResponse_SERVING
+	} else {
+		atomic.StoreInt32(&r.ready, 0)
+	}
+	r.health.SetServingStatus("", servingStatus)
+}
+
+func (r *readiness) isReady() bool {
+	return atomic.LoadInt32(&r.ready) == 1
+}
+
+// WithReadinessGate makes the proxy start out not ready: TF Serving calls
+// fail with Unavailable and the health service reports NOT_SERVING until
+// SetReady(true) is called, e.g. once service discovery has synced.
+func WithReadinessGate() GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.readiness.set(false)
+	}
+}
+
+// SetReady sets whether the proxy accepts TF Serving calls. It is safe to
+// call while serving.
+func (proxy *GrpcProxy) SetReady(ready bool) {
+	proxy.readiness.set(ready)
+}
+
+// Ready returns whether the proxy accepts TF Serving calls
+func (proxy *GrpcProxy) Ready() bool {
+	return proxy.readiness.isReady()
+}
+
+// readinessInterceptor rejects TF Serving calls while the proxy is not
+// ready. Other services, such as health checks, are always served.
+func (r *readiness) interceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !r.isReady() && strings.HasPrefix(info.FullMethod, "/tensorflow.serving.") {
+		promNotReady.WithLabelValues("grpc").Inc()
+		return nil, status.Error(codes.Unavailable, "proxy warming up")
+	}
+	return handler(ctx, req)
+}
@@ -0,0 +1,229 @@
+package tfservingproxy
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// tunables are the settings of a GrpcProxy that ApplyConfig can change
+// while it serves. A set of tunables in use is never modified, it is
+// replaced as a whole, so each call sees a consistent set.
+type tunables struct {
+	defaultTimeout  time.Duration
+	timeouts        TimeoutOverrides
+	deadlineBudget  DeadlineBudget
+	maxInFlight     int64
+	maxRequestSizes map[string]int
+	upstreamRetries int
+	waitForReady    WaitForReady
+	routingTrailers bool
+	modelLimiter    *modelLimiter
+	canaries        *canaries
+}
+
+// settings returns the tunables in use
+func (server *proxyServiceServer) settings() *tunables {
+	return server.live.Load().(*tunables)
+}
+
+// validate returns an error if the tunables contradict each other or the
+// max message size of the server
+func (settings *tunables) validate(maxRecvMsgSize int) error {
+	if maxRecvMsgSize > 0 {
+		for model, limit := range settings.maxRequestSizes {
+			if limit > maxRecvMsgSize {
+				return fmt.Errorf("request size limit of %d bytes for model %s exceeds the max message size of %d bytes", limit, model, maxRecvMsgSize)
+			}
+		}
+	}
+	if settings.defaultTimeout > 0 && settings.defaultTimeout <= settings.deadlineBudget.MinRemaining {
+		return fmt.Errorf("default timeout of %v is within the minimum deadline budget of %v", settings.defaultTimeout, settings.deadlineBudget.MinRemaining)
+	}
+	if shortest := settings.timeouts.shortest(); shortest > 0 && shortest <= settings.deadlineBudget.MinRemaining {
+		return fmt.Errorf("timeout override of %v is within the minimum deadline budget of %v", shortest, settings.deadlineBudget.MinRemaining)
+	}
+	return nil
+}
+
+// ApplyConfig replaces the settings of the proxy that can change while it
+// serves with those of cfg: the default timeout, timeout overrides, deadline budget, in-flight
+// ceiling, request size limits, concurrency limits, upstream retries,
+// waiting for ready connections, routing trailers, canary weights, rate limits, dry runs, faults, experiments and
+// the fair queue. Calls in flight finish with the settings they started
+// with. Settings that need a new server, such as addresses, TLS and message
+// sizes, are ignored.
+//
+// An invalid cfg is rejected as a whole and nothing is changed. It is safe
+// to call while serving.
+func (proxy *GrpcProxy) ApplyConfig(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	c := cfg.Grpc
+	if len(cfg.RateLimits) > 0 && proxy.serverImpl.rateLimiter == nil {
+		return errors.New("rate limits need a proxy created with a rate limiter")
+	}
+	if len(cfg.DryRun) > 0 && proxy.serverImpl.dryRuns == nil {
+		return errors.New("dry runs need a proxy created with DryRuns")
+	}
+	if len(cfg.Faults) > 0 && proxy.serverImpl.faults == nil {
+		return errors.New("faults need a proxy created with Faults")
+	}
+	if len(cfg.Experiments) > 0 && proxy.serverImpl.experiments == nil {
+		return errors.New("experiments need a proxy created with Experiments")
+	}
+	if cfg.FairQueue.Capacity > 0 && proxy.serverImpl.fairQueue == nil {
+		return errors.New("a fair queue needs a proxy created with a FairQueue")
+	}
+	proxy.reconfigure.Lock()
+	defer proxy.reconfigure.Unlock()
+
+	current := proxy.serverImpl.settings()
+	next := &tunables{
+		defaultTimeout:  c.DefaultTimeout,
+		timeouts:        c.TimeoutOverrides.normalized(),
+		deadlineBudget:  c.DeadlineBudget,
+		maxInFlight:     c.MaxInFlight,
+		maxRequestSizes: c.MaxRequestBytes,
+		upstreamRetries: c.UpstreamRetries,
+		waitForReady:    c.WaitForReady,
+		routingTrailers: c.RoutingTrailers,
+		modelLimiter:    current.modelLimiter,
+		canaries:        newCanaries(),
+	}
+	// Keep the semaphores of unchanged limits, new ones only count new calls
+	if current.modelLimiter == nil || !reflect.DeepEqual(current.modelLimiter.limits, c.ConcurrencyLimits) {
+		next.modelLimiter = nil
+		if c.ConcurrencyLimits.Default > 0 || len(c.ConcurrencyLimits.PerModel) > 0 {
+			next.modelLimiter = newModelLimiter(c.ConcurrencyLimits)
+		}
+	}
+	for model, weights := range c.CanaryWeights {
+		next.canaries.set(model, weights)
+	}
+	if err := next.validate(proxy.maxRecvMsgSize); err != nil {
+		return err
+	}
+
+	proxy.serverImpl.live.Store(next)
+	if proxy.serverImpl.rateLimiter != nil {
+		proxy.serverImpl.rateLimiter.SetLimits(cfg.RateLimits)
+	}
+	if proxy.serverImpl.dryRuns != nil {
+		proxy.serverImpl.dryRuns.Set(cfg.DryRun)
+	}
+	if proxy.serverImpl.faults != nil {
+		proxy.serverImpl.faults.Set(cfg.Faults)
+	}
+	if proxy.serverImpl.experiments != nil {
+		proxy.serverImpl.experiments.Set(cfg.Experiments)
+	}
+	if proxy.serverImpl.fairQueue != nil {
+		proxy.serverImpl.fairQueue.Set(cfg.FairQueue)
+	}
+	proxy.serverImpl.logger.Info("Applied new grpc proxy config")
+	return nil
+}
+
+// ApplyConfig replaces the rate limits, dry runs, faults, experiments, fair
+// queue, the upstream timeout and the retry of unavailable nodes of the
+// proxy with those of cfg. Requests in flight are not affected. An
+// invalid cfg is rejected as a whole and nothing is changed. It is safe to
+// call while serving.
+func (handler *RestProxy) ApplyConfig(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if len(cfg.RateLimits) > 0 && handler.rateLimiter == nil {
+		return errors.New("rate limits need a proxy created with a rate limiter")
+	}
+	if len(cfg.DryRun) > 0 && handler.dryRuns == nil {
+		return errors.New("dry runs need a proxy created with DryRuns")
+	}
+	if len(cfg.Faults) > 0 && handler.faults == nil {
+		return errors.New("faults need a proxy created with Faults")
+	}
+	if len(cfg.Experiments) > 0 && handler.experiments == nil {
+		return errors.New("experiments need a proxy created with Experiments")
+	}
+	if cfg.FairQueue.Capacity > 0 && handler.fairQueue == nil {
+		return errors.New("a fair queue needs a proxy created with a FairQueue")
+	}
+	if handler.rateLimiter != nil {
+		handler.rateLimiter.SetLimits(cfg.RateLimits)
+	}
+	if handler.dryRuns != nil {
+		handler.dryRuns.Set(cfg.DryRun)
+	}
+	if handler.faults != nil {
+		handler.faults.Set(cfg.Faults)
+	}
+	if handler.experiments != nil {
+		handler.experiments.Set(cfg.Experiments)
+	}
+	if handler.fairQueue != nil {
+		handler.fairQueue.Set(cfg.FairQueue)
+	}
+	if transport, ok := handler.RestProxy.Transport.(*resolveErrorTransport); ok {
+		transport.setUpstreamTimeout(cfg.Rest.UpstreamTimeout)
+		transport.setUnavailableRetry(cfg.Rest.UnavailableRetry)
+	}
+	log.Info("Applied new REST proxy config")
+	return nil
+}
+
+// WatchConfig checks the config file at path for changes every interval
+// and passes the new config to each of apply, such as the ApplyConfig
+// methods of the proxies. A config that cannot be loaded or is invalid is
+// logged and skipped. The file should be replaced at once, such as by a
+// rename, so a partly written file is never read. The returned function
+// stops watching.
+func WatchConfig(path string, interval time.Duration, apply ...func(Config) error) func() {
+	done := make(chan struct{})
+	lastMod := configModTime(path)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			modTime := configModTime(path)
+			if modTime.Equal(lastMod) {
+				continue
+			}
+			lastMod = modTime
+			cfg, err := LoadConfig(path)
+			if err == nil {
+				err = cfg.Validate()
+			}
+			if err != nil {
+				log.WithError(err).Errorf("Could not reload config %s", path)
+				continue
+			}
+			for _, applyConfig := range apply {
+				if err := applyConfig(cfg); err != nil {
+					log.WithError(err).Errorf("Could not apply config %s", path)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// configModTime returns the modification time of the file at path, or the
+// zero time if it cannot be read
+func configModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,181 @@
+package tfservingproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGrpcProxyApplyConfigUnderTraffic(t *testing.T) {
+	release := make(chan struct{})
+	slow := tfservingtest.NewGRPCNode(t, "slow", tfservingtest.WithPredict(func(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+		<-release
+		return &pb.PredictResponse{ModelSpec: req.GetModelSpec()}, nil
+	}))
+	harness := tfservingtest.NewHarness(t, tfservingtest.Route("slow", slow))
+	cfg := Config{Grpc: GrpcConfig{MaxRecvMsgSize: 4096, MaxSendMsgSize: 4096}}
+	proxy, err := NewGrpcProxyFromConfig(cfg, ClientProviderFunc(harness.ClientProvider))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := harness.Serve(proxy)
+	predict := func(model string) error {
+		_, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: model}})
+		return err
+	}
+
+	// Keep calls flowing while the config changes
+	var limited, unexpected int64
+	stop := make(chan struct{})
+	var traffic sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		traffic.Add(1)
+		go func() {
+			defer traffic.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				switch err := predict("foo"); status.Code(err) {
+				case codes.OK:
+				case codes.ResourceExhausted:
+					atomic.AddInt64(&limited, 1)
+				default:
+					atomic.AddInt64(&unexpected, 1)
+				}
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	cfg.RateLimits = map[string]RateLimit{"foo": {PerSecond: 0.001, Burst: 1}}
+	if err := proxy.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(stop)
+	traffic.Wait()
+	if atomic.LoadInt64(&limited) == 0 || atomic.LoadInt64(&unexpected) > 0 {
+		t.Errorf("Expected the new rate limit to reject calls without other failures, got %d limited and %d failed", limited, unexpected)
+	}
+
+	// An invalid update changes nothing, not even its valid parts
+	invalid := cfg
+	invalid.RateLimits = nil
+	invalid.Grpc.MaxRequestBytes = map[string]int{"foo": 8192}
+	if err := proxy.ApplyConfig(invalid); err == nil {
+		t.Error("Expected a request size limit above the max message size to be rejected")
+	}
+	if err := predict("foo"); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected the rate limit to stay after a rejected update but got %v", err)
+	}
+
+	// Calls in flight are not affected by a new in-flight ceiling
+	done := make(chan error)
+	go func() { done <- predict("slow") }()
+	for tfservingtest.Received(slow, "slow", "") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cfg.RateLimits = nil
+	cfg.Grpc.MaxInFlight = 1
+	if err := proxy.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := predict("foo"); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected the new in-flight ceiling to shed calls but got %v", err)
+	}
+	close(release)
+	if err := <-done; err != nil {
+		t.Errorf("Expected the call in flight to finish but got %v", err)
+	}
+	if err := predict("foo"); err != nil {
+		t.Errorf("Expected calls to pass once the proxy is idle but got %v", err)
+	}
+}
+
+func TestRestProxyApplyConfig(t *testing.T) {
+	upstream := tfservingtest.NewRESTNode(t, "upstream")
+	upstream.Respond("foo", "", http.StatusOK, `{"predictions": [1]}`)
+	proxy, err := NewRestProxyFromConfig(Config{}, func(req *http.Request, _ string, _ string) error {
+		req.URL.Scheme, req.URL.Host = upstream.URL().Scheme, upstream.URL().Host
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	predict := func() int {
+		rw := httptest.NewRecorder()
+		proxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/foo/versions/1:predict", nil))
+		return rw.Code
+	}
+
+	if code := predict(); code != http.StatusOK {
+		t.Fatalf("Expected the request to pass but got %d", code)
+	}
+	cfg := Config{RateLimits: map[string]RateLimit{"foo": {PerSecond: 0.001, Burst: 1}}}
+	if err := proxy.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	predict()
+	if code := predict(); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the new rate limit to apply but got %d", code)
+	}
+	cfg.Rest.ReadTimeout = -time.Second
+	if err := proxy.ApplyConfig(cfg); err == nil {
+		t.Error("Expected an invalid config to be rejected")
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "proxy.yaml")
+	// Replace the file at once, like a deployed config
+	write := func(content string, modTime time.Time) {
+		tmp := path + ".tmp"
+		if err := ioutil.WriteFile(tmp, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(tmp, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("grpc:\n  upstreamRetries: 1\n", time.Now().Add(-time.Minute))
+
+	applied := make(chan Config, 10)
+	stop := WatchConfig(path, 5*time.Millisecond, func(cfg Config) error {
+		applied <- cfg
+		return nil
+	})
+	defer stop()
+
+	write("grpc:\n  port: -1\n", time.Now().Add(-time.Second))
+	write("grpc:\n  upstreamRetries: 3\n", time.Now())
+	select {
+	case cfg := <-applied:
+		if cfg.Grpc.UpstreamRetries != 3 {
+			t.Errorf("Expected the changed config but got %+v", cfg.Grpc)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the changed config to be applied")
+	}
+}
@@ -0,0 +1,98 @@
+package tfservingproxy
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// redactedValue replaces the values of metadata keys not in the allowlist
+// of the request log
+const redactedValue = "[redacted]"
+
+// RequestLogConfig configures the log of grpc calls. The log never holds
+// messages, and metadata values only for the keys in Metadata.
+type RequestLogConfig struct {
+	// Enabled enables the log in NewGrpcProxyFromConfig
+	Enabled bool `mapstructure:"enabled" yaml:"enabled"`
+	// Metadata are the metadata keys whose values are logged. The values
+	// of all other keys are logged as [redacted].
+	Metadata []string `mapstructure:"metadata" yaml:"metadata"`
+	// SampleRate is the fraction of calls logged. Zero logs all calls.
+	SampleRate float64 `mapstructure:"sampleRate" yaml:"sampleRate"`
+	// MessageSizes logs the sizes in bytes of the request and response
+	MessageSizes bool `mapstructure:"messageSizes" yaml:"messageSizes"`
+}
+
+func (config RequestLogConfig) validate() error {
+	if config.SampleRate < 0 || config.SampleRate > 1 {
+		return fmt.Errorf("request log sample rate must be between 0 and 1, got %v", config.SampleRate)
+	}
+	return nil
+}
+
+// WithRequestLog logs each sampled grpc call with its metadata, status
+// and duration to the logger of the proxy, see WithLogger, along with the
+// fields of the request logger such as the method, model and target. It
+// sees the calls rejected by the proxy too.
+func WithRequestLog(config RequestLogConfig) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		if err := config.validate(); err != nil {
+			proxy.optionErrors = append(proxy.optionErrors, err)
+			return
+		}
+		if config.SampleRate == 0 {
+			config.SampleRate = 1
+		}
+		proxy.requestLog = &config
+	}
+}
+
+// requestLogInterceptor logs the calls as configured by config. It runs
+// after logFieldsInterceptor, so its entries have the request fields.
+func (server *proxyServiceServer) requestLogInterceptor(config RequestLogConfig) grpc.UnaryServerInterceptor {
+	allowed := make(map[string]bool, len(config.Metadata))
+	for _, key := range config.Metadata {
+		allowed[strings.ToLower(key)] = true
+	}
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if config.SampleRate < 1 && rand.Float64() >= config.SampleRate {
+			return handler(ctx, req)
+		}
+		start := time.Now()
+		res, err := handler(ctx, req)
+		duration := time.Since(start)
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		logged := make(map[string]string, len(md))
+		for key, values := range md {
+			logged[key] = redactedValue
+			if allowed[key] {
+				logged[key] = strings.Join(values, ",")
+			}
+		}
+		fields := log.Fields{
+			"metadata": logged,
+			"code":     status.Code(err).String(),
+			"duration": duration,
+		}
+		if config.MessageSizes {
+			if msg, ok := req.(proto.Message); ok {
+				fields["request_size"] = proto.Size(msg)
+			}
+			if msg, ok := res.(proto.Message); ok && err == nil {
+				fields["response_size"] = proto.Size(msg)
+			}
+		}
+		server.loggerFor(ctx).WithFields(fields).Infof("Handled %s in %v", info.FullMethod, duration)
+		return res, err
+	}
+}
@@ -0,0 +1,107 @@
+package tfservingproxy
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestRequestLogRedactsMetadata(t *testing.T) {
+	logger, logs := logtest.NewNullLogger()
+	harness := tfservingtest.NewHarness(t)
+	client := harness.Serve(NewGrpcProxy(harness.ClientProvider, WithLogger(logger),
+		WithRequestLog(RequestLogConfig{Metadata: []string{"X-Client-Id"}, MessageSizes: true})))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(),
+		"authorization", "Bearer secret-token", "x-client-id", "client-7")
+	if _, err := client.Predict(ctx, predictVersion("foo", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := logs.AllEntries()
+	if len(entries) != 1 {
+		t.Fatalf("Expected one request log entry but got %d", len(entries))
+	}
+	entry := entries[0]
+	if text, _ := entry.String(); strings.Contains(text, "secret-token") {
+		t.Errorf("Expected the authorization token to be redacted but got %s", text)
+	}
+	logged := entry.Data["metadata"].(map[string]string)
+	if logged["authorization"] != redactedValue || logged["x-client-id"] != "client-7" {
+		t.Errorf("Expected only x-client-id in the clear but got %v", logged)
+	}
+	checkLogFields(t, entries, log.Fields{
+		logFieldModel: "foo",
+		logFieldPeer:  "bufconn",
+		"code":        "OK",
+	})
+	if size, ok := entry.Data["request_size"].(int); !ok || size == 0 {
+		t.Errorf("Expected the request size but got %v", entry.Data["request_size"])
+	}
+	if _, ok := entry.Data["response_size"].(int); !ok {
+		t.Errorf("Expected the response size but got %v", entry.Data["response_size"])
+	}
+}
+
+func TestRequestLogSeesRejectedCalls(t *testing.T) {
+	logger, logs := logtest.NewNullLogger()
+	harness := tfservingtest.NewHarness(t)
+	client := harness.Serve(NewGrpcProxy(harness.ClientProvider, WithLogger(logger),
+		WithRequestLog(RequestLogConfig{}), WithReadinessGate()))
+
+	_, err := client.Predict(context.Background(), predictVersion("foo", 1))
+	if status.Code(err) != codes.Unavailable {
+		t.Fatalf("Expected the call to be rejected before the proxy is ready but got %v", err)
+	}
+	entries := logs.AllEntries()
+	if len(entries) != 1 || entries[0].Data["code"] != "Unavailable" {
+		t.Fatalf("Expected the rejected call to be logged but got %v", entries)
+	}
+	if _, ok := entries[0].Data["request_size"]; ok {
+		t.Error("Expected no message sizes unless enabled")
+	}
+}
+
+func TestRequestLogSeesUnauthenticatedCalls(t *testing.T) {
+	logger, logs := logtest.NewNullLogger()
+	harness := tfservingtest.NewHarness(t)
+	client := harness.Serve(NewGrpcProxy(harness.ClientProvider, WithLogger(logger),
+		WithAuthenticator(StaticTokenAuthenticator(map[string][]string{"secret": {"foo"}})), WithRequestLog(RequestLogConfig{})))
+
+	_, err := client.Predict(context.Background(), predictVersion("foo", 1))
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("Expected the call without credentials to be rejected but got %v", err)
+	}
+	var logged []interface{}
+	for _, entry := range logs.AllEntries() {
+		if code, ok := entry.Data["code"]; ok {
+			logged = append(logged, code)
+		}
+	}
+	if len(logged) != 1 || logged[0] != "Unauthenticated" {
+		t.Fatalf("Expected the unauthenticated call to be logged but got codes %v", logged)
+	}
+}
+
+func TestRequestLogSamples(t *testing.T) {
+	logger, logs := logtest.NewNullLogger()
+	harness := tfservingtest.NewHarness(t)
+	client := harness.Serve(NewGrpcProxy(harness.ClientProvider, WithLogger(logger),
+		WithRequestLog(RequestLogConfig{SampleRate: 0.5})))
+
+	for i := 0; i < 100; i++ {
+		if _, err := client.Predict(context.Background(), predictVersion("foo", 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if logged := len(logs.AllEntries()); logged < 20 || logged > 80 {
+		t.Errorf("Expected about half of 100 calls to be logged but got %d", logged)
+	}
+}
@@ -0,0 +1,40 @@
+package tfservingproxy
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/codes"
+)
+
+var promResolveDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "tfservingcache_proxy_resolve_duration_seconds",
+	Help:    "The time taken by the REST handler or grpc resolver to route a request, by outcome",
+	Buckets: []float64{.0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+}, []string{"protocol", "outcome"})
+
+// Outcomes of resolving a request
+const (
+	resolveOK          = "ok"
+	resolveNotFound    = "not_found"
+	resolveUnavailable = "unavailable"
+	resolveTimeout     = "timeout"
+)
+
+// observeResolve records how long resolving a request of protocol took
+// since start and whether it failed with err
+func observeResolve(protocol string, start time.Time, err error) {
+	outcome := resolveOK
+	if err != nil {
+		switch grpcCode(err) {
+		case codes.NotFound:
+			outcome = resolveNotFound
+		case codes.DeadlineExceeded:
+			outcome = resolveTimeout
+		default:
+			outcome = resolveUnavailable
+		}
+	}
+	promResolveDuration.WithLabelValues(protocol, outcome).Observe(time.Since(start).Seconds())
+}
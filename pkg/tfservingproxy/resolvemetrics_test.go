@@ -0,0 +1,69 @@
+package tfservingproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+)
+
+// resolveCounts returns the number of resolutions of protocol by outcome
+func resolveCounts(protocol string) map[string]uint64 {
+	counts := make(map[string]uint64)
+	for _, outcome := range []string{resolveOK, resolveNotFound, resolveUnavailable, resolveTimeout} {
+		counts[outcome], _ = histogramSample(promResolveDuration.WithLabelValues(protocol, outcome))
+	}
+	return counts
+}
+
+func TestGrpcResolveDuration(t *testing.T) {
+	harness := tfservingtest.NewHarness(t,
+		tfservingtest.ProviderError("missing", ErrModelNotFound),
+		tfservingtest.ProviderError("down", errors.New("no nodes")),
+		tfservingtest.ProviderError("slow", fmt.Errorf("discovery timed out: %w", context.DeadlineExceeded)))
+	client := harness.Serve(NewGrpcProxy(harness.ClientProvider))
+
+	before := resolveCounts("grpc")
+	for _, model := range []string{"foo", "missing", "down", "slow"} {
+		client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: model}})
+	}
+	after := resolveCounts("grpc")
+	for outcome := range after {
+		if n := after[outcome] - before[outcome]; n != 1 {
+			t.Errorf("Expected one %s resolution but got %d", outcome, n)
+		}
+	}
+}
+
+func TestRESTResolveDuration(t *testing.T) {
+	upstream := tfservingtest.NewRESTNode(t, "upstream")
+	upstream.Respond("foo", "1", http.StatusOK, `{"predictions": [1]}`)
+	proxy := NewRestProxy(func(req *http.Request, model string, _ string) error {
+		switch model {
+		case "missing":
+			return ErrModelNotFound
+		case "down":
+			return errors.New("no nodes")
+		case "slow":
+			return context.DeadlineExceeded
+		}
+		req.URL.Scheme, req.URL.Host = upstream.URL().Scheme, upstream.URL().Host
+		return nil
+	})
+
+	before := resolveCounts("rest")
+	for _, model := range []string{"foo", "missing", "down", "slow"} {
+		proxy.Serve()(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/models/"+model+"/versions/1:predict", nil))
+	}
+	after := resolveCounts("rest")
+	for outcome := range after {
+		if n := after[outcome] - before[outcome]; n != 1 {
+			t.Errorf("Expected one %s resolution but got %d", outcome, n)
+		}
+	}
+}
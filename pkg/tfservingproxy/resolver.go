@@ -0,0 +1,96 @@
+package tfservingproxy
+
+import (
+	"context"
+	"fmt"
+
+	"google.golang.org/grpc"
+)
+
+// Target is an upstream TF Serving node that can serve a model
+type Target struct {
+	// Address is the host:port of the node's grpc endpoint
+	Address string
+	// Conn is an existing connection to the node. If nil, the proxy
+	// dials Address and keeps the connection for later requests.
+	Conn *grpc.ClientConn
+	// REST marks a node that only serves TF Serving's REST api at Address.
+	// Calls to it need WithRESTFallback and are not balanced with the
+	// other targets, it takes its share of calls by weight instead.
+	REST bool
+	// Weight is the share of calls for the target relative to the other
+	// targets, see WeightedRoundRobin. Targets without a weight count as
+	// 1.
+	Weight int
+}
+
+// CacheDisposition tells whether the model was already loaded on the target
+type CacheDisposition int
+
+const (
+	// CacheUnknown means that the resolver did not report the cache state
+	CacheUnknown CacheDisposition = iota
+	// CacheHit means that the model was already loaded
+	CacheHit
+	// CacheMiss means that the model was not loaded and the request
+	// triggered its load
+	CacheMiss
+	// CacheMissQueued means that the model was not loaded and its load
+	// waits for others to finish
+	CacheMissQueued
+)
+
+// String returns "hit", "miss" or "miss-queued", or "" if the disposition
+// is unknown
+func (disposition CacheDisposition) String() string {
+	switch disposition {
+	case CacheHit:
+		return "hit"
+	case CacheMiss:
+		return "miss"
+	case CacheMissQueued:
+		return "miss-queued"
+	}
+	return ""
+}
+
+// Resolution is the answer of a Resolver
+type Resolution struct {
+	// Targets are the candidate nodes in order of preference
+	Targets []Target
+	// Cache tells whether resolving hit the model cache. Resolvers that do
+	// not know leave it CacheUnknown.
+	Cache CacheDisposition
+}
+
+// Resolver finds the upstream nodes for a model. Resolve should honor the
+// deadline of ctx and return an error wrapping ErrModelNotFound,
+// ErrInvalidModel or ErrUnavailable to control the status returned to
+// the caller. Other errors are reported as unavailable.
+type Resolver interface {
+	Resolve(ctx context.Context, key ModelKey) (Resolution, error)
+}
+
+// ClientProviderFunc adapts a function returning a single connection to
+// the Resolver interface
+type ClientProviderFunc func(modelName string, version string) (*grpc.ClientConn, error)
+
+// Resolve calls the client provider and returns its connection as the only target
+func (provider ClientProviderFunc) Resolve(ctx context.Context, key ModelKey) (Resolution, error) {
+	conn, err := provider(key.Name, key.Version)
+	if err != nil {
+		return Resolution{}, err
+	}
+	if conn == nil {
+		return Resolution{}, fmt.Errorf("no connection for model %s: %w", key, ErrUnavailable)
+	}
+	return Resolution{Targets: []Target{{Address: conn.Target(), Conn: conn}}}, nil
+}
+
+// ResolverFunc adapts a function to the Resolver interface
+type ResolverFunc func(ctx context.Context, key ModelKey) (Resolution, error)
+
+// Resolve calls the function
+func (f ResolverFunc) Resolve(ctx context.Context, key ModelKey) (Resolution, error) {
+	return f(ctx, key)
+}
@@ -0,0 +1,362 @@
+package tfservingproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/ptypes"
+	anypb "github.com/golang/protobuf/ptypes/any"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/tensorflow/tensorflow/tensorflow/go/core/framework"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// WithRESTFallback lets the proxy serve grpc calls routed to targets the
+// Resolver marked as REST only. Predict and GetModelMetadata calls are
+// converted to TF Serving REST calls made with client, or
+// http.DefaultClient if nil, and other calls fail as unimplemented.
+// Without this option such targets are reported as unavailable.
+func WithRESTFallback(client *http.Client) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		if client == nil {
+			client = http.DefaultClient
+		}
+		proxy.serverImpl.conns.restClient = client
+	}
+}
+
+// getREST returns a connection to the REST bridge of address, starting it if needed
+func (manager *connManager) getREST(address string) (*grpc.ClientConn, error) {
+	if manager.restClient == nil {
+		return nil, fmt.Errorf("target %s only serves REST and REST fallback is disabled: %w", address, ErrUnavailable)
+	}
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if manager.closed {
+		return nil, errShuttingDown
+	}
+	if bridge, ok := manager.restBridges[address]; ok {
+		return bridge.conn, nil
+	}
+	bridge, err := newRESTBridge(address, manager.restClient)
+	if err != nil {
+		return nil, err
+	}
+	manager.restBridges[address] = bridge
+	return bridge.conn, nil
+}
+
+// restBridge is an in-process grpc server answering calls by making REST
+// calls to a TF Serving node. The proxy reaches it through a regular
+// connection, so calls to REST targets take the same path as others.
+type restBridge struct {
+	pb.UnimplementedPredictionServiceServer
+	baseURL    string
+	client     *http.Client
+	server     *grpc.Server
+	conn       *grpc.ClientConn
+	signatures map[ModelKey]*pb.SignatureDefMap
+	mutex      sync.RWMutex
+}
+
+func newRESTBridge(address string, client *http.Client) (*restBridge, error) {
+	bridge := &restBridge{
+		baseURL:    "http://" + address,
+		client:     client,
+		server:     grpc.NewServer(),
+		signatures: make(map[ModelKey]*pb.SignatureDefMap),
+	}
+	pb.RegisterPredictionServiceServer(bridge.server, bridge)
+	lis := newPipeListener()
+	go bridge.server.Serve(lis)
+	conn, err := grpc.Dial("passthrough:///rest:"+address, grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.dial(ctx)
+		}))
+	if err != nil {
+		bridge.server.Stop()
+		return nil, err
+	}
+	bridge.conn = conn
+	return bridge, nil
+}
+
+// Close closes the connection to the bridge and stops it
+func (bridge *restBridge) Close() error {
+	err := bridge.conn.Close()
+	bridge.server.Stop()
+	return err
+}
+
+// modelURL returns the REST url of the model version in spec
+func (bridge *restBridge) modelURL(spec *pb.ModelSpec) string {
+	if spec.GetVersion() == nil {
+		return fmt.Sprintf("%s/v1/models/%s", bridge.baseURL, spec.GetName())
+	}
+	return fmt.Sprintf("%s/v1/models/%s/versions/%d", bridge.baseURL, spec.GetName(), spec.GetVersion().GetValue())
+}
+
+// do makes a REST call and decodes the JSON response into v. Error
+// responses are converted to the status TF Serving uses for them.
+func (bridge *restBridge) do(ctx context.Context, method string, url string, body interface{}, v interface{}) error {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return status.Errorf(codes.InvalidArgument, "could not encode REST request: %v", err)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, &reqBody)
+	if err != nil {
+		return status.Errorf(codes.Internal, "could not create REST request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := bridge.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return status.FromContextError(ctx.Err()).Err()
+		}
+		return status.Errorf(codes.Unavailable, "REST call failed: %v", err)
+	}
+	defer res.Body.Close()
+	resBody, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "could not read REST response: %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		var restErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(resBody, &restErr) != nil || restErr.Error == "" {
+			restErr.Error = strings.TrimSpace(string(resBody))
+		}
+		return status.Error(grpcCodeForHTTPStatus(res.StatusCode), restErr.Error)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(resBody))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return status.Errorf(codes.Internal, "malformed REST response: %v", err)
+	}
+	return nil
+}
+
+// grpcCodeForHTTPStatus is the inverse of tfServingHTTPStatus
+func grpcCodeForHTTPStatus(statusCode int) codes.Code {
+	switch statusCode {
+	case http.StatusBadRequest:
+		return codes.InvalidArgument
+	case http.StatusUnauthorized:
+		return codes.Unauthenticated
+	case http.StatusForbidden:
+		return codes.PermissionDenied
+	case http.StatusNotFound:
+		return codes.NotFound
+	case http.StatusConflict:
+		return codes.Aborted
+	case http.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	case http.StatusNotImplemented:
+		return codes.Unimplemented
+	case http.StatusBadGateway, http.StatusServiceUnavailable:
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
+
+type restMetadata struct {
+	ModelSpec json.RawMessage `json:"model_spec"`
+	Metadata  struct {
+		SignatureDef json.RawMessage `json:"signature_def"`
+	} `json:"metadata"`
+}
+
+// getSignatures fetches the model metadata from the REST metadata endpoint
+func (bridge *restBridge) getSignatures(ctx context.Context, spec *pb.ModelSpec) (*pb.SignatureDefMap, *pb.ModelSpec, error) {
+	var metadata restMetadata
+	if err := bridge.do(ctx, http.MethodGet, bridge.modelURL(spec)+"/metadata", nil, &metadata); err != nil {
+		return nil, nil, err
+	}
+	modelSpec := &pb.ModelSpec{}
+	signatures := &pb.SignatureDefMap{}
+	unmarshaler := jsonpb.Unmarshaler{AllowUnknownFields: true}
+	if len(metadata.ModelSpec) > 0 {
+		if err := unmarshaler.Unmarshal(bytes.NewReader(metadata.ModelSpec), modelSpec); err != nil {
+			return nil, nil, status.Errorf(codes.Internal, "malformed REST model spec: %v", err)
+		}
+	}
+	if err := unmarshaler.Unmarshal(bytes.NewReader(metadata.Metadata.SignatureDef), signatures); err != nil {
+		return nil, nil, status.Errorf(codes.Internal, "malformed REST signature def: %v", err)
+	}
+	return signatures, modelSpec, nil
+}
+
+// cachedSignatures returns the signatures of the model version in spec,
+// fetching them on first use
+func (bridge *restBridge) cachedSignatures(ctx context.Context, spec *pb.ModelSpec) (*pb.SignatureDefMap, error) {
+	key := ModelKey{Name: spec.GetName(), Version: strconv.FormatInt(spec.GetVersion().GetValue(), 10)}
+	bridge.mutex.RLock()
+	signatures, ok := bridge.signatures[key]
+	bridge.mutex.RUnlock()
+	if ok {
+		return signatures, nil
+	}
+	signatures, _, err := bridge.getSignatures(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	bridge.mutex.Lock()
+	bridge.signatures[key] = signatures
+	bridge.mutex.Unlock()
+	return signatures, nil
+}
+
+// GetModelMetadata answers from the REST metadata endpoint
+func (bridge *restBridge) GetModelMetadata(ctx context.Context, req *pb.GetModelMetadataRequest) (*pb.GetModelMetadataResponse, error) {
+	for _, field := range req.GetMetadataField() {
+		if field != signatureDefField {
+			return nil, status.Errorf(codes.InvalidArgument, "Metadata field %s is not supported", field)
+		}
+	}
+	signatures, modelSpec, err := bridge.getSignatures(ctx, req.GetModelSpec())
+	if err != nil {
+		return nil, err
+	}
+	packed, err := ptypes.MarshalAny(signatures)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not pack signatures: %v", err)
+	}
+	if modelSpec.GetName() == "" {
+		modelSpec = req.GetModelSpec()
+	}
+	return &pb.GetModelMetadataResponse{
+		ModelSpec: modelSpec,
+		Metadata:  map[string]*anypb.Any{signatureDefField: packed},
+	}, nil
+}
+
+// Predict sends the request to the REST predict endpoint in the columnar
+// format and converts the outputs with the dtypes of the model signature
+func (bridge *restBridge) Predict(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+	signatures, err := bridge.cachedSignatures(ctx, req.GetModelSpec())
+	if err != nil {
+		return nil, err
+	}
+	signatureName := req.GetModelSpec().GetSignatureName()
+	if signatureName == "" {
+		signatureName = defaultSignatureName
+	}
+	signature, ok := signatures.GetSignatureDef()[signatureName]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "serving signature name: %q not found in signature def", signatureName)
+	}
+	inputs := make(map[string]interface{}, len(req.GetInputs()))
+	for name, tensor := range req.GetInputs() {
+		value, err := tensorToJSON(tensor, strings.HasSuffix(name, "_bytes"))
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "input %s: %v", name, err)
+		}
+		inputs[name] = value
+	}
+	var res struct {
+		Outputs interface{} `json:"outputs"`
+	}
+	body := map[string]interface{}{"signature_name": signatureName, "inputs": inputs}
+	if err := bridge.do(ctx, http.MethodPost, bridge.modelURL(req.GetModelSpec())+":predict", body, &res); err != nil {
+		return nil, err
+	}
+	// A sole output is not named in the columnar format
+	outputs, named := namedValues(res.Outputs)
+	if len(signature.GetOutputs()) == 1 {
+		for name := range signature.GetOutputs() {
+			if _, ok := outputs[name]; !named || !ok {
+				outputs = map[string]interface{}{name: res.Outputs}
+			}
+		}
+	} else if !named {
+		return nil, status.Error(codes.Internal, "REST response outputs are not named")
+	}
+	filter := make(map[string]bool, len(req.GetOutputFilter()))
+	for _, name := range req.GetOutputFilter() {
+		filter[name] = true
+	}
+	predictRes := &pb.PredictResponse{
+		ModelSpec: req.GetModelSpec(),
+		Outputs:   make(map[string]*framework.TensorProto, len(outputs)),
+	}
+	for name, value := range outputs {
+		if len(filter) > 0 && !filter[name] {
+			continue
+		}
+		info, ok := signature.GetOutputs()[name]
+		if !ok {
+			return nil, status.Errorf(codes.Internal, "REST response has unknown output %s", name)
+		}
+		tensor, err := tensorFromJSON(value, info.GetDtype())
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "output %s: %v", name, err)
+		}
+		predictRes.Outputs[name] = tensor
+	}
+	return predictRes, nil
+}
+
+// pipeListener is an in-memory listener handing out net.Pipe connections
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+var errListenerClosed = errors.New("listener closed")
+
+func (lis *pipeListener) dial(ctx context.Context) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case lis.conns <- server:
+		return client, nil
+	case <-lis.closed:
+		return nil, errListenerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (lis *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-lis.conns:
+		return conn, nil
+	case <-lis.closed:
+		return nil, errListenerClosed
+	}
+}
+
+func (lis *pipeListener) Close() error {
+	lis.once.Do(func() { close(lis.closed) })
+	return nil
+}
+
+func (lis *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,188 @@
+package tfservingproxy
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/tensorflow/tensorflow/tensorflow/go/core/framework"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "restfallback", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// startRESTNode serves the REST api of a TF Serving node hosting the
+// "toy" model of the fixtures. It returns the address of the node and the
+// body of the last predict request.
+func startRESTNode(t *testing.T) (string, func() []byte) {
+	node := tfservingtest.NewRESTNode(t, "toy")
+	node.Handle("toy", "1", func(rw http.ResponseWriter, req *http.Request) {
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/metadata"):
+			rw.Write(readFixture(t, "metadata.json"))
+		case strings.HasSuffix(req.URL.Path, ":predict"):
+			body, _ := ioutil.ReadAll(req.Body)
+			if strings.Contains(string(body), `"single"`) {
+				rw.Write(readFixture(t, "predict_single.response.json"))
+			} else {
+				rw.Write(readFixture(t, "predict.response.json"))
+			}
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write(readFixture(t, "not_found.response.json"))
+		}
+	})
+	node.Handle("", "", func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write(readFixture(t, "not_found.response.json"))
+	})
+	return node.Address(), func() []byte {
+		var lastPredict []byte
+		for _, req := range node.Requests() {
+			if strings.HasSuffix(req.Path, ":predict") {
+				lastPredict = req.Body
+			}
+		}
+		return lastPredict
+	}
+}
+
+func tensor(dtype framework.DataType, dims []int64, fill func(*framework.TensorProto)) *framework.TensorProto {
+	t := &framework.TensorProto{Dtype: dtype, TensorShape: &framework.TensorShapeProto{}}
+	for _, size := range dims {
+		t.TensorShape.Dim = append(t.TensorShape.Dim, &framework.TensorShapeProto_Dim{Size: size})
+	}
+	fill(t)
+	return t
+}
+
+func toySpec(name string) *pb.ModelSpec {
+	return &pb.ModelSpec{Name: name, VersionChoice: &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: 1}}}
+}
+
+func TestGrpcProxyRESTFallbackRoundTrip(t *testing.T) {
+	address, lastPredict := startRESTNode(t)
+	client := startProxy(t, NewGrpcProxyWithResolver(ResolverFunc(func(context.Context, ModelKey) (Resolution, error) {
+		return Resolution{Targets: []Target{{Address: address, REST: true}}}, nil
+	}), WithRESTFallback(nil)))
+
+	res, err := client.Predict(context.Background(), &pb.PredictRequest{
+		ModelSpec: toySpec("toy"),
+		Inputs: map[string]*framework.TensorProto{
+			"f":           tensor(framework.DataType_DT_FLOAT, []int64{2}, func(t *framework.TensorProto) { t.FloatVal = []float32{1.5, -2} }),
+			"d":           tensor(framework.DataType_DT_DOUBLE, []int64{1, 2}, func(t *framework.TensorProto) { t.DoubleVal = []float64{0.1, 1e100} }),
+			"i":           tensor(framework.DataType_DT_INT32, []int64{2}, func(t *framework.TensorProto) { t.IntVal = []int32{1, -7} }),
+			"l":           tensor(framework.DataType_DT_INT64, []int64{2}, func(t *framework.TensorProto) { t.Int64Val = []int64{9007199254740993, -1} }),
+			"b":           tensor(framework.DataType_DT_BOOL, []int64{2}, func(t *framework.TensorProto) { t.BoolVal = []bool{true, false} }),
+			"s":           tensor(framework.DataType_DT_STRING, []int64{2}, func(t *framework.TensorProto) { t.StringVal = [][]byte{[]byte("hello"), []byte("wörld")} }),
+			"image_bytes": tensor(framework.DataType_DT_STRING, []int64{1}, func(t *framework.TensorProto) { t.StringVal = [][]byte{{0xff, 0x00}} }),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSONEqual(t, "predict request", readFixture(t, "predict.request.json"), lastPredict())
+	// json.Number keeps int64 precision that float64 comparison above would lose
+	if !strings.Contains(string(lastPredict()), "9007199254740993") {
+		t.Errorf("int64 input lost precision: %s", lastPredict())
+	}
+
+	expected := map[string]*framework.TensorProto{
+		"f_out":           tensor(framework.DataType_DT_FLOAT, []int64{2}, func(t *framework.TensorProto) { t.FloatVal = []float32{3.25, -0.5} }),
+		"d_out":           tensor(framework.DataType_DT_DOUBLE, []int64{1, 2}, func(t *framework.TensorProto) { t.DoubleVal = []float64{0.2, 2e100} }),
+		"i_out":           tensor(framework.DataType_DT_INT32, []int64{2}, func(t *framework.TensorProto) { t.IntVal = []int32{2, -14} }),
+		"l_out":           tensor(framework.DataType_DT_INT64, []int64{2}, func(t *framework.TensorProto) { t.Int64Val = []int64{9007199254740995, -2} }),
+		"b_out":           tensor(framework.DataType_DT_BOOL, []int64{2}, func(t *framework.TensorProto) { t.BoolVal = []bool{false, true} }),
+		"s_out":           tensor(framework.DataType_DT_STRING, []int64{2}, func(t *framework.TensorProto) { t.StringVal = [][]byte{[]byte("HELLO"), []byte("WÖRLD")} }),
+		"image_bytes_out": tensor(framework.DataType_DT_STRING, []int64{1}, func(t *framework.TensorProto) { t.StringVal = [][]byte{{0x00, 0xff}} }),
+	}
+	if len(res.GetOutputs()) != len(expected) {
+		t.Errorf("Expected %d outputs but got %v", len(expected), res.GetOutputs())
+	}
+	for name, tensor := range expected {
+		if !proto.Equal(tensor, res.GetOutputs()[name]) {
+			t.Errorf("Output %s: expected %v but got %v", name, tensor, res.GetOutputs()[name])
+		}
+	}
+
+	// The sole output of a signature is not named in the REST response
+	spec := toySpec("toy")
+	spec.SignatureName = "single"
+	res, err = client.Predict(context.Background(), &pb.PredictRequest{
+		ModelSpec: spec,
+		Inputs: map[string]*framework.TensorProto{
+			"x": tensor(framework.DataType_DT_FLOAT, []int64{2}, func(t *framework.TensorProto) { t.FloatVal = []float32{1, 2} }),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertJSONEqual(t, "single predict request", readFixture(t, "predict_single.request.json"), lastPredict())
+	y := tensor(framework.DataType_DT_FLOAT, []int64{2}, func(t *framework.TensorProto) { t.FloatVal = []float32{0.5, 1} })
+	if !proto.Equal(y, res.GetOutputs()["y"]) {
+		t.Errorf("Expected output y %v but got %v", y, res.GetOutputs())
+	}
+}
+
+func TestGrpcProxyRESTFallbackMetadataAndErrors(t *testing.T) {
+	address, _ := startRESTNode(t)
+	client := startProxy(t, NewGrpcProxyWithResolver(ResolverFunc(func(context.Context, ModelKey) (Resolution, error) {
+		return Resolution{Targets: []Target{{Address: address, REST: true}}}, nil
+	}), WithRESTFallback(nil)))
+
+	res, err := client.GetModelMetadata(context.Background(), &pb.GetModelMetadataRequest{
+		ModelSpec:     toySpec("toy"),
+		MetadataField: []string{"signature_def"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signatures := &pb.SignatureDefMap{}
+	if err := ptypes.UnmarshalAny(res.GetMetadata()["signature_def"], signatures); err != nil {
+		t.Fatal(err)
+	}
+	if signatures.GetSignatureDef()["serving_default"].GetInputs()["l"].GetDtype() != framework.DataType_DT_INT64 ||
+		res.GetModelSpec().GetName() != "toy" || res.GetModelSpec().GetVersion().GetValue() != 1 {
+		t.Errorf("Unexpected metadata: %v", res)
+	}
+
+	_, err = client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: toySpec("other")})
+	var notFound struct {
+		Error string `json:"error"`
+	}
+	json.Unmarshal(readFixture(t, "not_found.response.json"), &notFound)
+	if status.Code(err) != codes.NotFound || status.Convert(err).Message() != notFound.Error {
+		t.Errorf("Expected NotFound from the REST error but got %v", err)
+	}
+
+	_, err = client.Classify(context.Background(), &pb.ClassificationRequest{ModelSpec: toySpec("toy")})
+	if status.Code(err) != codes.Unimplemented {
+		t.Errorf("Expected Classify to be unimplemented over REST but got %v", err)
+	}
+}
+
+func TestGrpcProxyRESTTargetsNeedFallback(t *testing.T) {
+	client := startProxy(t, NewGrpcProxyWithResolver(ResolverFunc(func(context.Context, ModelKey) (Resolution, error) {
+		return Resolution{Targets: []Target{{Address: "node1:8501", REST: true}}}, nil
+	})))
+	_, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: toySpec("toy")})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected REST target to be unavailable without fallback but got %v", err)
+	}
+}
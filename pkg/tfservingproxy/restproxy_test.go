@@ -0,0 +1,154 @@
+package tfservingproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestRestProxyTypedHandlerErrors(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected int
+	}{
+		{fmt.Errorf("no such model: %w", ErrModelNotFound), http.StatusNotFound},
+		{fmt.Errorf("bad version: %w", ErrInvalidModel), http.StatusBadRequest},
+		{fmt.Errorf("cluster empty: %w", ErrUnavailable), http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		proxy := NewRestProxy(func(*http.Request, string, string) error {
+			return test.err
+		})
+		rw := httptest.NewRecorder()
+		proxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/foo/versions/1:predict", nil))
+		if rw.Code != test.expected {
+			t.Errorf("%v: expected status %d but got %d", test.err, test.expected, rw.Code)
+		}
+	}
+}
+
+func TestRestProxyShutdownWaitsForRequests(t *testing.T) {
+	release := make(chan struct{})
+	upstream := tfservingtest.NewRESTNode(t, "upstream")
+	upstream.Handle("foo", "1", func(rw http.ResponseWriter, req *http.Request) {
+		<-release
+		rw.Write([]byte(`{"predictions": []}`))
+	})
+	upstreamURL := upstream.URL()
+	proxy := NewRestProxy(func(req *http.Request, _ string, _ string) error {
+		req.URL.Scheme, req.URL.Host = upstreamURL.Scheme, upstreamURL.Host
+		return nil
+	})
+
+	served := make(chan int)
+	go func() {
+		rw := httptest.NewRecorder()
+		proxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/foo/versions/1:predict", nil))
+		served <- rw.Code
+	}()
+	for atomic.LoadInt64(&proxy.inFlight) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := proxy.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected Shutdown to time out with a request in flight but got %v", err)
+	}
+	rw := httptest.NewRecorder()
+	proxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/foo/versions/1:predict", nil))
+	if rw.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected requests during shutdown to be rejected but got %d", rw.Code)
+	}
+
+	close(release)
+	if code := <-served; code != http.StatusOK {
+		t.Errorf("Expected the request in flight to complete but got %d", code)
+	}
+	if err := proxy.Shutdown(context.Background()); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+}
+
+func TestRestProxySlowRequestLog(t *testing.T) {
+	upstream := tfservingtest.NewRESTNode(t, "upstream")
+	for model, delay := range map[string]time.Duration{"embedding": 100 * time.Millisecond, "llm": 100 * time.Millisecond, "stuck": time.Second} {
+		delay := delay
+		upstream.Handle(model, "", func(rw http.ResponseWriter, req *http.Request) {
+			select {
+			case <-time.After(delay):
+			case <-req.Context().Done():
+			}
+			rw.Write([]byte(`{"predictions": [1]}`))
+		})
+	}
+	proxy := NewRestProxy(func(req *http.Request, _ string, _ string) error {
+		req.URL.Scheme, req.URL.Host = "http", upstream.Address()
+		return nil
+	}, WithRESTModelLabels(true), WithRESTSlowRequestLog(SlowRequestThresholds{
+		Default:  50 * time.Millisecond,
+		PerModel: map[string]time.Duration{"llm": time.Second},
+	}))
+	proxy.RestProxy.Transport.(*resolveErrorTransport).setUpstreamTimeout(300 * time.Millisecond)
+	before := testutil.ToFloat64(promSlowRequests.WithLabelValues("rest", "embedding", timeoutRuleNone))
+	hook := captureLogs(t)
+	predict := func(model string) int {
+		req := httptest.NewRequest("POST", "/v1/models/"+model+"/versions/3:predict", nil)
+		req.Header.Set(requestIDHeader, "req-"+model)
+		rw := httptest.NewRecorder()
+		proxy.Serve()(rw, req)
+		return rw.Code
+	}
+
+	if code := predict("llm"); code != http.StatusOK {
+		t.Fatalf("Expected the request to succeed but got %d", code)
+	}
+	if entries := slowRequestEntries(hook); len(entries) != 0 {
+		t.Errorf("Expected no slow request logs under the thresholds but got %v", entries[0].Data)
+	}
+	if code := predict("embedding"); code != http.StatusOK {
+		t.Fatalf("Expected the request to succeed but got %d", code)
+	}
+	if code := predict("stuck"); code != http.StatusBadGateway {
+		t.Fatalf("Expected the request to time out but got %d", code)
+	}
+
+	entries := slowRequestEntries(hook)
+	if len(entries) != 2 {
+		t.Fatalf("Expected two slow request logs but got %d", len(entries))
+	}
+	slow := entries[0]
+	if slow.Level != log.WarnLevel || slow.Data["method"] != "POST" || slow.Data["model"] != "embedding" ||
+		slow.Data["version"] != "3" || slow.Data["target"] != upstream.Address() || slow.Data["status"] != http.StatusOK ||
+		slow.Data["request_id"] != "req-embedding" || slow.Data["duration"].(time.Duration) < 50*time.Millisecond {
+		t.Errorf("Unexpected slow request log: %v", slow.Data)
+	}
+	if timedOut := entries[1]; timedOut.Data["status"] != http.StatusBadGateway || timedOut.Data["model"] != "stuck" {
+		t.Errorf("Unexpected slow request log for the timed out request: %v", timedOut.Data)
+	}
+	if n := testutil.ToFloat64(promSlowRequests.WithLabelValues("rest", "embedding", timeoutRuleNone)) - before; n != 1 {
+		t.Errorf("Expected one slow request of embedding to be counted but got %v", n)
+	}
+}
+
+// slowRequestEntries returns the slow REST request warnings among the
+// entries of hook
+func slowRequestEntries(hook *logtest.Hook) []*log.Entry {
+	var entries []*log.Entry
+	for _, entry := range hook.AllEntries() {
+		if strings.HasPrefix(entry.Message, "Slow request") {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
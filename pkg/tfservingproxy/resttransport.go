@@ -0,0 +1,211 @@
+package tfservingproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Defaults of RESTTransportConfig
+const (
+	defaultRESTMaxConnsPerHost     = 256
+	defaultRESTMaxIdleConnsPerHost = 32
+	defaultRESTIdleConnTimeout     = 90 * time.Second
+	defaultRESTConnWait            = time.Second
+)
+
+// errConnLimit is the error of REST requests that found no free
+// connection to their node in time
+var errConnLimit = errors.New("upstream connection limit reached")
+
+// RESTTransportConfig limits the connections of the REST proxy to each
+// node. Zero values are replaced by the defaults.
+type RESTTransportConfig struct {
+	// MaxConnsPerHost is the number of requests sent to a node at once,
+	// and so of connections in use, 256 by default
+	MaxConnsPerHost int `mapstructure:"maxConnsPerHost" yaml:"maxConnsPerHost"`
+	// PerHost overrides MaxConnsPerHost by host:port
+	PerHost map[string]int `mapstructure:"perHost" yaml:"perHost"`
+	// MaxIdleConnsPerHost is the number of idle connections kept per node,
+	// 32 by default
+	MaxIdleConnsPerHost int `mapstructure:"maxIdleConnsPerHost" yaml:"maxIdleConnsPerHost"`
+	// IdleConnTimeout closes connections idle for this long, 90 seconds by
+	// default
+	IdleConnTimeout time.Duration `mapstructure:"idleConnTimeout" yaml:"idleConnTimeout"`
+	// ConnWait is how long a request waits for a connection when its node
+	// is at the limit before failing with 503, 1 second by default
+	ConnWait time.Duration `mapstructure:"connWait" yaml:"connWait"`
+}
+
+// WithRESTTransportLimits sends requests upstream with a transport
+// limited by config instead of the default limits
+func WithRESTTransportLimits(config RESTTransportConfig) RestProxyOption {
+	return func(proxy *RestProxy) {
+		if transport, ok := proxy.RestProxy.Transport.(*resolveErrorTransport); ok {
+			transport.setLimits(config)
+		}
+	}
+}
+
+func (config RESTTransportConfig) validate() error {
+	if config.MaxConnsPerHost < 0 || config.MaxIdleConnsPerHost < 0 {
+		return fmt.Errorf("connection limits must not be negative, got %d and %d", config.MaxConnsPerHost, config.MaxIdleConnsPerHost)
+	}
+	for host, limit := range config.PerHost {
+		if limit <= 0 {
+			return fmt.Errorf("connection limit of %s must be positive, got %d", host, limit)
+		}
+	}
+	if config.IdleConnTimeout < 0 || config.ConnWait < 0 {
+		return errors.New("idle timeout and connection wait must not be negative")
+	}
+	return nil
+}
+
+func (config RESTTransportConfig) withDefaults() RESTTransportConfig {
+	if config.MaxConnsPerHost == 0 {
+		config.MaxConnsPerHost = defaultRESTMaxConnsPerHost
+	}
+	if config.MaxIdleConnsPerHost == 0 {
+		config.MaxIdleConnsPerHost = defaultRESTMaxIdleConnsPerHost
+	}
+	if config.IdleConnTimeout == 0 {
+		config.IdleConnTimeout = defaultRESTIdleConnTimeout
+	}
+	if config.ConnWait == 0 {
+		config.ConnWait = defaultRESTConnWait
+	}
+	return config
+}
+
+// newRESTTransport creates the upstream transport of a RestProxy. It caps
+// the connections per host at the highest limit of config, as hostLimits
+// enforces the limit of each host.
+func newRESTTransport(config RESTTransportConfig) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxConnsPerHost = config.MaxConnsPerHost
+	for _, limit := range config.PerHost {
+		if limit > transport.MaxConnsPerHost {
+			transport.MaxConnsPerHost = limit
+		}
+	}
+	transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	transport.IdleConnTimeout = config.IdleConnTimeout
+	return transport
+}
+
+// setLimits replaces the upstream transport with one limited by config.
+// Requests in flight keep the old transport, whose idle connections are
+// closed.
+func (transport *resolveErrorTransport) setLimits(config RESTTransportConfig) {
+	config = config.withDefaults()
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	base := newRESTTransport(config)
+	if old, ok := transport.base.(*http.Transport); ok {
+		base.ResponseHeaderTimeout = old.ResponseHeaderTimeout
+		old.CloseIdleConnections()
+	}
+	if transport.dial != nil {
+		base.DialContext = networkDialer(transport.dial)
+	}
+	transport.base = base
+	transport.limits = newHostLimits(config)
+}
+
+// setDialer replaces the upstream transport with one connecting to the
+// nodes with dial. Requests in flight keep the old transport, whose idle
+// connections are closed.
+func (transport *resolveErrorTransport) setDialer(dial func(ctx context.Context, address string) (net.Conn, error)) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	transport.dial = dial
+	old, ok := transport.base.(*http.Transport)
+	if !ok {
+		return
+	}
+	base := old.Clone()
+	base.DialContext = networkDialer(dial)
+	transport.base = base
+	old.CloseIdleConnections()
+}
+
+// networkDialer adapts dial to http.Transport.DialContext
+func networkDialer(dial func(ctx context.Context, address string) (net.Conn, error)) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	return func(ctx context.Context, _ string, address string) (net.Conn, error) {
+		return dial(ctx, address)
+	}
+}
+
+// hostLimits limits the requests in flight to each node
+type hostLimits struct {
+	config RESTTransportConfig
+	hosts  map[string]chan struct{}
+	mutex  sync.Mutex
+}
+
+func newHostLimits(config RESTTransportConfig) *hostLimits {
+	return &hostLimits{config: config, hosts: make(map[string]chan struct{})}
+}
+
+// acquire takes a connection slot of host, waiting at most ConnWait. The
+// returned function frees the slot.
+func (limits *hostLimits) acquire(ctx context.Context, host string) (func(), error) {
+	slots := limits.slots(host)
+	select {
+	case slots <- struct{}{}:
+		return limitRelease(slots), nil
+	default:
+	}
+	timer := time.NewTimer(limits.config.ConnWait)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return limitRelease(slots), nil
+	case <-timer.C:
+		promRESTConns.WithLabelValues(restRejected).Inc()
+		return nil, fmt.Errorf("no connection to %s within %v: %w", host, limits.config.ConnWait, errConnLimit)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (limits *hostLimits) slots(host string) chan struct{} {
+	limits.mutex.Lock()
+	defer limits.mutex.Unlock()
+	slots, ok := limits.hosts[host]
+	if !ok {
+		limit, ok := limits.config.PerHost[host]
+		if !ok {
+			limit = limits.config.MaxConnsPerHost
+		}
+		slots = make(chan struct{}, limit)
+		limits.hosts[host] = slots
+	}
+	return slots
+}
+
+func limitRelease(slots chan struct{}) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-slots })
+	}
+}
+
+// releasingBody frees the connection slot of a request once its response
+// body is closed
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (body *releasingBody) Close() error {
+	err := body.ReadCloser.Close()
+	body.release()
+	return err
+}
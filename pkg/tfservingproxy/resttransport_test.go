@@ -0,0 +1,59 @@
+package tfservingproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRESTConnectionLimitRejectsWhenFull(t *testing.T) {
+	upstream := tfservingtest.NewRESTNode(t, "upstream")
+	upstream.Handle("foo", "", func(rw http.ResponseWriter, req *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+		rw.Write([]byte(`{"predictions": [1]}`))
+	})
+	proxy := NewRestProxy(func(req *http.Request, _ string, _ string) error {
+		req.URL.Scheme, req.URL.Host = "http", upstream.Address()
+		return nil
+	}, WithRESTTransportLimits(RESTTransportConfig{PerHost: map[string]int{upstream.Address(): 1}, ConnWait: 20 * time.Millisecond}))
+	before := testutil.ToFloat64(promRESTConns.WithLabelValues(restRejected))
+
+	codes := make([]int, 3)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rw := httptest.NewRecorder()
+			proxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/foo/versions/1:predict", nil))
+			codes[i] = rw.Code
+		}(i)
+	}
+	wg.Wait()
+
+	counts := make(map[int]int)
+	for _, code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusOK] != 1 || counts[http.StatusServiceUnavailable] != 2 {
+		t.Errorf("Expected one request to get the connection and the others 503 but got %v", codes)
+	}
+	if n := len(upstream.Requests()); n != 1 {
+		t.Errorf("Expected only one request upstream but got %d", n)
+	}
+	if n := testutil.ToFloat64(promRESTConns.WithLabelValues(restRejected)) - before; n != 2 {
+		t.Errorf("Expected two rejections to be counted but got %v", n)
+	}
+
+	// The connection is free again once the response is done
+	rw := httptest.NewRecorder()
+	proxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/foo/versions/1:predict", nil))
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected the connection to be released but got %d", rw.Code)
+	}
+}
@@ -0,0 +1,108 @@
+package tfservingproxy
+
+import (
+	"context"
+	"strconv"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Trailer keys set on proxied calls when WithRoutingTrailers is used
+const (
+	// TrailerTarget is the upstream target that served the call
+	TrailerTarget = "tfservingcache-target"
+	// TrailerModel is the model key the call was routed for, as name:version
+	TrailerModel = "tfservingcache-model"
+	// TrailerCache is "hit", "miss" or "miss-queued" if the resolver
+	// reported whether the model was already loaded
+	TrailerCache = "tfservingcache-cache"
+	// TrailerRetries is the number of times the call was retried upstream
+	TrailerRetries = "tfservingcache-retries"
+	// TrailerCanary is "true" if the version in TrailerModel was chosen by
+	// a canary split
+	TrailerCanary = "tfservingcache-canary"
+)
+
+// routeInfo records how a call was routed
+type routeInfo struct {
+	key     ModelKey
+	target  string
+	cache   CacheDisposition
+	retries int
+	canary  bool
+	dryRun  bool
+	// arm is the experiment arm the request was assigned to
+	arm string
+	// timeoutRule is the timeout rule that set the deadline of the call
+	timeoutRule string
+	// weight is the weight of the target chosen among candidates with a
+	// total weight of totalWeight, or zero if it was not chosen by weight
+	weight      int
+	totalWeight int
+	// waitForReady is set if the last attempt waited for a ready
+	// connection to its node
+	waitForReady bool
+	// fault is the type of the fault injected into the request, if any
+	fault FaultType
+}
+
+// routeKey is the context key of the routeInfo of a call
+type routeKey struct{}
+
+// withRoute returns a context in which forward records how the call was
+// routed, so that interceptors can report it
+func withRoute(ctx context.Context) (context.Context, *routeInfo) {
+	if route, ok := ctx.Value(routeKey{}).(*routeInfo); ok {
+		return ctx, route
+	}
+	route := &routeInfo{}
+	return context.WithValue(ctx, routeKey{}, route), route
+}
+
+// WithRoutingTrailers sets trailer metadata on each proxied call telling
+// the caller how the call was routed, see the Trailer constants.
+func WithRoutingTrailers() GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.tunables.routingTrailers = true
+	}
+}
+
+// WithUpstreamRetries retries calls that fail with Unavailable upstream
+// up to retries times, resolving the model again before each retry. TF
+// Serving calls have no side effects, so retrying them is safe. Calls that
+// waited for a ready connection already had their deadline to succeed and
+// are not retried, see WithWaitForReady.
+func WithUpstreamRetries(retries int) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.tunables.upstreamRetries = retries
+	}
+}
+
+// shouldRetry returns whether a call that failed with err should be retried
+func (settings *tunables) shouldRetry(ctx context.Context, err error, route *routeInfo) bool {
+	return err != nil && status.Code(err) == codes.Unavailable && !route.waitForReady &&
+		route.retries < settings.upstreamRetries && ctx.Err() == nil
+}
+
+// setRoutingTrailers sets the routing trailers of the call in ctx
+func (server *proxyServiceServer) setRoutingTrailers(ctx context.Context, route *routeInfo) {
+	md := metadata.Pairs(
+		TrailerModel, route.key.String(),
+		TrailerRetries, strconv.Itoa(route.retries),
+	)
+	if route.canary {
+		md.Set(TrailerCanary, "true")
+	}
+	if route.target != "" {
+		md.Set(TrailerTarget, route.target)
+	}
+	if cache := route.cache.String(); cache != "" {
+		md.Set(TrailerCache, cache)
+	}
+	if err := grpc.SetTrailer(ctx, md); err != nil {
+		server.loggerFor(ctx).WithError(err).Debug("Could not set routing trailers")
+	}
+}
@@ -0,0 +1,257 @@
+package tfservingproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultRoutingLogSize is the number of decisions a RoutingLog keeps if
+// no size is given
+const DefaultRoutingLogSize = 4096
+
+// defaultRoutingLogLimit is the number of decisions ServeRecent returns if
+// the request has no limit
+const defaultRoutingLogLimit = 100
+
+// requestIDHeader is the header and metadata key of the request id
+const requestIDHeader = "x-request-id"
+
+// RoutingDecision describes how a request was routed. It never holds
+// request or response payloads.
+type RoutingDecision struct {
+	Time      time.Time     `json:"time"`
+	RequestID string        `json:"requestId,omitempty"`
+	Protocol  string        `json:"protocol"`
+	Model     string        `json:"model"`
+	Version   string        `json:"version"`
+	Target    string        `json:"target,omitempty"`
+	Outcome   string        `json:"outcome"`
+	Duration  time.Duration `json:"duration"`
+	// DryRun is set if the request was resolved but not forwarded
+	DryRun bool `json:"dryRun,omitempty"`
+	// Arm is the experiment arm the request was assigned to
+	Arm string `json:"arm,omitempty"`
+	// Cache is "hit", "miss" or "miss-queued" if the resolver reported
+	// whether the model was already loaded
+	Cache string `json:"cache,omitempty"`
+	// Weight is the weight of Target if it was chosen by weight among
+	// candidates with a total weight of TotalWeight
+	Weight      int `json:"weight,omitempty"`
+	TotalWeight int `json:"totalWeight,omitempty"`
+	// Fault is the type of the fault injected into the request, if any
+	Fault string `json:"fault,omitempty"`
+}
+
+// RoutingLog keeps the most recent routing decisions in a ring buffer.
+// Recording takes a single atomic increment, so it can stay enabled in
+// production. A RoutingLog may be shared by a GrpcProxy and a RestProxy.
+type RoutingLog struct {
+	slots []atomic.Value // *RoutingDecision
+	next  uint64
+}
+
+// NewRoutingLog creates a RoutingLog keeping the last size decisions, or
+// DefaultRoutingLogSize if size is not positive
+func NewRoutingLog(size int) *RoutingLog {
+	if size <= 0 {
+		size = DefaultRoutingLogSize
+	}
+	return &RoutingLog{slots: make([]atomic.Value, size)}
+}
+
+// WithRoutingLog records the routing decision of each grpc call in
+// routingLog
+func WithRoutingLog(routingLog *RoutingLog) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.serverImpl.routingLog = routingLog
+	}
+}
+
+// WithRESTRoutingLog records the routing decision of each REST request in
+// routingLog
+func WithRESTRoutingLog(routingLog *RoutingLog) RestProxyOption {
+	return func(proxy *RestProxy) {
+		proxy.routingLog = routingLog
+	}
+}
+
+// record adds decision to the log, overwriting the oldest decision if the
+// log is full
+func (routingLog *RoutingLog) record(decision RoutingDecision) {
+	i := atomic.AddUint64(&routingLog.next, 1) - 1
+	routingLog.slots[i%uint64(len(routingLog.slots))].Store(&decision)
+}
+
+// Recent returns up to limit of the most recent decisions for model, or
+// for all models if model is empty, newest first. A non-positive limit
+// returns all of them.
+func (routingLog *RoutingLog) Recent(model string, limit int) []RoutingDecision {
+	size := uint64(len(routingLog.slots))
+	if limit <= 0 || uint64(limit) > size {
+		limit = int(size)
+	}
+	next := atomic.LoadUint64(&routingLog.next)
+	decisions := make([]RoutingDecision, 0, limit)
+	for n := uint64(0); n < size && n < next && len(decisions) < limit; n++ {
+		decision, ok := routingLog.slots[(next-1-n)%size].Load().(*RoutingDecision)
+		if !ok {
+			continue
+		}
+		if model == "" || decision.Model == model {
+			decisions = append(decisions, *decision)
+		}
+	}
+	return decisions
+}
+
+// ServeRecent writes the most recent decisions as JSON. The model and
+// limit query parameters select the model and the number of decisions.
+func (routingLog *RoutingLog) ServeRecent(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(rw, http.StatusMethodNotAllowed, "Use GET to read routing decisions")
+		return
+	}
+	limit := defaultRoutingLogLimit
+	if value := req.URL.Query().Get("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			writeError(rw, http.StatusBadRequest, "Limit must be a positive number")
+			return
+		}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(routingLog.Recent(req.URL.Query().Get("model"), limit)); err != nil {
+		log.WithError(err).Error("Could not write routing decisions")
+	}
+}
+
+// recordRoute records the routing decision of a grpc call for modelSpec
+// that returned err. route is nil if the call was rejected before routing.
+func (server *proxyServiceServer) recordRoute(ctx context.Context, modelSpec *pb.ModelSpec, route *routeInfo, start time.Time, err error) {
+	decision := RoutingDecision{
+		Time:      start,
+		RequestID: requestID(ctx),
+		Protocol:  "grpc",
+		Model:     modelSpec.GetName(),
+		Version:   modelKeyForSpec(modelSpec).Version,
+		Outcome:   status.Code(err).String(),
+		Duration:  time.Since(start),
+	}
+	if route != nil {
+		decision.Version, decision.Target, decision.DryRun, decision.Arm = route.key.Version, route.target, route.dryRun, route.arm
+		decision.Cache = route.cache.String()
+		decision.Weight, decision.TotalWeight = route.weight, route.totalWeight
+		decision.Fault = string(route.fault)
+	}
+	server.routingLog.record(decision)
+}
+
+// recordRoute records the routing decision of the REST request req, whose
+// response was written to rec
+func (handler *RestProxy) recordRoute(req *http.Request, route *routeInfo, rec *statusRecorder, start time.Time) {
+	decision := RoutingDecision{
+		Time:      start,
+		RequestID: restRequestID(req),
+		Protocol:  "rest",
+		Target:    route.target,
+		DryRun:    route.dryRun,
+		Arm:       route.arm,
+		Cache:     route.cache.String(),
+		Outcome:   strconv.Itoa(http.StatusOK),
+		Duration:  time.Since(start),
+	}
+	decision.Weight, decision.TotalWeight = route.weight, route.totalWeight
+	decision.Fault = string(route.fault)
+	if rec.status != 0 {
+		decision.Outcome = strconv.Itoa(rec.status)
+	}
+	if key, _, err := ParseRESTPath(req.URL.Path); err == nil {
+		decision.Model, decision.Version = key.Name, key.Version
+	}
+	if route.key.Version != "" {
+		decision.Version = route.key.Version
+	}
+	handler.routingLog.record(decision)
+}
+
+// requestID returns the request id sent by the caller of the grpc call in
+// ctx, or the trace id if there is none
+func requestID(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(requestIDHeader); len(ids) > 0 {
+			return ids[0]
+		}
+	}
+	return traceID(ctx)
+}
+
+// restRequestID returns the request id header of req, or the trace id if
+// there is none
+func restRequestID(req *http.Request) string {
+	if id := req.Header.Get(requestIDHeader); id != "" {
+		return id
+	}
+	return traceID(req.Context())
+}
+
+// traceID returns the id of the trace of ctx, or an empty string
+func traceID(ctx context.Context) string {
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.IsValid() {
+		return spanContext.TraceID().String()
+	}
+	return ""
+}
+
+// statusRecorder records the status code written to a ResponseWriter
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(statusCode int) {
+	if rec.status == 0 {
+		rec.status = statusCode
+	}
+	rec.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack takes over the connection of the underlying ResponseWriter, if
+// it allows that
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer cannot be hijacked")
+	}
+	return hijacker.Hijack()
+}
+
+// Unwrap returns the underlying ResponseWriter
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
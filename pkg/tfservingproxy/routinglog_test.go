@@ -0,0 +1,112 @@
+package tfservingproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestRoutingLogKeepsMostRecent(t *testing.T) {
+	routingLog := NewRoutingLog(3)
+	var recording sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		recording.Add(1)
+		go func() {
+			defer recording.Done()
+			for j := 0; j < 100; j++ {
+				routingLog.record(RoutingDecision{Model: "other"})
+				routingLog.Recent("", 0)
+			}
+		}()
+	}
+	recording.Wait()
+	for i := 1; i <= 5; i++ {
+		routingLog.record(RoutingDecision{Model: "foo", Version: strconv.Itoa(i)})
+	}
+
+	decisions := routingLog.Recent("", 0)
+	if len(decisions) != 3 || decisions[0].Version != "5" || decisions[2].Version != "3" {
+		t.Errorf("Expected the three newest decisions, newest first, but got %+v", decisions)
+	}
+	if decisions := routingLog.Recent("foo", 2); len(decisions) != 2 || decisions[1].Version != "4" {
+		t.Errorf("Expected the limit to apply but got %+v", decisions)
+	}
+	if decisions := routingLog.Recent("other", 0); len(decisions) != 0 {
+		t.Errorf("Expected overwritten decisions to be gone but got %+v", decisions)
+	}
+}
+
+func TestRoutingLogRecordsGrpcCalls(t *testing.T) {
+	routingLog := NewRoutingLog(10)
+	harness := tfservingtest.NewHarness(t, tfservingtest.ProviderError("missing", errors.New("no nodes")))
+	client := harness.Serve(NewGrpcProxy(harness.ClientProvider, WithRoutingLog(routingLog)))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), requestIDHeader, "req-1")
+	if _, err := client.Predict(ctx, &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo", VersionChoice: &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: 2}}}}); err != nil {
+		t.Fatal(err)
+	}
+	client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "missing"}})
+
+	decisions := routingLog.Recent("", 0)
+	if len(decisions) != 2 {
+		t.Fatalf("Expected two decisions but got %+v", decisions)
+	}
+	failed, served := decisions[0], decisions[1]
+	if served.RequestID != "req-1" || served.Protocol != "grpc" || served.Model != "foo" || served.Version != "2" ||
+		served.Target != "upstream" || served.Outcome != "OK" || served.Duration <= 0 {
+		t.Errorf("Unexpected decision for a served call: %+v", served)
+	}
+	if failed.Model != "missing" || failed.Target != "" || failed.Outcome != "Unavailable" {
+		t.Errorf("Unexpected decision for a failed call: %+v", failed)
+	}
+}
+
+func TestRoutingLogRecordsRestRequests(t *testing.T) {
+	routingLog := NewRoutingLog(10)
+	upstream := tfservingtest.NewRESTNode(t, "upstream")
+	upstream.Respond("foo", "", http.StatusOK, `{"predictions": [1]}`)
+	proxy := NewRestProxy(func(req *http.Request, model string, _ string) error {
+		if model == "bar" {
+			return ErrModelNotFound
+		}
+		req.URL.Scheme, req.URL.Host = upstream.URL().Scheme, upstream.URL().Host
+		return nil
+	}, WithRESTRoutingLog(routingLog))
+	for _, path := range []string{"/v1/models/foo/versions/1:predict", "/v1/models/bar/versions/1:predict"} {
+		req := httptest.NewRequest("POST", path, nil)
+		req.Header.Set("X-Request-Id", "req-"+path)
+		proxy.Serve()(httptest.NewRecorder(), req)
+	}
+
+	rw := httptest.NewRecorder()
+	routingLog.ServeRecent(rw, httptest.NewRequest("GET", "/admin/debug/routing?model=foo&limit=5", nil))
+	var decisions []RoutingDecision
+	if err := json.NewDecoder(rw.Body).Decode(&decisions); err != nil {
+		t.Fatal(err)
+	}
+	if len(decisions) != 1 {
+		t.Fatalf("Expected one decision for foo but got %+v", decisions)
+	}
+	if d := decisions[0]; d.Protocol != "rest" || d.Version != "1" || d.Target != upstream.URL().Host || d.Outcome != "200" || d.RequestID != "req-/v1/models/foo/versions/1:predict" {
+		t.Errorf("Unexpected decision for a served request: %+v", d)
+	}
+	if d := routingLog.Recent("bar", 1); len(d) != 1 || d[0].Outcome != "404" || d[0].Target != "" {
+		t.Errorf("Expected an unrouted request to be recorded with its status but got %+v", d)
+	}
+
+	rw = httptest.NewRecorder()
+	routingLog.ServeRecent(rw, httptest.NewRequest("GET", "/admin/debug/routing?limit=-1", nil))
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid limit but got %d", rw.Code)
+	}
+}
@@ -0,0 +1,86 @@
+package tfservingproxy
+
+import (
+	"context"
+
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+// Service is a TF Serving grpc service the proxy can expose
+type Service int
+
+const (
+	// PredictionService is tensorflow.serving.PredictionService
+	PredictionService Service = 1 << iota
+	// SessionService is tensorflow.serving.SessionService
+	SessionService
+	// ModelService is tensorflow.serving.ModelService. Only
+	// GetModelStatus is proxied, config reloads are not.
+	ModelService
+	// HealthService is grpc.health.v1.Health, reporting whether the
+	// proxy is ready
+	HealthService
+)
+
+// defaultServices are the services registered when WithServices is not used
+const defaultServices = PredictionService | SessionService | HealthService
+
+// WithServices sets the services the proxy registers. Calls to other
+// services fail with the standard unknown service error. By default
+// PredictionService, SessionService and HealthService are registered.
+func WithServices(services ...Service) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.services = 0
+		for _, service := range services {
+			proxy.services |= service
+		}
+	}
+}
+
+// WithReflection registers the grpc reflection service, listing the
+// services registered on the proxy
+func WithReflection() GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.reflection = true
+	}
+}
+
+// registerServices registers the configured services on server
+func (proxy *GrpcProxy) registerServices(server *grpc.Server) {
+	if proxy.services&PredictionService != 0 {
+		pb.RegisterPredictionServiceServer(server, proxy.serverImpl)
+	}
+	if proxy.services&SessionService != 0 {
+		pb.RegisterSessionServiceServer(server, proxy.serverImpl)
+	}
+	if proxy.services&ModelService != 0 {
+		pb.RegisterModelServiceServer(server, proxy.serverImpl)
+	}
+	if proxy.services&HealthService != 0 {
+		healthpb.RegisterHealthServer(server, proxy.readiness.health)
+	}
+	proxy.registerChannelz(server)
+	if proxy.reflection {
+		reflection.Register(server)
+	}
+}
+
+// GetModelStatus - provides the status of a model on the node serving it.
+func (server *proxyServiceServer) GetModelStatus(ctx context.Context, req *pb.GetModelStatusRequest) (*pb.GetModelStatusResponse, error) {
+	var res *pb.GetModelStatusResponse
+	err := server.forward(ctx, req.GetModelSpec(), func(ctx context.Context, client *grpc.ClientConn, opts ...grpc.CallOption) (err error) {
+		res, err = pb.NewModelServiceClient(client).GetModelStatus(ctx, req, opts...)
+		return err
+	})
+	return res, err
+}
+
+// HandleReloadConfigRequest is not supported, model configs are managed by the cache.
+func (server *proxyServiceServer) HandleReloadConfigRequest(ctx context.Context, req *pb.ReloadConfigRequest) (*pb.ReloadConfigResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "HandleReloadConfigRequest not supported")
+}
@@ -0,0 +1,116 @@
+package tfservingproxy
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc/status"
+)
+
+var promShadowRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_shadow_requests_total",
+	Help: "The total number of shadow Predict calls by status code",
+}, []string{"model", "code"})
+var promShadowDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_shadow_dropped_total",
+	Help: "The total number of shadow Predict calls dropped because too many were in flight",
+}, []string{"model"})
+var promShadowDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Name: "tfservingcache_proxy_shadow_request_duration_seconds",
+	Help: "The latency of shadow Predict calls",
+}, []string{"model"})
+
+// defaultShadowTimeout bounds shadow calls of requests without a deadline
+const defaultShadowTimeout = 10 * time.Second
+
+// Shadow duplicates a share of the Predict calls of a model to another
+// version of it
+type Shadow struct {
+	// Version is the model version receiving the copies
+	Version int64
+	// Percent is the share of Predict calls to copy, from 0 to 100
+	Percent float64
+}
+
+// WithShadowing asynchronously copies Predict calls to the shadow versions
+// in shadows, keyed by model name. Calls are copied once the proxy admits
+// them, so rejected calls and dry runs are not copied. The copies are resolved on their own,
+// their responses are discarded and their outcome is only recorded in the
+// shadow metrics. At most maxInFlight copies run at a time; further
+// copies are dropped, so shadowing is off unless maxInFlight is positive.
+func WithShadowing(shadows map[string]Shadow, maxInFlight int) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.serverImpl.shadower = &shadower{
+			shadows: shadows,
+			slots:   make(chan struct{}, maxInFlight),
+		}
+	}
+}
+
+// shadower sends the shadow copies of Predict calls
+type shadower struct {
+	shadows map[string]Shadow
+	slots   chan struct{}
+}
+
+// shadowKey is the context key of a Predict request to shadow
+type shadowKey struct{}
+
+// withShadow returns a context in which forward shadows req once the call
+// is admitted, so that rejected calls and dry runs are never copied
+func withShadow(ctx context.Context, req *pb.PredictRequest) context.Context {
+	return context.WithValue(ctx, shadowKey{}, req)
+}
+
+// shadowPredict starts a shadow copy of req if its model is shadowed and
+// the call is sampled. It never blocks the primary call.
+func (server *proxyServiceServer) shadowPredict(ctx context.Context, req *pb.PredictRequest) {
+	shadow, ok := server.shadower.shadows[req.GetModelSpec().GetName()]
+	if !ok || rand.Float64()*100 >= shadow.Percent {
+		return
+	}
+	modelLabel := server.modelLabel(req.GetModelSpec().GetName())
+	select {
+	case server.shadower.slots <- struct{}{}:
+	default:
+		promShadowDropped.WithLabelValues(modelLabel).Inc()
+		return
+	}
+	shadowReq := proto.Clone(req).(*pb.PredictRequest)
+	shadowReq.ModelSpec.VersionChoice = &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: shadow.Version}}
+
+	// The copy must outlive the primary call, so it only keeps its deadline
+	timeout := defaultShadowTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+	logger := server.loggerFor(ctx)
+	go func() {
+		defer func() { <-server.shadower.slots }()
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		start := time.Now()
+		err := server.shadowCall(ctx, shadowReq)
+		promShadowDuration.WithLabelValues(modelLabel).Observe(time.Since(start).Seconds())
+		promShadowRequests.WithLabelValues(modelLabel, status.Code(err).String()).Inc()
+		if err != nil {
+			logger.WithError(err).Debugf("Shadow call to model %s failed", modelKeyForSpec(shadowReq.GetModelSpec()))
+		}
+	}()
+}
+
+// shadowCall resolves and calls the shadow version, discarding the response
+func (server *proxyServiceServer) shadowCall(ctx context.Context, req *pb.PredictRequest) error {
+	client, _, err := server.resolve(ctx, modelKeyForSpec(req.GetModelSpec()))
+	if err != nil {
+		return status.Error(grpcCode(err), err.Error())
+	}
+	_, err = pb.NewPredictionServiceClient(client).Predict(ctx, req)
+	return err
+}
@@ -0,0 +1,175 @@
+package tfservingproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultShutdownGracePeriod is how long Close waits for in-flight calls
+const defaultShutdownGracePeriod = 5 * time.Second
+
+// drainPollInterval is how often draining checks for in-flight calls
+const drainPollInterval = 10 * time.Millisecond
+
+// errShuttingDown is returned for calls arriving while the proxy shuts down
+var errShuttingDown = fmt.Errorf("proxy is shutting down: %w", ErrUnavailable)
+
+// WithShutdownGracePeriod sets how long Close waits for in-flight calls,
+// both to the proxy and to upstream nodes, before closing connections
+// under them. It defaults to 5 seconds.
+func WithShutdownGracePeriod(grace time.Duration) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.shutdownGrace = grace
+	}
+}
+
+// stopReady makes health checks report the proxy as not serving
+func (proxy *GrpcProxy) stopReady() {
+	proxy.readiness.health.Shutdown()
+}
+
+// drain stops accepting calls and waits for those in flight until ctx is
+// done, then stops the server under them
+func (proxy *GrpcProxy) drain(ctx context.Context) error {
+	var err error
+	proxy.listenerMutex.Lock()
+	if proxy.listener != nil {
+		err = proxy.listener.Close()
+	}
+	proxy.listenerMutex.Unlock()
+	proxy.stopWarming()
+	proxy.gracefulStop(ctx)
+	return err
+}
+
+// closeUpstream closes the upstream connections once their calls are done
+// or ctx is done, and then the Handler of the proxy
+func (proxy *GrpcProxy) closeUpstream(ctx context.Context) error {
+	err := proxy.serverImpl.conns.drain(ctx)
+	if closeErr := proxy.lifecycle.close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// gracefulStop stops the grpc server, waiting for its calls until ctx is
+// done
+func (proxy *GrpcProxy) gracefulStop(ctx context.Context) {
+	stopped := make(chan struct{})
+	go func() {
+		proxy.GrpcProxy.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		proxy.serverImpl.logger.Warn("Grpc calls did not finish within the shutdown grace period, stopping the server")
+		proxy.GrpcProxy.Stop()
+	}
+}
+
+// inFlight returns the number of calls still running on the connection
+func (counters *callCounters) inFlight() int64 {
+	return atomic.LoadInt64(&counters.started) - atomic.LoadInt64(&counters.succeeded) - atomic.LoadInt64(&counters.failed)
+}
+
+// drain stops handing out connections, waits until ctx is done for the
+// calls on them to finish and then closes them
+func (manager *connManager) drain(ctx context.Context) error {
+	manager.mutex.Lock()
+	manager.closed = true
+	manager.mutex.Unlock()
+
+	for manager.inFlight() > 0 && ctx.Err() == nil {
+		time.Sleep(drainPollInterval)
+	}
+	manager.mutex.RLock()
+	for address, conn := range manager.conns {
+		if n := conn.calls.inFlight(); n > 0 {
+			log.Warnf("Closing grpc connection %s with %d calls in flight", address, n)
+		}
+	}
+	for key, balanced := range manager.balanced {
+		if n := balanced.calls.inFlight(); n > 0 {
+			log.Warnf("Closing balanced grpc connection for model %s with %d calls in flight", key, n)
+		}
+	}
+	manager.mutex.RUnlock()
+	return manager.Close()
+}
+
+// inFlight returns the number of calls running on all connections
+func (manager *connManager) inFlight() int64 {
+	manager.mutex.RLock()
+	defer manager.mutex.RUnlock()
+	var n int64
+	for _, conn := range manager.conns {
+		n += conn.calls.inFlight()
+	}
+	for _, balanced := range manager.balanced {
+		n += balanced.calls.inFlight()
+	}
+	return n
+}
+
+// Start starts the Handler of the proxy. Call it before serving requests
+// if the Handler implements Starter.
+func (handler *RestProxy) Start(ctx context.Context) error {
+	return handler.lifecycle.start(ctx)
+}
+
+// Shutdown stops the REST proxy from accepting requests and waits for the
+// requests being proxied to finish or ctx to be done. Idle upstream
+// connections and the Handler of the proxy are then closed.
+func (handler *RestProxy) Shutdown(ctx context.Context) error {
+	return shutdown(ctx, []shutdownStages{handler}, nil)
+}
+
+// stopReady answers new requests with 503
+func (handler *RestProxy) stopReady() {
+	atomic.StoreInt32(&handler.shuttingDown, 1)
+}
+
+// drain waits for the requests being proxied to finish or ctx to be done
+func (handler *RestProxy) drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&handler.inFlight) > 0 {
+		select {
+		case <-ctx.Done():
+			log.Warnf("Shutting down REST proxy with %d requests in flight", atomic.LoadInt64(&handler.inFlight))
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// closeUpstream closes the idle upstream connections and the Handler of
+// the proxy
+func (handler *RestProxy) closeUpstream(context.Context) error {
+	if transport, ok := handler.RestProxy.Transport.(*resolveErrorTransport); ok {
+		if closer, ok := transport.roundTripper().(interface{ CloseIdleConnections() }); ok {
+			closer.CloseIdleConnections()
+		}
+	}
+	return handler.lifecycle.close()
+}
+
+// admit counts a request as in flight unless the proxy is shutting down.
+// The returned function must be called when the request is done.
+func (handler *RestProxy) admit(rw http.ResponseWriter) (func(), bool) {
+	atomic.AddInt64(&handler.inFlight, 1)
+	done := func() { atomic.AddInt64(&handler.inFlight, -1) }
+	if atomic.LoadInt32(&handler.shuttingDown) == 1 {
+		done()
+		writeError(rw, http.StatusServiceUnavailable, errShuttingDown.Error())
+		return nil, false
+	}
+	return done, true
+}
@@ -0,0 +1,124 @@
+package tfservingproxy
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var promSlowRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_slow_requests_total",
+	Help: "The total number of requests taking longer than the slow request threshold of their model",
+}, []string{"protocol", "model", "timeout_rule"})
+
+// SlowRequestThresholds are the durations above which calls are logged as slow
+type SlowRequestThresholds struct {
+	// Default is the threshold for models not in PerModel. Zero disables
+	// logging for them.
+	Default time.Duration
+	// PerModel overrides the default threshold for specific models
+	PerModel map[string]time.Duration
+}
+
+func (thresholds *SlowRequestThresholds) thresholdFor(modelName string) time.Duration {
+	if threshold, ok := thresholds.PerModel[modelName]; ok {
+		return threshold
+	}
+	return thresholds.Default
+}
+
+// WithSlowRequestLog logs a warning for each call taking longer than its
+// model's threshold, whether it succeeded or not.
+func WithSlowRequestLog(thresholds SlowRequestThresholds) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.interceptors = append(proxy.interceptors, slowRequestInterceptor(thresholds, proxy.serverImpl))
+	}
+}
+
+func slowRequestInterceptor(thresholds SlowRequestThresholds, server *proxyServiceServer) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		var modelName string
+		if specReq, ok := req.(modelSpecRequest); ok {
+			modelName = specReq.GetModelSpec().GetName()
+		}
+		threshold := thresholds.thresholdFor(modelName)
+		if threshold <= 0 {
+			return handler(ctx, req)
+		}
+		start := time.Now()
+		deadline, hasDeadline := ctx.Deadline()
+		ctx, route := withRoute(ctx)
+		res, err := handler(ctx, req)
+		duration := time.Since(start)
+		if duration < threshold {
+			return res, err
+		}
+		fields := log.Fields{
+			"method":       info.FullMethod,
+			"model":        route.key.Name,
+			"version":      route.key.Version,
+			"target":       route.target,
+			"duration":     duration,
+			"code":         status.Code(err).String(),
+			"timeout_rule": route.timeoutRule,
+		}
+		if route.key.Name == "" {
+			fields["model"] = modelName
+		}
+		if hasDeadline {
+			fields["deadline"] = deadline.Sub(start)
+		}
+		promSlowRequests.WithLabelValues("grpc", server.modelLabel(modelName), route.timeoutRule).Inc()
+		server.loggerFor(ctx).WithFields(fields).Warnf("Slow call to %s took %v", info.FullMethod, duration)
+		return res, err
+	}
+}
+
+// WithRESTSlowRequestLog logs a warning for each REST request taking
+// longer than its model's threshold, whatever its status
+func WithRESTSlowRequestLog(thresholds SlowRequestThresholds) RestProxyOption {
+	return func(proxy *RestProxy) {
+		proxy.slowRequests = &thresholds
+	}
+}
+
+// logSlowREST logs req if it took longer than the threshold of its model
+// since start
+func (handler *RestProxy) logSlowREST(req *http.Request, route *routeInfo, rec *statusRecorder, start time.Time) {
+	if handler.slowRequests == nil {
+		return
+	}
+	key, _, err := ParseRESTPath(req.URL.Path)
+	if err != nil {
+		return
+	}
+	threshold := handler.slowRequests.thresholdFor(key.Name)
+	duration := time.Since(start)
+	if threshold <= 0 || duration < threshold {
+		return
+	}
+	if route.key.Version != "" {
+		key.Version = route.key.Version
+	}
+	code := rec.status
+	if code == 0 {
+		code = http.StatusOK
+	}
+	fields := log.Fields{
+		logFieldRequestID: restRequestID(req),
+		"method":          req.Method,
+		"model":           key.Name,
+		"version":         key.Version,
+		"target":          route.target,
+		"duration":        duration,
+		"status":          code,
+	}
+	promSlowRequests.WithLabelValues("rest", handler.modelLabel(key.Name), timeoutRuleNone).Inc()
+	restLogger(req).WithFields(fields).Warnf("Slow request to %s took %v", req.URL.Path, duration)
+}
@@ -0,0 +1,108 @@
+package tfservingproxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var promStaleRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_stale_routing_retries_total",
+	Help: "The total number of requests resolved again because the node they were routed to did not have the model, by whether the retry succeeded",
+}, []string{"protocol", "outcome"})
+
+// Outcomes of promStaleRetries
+const (
+	staleSuccess = "success"
+	staleFailure = "failure"
+)
+
+// servableNotFound is how TF Serving starts the message of errors for
+// models it does not have loaded
+const servableNotFound = "Servable not found"
+
+// Invalidator is implemented by a Resolver or Handler that caches where
+// models are. When a node answers that it does not have the model it was
+// routed to, the proxy calls Invalidate and then resolves the model once
+// more to retry the request.
+type Invalidator interface {
+	Invalidate(key ModelKey)
+}
+
+// isStaleRouting returns whether err is a node answering that it does not
+// have the model, as happens when routing is behind the cluster state
+func isStaleRouting(err error) bool {
+	st, ok := status.FromError(err)
+	if !ok || (st.Code() != codes.NotFound && st.Code() != codes.FailedPrecondition) {
+		return false
+	}
+	return strings.Contains(st.Message(), servableNotFound)
+}
+
+// invalidate drops the cached resolution of key, if the resolver caches
+func (server *proxyServiceServer) invalidate(key ModelKey) {
+	if server.invalidator != nil {
+		server.invalidator.Invalidate(key)
+	}
+}
+
+// staleOutcome returns the outcome of a retry that ended with err
+func staleOutcome(err error) string {
+	if err != nil {
+		return staleFailure
+	}
+	return staleSuccess
+}
+
+// isStaleREST returns whether res is a node answering that it does not
+// have the model. The body of res is left to be read again.
+func isStaleREST(res *http.Response) bool {
+	if res.StatusCode != http.StatusNotFound {
+		return false
+	}
+	head, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1<<16))
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), res.Body), res.Body}
+	return bytes.Contains(head, []byte(servableNotFound))
+}
+
+// retryStale resolves req again once its node answered res, that it does
+// not have the model, and sends it to the new target
+func (transport *resolveErrorTransport) retryStale(req *http.Request, res *http.Response, body []byte) (*http.Response, error) {
+	original, ok := req.Context().Value(undirectedKey{}).(*undirected)
+	if !ok || req.Context().Err() != nil {
+		return res, nil
+	}
+	if transport.invalidate != nil {
+		transport.invalidate(original.key)
+	}
+	next := transport.resolveAgain(req)
+	if next != nil && transport.drains.Drained(next.URL.Host) {
+		next = transport.avoidDrained(next)
+	}
+	if next == nil {
+		promStaleRetries.WithLabelValues("rest", staleFailure).Inc()
+		return res, nil
+	}
+	discard(res)
+	restLogger(req).Warnf("Node %s does not have model %s, retrying on %s", req.URL.Host, original.key, next.URL.Host)
+	retarget(req, next)
+	addLogFields(req.Context(), log.Fields{logFieldAttempt: 2, logFieldTarget: next.URL.Host})
+	res, err := transport.send(next, body)
+	outcome := staleSuccess
+	if err != nil || res.StatusCode >= http.StatusBadRequest {
+		outcome = staleFailure
+	}
+	promStaleRetries.WithLabelValues("rest", outcome).Inc()
+	return res, err
+}
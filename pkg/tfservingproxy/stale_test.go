@@ -0,0 +1,113 @@
+package tfservingproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// staleHandler routes to stale until it is invalidated and to fresh after
+type staleHandler struct {
+	stale, fresh string
+	invalidated  bool
+	mutex        sync.Mutex
+}
+
+func (h *staleHandler) target() string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.invalidated {
+		return h.fresh
+	}
+	return h.stale
+}
+
+func (h *staleHandler) Invalidate(key ModelKey) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.invalidated = true
+}
+
+func (h *staleHandler) ResolveGRPC(ctx context.Context, key ModelKey) (Resolution, error) {
+	return Resolution{Targets: []Target{{Address: h.target()}}}, nil
+}
+
+func (h *staleHandler) ResolveREST(ctx context.Context, key ModelKey, req *http.Request) error {
+	req.URL.Scheme, req.URL.Host = "http", h.target()
+	return nil
+}
+
+func TestGrpcRetriesStaleRouting(t *testing.T) {
+	stale := tfservingtest.NewGRPCNode(t, "stale", tfservingtest.WithPredict(func(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+		return nil, status.Error(codes.NotFound, "Servable not found for request: Specific(foo, 1)")
+	}))
+	fresh := tfservingtest.NewGRPCNode(t, "fresh")
+	handler := &staleHandler{stale: stale.Address(), fresh: fresh.Address()}
+	client := startProxy(t, NewGrpcProxyWithHandler(handler,
+		WithUpstreamDialOptions(tfservingtest.DialNodes(stale, fresh), grpc.WithInsecure())))
+	before := testutil.ToFloat64(promStaleRetries.WithLabelValues("grpc", staleSuccess))
+
+	if _, err := client.Predict(context.Background(), predictVersion("foo", 1)); err != nil {
+		t.Fatalf("Expected the call to be retried on the node with the model but got %v", err)
+	}
+	tfservingtest.AssertReached(t, stale, "foo", "1")
+	tfservingtest.AssertReached(t, fresh, "foo", "1")
+	if n := testutil.ToFloat64(promStaleRetries.WithLabelValues("grpc", staleSuccess)) - before; n != 1 {
+		t.Errorf("Expected one successful stale routing retry but got %v", n)
+	}
+}
+
+func TestGrpcRetriesStaleRoutingOnce(t *testing.T) {
+	stale := tfservingtest.NewGRPCNode(t, "stale", tfservingtest.WithPredict(func(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+		return nil, status.Error(codes.NotFound, "Servable not found for request: Specific(foo, 1)")
+	}))
+	handler := &staleHandler{stale: stale.Address(), fresh: stale.Address()}
+	client := startProxy(t, NewGrpcProxyWithHandler(handler,
+		WithUpstreamDialOptions(tfservingtest.DialNodes(stale), grpc.WithInsecure())))
+	before := testutil.ToFloat64(promStaleRetries.WithLabelValues("grpc", staleFailure))
+
+	_, err := client.Predict(context.Background(), predictVersion("foo", 1))
+	if status.Code(err) != codes.NotFound || len(stale.Requests()) != 2 {
+		t.Errorf("Expected the upstream error after a single retry but got %v after %d calls", err, len(stale.Requests()))
+	}
+	if n := testutil.ToFloat64(promStaleRetries.WithLabelValues("grpc", staleFailure)) - before; n != 1 {
+		t.Errorf("Expected one failed stale routing retry but got %v", n)
+	}
+}
+
+func TestRESTRetriesStaleRouting(t *testing.T) {
+	// Nodes without a handler for a model answer 404 like TF Serving
+	stale := tfservingtest.NewRESTNode(t, "stale")
+	fresh := tfservingtest.NewRESTNode(t, "fresh")
+	fresh.Respond("foo", "1", http.StatusOK, `{"predictions": [1]}`)
+	handler := &staleHandler{stale: stale.Address(), fresh: fresh.Address()}
+	proxy := NewRestProxyWithHandler(handler)
+	before := testutil.ToFloat64(promStaleRetries.WithLabelValues("rest", staleSuccess))
+
+	rw := httptest.NewRecorder()
+	proxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/foo/versions/1:predict", nil))
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected the request to be retried on the node with the model but got %d", rw.Code)
+	}
+	tfservingtest.AssertReached(t, stale, "foo", "1")
+	if n := testutil.ToFloat64(promStaleRetries.WithLabelValues("rest", staleSuccess)) - before; n != 1 {
+		t.Errorf("Expected one successful stale routing retry but got %v", n)
+	}
+
+	// Other 404s are relayed as they are
+	fresh.Respond("bar", "1", http.StatusNotFound, `{"error": "Not found"}`)
+	rw = httptest.NewRecorder()
+	proxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/bar/versions/1:predict", nil))
+	if rw.Code != http.StatusNotFound || rw.Body.String() != `{"error": "Not found"}` || len(fresh.Requests()) != 2 {
+		t.Errorf("Expected other 404s to be relayed but got %d %s", rw.Code, rw.Body)
+	}
+}
@@ -0,0 +1,40 @@
+package tfservingproxy
+
+import (
+	"strconv"
+
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ProxyResourceType is the resource type set on the ResourceInfo detail
+// attached to statuses that originate in the proxy rather than upstream.
+const ProxyResourceType = "tfservingcache.proxy"
+
+// proxyStatus builds the status returned for a failure that happened in the
+// proxy itself. If err already carries a gRPC status its code and message are
+// kept, otherwise code is used. A ResourceInfo detail identifies the proxy,
+// the model and the upstream target (if one was selected) so callers can tell
+// proxy errors apart from errors reported by TF Serving.
+func proxyStatus(code codes.Code, modelSpec *pb.ModelSpec, target string, err error) *status.Status {
+	st, ok := status.FromError(err)
+	if !ok || st.Code() == codes.Unknown {
+		st = status.New(code, err.Error())
+	}
+	description := "no upstream target selected"
+	if target != "" {
+		description = "upstream target: " + target
+	}
+	detailed, detailErr := st.WithDetails(&errdetails.ResourceInfo{
+		ResourceType: ProxyResourceType,
+		ResourceName: modelSpec.GetName() + ":" + strconv.FormatInt(modelSpec.GetVersion().GetValue(), 10),
+		Owner:        "tfservingcache",
+		Description:  description,
+	})
+	if detailErr != nil {
+		return st
+	}
+	return detailed
+}
@@ -0,0 +1,382 @@
+package tfservingproxy
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/tensorflow/tensorflow/tensorflow/go/core/example"
+	"github.com/tensorflow/tensorflow/tensorflow/go/core/framework"
+)
+
+// This file converts between TF Serving's REST JSON values and the
+// protobuf messages of its grpc api. JSON must be decoded with UseNumber
+// so integers and floats can be told apart and keep their precision.
+
+// b64Key is the key of JSON objects holding base64 encoded binary values
+const b64Key = "b64"
+
+// tensorFromJSON converts a JSON value of nested lists into a tensor of dtype
+func tensorFromJSON(value interface{}, dtype framework.DataType) (*framework.TensorProto, error) {
+	var shape []int64
+	var leaves []interface{}
+	if err := flattenJSON(value, 0, &shape, &leaves); err != nil {
+		return nil, err
+	}
+	tensor := &framework.TensorProto{Dtype: dtype, TensorShape: &framework.TensorShapeProto{}}
+	for _, size := range shape {
+		tensor.TensorShape.Dim = append(tensor.TensorShape.Dim, &framework.TensorShapeProto_Dim{Size: size})
+	}
+	for _, leaf := range leaves {
+		if err := appendTensorValue(tensor, leaf); err != nil {
+			return nil, err
+		}
+	}
+	return tensor, nil
+}
+
+// flattenJSON appends the leaves of value to leaves and checks that the
+// nested lists are rectangular, recording their shape
+func flattenJSON(value interface{}, depth int, shape *[]int64, leaves *[]interface{}) error {
+	list, ok := value.([]interface{})
+	if !ok {
+		if depth != len(*shape) {
+			return fmt.Errorf("tensor has mixed nesting depths")
+		}
+		*leaves = append(*leaves, value)
+		return nil
+	}
+	if depth == len(*shape) {
+		if len(*leaves) > 0 {
+			return fmt.Errorf("tensor has mixed nesting depths")
+		}
+		*shape = append(*shape, int64(len(list)))
+	} else if depth > len(*shape) || (*shape)[depth] != int64(len(list)) {
+		return fmt.Errorf("tensor lists at depth %d have different lengths", depth)
+	}
+	for _, item := range list {
+		if err := flattenJSON(item, depth+1, shape, leaves); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appendTensorValue(tensor *framework.TensorProto, leaf interface{}) error {
+	switch tensor.Dtype {
+	case framework.DataType_DT_STRING:
+		value, err := jsonBytes(leaf)
+		if err != nil {
+			return err
+		}
+		tensor.StringVal = append(tensor.StringVal, value)
+		return nil
+	case framework.DataType_DT_BOOL:
+		value, ok := leaf.(bool)
+		if !ok {
+			return fmt.Errorf("expected bool but got %v", leaf)
+		}
+		tensor.BoolVal = append(tensor.BoolVal, value)
+		return nil
+	}
+	number, ok := leaf.(json.Number)
+	if !ok {
+		return fmt.Errorf("expected number but got %v", leaf)
+	}
+	switch tensor.Dtype {
+	case framework.DataType_DT_FLOAT:
+		value, err := strconv.ParseFloat(number.String(), 32)
+		tensor.FloatVal = append(tensor.FloatVal, float32(value))
+		return err
+	case framework.DataType_DT_DOUBLE:
+		value, err := strconv.ParseFloat(number.String(), 64)
+		tensor.DoubleVal = append(tensor.DoubleVal, value)
+		return err
+	case framework.DataType_DT_INT32, framework.DataType_DT_INT16, framework.DataType_DT_INT8,
+		framework.DataType_DT_UINT8, framework.DataType_DT_UINT16:
+		value, err := strconv.ParseInt(number.String(), 10, 32)
+		tensor.IntVal = append(tensor.IntVal, int32(value))
+		return err
+	case framework.DataType_DT_INT64:
+		value, err := strconv.ParseInt(number.String(), 10, 64)
+		tensor.Int64Val = append(tensor.Int64Val, value)
+		return err
+	case framework.DataType_DT_UINT32:
+		value, err := strconv.ParseUint(number.String(), 10, 32)
+		tensor.Uint32Val = append(tensor.Uint32Val, uint32(value))
+		return err
+	case framework.DataType_DT_UINT64:
+		value, err := strconv.ParseUint(number.String(), 10, 64)
+		tensor.Uint64Val = append(tensor.Uint64Val, value)
+		return err
+	}
+	return fmt.Errorf("unsupported tensor dtype %s", tensor.Dtype)
+}
+
+// jsonBytes returns the bytes of a JSON string or base64 object
+func jsonBytes(leaf interface{}) ([]byte, error) {
+	switch value := leaf.(type) {
+	case string:
+		return []byte(value), nil
+	case map[string]interface{}:
+		if encoded, ok := value[b64Key].(string); ok && len(value) == 1 {
+			return base64.StdEncoding.DecodeString(encoded)
+		}
+	}
+	return nil, fmt.Errorf("expected string but got %v", leaf)
+}
+
+// isB64Object returns whether value is a base64 encoded binary value
+func isB64Object(value interface{}) bool {
+	object, ok := value.(map[string]interface{})
+	if !ok || len(object) != 1 {
+		return false
+	}
+	_, ok = object[b64Key]
+	return ok
+}
+
+// tensorToJSON converts a tensor to a JSON value of nested lists. Strings
+// are base64 encoded if binary is set or they are not valid UTF-8.
+func tensorToJSON(tensor *framework.TensorProto, binary bool) (interface{}, error) {
+	values, err := tensorValues(tensor, binary)
+	if err != nil {
+		return nil, err
+	}
+	dims := tensor.GetTensorShape().GetDim()
+	size := int64(1)
+	for _, dim := range dims {
+		size *= dim.GetSize()
+	}
+	if int64(len(values)) != size {
+		// A single value fills the whole tensor
+		if len(values) != 1 {
+			return nil, fmt.Errorf("tensor has %d values but its shape holds %d", len(values), size)
+		}
+		filled := make([]interface{}, size)
+		for i := range filled {
+			filled[i] = values[0]
+		}
+		values = filled
+	}
+	if len(dims) == 0 {
+		return values[0], nil
+	}
+	return nestJSON(values, dims), nil
+}
+
+// nestJSON splits values into nested lists of the given dimensions
+func nestJSON(values []interface{}, dims []*framework.TensorShapeProto_Dim) []interface{} {
+	size := dims[0].GetSize()
+	nested := make([]interface{}, size)
+	if len(dims) == 1 {
+		copy(nested, values)
+		return nested
+	}
+	stride := int64(len(values)) / max64(size, 1)
+	for i := int64(0); i < size; i++ {
+		nested[i] = nestJSON(values[i*stride:(i+1)*stride], dims[1:])
+	}
+	return nested
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// tensorValues returns the flat values of tensor as JSON values
+func tensorValues(tensor *framework.TensorProto, binary bool) ([]interface{}, error) {
+	if len(tensor.TensorContent) > 0 {
+		return tensorContentValues(tensor)
+	}
+	var values []interface{}
+	switch tensor.Dtype {
+	case framework.DataType_DT_FLOAT:
+		for _, v := range tensor.FloatVal {
+			values = append(values, floatJSON(float64(v), 32))
+		}
+	case framework.DataType_DT_DOUBLE:
+		for _, v := range tensor.DoubleVal {
+			values = append(values, floatJSON(v, 64))
+		}
+	case framework.DataType_DT_INT32, framework.DataType_DT_INT16, framework.DataType_DT_INT8,
+		framework.DataType_DT_UINT8, framework.DataType_DT_UINT16:
+		for _, v := range tensor.IntVal {
+			values = append(values, json.Number(strconv.FormatInt(int64(v), 10)))
+		}
+	case framework.DataType_DT_INT64:
+		for _, v := range tensor.Int64Val {
+			values = append(values, json.Number(strconv.FormatInt(v, 10)))
+		}
+	case framework.DataType_DT_UINT32:
+		for _, v := range tensor.Uint32Val {
+			values = append(values, json.Number(strconv.FormatUint(uint64(v), 10)))
+		}
+	case framework.DataType_DT_UINT64:
+		for _, v := range tensor.Uint64Val {
+			values = append(values, json.Number(strconv.FormatUint(v, 10)))
+		}
+	case framework.DataType_DT_BOOL:
+		for _, v := range tensor.BoolVal {
+			values = append(values, v)
+		}
+	case framework.DataType_DT_STRING:
+		for _, v := range tensor.StringVal {
+			if binary || !utf8.Valid(v) {
+				values = append(values, map[string]interface{}{b64Key: base64.StdEncoding.EncodeToString(v)})
+			} else {
+				values = append(values, string(v))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported tensor dtype %s", tensor.Dtype)
+	}
+	return values, nil
+}
+
+// tensorContentValues decodes the little endian tensor_content of tensor
+func tensorContentValues(tensor *framework.TensorProto) ([]interface{}, error) {
+	content := tensor.TensorContent
+	var width int
+	var decode func([]byte) interface{}
+	switch tensor.Dtype {
+	case framework.DataType_DT_FLOAT:
+		width = 4
+		decode = func(b []byte) interface{} {
+			return floatJSON(float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), 32)
+		}
+	case framework.DataType_DT_DOUBLE:
+		width = 8
+		decode = func(b []byte) interface{} { return floatJSON(math.Float64frombits(binary.LittleEndian.Uint64(b)), 64) }
+	case framework.DataType_DT_INT32:
+		width = 4
+		decode = func(b []byte) interface{} {
+			return json.Number(strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(b))), 10))
+		}
+	case framework.DataType_DT_INT64:
+		width = 8
+		decode = func(b []byte) interface{} {
+			return json.Number(strconv.FormatInt(int64(binary.LittleEndian.Uint64(b)), 10))
+		}
+	case framework.DataType_DT_UINT8:
+		width = 1
+		decode = func(b []byte) interface{} { return json.Number(strconv.Itoa(int(b[0]))) }
+	case framework.DataType_DT_BOOL:
+		width = 1
+		decode = func(b []byte) interface{} { return b[0] != 0 }
+	default:
+		return nil, fmt.Errorf("unsupported tensor_content dtype %s", tensor.Dtype)
+	}
+	if len(content)%width != 0 {
+		return nil, fmt.Errorf("tensor_content has %d bytes, not a multiple of %d", len(content), width)
+	}
+	values := make([]interface{}, 0, len(content)/width)
+	for i := 0; i < len(content); i += width {
+		values = append(values, decode(content[i:i+width]))
+	}
+	return values, nil
+}
+
+// floatJSON returns the shortest JSON number for v. JSON has no NaN or
+// infinity, they are rendered as strings.
+func floatJSON(v float64, bitSize int) interface{} {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "Infinity"
+	case math.IsInf(v, -1):
+		return "-Infinity"
+	}
+	return json.Number(strconv.FormatFloat(v, 'g', -1, bitSize))
+}
+
+// exampleFromJSON converts a JSON object of features into an Example.
+// Integers become int64 lists, numbers with a fraction or exponent float
+// lists, and strings or base64 objects bytes lists.
+func exampleFromJSON(value interface{}) (*example.Example, error) {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected example object but got %v", value)
+	}
+	features := make(map[string]*example.Feature, len(object))
+	for name, featureValue := range object {
+		feature, err := featureFromJSON(featureValue)
+		if err != nil {
+			return nil, fmt.Errorf("feature %s: %v", name, err)
+		}
+		features[name] = feature
+	}
+	return &example.Example{Features: &example.Features{Feature: features}}, nil
+}
+
+func featureFromJSON(value interface{}) (*example.Feature, error) {
+	items, ok := value.([]interface{})
+	if !ok {
+		items = []interface{}{value}
+	}
+	if len(items) == 0 {
+		return &example.Feature{}, nil
+	}
+	switch items[0].(type) {
+	case string, map[string]interface{}:
+		list := &example.BytesList{}
+		for _, item := range items {
+			value, err := jsonBytes(item)
+			if err != nil {
+				return nil, err
+			}
+			list.Value = append(list.Value, value)
+		}
+		return &example.Feature{Kind: &example.Feature_BytesList{BytesList: list}}, nil
+	case json.Number:
+		isFloat := false
+		for _, item := range items {
+			number, ok := item.(json.Number)
+			if !ok {
+				return nil, fmt.Errorf("expected number but got %v", item)
+			}
+			isFloat = isFloat || strings.ContainsAny(number.String(), ".eE")
+		}
+		if isFloat {
+			list := &example.FloatList{}
+			for _, item := range items {
+				value, err := strconv.ParseFloat(item.(json.Number).String(), 32)
+				if err != nil {
+					return nil, err
+				}
+				list.Value = append(list.Value, float32(value))
+			}
+			return &example.Feature{Kind: &example.Feature_FloatList{FloatList: list}}, nil
+		}
+		list := &example.Int64List{}
+		for _, item := range items {
+			value, err := strconv.ParseInt(item.(json.Number).String(), 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			list.Value = append(list.Value, value)
+		}
+		return &example.Feature{Kind: &example.Feature_Int64List{Int64List: list}}, nil
+	}
+	return nil, fmt.Errorf("unsupported feature value %v", items[0])
+}
+
+// sortedKeys returns the keys of m in order
+func sortedKeys(m map[string]*framework.TensorProto) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
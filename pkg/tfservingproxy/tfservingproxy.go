@@ -2,23 +2,33 @@ package tfservingproxy
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/http/httputil"
-	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 )
 
-var tfServingRestURLMatch = regexp.MustCompile(`(?i)^/v1/models/(?P<modelName>[^/]+)(/versions/(?P<version>[0-9]+))?`)
 var promRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
 	Name: "tfservingcache_proxy_requests_total",
 	Help: "The total number of requests",
@@ -31,55 +41,247 @@ var promRequestsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
 // RestProxy is the proxy for the TFServing HTTP REST api that directs
 // api calls to the right nodes
 type RestProxy struct {
-	RestProxy      *httputil.ReverseProxy
-	successCounter *prometheus.CounterVec
-	errorCounter   *prometheus.CounterVec
+	RestProxy        *httputil.ReverseProxy
+	successCounter   *prometheus.CounterVec
+	errorCounter     *prometheus.CounterVec
+	transcoder       *Transcoder
+	transcodedModels map[string]bool
+	rateLimiter      *RateLimiter
+	clientQuotas     *ClientQuotas
+	dryRuns          *DryRuns
+	faults           *Faults
+	experiments      *Experiments
+	fairQueue        *FairQueue
+	handler          Handler
+	metadataCache    *MetadataCache
+	metadataMaxAge   time.Duration
+	routingLog       *RoutingLog
+	slowRequests     *SlowRequestThresholds
+	topModels        *TopModels
+	modelLabels      bool
+	cacheHeader      bool
+	bodyTransforms   *bodyTransforms
+	coalescer        *coalescer
+	requestHeaders   *headerFilter
+	responseHeaders  *headerFilter
+	hooks            Hooks
+	lifecycle        *lifecycle
+	logger           log.FieldLogger
+	inFlight         int64
+	shuttingDown     int32
 }
 
 // GrpcProxy is the proxy for the TFServing GRPC api that directs
 // api calls to the right nodes
 type GrpcProxy struct {
-	GrpcProxy  *grpc.Server
-	serverImpl *proxyServiceServer
-	listener   net.Listener
+	GrpcProxy           *grpc.Server
+	serverImpl          *proxyServiceServer
+	listener            net.Listener
+	listenerMutex       sync.Mutex
+	tracerProvider      trace.TracerProvider
+	interceptors        []grpc.UnaryServerInterceptor
+	serverOptions       []grpc.ServerOption
+	upstreamDialOptions []grpc.DialOption
+	upstreamDialer      func(ctx context.Context, address string) (net.Conn, error)
+	egress              *EgressProxies
+	shutdownGrace       time.Duration
+	warmModels          func() []ModelKey
+	warmBackoff         warmBackoff
+	serverTLS           *tls.Config
+	maxRecvMsgSize      int
+	maxSendMsgSize      int
+	registry            prometheus.Registerer
+	optionErrors        []error
+	warming             context.Context
+	stopWarming         context.CancelFunc
+	inFlight            int64
+	services            Service
+	reflection          bool
+	channelz            bool
+	readiness           *readiness
+	tunables            tunables
+	reconfigure         sync.Mutex
+	lifecycle           *lifecycle
+	requestLog          *RequestLogConfig
+	authenticator       Authenticator
+	// unary is the chain of interceptors calls go through
+	unary grpc.UnaryServerInterceptor
 }
 
 // NewRestProxy creates a new RestProxy for TF Serving
-func NewRestProxy(handler func(req *http.Request, modelName string, version string) error) *RestProxy {
+func NewRestProxy(handler func(req *http.Request, modelName string, version string) error, opts ...RestProxyOption) *RestProxy {
+	return NewRestProxyWithHandler(HandlerFuncs{REST: handler}, opts...)
+}
+
+// NewRestProxyWithHandler creates a new RestProxy for TF Serving that
+// routes requests with handler.ResolveREST
+func NewRestProxyWithHandler(handler Handler, opts ...RestProxyOption) *RestProxy {
 	promRequestsTotal.WithLabelValues("rest")
 	promRequestsFailed.WithLabelValues("rest")
 
+	h := &RestProxy{
+		handler:   handler,
+		lifecycle: newLifecycle(handler),
+		logger:    log.StandardLogger(),
+	}
+	transport := &resolveErrorTransport{resolve: h.resolveREST}
+	transport.setLimits(RESTTransportConfig{})
+	if invalidator, ok := handler.(Invalidator); ok {
+		transport.invalidate = invalidator.Invalidate
+	}
 	director := func(req *http.Request) {
-		log.Debugf("Handling URL: %s", req.URL.String())
-		matches := tfServingRestURLMatch.FindStringSubmatch(req.URL.String())
-		log.Debugf("Model name: '%s' Version: '%s'", matches[1], matches[3])
-		err := handler(req, matches[1], matches[3])
+		removeHopByHopHeaders(req.Header)
+		h.requestHeaders.apply(req.Header)
+		key, _, err := ParseRESTPath(req.URL.Path)
+		if err == nil {
+			*req = *withUndirected(req, key)
+			err = h.resolveREST(req, key)
+		}
+		if err == nil && transport.drains.Drained(req.URL.Host) {
+			*req = *transport.avoidDrained(req)
+		}
 		if err != nil {
-			promRequestsFailed.WithLabelValues("rest").Inc()
-		} else {
-			promRequestsFailed.WithLabelValues("rest").Inc()
+			// Abort in the transport, the director cannot fail by itself
+			*req = *req.WithContext(context.WithValue(req.Context(), resolveErrorKey{}, err))
+			return
 		}
+		if route, ok := req.Context().Value(routeKey{}).(*routeInfo); ok {
+			route.target = req.URL.Host
+		}
+		addLogFields(req.Context(), log.Fields{logFieldTarget: req.URL.Host})
+		restHooks(req).forward(req.Context(), key, req.URL.Host)
 	}
-	h := &RestProxy{
-		RestProxy: &httputil.ReverseProxy{Director: director},
+	h.RestProxy = &httputil.ReverseProxy{
+		Director:     director,
+		Transport:    transport,
+		ErrorHandler: restErrorHandler,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	next := h.RestProxy.ModifyResponse
+	h.RestProxy.ModifyResponse = func(res *http.Response) error {
+		h.filterResponseHeaders(res)
+		if h.cacheHeader {
+			setCacheHeader(res)
+		}
+		completeREST(res)
+		if next != nil {
+			return next(res)
+		}
+		return nil
 	}
-
 	return h
 }
 
-// NewGrpcProxy creates a new GrpcProxy for TF Serving
-func NewGrpcProxy(clientProvider func(modelName string, version string) (*grpc.ClientConn, error)) *GrpcProxy {
+// NewGrpcProxy creates a new GrpcProxy for TF Serving that forwards
+// requests to the connection returned by clientProvider
+func NewGrpcProxy(clientProvider func(modelName string, version string) (*grpc.ClientConn, error), opts ...GrpcProxyOption) *GrpcProxy {
+	return NewGrpcProxyWithResolver(ClientProviderFunc(clientProvider), opts...)
+}
+
+// NewGrpcProxyWithHandler creates a new GrpcProxy for TF Serving that
+// forwards requests to the targets found by handler.ResolveGRPC. It
+// panics if an option is invalid or the options contradict each other.
+func NewGrpcProxyWithHandler(handler Handler, opts ...GrpcProxyOption) *GrpcProxy {
+	proxy := NewGrpcProxyWithResolver(ResolverFunc(handler.ResolveGRPC), opts...)
+	proxy.lifecycle = newLifecycle(handler)
+	proxy.serverImpl.invalidator, _ = handler.(Invalidator)
+	return proxy
+}
+
+// NewGrpcProxyWithResolver creates a new GrpcProxy for TF Serving that
+// forwards requests to the targets found by resolver. It panics if an
+// option is invalid or the options contradict each other.
+func NewGrpcProxyWithResolver(resolver Resolver, opts ...GrpcProxyOption) *GrpcProxy {
+	proxy, err := newGrpcProxy(resolver, opts...)
+	if err != nil {
+		panic(err)
+	}
+	return proxy
+}
+
+// newGrpcProxy creates a GrpcProxy like NewGrpcProxyWithResolver but
+// returns an error for invalid options and metrics that cannot be
+// registered
+func newGrpcProxy(resolver Resolver, opts ...GrpcProxyOption) (*GrpcProxy, error) {
 	promRequestsTotal.WithLabelValues("grpc")
 	promRequestsFailed.WithLabelValues("grpc")
+	promInFlight.WithLabelValues("grpc")
+	promShed.WithLabelValues("grpc")
+	promNotReady.WithLabelValues("grpc")
+	promDeadlineRejected.WithLabelValues("grpc")
 
+	invalidator, _ := resolver.(Invalidator)
 	server := proxyServiceServer{
-		clientProvider: clientProvider,
+		resolver:    resolver,
+		invalidator: invalidator,
+		propagator:  otel.GetTextMapPropagator(),
+		logger:      log.StandardLogger(),
 	}
 
 	proxy := GrpcProxy{
-		serverImpl: &server,
+		serverImpl:     &server,
+		tracerProvider: trace.NewNoopTracerProvider(),
+		services:       defaultServices,
+		shutdownGrace:  defaultShutdownGracePeriod,
+		warmBackoff:    defaultWarmBackoff,
+		readiness:      newReadiness(),
+		tunables:       tunables{canaries: newCanaries()},
+	}
+	proxy.warming, proxy.stopWarming = context.WithCancel(context.Background())
+	server.conns = newConnManager(proxy.DialUpstream)
+	for _, opt := range opts {
+		opt(&proxy)
+	}
+	if err := proxy.validate(); err != nil {
+		return nil, err
 	}
-	return &proxy
+	if proxy.registry != nil {
+		if err := registerMetrics(proxy.registry); err != nil {
+			return nil, err
+		}
+	}
+	live := proxy.tunables
+	server.live.Store(&live)
+	go server.conns.evictIdleLoop()
+	server.tracer = proxy.tracerProvider.Tracer(tracerName)
+	interceptors := []grpc.UnaryServerInterceptor{
+		server.logFieldsInterceptor,
+		codeInterceptor,
+	}
+	if proxy.requestLog != nil {
+		interceptors = append(interceptors, server.requestLogInterceptor(*proxy.requestLog))
+	}
+	// Unauthenticated calls are rejected before they take up any resources
+	if proxy.authenticator != nil {
+		interceptors = append(interceptors, authInterceptor(proxy.authenticator))
+	}
+	interceptors = append(interceptors,
+		proxy.inFlightInterceptor,
+		proxy.readiness.interceptor,
+		server.timeoutInterceptor,
+		tracingInterceptor(server.tracer, server.propagator),
+		server.payloadInterceptor,
+	)
+	proxy.interceptors = append(interceptors, proxy.interceptors...)
+	proxy.unary = chainUnaryInterceptors(proxy.interceptors)
+	serverOptions := []grpc.ServerOption{
+		grpc.UnaryInterceptor(proxy.unary),
+	}
+	if proxy.serverTLS != nil {
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(proxy.serverTLS)))
+	}
+	if proxy.maxRecvMsgSize > 0 {
+		serverOptions = append(serverOptions, grpc.MaxRecvMsgSize(proxy.maxRecvMsgSize), grpc.MaxSendMsgSize(proxy.maxSendMsgSize))
+		proxy.upstreamDialOptions = append([]grpc.DialOption{
+			grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(proxy.maxSendMsgSize)),
+		}, proxy.upstreamDialOptions...)
+	}
+	serverOptions = append(serverOptions, proxy.serverOptions...)
+	proxy.GrpcProxy = grpc.NewServer(serverOptions...)
+	proxy.registerServices(proxy.GrpcProxy)
+	return &proxy, nil
 }
 
 // Serve returns the HTTP handler function for TF serving REST api proxying
@@ -87,130 +289,522 @@ func (handler *RestProxy) Serve() func(http.ResponseWriter, *http.Request) {
 	// Wrap proxy in custom function to check for invalid requests
 	proxyFun := func(rw http.ResponseWriter, req *http.Request) {
 		promRequestsTotal.WithLabelValues("rest").Inc()
-		log.Debugf("Handling URL: %s", req.URL.String())
-		matches := tfServingRestURLMatch.FindStringSubmatch(req.URL.String())
-		log.Debugf("Model name: '%s' Version: '%s'", matches[1], matches[3])
-		if matches[3] == "" {
-			rw.Header().Set("Content-Type", "application/json")
-			rw.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(rw).Encode(struct {
-				Status  string
-				Message string
-			}{
-				Status:  "Error",
-				Message: "Model version must be provided",
-			})
+		req = handler.withRESTLogger(req)
+		if handler.routingLog != nil || handler.slowRequests != nil || handler.topModels != nil {
+			rec := &statusRecorder{ResponseWriter: rw}
+			ctx, route := withRoute(req.Context())
+			rw, req = rec, req.WithContext(ctx)
+			start := time.Now()
+			defer func() {
+				if handler.routingLog != nil {
+					handler.recordRoute(req, route, rec, start)
+				}
+				handler.logSlowREST(req, route, rec, start)
+				handler.recordTopModel(req, rec, start)
+			}()
+		}
+		done, ok := handler.admit(rw)
+		if !ok {
 			promRequestsFailed.WithLabelValues("rest").Inc()
 			return
 		}
+		defer done()
+		restLogger(req).Debugf("Handling URL: %s", req.URL.String())
+		key, verb, err := ParseRESTPath(req.URL.Path)
+		if err == nil {
+			addLogFields(req.Context(), log.Fields{logFieldModel: key.Name, logFieldVersion: key.Version, logFieldVerb: string(verb)})
+			req, key = handler.applyRESTExperiment(rw, req, key)
+		}
+		req, hooks := handler.newRESTHooks(req, key)
+		if err == nil && key.Version == "" {
+			err = fmt.Errorf("Model version must be provided: %w", ErrInvalidModel)
+		}
+		if err != nil {
+			if violation, ok := err.(*specViolation); ok {
+				promValidationFailures.WithLabelValues("rest", violation.reason).Inc()
+			}
+			writeError(rw, http.StatusBadRequest, err.Error())
+			promRequestsFailed.WithLabelValues("rest").Inc()
+			hooks.fail(req.Context(), FailureInvalid, err)
+			return
+		}
+		restLogger(req).Debugf("Model name: '%s' Version: '%s'", key.Name, key.Version)
+		hooks.resolve(req.Context())
+		if handler.clientQuotas != nil {
+			if ok, client, retryDelay := handler.clientQuotas.allowREST(req); !ok {
+				restLogger(req).WithField("client", client).Warn("Rejecting request over the client quota")
+				promRequestsFailed.WithLabelValues("rest").Inc()
+				writeTooManyRequests(rw, errClientQuota.Error(), retryDelay)
+				hooks.fail(req.Context(), FailureRejected, errClientQuota)
+				return
+			}
+		}
+		if handler.rateLimiter != nil {
+			if ok, retryDelay := handler.rateLimiter.allow(key.Name); !ok {
+				restLogger(req).Warnf("Rate limiting request for model %s", key.Name)
+				promRateLimited.WithLabelValues("rest", key.Name).Inc()
+				promRequestsFailed.WithLabelValues("rest").Inc()
+				writeRateLimited(rw, key.Name, retryDelay)
+				hooks.fail(req.Context(), FailureRejected, fmt.Errorf("rate limited model %s", key.Name))
+				return
+			}
+		}
+		release, err := handler.fairQueue.acquire(req.Context(), "rest", key.Name, handler.modelLabel(key.Name))
+		if err != nil {
+			restLogger(req).WithError(err).Warnf("Shedding request for model %s", key.Name)
+			promRequestsFailed.WithLabelValues("rest").Inc()
+			if errors.Is(err, errFairQueue) {
+				writeTooManyRequests(rw, err.Error(), handler.fairQueue.retryDelay())
+			} else {
+				writeError(rw, http.StatusServiceUnavailable, err.Error())
+			}
+			hooks.fail(req.Context(), FailureRejected, err)
+			return
+		}
+		defer release()
+		if dryRun, ok := handler.dryRuns.get(key.Name); ok {
+			handler.serveDryRun(rw, req, key, dryRun)
+			return
+		}
+		req = handler.withFault(req, key)
+		if code, err := handler.transformBody(req, key); err != nil {
+			restLogger(req).WithError(err).Warnf("Could not transform the body of a request for model %s", key.Name)
+			writeError(rw, code, err.Error())
+			promRequestsFailed.WithLabelValues("rest").Inc()
+			hooks.fail(req.Context(), FailureInvalid, err)
+			return
+		}
+		if handler.transcodes(key.Name) {
+			handler.transcoder.ServeModel(rw, req, key)
+			return
+		}
+		if handler.metadataCache != nil && req.Method == http.MethodGet && verb == VerbMetadata {
+			var served bool
+			if req, served = handler.serveRESTMetadata(rw, req, key); served {
+				return
+			}
+		}
+		if handler.coalescer != nil {
+			handler.coalescer.serve(rw, req, key, handler.RestProxy.ServeHTTP)
+			return
+		}
 		handler.RestProxy.ServeHTTP(rw, req)
 	}
 	return proxyFun
 }
 
-// Listen starts the grpc server that proxies TF serving GRPC api calls
+// Listen starts the grpc server that proxies TF serving GRPC api calls on
+// port of all interfaces
 func (proxy *GrpcProxy) Listen(port int) error {
-	proxy.GrpcProxy = grpc.NewServer()
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	return proxy.ListenAddr(ListenAddress("", port))
+}
+
+// ListenAddr starts the grpc server on addr, a host:port with IPv6
+// literals in brackets such as [::1]:8500. An empty host listens on all
+// interfaces.
+func (proxy *GrpcProxy) ListenAddr(addr string) error {
+	lis, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
+	return proxy.Serve(lis)
+}
+
+// Addr returns the address the proxy listens on, or nil if it is not
+// serving yet
+func (proxy *GrpcProxy) Addr() net.Addr {
+	proxy.listenerMutex.Lock()
+	defer proxy.listenerMutex.Unlock()
+	if proxy.listener == nil {
+		return nil
+	}
+	return proxy.listener.Addr()
+}
+
+// ListenAddress returns the address to listen on for host and port. host
+// may be an IPv6 literal with or without brackets, or empty for all
+// interfaces.
+func ListenAddress(host string, port int) string {
+	return net.JoinHostPort(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), strconv.Itoa(port))
+}
+
+// Serve starts the grpc server on an existing listener. It blocks until
+// the proxy is closed. It returns an error without serving if the Handler
+// of the proxy fails to start.
+func (proxy *GrpcProxy) Serve(lis net.Listener) error {
+	if err := proxy.start(); err != nil {
+		lis.Close()
+		return err
+	}
+	proxy.listenerMutex.Lock()
 	proxy.listener = lis
-	pb.RegisterPredictionServiceServer(proxy.GrpcProxy, proxy.serverImpl)
-	pb.RegisterSessionServiceServer(proxy.GrpcProxy, proxy.serverImpl)
-	proxy.GrpcProxy.Serve(lis)
+	proxy.listenerMutex.Unlock()
+	return proxy.GrpcProxy.Serve(lis)
+}
+
+// start starts the Handler of the proxy and warming the warm models
+func (proxy *GrpcProxy) start() error {
+	if err := proxy.lifecycle.start(proxy.warming); err != nil {
+		return fmt.Errorf("could not start handler: %w", err)
+	}
+	proxy.startWarming()
 	return nil
 }
 
-// Close stops the grpc proxy ser
+// Close stops the grpc proxy server and closes the upstream connections
+// dialed by the proxy once the calls using them are done, waiting at most
+// the shutdown grace period
 func (proxy *GrpcProxy) Close() error {
-	err := proxy.listener.Close()
-	proxy.GrpcProxy.GracefulStop()
-	return err
+	ctx, cancel := context.WithTimeout(context.Background(), proxy.shutdownGrace)
+	defer cancel()
+	return shutdown(ctx, []shutdownStages{proxy}, nil)
 }
 
 // proxyServiceServer implements the relevant TF serving grpc methods
 // and extracts model name and version and forwards the requests to a handler node
 type proxyServiceServer struct {
-	clientProvider func(modelName string, version string) (*grpc.ClientConn, error)
+	resolver      Resolver
+	invalidator   Invalidator
+	conns         *connManager
+	tracer        trace.Tracer
+	propagator    propagation.TextMapPropagator
+	modelLabels   bool
+	shadower      *shadower
+	rateLimiter   *RateLimiter
+	clientQuotas  *ClientQuotas
+	dryRuns       *DryRuns
+	faults        *Faults
+	experiments   *Experiments
+	fairQueue     *FairQueue
+	topModels     *TopModels
+	drains        *UpstreamDrains
+	metadataCache *MetadataCache
+	routingLog    *RoutingLog
+	hooks         Hooks
+	logger        log.FieldLogger
+	live          atomic.Value // *tunables
 }
 
 // Classify.
 func (server *proxyServiceServer) Classify(ctx context.Context, req *pb.ClassificationRequest) (*pb.ClassificationResponse, error) {
-	promRequestsTotal.WithLabelValues("grpc").Inc()
-	client, err := server.clientForSpec(req.GetModelSpec())
-	if err != nil {
-		promRequestsFailed.WithLabelValues("grpc").Inc()
-		log.WithError(err).Error("Could not get grpc client")
-		return nil, err
-	}
-	service := pb.NewPredictionServiceClient(client)
-	res, err := service.Classify(ctx, req)
+	var res *pb.ClassificationResponse
+	err := server.forward(ctx, req.GetModelSpec(), func(ctx context.Context, client *grpc.ClientConn, opts ...grpc.CallOption) (err error) {
+		res, err = pb.NewPredictionServiceClient(client).Classify(ctx, req, opts...)
+		return err
+	})
 	return res, err
 }
 
 // Regress.
 func (server *proxyServiceServer) Regress(ctx context.Context, req *pb.RegressionRequest) (*pb.RegressionResponse, error) {
-	promRequestsTotal.WithLabelValues("grpc").Inc()
-	client, err := server.clientForSpec(req.GetModelSpec())
-	if err != nil {
-		log.WithError(err).Error("Could not get grpc client")
-		promRequestsFailed.WithLabelValues("grpc").Inc()
-		return nil, err
-	}
-	service := pb.NewPredictionServiceClient(client)
-	res, err := service.Regress(ctx, req)
+	var res *pb.RegressionResponse
+	err := server.forward(ctx, req.GetModelSpec(), func(ctx context.Context, client *grpc.ClientConn, opts ...grpc.CallOption) (err error) {
+		res, err = pb.NewPredictionServiceClient(client).Regress(ctx, req, opts...)
+		return err
+	})
 	return res, err
 }
 
 // Predict -- provides access to loaded TensorFlow model.
 func (server *proxyServiceServer) Predict(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
-	promRequestsTotal.WithLabelValues("grpc").Inc()
-	client, err := server.clientForSpec(req.GetModelSpec())
-	if err != nil {
-		log.WithError(err).Error("Could not get grpc client")
-		promRequestsFailed.WithLabelValues("grpc").Inc()
-		return nil, err
+	if server.shadower != nil {
+		ctx = withShadow(ctx, req)
 	}
-	service := pb.NewPredictionServiceClient(client)
-	res, err := service.Predict(ctx, req)
+	var res *pb.PredictResponse
+	err := server.forward(ctx, req.GetModelSpec(), func(ctx context.Context, client *grpc.ClientConn, opts ...grpc.CallOption) (err error) {
+		res, err = pb.NewPredictionServiceClient(client).Predict(ctx, req, opts...)
+		return err
+	})
 	return res, err
 }
 
 // MultiInference API for multi-headed models.
 func (server *proxyServiceServer) MultiInference(ctx context.Context, req *pb.MultiInferenceRequest) (*pb.MultiInferenceResponse, error) {
-	return nil, errors.New("MultiInference not supported")
+	return nil, status.Error(codes.Unimplemented, "MultiInference not supported")
 }
 
 // GetModelMetadata - provides access to metadata for loaded models.
 func (server *proxyServiceServer) GetModelMetadata(ctx context.Context, req *pb.GetModelMetadataRequest) (*pb.GetModelMetadataResponse, error) {
-	promRequestsTotal.WithLabelValues("grpc").Inc()
-	client, err := server.clientForSpec(req.GetModelSpec())
-	if err != nil {
-		log.WithError(err).Error("Could not get grpc client")
-		promRequestsFailed.WithLabelValues("grpc").Inc()
-		return nil, err
-	}
-	service := pb.NewPredictionServiceClient(client)
-	res, err := service.GetModelMetadata(ctx, req)
+	var res *pb.GetModelMetadataResponse
+	err := server.forward(ctx, req.GetModelSpec(), func(ctx context.Context, client *grpc.ClientConn, opts ...grpc.CallOption) (err error) {
+		key, cacheable := grpcMetadataKey(req)
+		cacheable = cacheable && server.metadataCache != nil
+		if cacheable {
+			if cached, ok := server.metadataCache.get(key, client.Target()); ok {
+				res = cached.(*pb.GetModelMetadataResponse)
+				return nil
+			}
+		}
+		res, err = pb.NewPredictionServiceClient(client).GetModelMetadata(ctx, req, opts...)
+		if err == nil && cacheable {
+			server.metadataCache.put(key, client.Target(), res)
+		}
+		return err
+	})
 	return res, err
 }
 
 func (server *proxyServiceServer) SessionRun(ctx context.Context, req *pb.SessionRunRequest) (*pb.SessionRunResponse, error) {
-	promRequestsTotal.WithLabelValues("grpc").Inc()
-	client, err := server.clientForSpec(req.GetModelSpec())
+	var res *pb.SessionRunResponse
+	err := server.forward(ctx, req.GetModelSpec(), func(ctx context.Context, client *grpc.ClientConn, opts ...grpc.CallOption) (err error) {
+		res, err = pb.NewSessionServiceClient(client).SessionRun(ctx, req, opts...)
+		return err
+	})
+	return res, err
+}
+
+// forward resolves the upstream connection for modelSpec and invokes call on it.
+// Errors returned by call are upstream statuses and are handed back to the
+// caller as-is, so codes, messages and details survive the proxy untouched.
+// Only failures that originate in the proxy get a proxy-constructed status.
+func (server *proxyServiceServer) forward(ctx context.Context, modelSpec *pb.ModelSpec, call func(context.Context, *grpc.ClientConn, ...grpc.CallOption) error) (err error) {
+	countGrpcRequest(ctx)
+	var route *routeInfo
+	if server.routingLog != nil {
+		start := time.Now()
+		defer func() { server.recordRoute(ctx, modelSpec, route, start, err) }()
+	}
+	if server.topModels != nil {
+		start := time.Now()
+		defer func() { server.topModels.record(modelSpec.GetName(), time.Since(start), err != nil) }()
+	}
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(modelAttributes(modelSpec)...)
+	hooks := server.newGrpcHooks(ctx, modelSpec)
+	key, err := FromModelSpec(modelSpec)
+	if violation, ok := err.(*specViolation); ok {
+		server.loggerFor(ctx).Warnf("Rejecting invalid model spec: %s", violation.description)
+		promValidationFailures.WithLabelValues("grpc", violation.reason).Inc()
+		countGrpcFailure(ctx)
+		err := proxyStatus(codes.InvalidArgument, modelSpec, "", violation.status().Err()).Err()
+		hooks.fail(ctx, FailureInvalid, err)
+		return err
+	}
+	if id := requestID(ctx); id != "" {
+		addLogFields(ctx, log.Fields{logFieldRequestID: id})
+	}
+	hooks.resolve(ctx)
+	settings := server.settings()
+	if below, remaining := settings.deadlineBudget.belowMinimum(ctx); below {
+		server.loggerFor(ctx).Warnf("Rejecting request for model %s with %v left of its deadline", modelSpec.GetName(), remaining)
+		promDeadlineRejected.WithLabelValues("grpc").Inc()
+		countGrpcFailure(ctx)
+		err := proxyStatus(codes.DeadlineExceeded, modelSpec, "", fmt.Errorf("%v left of the deadline, the proxy needs at least %v", remaining, settings.deadlineBudget.MinRemaining)).Err()
+		hooks.fail(ctx, FailureRejected, err)
+		return err
+	}
+	if server.clientQuotas != nil {
+		if ok, client, retryDelay := server.clientQuotas.allowGrpc(ctx); !ok {
+			server.loggerFor(ctx).WithField("client", client).Warn("Rejecting call over the client quota")
+			countGrpcFailure(ctx)
+			err := proxyStatus(codes.ResourceExhausted, modelSpec, "", exhaustedStatus(errClientQuota.Error(), retryDelay)).Err()
+			hooks.fail(ctx, FailureRejected, err)
+			return err
+		}
+	}
+	if server.rateLimiter != nil {
+		if ok, retryDelay := server.rateLimiter.allow(modelSpec.GetName()); !ok {
+			server.loggerFor(ctx).Warnf("Rate limiting request for model %s", modelSpec.GetName())
+			promRateLimited.WithLabelValues("grpc", modelSpec.GetName()).Inc()
+			countGrpcFailure(ctx)
+			err := proxyStatus(codes.ResourceExhausted, modelSpec, "", rateLimitStatus(modelSpec.GetName(), retryDelay)).Err()
+			hooks.fail(ctx, FailureRejected, err)
+			return err
+		}
+	}
+	if settings.modelLimiter != nil {
+		release, err := settings.modelLimiter.acquire(ctx, modelSpec.GetName())
+		if err != nil {
+			server.loggerFor(ctx).WithError(err).Warnf("Rejecting request for model %s", modelSpec.GetName())
+			countGrpcFailure(ctx)
+			err = proxyStatus(codes.ResourceExhausted, modelSpec, "", err).Err()
+			hooks.fail(ctx, FailureRejected, err)
+			return err
+		}
+		defer release()
+	}
+	release, err := server.fairQueue.acquire(ctx, "grpc", modelSpec.GetName(), server.modelLabel(modelSpec.GetName()))
 	if err != nil {
-		log.WithError(err).Error("Could not get grpc client")
-		promRequestsFailed.WithLabelValues("grpc").Inc()
+		server.loggerFor(ctx).WithError(err).Warnf("Shedding request for model %s", modelSpec.GetName())
+		countGrpcFailure(ctx)
+		if errors.Is(err, errFairQueue) {
+			err = exhaustedStatus(err.Error(), server.fairQueue.retryDelay())
+		}
+		err = proxyStatus(grpcCode(err), modelSpec, "", err).Err()
+		hooks.fail(ctx, FailureRejected, err)
+		return err
+	}
+	defer release()
+	modelInFlight := promModelInFlight.WithLabelValues("grpc", server.modelLabel(modelSpec.GetName()))
+	modelInFlight.Inc()
+	defer modelInFlight.Dec()
+	_, route = withRoute(ctx)
+	route.key = key
+	if settings.routingTrailers {
+		defer server.setRoutingTrailers(ctx, route)
+	}
+	if dryRun, ok := server.dryRuns.get(key.Name); ok {
+		return server.dryRun(ctx, modelSpec, route, hooks, dryRun)
+	}
+	if req, ok := ctx.Value(shadowKey{}).(*pb.PredictRequest); ok {
+		server.shadowPredict(ctx, req)
+	}
+	fault, inject := server.faults.roll(key.Name)
+	// staleRetry is set while a call is retried because its node did not
+	// have the model, and staleRetried once it was
+	var staleRetry, staleRetried bool
+	for {
+		addLogFields(ctx, log.Fields{logFieldAttempt: route.retries + 1})
+		client, err := server.clientForSpec(ctx, modelSpec, route)
+		if staleRetry && err != nil {
+			promStaleRetries.WithLabelValues("grpc", staleFailure).Inc()
+		}
+		if err != nil {
+			server.loggerFor(ctx).WithError(err).Error("Could not get grpc client")
+			countGrpcFailure(ctx)
+			hooks.fail(ctx, resolveFailure(err), err)
+			return proxyStatus(grpcCode(err), modelSpec, "", err).Err()
+		}
+		span.SetAttributes(attrTarget.String(client.Target()))
+		addLogFields(ctx, log.Fields{logFieldVersion: route.key.Version, logFieldTarget: client.Target()})
+		if inject {
+			inject = false
+			if err := server.injectFault(ctx, modelSpec, route, hooks, client.Target(), fault); err != nil {
+				return err
+			}
+		}
+		hooks.forward(ctx, route.key, client.Target())
+		callCtx, cancel := settings.deadlineBudget.upstreamContext(ctx)
+		err = call(server.injectTraceContext(callCtx), client, settings.callOptions(callCtx, route.key.Name, route)...)
+		cancel()
+		hooks.completeGrpc(ctx, err)
+		if staleRetry {
+			promStaleRetries.WithLabelValues("grpc", staleOutcome(err)).Inc()
+			staleRetry = false
+		}
+		if !staleRetried && isStaleRouting(err) && ctx.Err() == nil {
+			staleRetry, staleRetried = true, true
+			route.retries++
+			server.invalidate(route.key)
+			server.loggerFor(ctx).WithError(err).Warnf("Node %s does not have model %s, resolving it again", client.Target(), route.key)
+			continue
+		}
+		if !settings.shouldRetry(ctx, err, route) {
+			if err != nil {
+				hooks.fail(ctx, FailureUpstream, err)
+			}
+			return err
+		}
+		route.retries++
+		server.loggerFor(ctx).WithError(err).Warnf("Retrying request for model %s, retry %d", route.key, route.retries)
+	}
+}
+
+// clientForSpec resolves the connection for modelSpec, recording the routing decision in route
+func (server *proxyServiceServer) clientForSpec(ctx context.Context, modelSpec *pb.ModelSpec, route *routeInfo) (*grpc.ClientConn, error) {
+	ctx, span := server.tracer.Start(ctx, "tfservingcache.resolve", trace.WithAttributes(modelAttributes(modelSpec)...))
+	defer span.End()
+	server.applyExperiment(ctx, modelSpec, route)
+	server.applyCanary(modelSpec, route)
+	client, cache, err := server.resolve(ctx, route.key)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
 		return nil, err
 	}
-	service := pb.NewSessionServiceClient(client)
-	res, err := service.SessionRun(ctx, req)
-	return res, err
+	// The balancer records the target it picks by weight during the call
+	route.target, route.cache, route.weight, route.totalWeight = client.Target(), cache, 0, 0
+	span.SetAttributes(attrTarget.String(client.Target()))
+	return client, nil
+}
+
+// resolve returns a connection to the preferred target for key and
+// whether the resolver found the model in the cache
+func (server *proxyServiceServer) resolve(ctx context.Context, key ModelKey) (*grpc.ClientConn, CacheDisposition, error) {
+	resolution, err := server.resolveTargets(ctx, key)
+	if err != nil {
+		return nil, CacheUnknown, err
+	}
+	conn, err := server.connForResolution(key, resolution)
+	return conn, resolution.Cache, err
+}
+
+// resolveTargets returns the targets of the resolver for key
+func (server *proxyServiceServer) resolveTargets(ctx context.Context, key ModelKey) (Resolution, error) {
+	start := time.Now()
+	resolution, err := server.resolver.Resolve(ctx, key)
+	observeResolve("grpc", start, err)
+	if err == nil {
+		observeCache("grpc", server.modelLabel(key.Name), resolution.Cache)
+		resolution.Targets = server.drains.filter(key, resolution.Targets)
+	}
+	return resolution, err
+}
+
+// resolveREST points req at a node that can serve key and counts the
+// cache disposition the handler reported
+func (handler *RestProxy) resolveREST(req *http.Request, key ModelKey) error {
+	if _, ok := req.Context().Value(cacheReportKey{}).(*cacheReport); ok {
+		ReportCacheDisposition(req.Context(), CacheUnknown)
+	} else {
+		*req = *withCacheReport(req)
+	}
+	start := time.Now()
+	err := handler.handler.ResolveREST(req.Context(), key, req)
+	observeResolve("rest", start, err)
+	if err == nil {
+		cache := reportedCache(req.Context())
+		observeCache("rest", handler.modelLabel(key.Name), cache)
+		if route, ok := req.Context().Value(routeKey{}).(*routeInfo); ok {
+			route.cache = cache
+		}
+	}
+	return err
 }
 
-func (server *proxyServiceServer) clientForSpec(modelSpec *pb.ModelSpec) (*grpc.ClientConn, error) {
-	modelName := modelSpec.GetName()
-	modelVersion := strconv.FormatInt(modelSpec.GetVersion().GetValue(), 10)
-	return server.clientProvider(modelName, modelVersion)
+// connForResolution returns a connection for the targets of resolution.
+// Targets dialed by address are balanced over one connection. Targets
+// with a connection of their own and REST only targets cannot join it, so
+// a call goes either to the balanced targets or to one of the others,
+// chosen by weight. REST only targets are left out without REST fallback.
+func (server *proxyServiceServer) connForResolution(key ModelKey, resolution Resolution) (*grpc.ClientConn, error) {
+	if len(resolution.Targets) == 0 {
+		return nil, fmt.Errorf("no targets for model %s: %w", key, ErrUnavailable)
+	}
+	var addresses []string
+	var weights []int
+	var separate []Target
+	total := 0
+	for _, target := range resolution.Targets {
+		switch {
+		case target.REST && server.conns.restClient == nil:
+			continue
+		case target.Conn != nil || target.REST:
+			separate = append(separate, target)
+		default:
+			addresses, weights = append(addresses, target.Address), append(weights, weightOf(target))
+		}
+		total += weightOf(target)
+	}
+	if total == 0 {
+		// Only REST targets, reported as unavailable without REST fallback
+		return server.conns.getREST(resolution.Targets[0].Address)
+	}
+	if len(separate) > 0 {
+		n := rand.Intn(total)
+		for _, target := range separate {
+			if n -= weightOf(target); n >= 0 {
+				continue
+			}
+			if target.Conn != nil {
+				return target.Conn, nil
+			}
+			return server.conns.getREST(target.Address)
+		}
+	}
+	if len(addresses) == 1 {
+		server.conns.dropBalanced(key)
+		return server.conns.get(addresses[0])
+	}
+	return server.conns.getBalanced(key, server.modelLabel(key.Name), addresses, weights)
 }
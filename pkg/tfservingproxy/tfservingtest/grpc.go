@@ -0,0 +1,249 @@
+package tfservingtest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// GRPCNode is a fake TF Serving node serving the PredictionService and
+// SessionService. Methods without a hook answer with the model spec of
+// the request.
+type GRPCNode struct {
+	pb.UnimplementedPredictionServiceServer
+	pb.UnimplementedSessionServiceServer
+	name     string
+	listener net.Listener
+	dial     func(ctx context.Context) (net.Conn, error)
+	server   *grpc.Server
+	hooks    grpcHooks
+	requests []Request
+	mutex    sync.Mutex
+}
+
+type grpcHooks struct {
+	predict          func(context.Context, *pb.PredictRequest) (*pb.PredictResponse, error)
+	classify         func(context.Context, *pb.ClassificationRequest) (*pb.ClassificationResponse, error)
+	regress          func(context.Context, *pb.RegressionRequest) (*pb.RegressionResponse, error)
+	multiInference   func(context.Context, *pb.MultiInferenceRequest) (*pb.MultiInferenceResponse, error)
+	getModelMetadata func(context.Context, *pb.GetModelMetadataRequest) (*pb.GetModelMetadataResponse, error)
+	sessionRun       func(context.Context, *pb.SessionRunRequest) (*pb.SessionRunResponse, error)
+}
+
+// GRPCNodeOption configures a GRPCNode
+type GRPCNodeOption func(*GRPCNode)
+
+// WithPredict answers Predict calls with fn
+func WithPredict(fn func(context.Context, *pb.PredictRequest) (*pb.PredictResponse, error)) GRPCNodeOption {
+	return func(node *GRPCNode) {
+		node.hooks.predict = fn
+	}
+}
+
+// WithClassify answers Classify calls with fn
+func WithClassify(fn func(context.Context, *pb.ClassificationRequest) (*pb.ClassificationResponse, error)) GRPCNodeOption {
+	return func(node *GRPCNode) {
+		node.hooks.classify = fn
+	}
+}
+
+// WithRegress answers Regress calls with fn
+func WithRegress(fn func(context.Context, *pb.RegressionRequest) (*pb.RegressionResponse, error)) GRPCNodeOption {
+	return func(node *GRPCNode) {
+		node.hooks.regress = fn
+	}
+}
+
+// WithMultiInference answers MultiInference calls with fn
+func WithMultiInference(fn func(context.Context, *pb.MultiInferenceRequest) (*pb.MultiInferenceResponse, error)) GRPCNodeOption {
+	return func(node *GRPCNode) {
+		node.hooks.multiInference = fn
+	}
+}
+
+// WithGetModelMetadata answers GetModelMetadata calls with fn
+func WithGetModelMetadata(fn func(context.Context, *pb.GetModelMetadataRequest) (*pb.GetModelMetadataResponse, error)) GRPCNodeOption {
+	return func(node *GRPCNode) {
+		node.hooks.getModelMetadata = fn
+	}
+}
+
+// WithSessionRun answers SessionRun calls with fn
+func WithSessionRun(fn func(context.Context, *pb.SessionRunRequest) (*pb.SessionRunResponse, error)) GRPCNodeOption {
+	return func(node *GRPCNode) {
+		node.hooks.sessionRun = fn
+	}
+}
+
+// WithListener serves the node on lis, e.g. a TCP listener, instead of an
+// in-memory listener
+func WithListener(lis net.Listener) GRPCNodeOption {
+	return func(node *GRPCNode) {
+		node.listener = lis
+		node.dial = func(ctx context.Context) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, lis.Addr().Network(), lis.Addr().String())
+		}
+	}
+}
+
+// NewGRPCNode starts a fake node called name on an in-memory listener. The
+// node is stopped when the test finishes.
+func NewGRPCNode(tb testing.TB, name string, opts ...GRPCNodeOption) *GRPCNode {
+	lis := bufconn.Listen(1024 * 1024)
+	node := &GRPCNode{
+		name:     name,
+		listener: lis,
+		dial: func(context.Context) (net.Conn, error) {
+			return lis.Dial()
+		},
+		server: grpc.NewServer(),
+	}
+	for _, opt := range opts {
+		opt(node)
+	}
+	pb.RegisterPredictionServiceServer(node.server, node)
+	pb.RegisterSessionServiceServer(node.server, node)
+	go node.server.Serve(node.listener)
+	tb.Cleanup(node.server.Stop)
+	return node
+}
+
+// Name returns the name of the node
+func (node *GRPCNode) Name() string {
+	return node.name
+}
+
+// Address returns the address of the listener of the node. For in-memory
+// listeners it is the name of the node.
+func (node *GRPCNode) Address() string {
+	if _, ok := node.listener.(*bufconn.Listener); ok {
+		return node.name
+	}
+	return node.listener.Addr().String()
+}
+
+// Dialer returns a dialer connecting to the node whatever address it is
+// given
+func (node *GRPCNode) Dialer() func(context.Context, string) (net.Conn, error) {
+	return func(ctx context.Context, _ string) (net.Conn, error) {
+		return node.dial(ctx)
+	}
+}
+
+// DialOption returns the dial option connecting to the node
+func (node *GRPCNode) DialOption() grpc.DialOption {
+	return grpc.WithContextDialer(node.Dialer())
+}
+
+// Dial returns an insecure connection to the node with the name of the
+// node as its target. The connection is closed when the test finishes.
+func (node *GRPCNode) Dial(tb testing.TB) *grpc.ClientConn {
+	tb.Helper()
+	conn, err := grpc.Dial(node.name, node.DialOption(), grpc.WithInsecure())
+	if err != nil {
+		tb.Fatalf("Could not dial node %s: %v", node.name, err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// DialNodes returns a dial option connecting to the node whose address
+// is dialed
+func DialNodes(nodes ...*GRPCNode) grpc.DialOption {
+	byAddress := make(map[string]*GRPCNode)
+	for _, node := range nodes {
+		byAddress[node.Address()] = node
+	}
+	return grpc.WithContextDialer(func(ctx context.Context, address string) (net.Conn, error) {
+		node, ok := byAddress[address]
+		if !ok {
+			return nil, fmt.Errorf("unknown node %s", address)
+		}
+		return node.dial(ctx)
+	})
+}
+
+// Requests returns the calls received so far, oldest first
+func (node *GRPCNode) Requests() []Request {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return append([]Request(nil), node.requests...)
+}
+
+func (node *GRPCNode) record(method string, spec *pb.ModelSpec) {
+	req := Request{Method: method, Model: spec.GetName(), Label: spec.GetVersionLabel()}
+	if version := spec.GetVersion(); version != nil {
+		req.Version = strconv.FormatInt(version.GetValue(), 10)
+	}
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.requests = append(node.requests, req)
+}
+
+// Predict records the call and answers it with the Predict hook
+func (node *GRPCNode) Predict(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+	node.record("Predict", req.GetModelSpec())
+	if node.hooks.predict != nil {
+		return node.hooks.predict(ctx, req)
+	}
+	return &pb.PredictResponse{ModelSpec: req.GetModelSpec()}, nil
+}
+
+// Classify records the call and answers it with the Classify hook
+func (node *GRPCNode) Classify(ctx context.Context, req *pb.ClassificationRequest) (*pb.ClassificationResponse, error) {
+	node.record("Classify", req.GetModelSpec())
+	if node.hooks.classify != nil {
+		return node.hooks.classify(ctx, req)
+	}
+	return &pb.ClassificationResponse{ModelSpec: req.GetModelSpec()}, nil
+}
+
+// Regress records the call and answers it with the Regress hook
+func (node *GRPCNode) Regress(ctx context.Context, req *pb.RegressionRequest) (*pb.RegressionResponse, error) {
+	node.record("Regress", req.GetModelSpec())
+	if node.hooks.regress != nil {
+		return node.hooks.regress(ctx, req)
+	}
+	return &pb.RegressionResponse{ModelSpec: req.GetModelSpec()}, nil
+}
+
+// MultiInference records the call with the model of its first task and
+// answers it with the MultiInference hook
+func (node *GRPCNode) MultiInference(ctx context.Context, req *pb.MultiInferenceRequest) (*pb.MultiInferenceResponse, error) {
+	var spec *pb.ModelSpec
+	if tasks := req.GetTasks(); len(tasks) > 0 {
+		spec = tasks[0].GetModelSpec()
+	}
+	node.record("MultiInference", spec)
+	if node.hooks.multiInference != nil {
+		return node.hooks.multiInference(ctx, req)
+	}
+	return &pb.MultiInferenceResponse{}, nil
+}
+
+// GetModelMetadata records the call and answers it with the
+// GetModelMetadata hook
+func (node *GRPCNode) GetModelMetadata(ctx context.Context, req *pb.GetModelMetadataRequest) (*pb.GetModelMetadataResponse, error) {
+	node.record("GetModelMetadata", req.GetModelSpec())
+	if node.hooks.getModelMetadata != nil {
+		return node.hooks.getModelMetadata(ctx, req)
+	}
+	return &pb.GetModelMetadataResponse{ModelSpec: req.GetModelSpec()}, nil
+}
+
+// SessionRun records the call and answers it with the SessionRun hook
+func (node *GRPCNode) SessionRun(ctx context.Context, req *pb.SessionRunRequest) (*pb.SessionRunResponse, error) {
+	node.record("SessionRun", req.GetModelSpec())
+	if node.hooks.sessionRun != nil {
+		return node.hooks.sessionRun(ctx, req)
+	}
+	return &pb.SessionRunResponse{ModelSpec: req.GetModelSpec()}, nil
+}
@@ -0,0 +1,197 @@
+package tfservingtest
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Server is a grpc server served by a Harness, such as a
+// tfservingproxy.GrpcProxy
+type Server interface {
+	Serve(lis net.Listener) error
+	Close() error
+}
+
+// WrapServer wraps each server a Harness serves if it is set. A TestMain
+// can set it to run a suite of tests against another way of serving.
+var WrapServer func(Server) Server
+
+// Harness serves a proxy on an in-memory listener in front of fake nodes,
+// also on in-memory listeners. The proxy gets its upstream connections
+// from ClientProvider, which routes each model to its node and injects
+// the faults the harness is configured with.
+type Harness struct {
+	tb          testing.TB
+	node        *GRPCNode
+	routes      map[string]*GRPCNode
+	faults      map[string]fault
+	conns       map[*GRPCNode]*grpc.ClientConn
+	server      Server
+	closeServer sync.Once
+	closeErr    error
+	conn        *grpc.ClientConn
+	mutex       sync.Mutex
+}
+
+// fault is what goes wrong for calls to a model
+type fault struct {
+	providerErr error
+	upstreamErr error
+	delay       time.Duration
+}
+
+// HarnessOption configures a Harness
+type HarnessOption func(*Harness)
+
+// Route sends the calls for model to node instead of the default node
+func Route(model string, node *GRPCNode) HarnessOption {
+	return func(h *Harness) {
+		h.routes[model] = node
+	}
+}
+
+// ProviderError makes ClientProvider fail with err for model
+func ProviderError(model string, err error) HarnessOption {
+	return func(h *Harness) {
+		f := h.faults[model]
+		f.providerErr = err
+		h.faults[model] = f
+	}
+}
+
+// UpstreamError makes the upstream calls for model fail with err without
+// reaching the node
+func UpstreamError(model string, err error) HarnessOption {
+	return func(h *Harness) {
+		f := h.faults[model]
+		f.upstreamErr = err
+		h.faults[model] = f
+	}
+}
+
+// SlowUpstream delays the upstream calls for model by delay, or until
+// their deadline if it is sooner
+func SlowUpstream(model string, delay time.Duration) HarnessOption {
+	return func(h *Harness) {
+		f := h.faults[model]
+		f.delay = delay
+		h.faults[model] = f
+	}
+}
+
+// NewHarness creates a Harness with a default node called "upstream" for
+// the models without a route. Everything it starts is stopped when the
+// test finishes.
+func NewHarness(tb testing.TB, opts ...HarnessOption) *Harness {
+	h := &Harness{
+		tb:     tb,
+		node:   NewGRPCNode(tb, "upstream"),
+		routes: make(map[string]*GRPCNode),
+		faults: make(map[string]fault),
+		conns:  make(map[*GRPCNode]*grpc.ClientConn),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// Node returns the default node
+func (h *Harness) Node() *GRPCNode {
+	return h.node
+}
+
+// ClientProvider returns the connection to the node of modelName. It has
+// the signature of the client provider of tfservingproxy.NewGrpcProxy.
+func (h *Harness) ClientProvider(modelName string, _ string) (*grpc.ClientConn, error) {
+	if err := h.faults[modelName].providerErr; err != nil {
+		return nil, err
+	}
+	node, ok := h.routes[modelName]
+	if !ok {
+		node = h.node
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if conn, ok := h.conns[node]; ok {
+		return conn, nil
+	}
+	conn, err := grpc.Dial(node.Name(), node.DialOption(), grpc.WithInsecure(),
+		grpc.WithUnaryInterceptor(h.injectFaults))
+	if err != nil {
+		return nil, err
+	}
+	h.tb.Cleanup(func() { conn.Close() })
+	h.conns[node] = conn
+	return conn, nil
+}
+
+// modelSpecRequest is a request naming the model it is for
+type modelSpecRequest interface {
+	GetModelSpec() *pb.ModelSpec
+}
+
+// injectFaults fails or delays upstream calls as configured for their model
+func (h *Harness) injectFaults(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	specReq, ok := req.(modelSpecRequest)
+	if !ok {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	f := h.faults[specReq.GetModelSpec().GetName()]
+	if f.delay > 0 {
+		select {
+		case <-time.After(f.delay):
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		}
+	}
+	if f.upstreamErr != nil {
+		return f.upstreamErr
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// Serve serves server on an in-memory listener and returns a client for
+// it. The server is closed when the test finishes unless Close closed it.
+func (h *Harness) Serve(server Server) pb.PredictionServiceClient {
+	h.tb.Helper()
+	if WrapServer != nil {
+		server = WrapServer(server)
+	}
+	lis := bufconn.Listen(1024 * 1024)
+	go server.Serve(lis)
+	conn, err := grpc.Dial("proxy", grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) {
+		return lis.Dial()
+	}), grpc.WithInsecure())
+	if err != nil {
+		h.tb.Fatalf("Could not dial proxy: %v", err)
+	}
+	h.server, h.conn = server, conn
+	h.tb.Cleanup(func() {
+		conn.Close()
+		h.Close()
+	})
+	return pb.NewPredictionServiceClient(conn)
+}
+
+// Conn returns the connection to the served server, for clients of other
+// services than the PredictionService
+func (h *Harness) Conn() *grpc.ClientConn {
+	return h.conn
+}
+
+// Close closes the served server once and returns the error of closing it
+func (h *Harness) Close() error {
+	h.closeServer.Do(func() {
+		h.closeErr = h.server.Close()
+	})
+	return h.closeErr
+}
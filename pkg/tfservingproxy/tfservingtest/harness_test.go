@@ -0,0 +1,59 @@
+package tfservingtest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy"
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestHarnessWithGrpcProxy(t *testing.T) {
+	other := tfservingtest.NewGRPCNode(t, "other")
+	harness := tfservingtest.NewHarness(t,
+		tfservingtest.Route("routed", other),
+		tfservingtest.ProviderError("unrouted", errors.New("no nodes")),
+		tfservingtest.UpstreamError("broken", status.Error(codes.Internal, "model crashed")),
+		tfservingtest.SlowUpstream("slow", time.Minute),
+	)
+	client := harness.Serve(tfservingproxy.NewGrpcProxy(harness.ClientProvider))
+	predict := func(ctx context.Context, model string) error {
+		_, err := client.Predict(ctx, &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: model}})
+		return err
+	}
+
+	if err := predict(context.Background(), "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if err := predict(context.Background(), "routed"); err != nil {
+		t.Fatal(err)
+	}
+	tfservingtest.AssertReached(t, harness.Node(), "foo", "")
+	tfservingtest.AssertReached(t, other, "routed", "")
+	tfservingtest.AssertNotReached(t, harness.Node(), "routed", "")
+
+	if err := predict(context.Background(), "unrouted"); status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected Unavailable for a provider error but got %v", err)
+	}
+	if err := predict(context.Background(), "broken"); status.Code(err) != codes.Internal {
+		t.Errorf("Expected the upstream error but got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := predict(ctx, "slow"); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded from a slow upstream but got %v", err)
+	}
+	tfservingtest.AssertNotReached(t, harness.Node(), "broken", "")
+
+	if err := harness.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if err := predict(context.Background(), "foo"); status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected calls to a closed proxy to fail with Unavailable but got %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+package tfservingtest
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+var restURLMatch = regexp.MustCompile(`^/v1/models/([^/:]+)(?:/versions/([0-9]+)|/labels/([^/:]+))?`)
+
+// RESTNode is a fake TF Serving node serving the REST api. Requests for
+// models without a handler get the 404 TF Serving answers for models it
+// does not serve.
+type RESTNode struct {
+	name     string
+	server   *httptest.Server
+	handlers map[restKey]http.HandlerFunc
+	requests []Request
+	mutex    sync.Mutex
+}
+
+type restKey struct {
+	model   string
+	version string
+}
+
+// NewRESTNode starts a fake REST node called name. The node is stopped
+// when the test finishes.
+func NewRESTNode(tb testing.TB, name string) *RESTNode {
+	node := &RESTNode{name: name, handlers: make(map[restKey]http.HandlerFunc)}
+	node.server = httptest.NewServer(http.HandlerFunc(node.serve))
+	tb.Cleanup(node.server.Close)
+	return node
+}
+
+// Name returns the name of the node
+func (node *RESTNode) Name() string {
+	return node.name
+}
+
+// Address returns the host:port the node listens on
+func (node *RESTNode) Address() string {
+	return node.server.Listener.Addr().String()
+}
+
+// URL returns the base URL of the node
+func (node *RESTNode) URL() *url.URL {
+	u, _ := url.Parse(node.server.URL)
+	return u
+}
+
+// Handle answers the requests for a model version with handler. An empty
+// version matches any version without a handler of its own, and an empty
+// model any model.
+func (node *RESTNode) Handle(model string, version string, handler http.HandlerFunc) {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	node.handlers[restKey{model, version}] = handler
+}
+
+// Respond answers the requests for a model version with status and a
+// JSON body, matching requests like Handle
+func (node *RESTNode) Respond(model string, version string, status int, body string) {
+	node.Handle(model, version, func(rw http.ResponseWriter, _ *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(status)
+		rw.Write([]byte(body))
+	})
+}
+
+// Requests returns the requests received so far, oldest first
+func (node *RESTNode) Requests() []Request {
+	node.mutex.Lock()
+	defer node.mutex.Unlock()
+	return append([]Request(nil), node.requests...)
+}
+
+func (node *RESTNode) serve(rw http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	recorded := Request{Method: req.Method, Path: req.URL.Path, Body: body}
+	if matches := restURLMatch.FindStringSubmatch(req.URL.Path); matches != nil {
+		recorded.Model, recorded.Version, recorded.Label = matches[1], matches[2], matches[3]
+	}
+
+	node.mutex.Lock()
+	node.requests = append(node.requests, recorded)
+	handler := node.handlers[restKey{recorded.Model, recorded.Version}]
+	if handler == nil {
+		handler = node.handlers[restKey{recorded.Model, ""}]
+	}
+	if handler == nil {
+		handler = node.handlers[restKey{}]
+	}
+	node.mutex.Unlock()
+
+	if handler == nil {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusNotFound)
+		fmt.Fprintf(rw, `{"error": "Servable not found for request: Latest(%s)"}`, recorded.Model)
+		return
+	}
+	handler(rw, req)
+}
@@ -0,0 +1,59 @@
+// Package tfservingtest provides fake TF Serving nodes for testing code that
+// talks to TF Serving, such as the proxies of the tfservingproxy package.
+package tfservingtest
+
+import (
+	"testing"
+)
+
+// Request is a request received by a fake node
+type Request struct {
+	// Method is the grpc method name, e.g. "Predict", or the HTTP method
+	// of a REST request
+	Method string
+	// Path is the URL path of a REST request
+	Path    string
+	Model   string
+	Version string
+	Label   string
+	// Body is the body of a REST request
+	Body []byte
+}
+
+// Node is a fake node recording the requests it receives
+type Node interface {
+	// Name identifies the node in test failures
+	Name() string
+	// Requests returns the requests received so far, oldest first
+	Requests() []Request
+}
+
+// Received returns the number of requests node received for the model
+// version. An empty version matches requests for any version.
+func Received(node Node, model string, version string) int {
+	var n int
+	for _, req := range node.Requests() {
+		if req.Model == model && (version == "" || req.Version == version) {
+			n++
+		}
+	}
+	return n
+}
+
+// AssertReached fails the test if node received no request for the model
+// version. An empty version matches requests for any version.
+func AssertReached(tb testing.TB, node Node, model string, version string) {
+	tb.Helper()
+	if Received(node, model, version) == 0 {
+		tb.Errorf("Expected a request for model %s version %q to reach node %s, got %v", model, version, node.Name(), node.Requests())
+	}
+}
+
+// AssertNotReached fails the test if node received a request for the
+// model version. An empty version matches requests for any version.
+func AssertNotReached(tb testing.TB, node Node, model string, version string) {
+	tb.Helper()
+	if n := Received(node, model, version); n > 0 {
+		tb.Errorf("Expected no request for model %s version %q to reach node %s, got %d", model, version, node.Name(), n)
+	}
+}
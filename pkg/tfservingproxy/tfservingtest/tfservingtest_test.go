@@ -0,0 +1,76 @@
+package tfservingtest
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/wrappers"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGRPCNodeRecordsAndHooks(t *testing.T) {
+	node := NewGRPCNode(t, "node1:8500", WithPredict(func(context.Context, *pb.PredictRequest) (*pb.PredictResponse, error) {
+		return nil, status.Error(codes.Unavailable, "restarting")
+	}))
+	other := NewGRPCNode(t, "node2:8500")
+	conn, err := grpc.Dial("node2:8500", DialNodes(node, other), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	spec := &pb.ModelSpec{Name: "foo", VersionChoice: &pb.ModelSpec_Version{Version: &wrappers.Int64Value{Value: 3}}}
+
+	res, err := pb.NewPredictionServiceClient(conn).GetModelMetadata(context.Background(), &pb.GetModelMetadataRequest{ModelSpec: spec})
+	if err != nil || res.GetModelSpec().GetName() != "foo" {
+		t.Fatalf("Expected the model spec back but got %v, %v", res, err)
+	}
+	_, err = pb.NewPredictionServiceClient(node.Dial(t)).Predict(context.Background(), &pb.PredictRequest{ModelSpec: spec})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("Expected the Predict hook to answer but got %v", err)
+	}
+
+	AssertReached(t, other, "foo", "3")
+	AssertNotReached(t, other, "foo", "4")
+	if requests := node.Requests(); len(requests) != 1 || requests[0].Method != "Predict" {
+		t.Errorf("Expected one Predict call on node1 but got %v", requests)
+	}
+}
+
+func TestRESTNodeResponses(t *testing.T) {
+	node := NewRESTNode(t, "rest")
+	node.Respond("foo", "", http.StatusOK, `{"predictions": [1]}`)
+	node.Respond("foo", "2", http.StatusBadRequest, `{"error": "bad input"}`)
+
+	get := func(path string) (int, string) {
+		res, err := http.Post(node.URL().String()+path, "application/json", strings.NewReader(`{"instances": [1]}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+	if code, body := get("/v1/models/foo/versions/1:predict"); code != http.StatusOK || body != `{"predictions": [1]}` {
+		t.Errorf("Expected the model response but got %d %s", code, body)
+	}
+	if code, _ := get("/v1/models/foo/versions/2:predict"); code != http.StatusBadRequest {
+		t.Errorf("Expected the version response but got %d", code)
+	}
+	if code, _ := get("/v1/models/bar:predict"); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown model but got %d", code)
+	}
+
+	AssertReached(t, node, "foo", "2")
+	if n := Received(node, "foo", ""); n != 2 {
+		t.Errorf("Expected two requests for foo but got %d", n)
+	}
+	if requests := node.Requests(); string(requests[0].Body) != `{"instances": [1]}` {
+		t.Errorf("Expected the request body to be recorded but got %q", requests[0].Body)
+	}
+}
@@ -0,0 +1,189 @@
+package tfservingproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The timeout rules that set the deadline of a call, from the most to the
+// least specific
+const (
+	timeoutRuleModelMethod = "model_method"
+	timeoutRuleModel       = "model"
+	timeoutRuleMethod      = "method"
+	timeoutRuleDefault     = "default"
+	// timeoutRuleCaller is the rule of calls whose own deadline is the
+	// earliest
+	timeoutRuleCaller = "caller"
+	// timeoutRuleNone is the rule of calls without a deadline
+	timeoutRuleNone = "none"
+)
+
+var promTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_timeouts_total",
+	Help: "The total number of grpc calls that exceeded their deadline by the timeout rule that set it",
+}, []string{"model", "rule"})
+
+// TimeoutOverrides are the timeouts of grpc calls by method and model.
+// Methods are the short names of the grpc methods in any case, such as
+// Predict or GetModelMetadata. The most specific timeout applies: the
+// method of the model, the model, the method, and then the default
+// timeout. Unlike the default timeout, overrides also shorten the
+// deadlines of callers, while an earlier deadline of the caller still
+// wins.
+type TimeoutOverrides struct {
+	Methods map[string]time.Duration `mapstructure:"methods" yaml:"methods"`
+	Models  map[string]ModelTimeouts `mapstructure:"models" yaml:"models"`
+}
+
+// ModelTimeouts are the timeouts of the calls for a model
+type ModelTimeouts struct {
+	// Timeout applies to the methods not in Methods. Zero uses the method
+	// timeouts of TimeoutOverrides.
+	Timeout time.Duration            `mapstructure:"timeout" yaml:"timeout"`
+	Methods map[string]time.Duration `mapstructure:"methods" yaml:"methods"`
+}
+
+func (overrides TimeoutOverrides) validate() error {
+	if err := validateMethodTimeouts(overrides.Methods); err != nil {
+		return err
+	}
+	for model, timeouts := range overrides.Models {
+		if model == "" {
+			return errors.New("timeout overrides need a model name")
+		}
+		if timeouts.Timeout < 0 {
+			return fmt.Errorf("timeout of model %s must not be negative, got %v", model, timeouts.Timeout)
+		}
+		if err := validateMethodTimeouts(timeouts.Methods); err != nil {
+			return fmt.Errorf("model %s: %w", model, err)
+		}
+	}
+	return nil
+}
+
+func validateMethodTimeouts(methods map[string]time.Duration) error {
+	for method, timeout := range methods {
+		if method == "" || strings.Contains(method, "/") {
+			return fmt.Errorf("timeout overrides need short method names like Predict, got %q", method)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("timeout of method %s must be positive, got %v", method, timeout)
+		}
+	}
+	return nil
+}
+
+// shortest returns the shortest timeout of the overrides, or zero if
+// there are none
+func (overrides TimeoutOverrides) shortest() time.Duration {
+	var shortest time.Duration
+	check := func(timeout time.Duration) {
+		if timeout > 0 && (shortest == 0 || timeout < shortest) {
+			shortest = timeout
+		}
+	}
+	for _, timeout := range overrides.Methods {
+		check(timeout)
+	}
+	for _, timeouts := range overrides.Models {
+		check(timeouts.Timeout)
+		for _, timeout := range timeouts.Methods {
+			check(timeout)
+		}
+	}
+	return shortest
+}
+
+// normalized returns the overrides with lower case method names
+func (overrides TimeoutOverrides) normalized() TimeoutOverrides {
+	lower := func(methods map[string]time.Duration) map[string]time.Duration {
+		lowered := make(map[string]time.Duration, len(methods))
+		for method, timeout := range methods {
+			lowered[strings.ToLower(method)] = timeout
+		}
+		return lowered
+	}
+	normalized := TimeoutOverrides{Methods: lower(overrides.Methods), Models: make(map[string]ModelTimeouts, len(overrides.Models))}
+	for model, timeouts := range overrides.Models {
+		normalized.Models[model] = ModelTimeouts{Timeout: timeouts.Timeout, Methods: lower(timeouts.Methods)}
+	}
+	return normalized
+}
+
+// timeoutFor returns the override for method of model and the rule it
+// comes from, or zero if there is none. The overrides must be normalized.
+func (overrides TimeoutOverrides) timeoutFor(model string, method string) (time.Duration, string) {
+	method = strings.ToLower(method)
+	if timeouts, ok := overrides.Models[model]; ok {
+		if timeout, ok := timeouts.Methods[method]; ok {
+			return timeout, timeoutRuleModelMethod
+		}
+		if timeouts.Timeout > 0 {
+			return timeouts.Timeout, timeoutRuleModel
+		}
+	}
+	if timeout, ok := overrides.Methods[method]; ok {
+		return timeout, timeoutRuleMethod
+	}
+	return 0, ""
+}
+
+// WithTimeoutOverrides sets the timeouts of calls by method and model,
+// which ApplyConfig can change later
+func WithTimeoutOverrides(overrides TimeoutOverrides) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		if err := overrides.validate(); err != nil {
+			proxy.optionErrors = append(proxy.optionErrors, err)
+			return
+		}
+		proxy.tunables.timeouts = overrides.normalized()
+	}
+}
+
+// timeoutInterceptor sets the deadline of each call from the most specific
+// timeout override, or the default timeout on calls without a deadline.
+// The rule that set the deadline is recorded in the route of the call and
+// counted if the call times out.
+func (server *proxyServiceServer) timeoutInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	settings := server.settings()
+	var model string
+	if specReq, ok := req.(modelSpecRequest); ok {
+		model = specReq.GetModelSpec().GetName()
+	}
+	method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+	timeout, rule := settings.timeouts.timeoutFor(model, method)
+	deadline, hasDeadline := ctx.Deadline()
+	switch {
+	case timeout > 0 && hasDeadline && time.Until(deadline) <= timeout:
+		timeout, rule = 0, timeoutRuleCaller
+	case timeout > 0:
+	case hasDeadline:
+		rule = timeoutRuleCaller
+	case settings.defaultTimeout > 0:
+		timeout, rule = settings.defaultTimeout, timeoutRuleDefault
+	default:
+		rule = timeoutRuleNone
+	}
+	ctx, route := withRoute(ctx)
+	route.timeoutRule = rule
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	res, err := handler(ctx, req)
+	if status.Code(err) == codes.DeadlineExceeded {
+		promTimeouts.WithLabelValues(server.modelLabel(model), rule).Inc()
+	}
+	return res, err
+}
@@ -0,0 +1,154 @@
+package tfservingproxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var testTimeouts = TimeoutOverrides{
+	Methods: map[string]time.Duration{"Predict": 2 * time.Second, "GetModelMetadata": 100 * time.Millisecond},
+	Models: map[string]ModelTimeouts{
+		"llm":       {Timeout: 30 * time.Second, Methods: map[string]time.Duration{"GetModelMetadata": time.Second}},
+		"embedding": {Methods: map[string]time.Duration{"Predict": 500 * time.Millisecond}},
+	},
+}
+
+func TestTimeoutOverridePrecedence(t *testing.T) {
+	for _, test := range []struct {
+		model   string
+		method  string
+		timeout time.Duration
+		rule    string
+	}{
+		{"llm", "GetModelMetadata", time.Second, timeoutRuleModelMethod},
+		{"llm", "Predict", 30 * time.Second, timeoutRuleModel},
+		{"embedding", "Predict", 500 * time.Millisecond, timeoutRuleModelMethod},
+		// A model without a timeout of its own falls back to the methods
+		{"embedding", "GetModelMetadata", 100 * time.Millisecond, timeoutRuleMethod},
+		{"foo", "Predict", 2 * time.Second, timeoutRuleMethod},
+		{"foo", "Classify", 0, ""},
+		{"foo", "predict", 2 * time.Second, timeoutRuleMethod},
+	} {
+		timeout, rule := testTimeouts.normalized().timeoutFor(test.model, test.method)
+		if timeout != test.timeout || rule != test.rule {
+			t.Errorf("Expected %v from %q for %s of %s but got %v from %q", test.timeout, test.rule, test.method, test.model, timeout, rule)
+		}
+	}
+}
+
+// deadlineNode returns a harness whose predictions for models report the
+// deadline left on deadlines, after sleeping for the version of the
+// request in ms
+func deadlineNode(t *testing.T, deadlines chan time.Duration, models ...string) *tfservingtest.Harness {
+	node := tfservingtest.NewGRPCNode(t, "upstream", tfservingtest.WithPredict(func(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+		if deadline, ok := ctx.Deadline(); ok {
+			deadlines <- time.Until(deadline)
+		} else {
+			deadlines <- 0
+		}
+		select {
+		case <-time.After(time.Duration(req.GetModelSpec().GetVersion().GetValue()) * time.Millisecond):
+		case <-ctx.Done():
+			return nil, status.FromContextError(ctx.Err()).Err()
+		}
+		return &pb.PredictResponse{}, nil
+	}))
+	var routes []tfservingtest.HarnessOption
+	for _, model := range models {
+		routes = append(routes, tfservingtest.Route(model, node))
+	}
+	return tfservingtest.NewHarness(t, routes...)
+}
+
+func TestTimeoutOverridesSetUpstreamDeadlines(t *testing.T) {
+	deadlines := make(chan time.Duration, 1)
+	harness := deadlineNode(t, deadlines, "llm", "embedding", "foo")
+	cfg := Config{Grpc: GrpcConfig{DefaultTimeout: 10 * time.Second, TimeoutOverrides: testTimeouts}}
+	proxy, err := NewGrpcProxyFromConfig(cfg, ClientProviderFunc(harness.ClientProvider))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := harness.Serve(proxy)
+	deadlineOf := func(ctx context.Context, model string) time.Duration {
+		t.Helper()
+		if _, err := client.Predict(ctx, predictVersion(model, 1)); err != nil {
+			t.Fatal(err)
+		}
+		return <-deadlines
+	}
+	within := func(got time.Duration, want time.Duration) bool {
+		return got > want-time.Second/4 && got <= want
+	}
+
+	if got := deadlineOf(context.Background(), "llm"); !within(got, 30*time.Second) {
+		t.Errorf("Expected the model timeout of 30s but got %v", got)
+	}
+	if got := deadlineOf(context.Background(), "embedding"); !within(got, 500*time.Millisecond) {
+		t.Errorf("Expected the model method timeout of 500ms but got %v", got)
+	}
+	if got := deadlineOf(context.Background(), "foo"); !within(got, 2*time.Second) {
+		t.Errorf("Expected the method timeout of 2s but got %v", got)
+	}
+
+	// Overrides shorten longer deadlines of callers, shorter ones win
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if got := deadlineOf(ctx, "foo"); !within(got, 2*time.Second) {
+		t.Errorf("Expected the override to shorten the deadline of a minute but got %v", got)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if got := deadlineOf(ctx, "llm"); got > 300*time.Millisecond {
+		t.Errorf("Expected the shorter deadline of the caller to win but got %v", got)
+	}
+
+	// Reloading the overrides applies to the next calls
+	cfg.Grpc.TimeoutOverrides = TimeoutOverrides{Models: map[string]ModelTimeouts{"foo": {Timeout: 5 * time.Second}}}
+	if err := proxy.ApplyConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if got := deadlineOf(context.Background(), "foo"); !within(got, 5*time.Second) {
+		t.Errorf("Expected the reloaded timeout of 5s but got %v", got)
+	}
+	if got := deadlineOf(context.Background(), "llm"); !within(got, 10*time.Second) {
+		t.Errorf("Expected the default timeout once the override is gone but got %v", got)
+	}
+}
+
+func TestTimeoutOverridesCountTimeoutsByRule(t *testing.T) {
+	deadlines := make(chan time.Duration, 2)
+	harness := deadlineNode(t, deadlines, "foo")
+	client := harness.Serve(NewGrpcProxy(harness.ClientProvider, WithTimeoutOverrides(TimeoutOverrides{
+		Models: map[string]ModelTimeouts{"foo": {Timeout: 50 * time.Millisecond}},
+	})))
+	counter := func(rule string) float64 {
+		return testutil.ToFloat64(promTimeouts.WithLabelValues(allModelsLabel, rule))
+	}
+	byModel, byCaller := counter(timeoutRuleModel), counter(timeoutRuleCaller)
+
+	if _, err := client.Predict(context.Background(), predictVersion("foo", 1000)); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("Expected the call to exceed the model timeout but got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := client.Predict(ctx, predictVersion("foo", 1000)); status.Code(err) != codes.DeadlineExceeded {
+		t.Fatalf("Expected the call to exceed the deadline of the caller but got %v", err)
+	}
+	// The proxy may still be handling the timed out call
+	for deadline := time.Now().Add(5 * time.Second); counter(timeoutRuleCaller) == byCaller && time.Now().Before(deadline); {
+		time.Sleep(time.Millisecond)
+	}
+	if n := counter(timeoutRuleModel) - byModel; n != 1 {
+		t.Errorf("Expected one timeout by the model rule but got %v", n)
+	}
+	if n := counter(timeoutRuleCaller) - byCaller; n != 1 {
+		t.Errorf("Expected one timeout by the deadline of the caller but got %v", n)
+	}
+}
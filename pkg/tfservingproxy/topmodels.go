@@ -0,0 +1,258 @@
+package tfservingproxy
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Defaults of TopModelsConfig
+const (
+	defaultTopModelsCapacity = 256
+	defaultTopModelsWindow   = 5 * time.Minute
+)
+
+// defaultTopModelsLimit is the number of models ServeTop returns if the
+// request has no n
+const defaultTopModelsLimit = 20
+
+// topModelsShards is the number of independently locked shards of a
+// TopModels, and topModelsBuckets the number of sub-windows of its window
+const (
+	topModelsShards  = 16
+	topModelsBuckets = 10
+)
+
+var (
+	topModelRequestsDesc = prometheus.NewDesc("tfservingcache_proxy_top_model_requests",
+		"The number of requests in the window of the models with the most traffic, by rank", []string{"rank", "model"}, nil)
+	topModelErrorsDesc = prometheus.NewDesc("tfservingcache_proxy_top_model_errors",
+		"The number of failed requests in the window of the models with the most traffic, by rank", []string{"rank", "model"}, nil)
+	topModelLatencyDesc = prometheus.NewDesc("tfservingcache_proxy_top_model_latency_seconds",
+		"The mean latency in the window of the models with the most traffic, by rank", []string{"rank", "model"}, nil)
+)
+
+// TopModelsConfig configures a TopModels. Zero values are replaced by the
+// defaults.
+type TopModelsConfig struct {
+	// Capacity is the number of models tracked at once, 256 by default.
+	// Models with less than a Capacity-th of the traffic may be missed.
+	Capacity int `mapstructure:"capacity" yaml:"capacity"`
+	// Window is how far back the traffic is counted, 5 minutes by default
+	Window time.Duration `mapstructure:"window" yaml:"window"`
+	// MetricRanks is the number of top models exported as metrics when the
+	// TopModels is registered as a collector. Zero exports none.
+	MetricRanks int `mapstructure:"metricRanks" yaml:"metricRanks"`
+}
+
+func (config TopModelsConfig) withDefaults() TopModelsConfig {
+	if config.Capacity <= 0 {
+		config.Capacity = defaultTopModelsCapacity
+	}
+	if config.Window <= 0 {
+		config.Window = defaultTopModelsWindow
+	}
+	return config
+}
+
+// ModelTraffic is the traffic of a model in the window of a TopModels.
+// Errors and Latency only count the requests since the model was last
+// tracked.
+type ModelTraffic struct {
+	Model    string `json:"model"`
+	Requests int64  `json:"requests"`
+	Errors   int64  `json:"errors"`
+	// Latency is the total latency of the requests
+	Latency time.Duration `json:"latency"`
+	// Overcount bounds how many of Requests may belong to models the
+	// model replaced when the tracker was full
+	Overcount int64 `json:"overcount,omitempty"`
+}
+
+// TopModels tracks the models with the most requests over a sliding
+// window. It uses the space-saving algorithm, so its memory is bounded by
+// its capacity however many model names clients send. Models are spread
+// over shards with their own lock so concurrent requests rarely contend.
+// A TopModels may be shared by a GrpcProxy and a RestProxy, and is a
+// prometheus.Collector exporting the top models by rank.
+type TopModels struct {
+	config    TopModelsConfig
+	subWindow time.Duration
+	shards    [topModelsShards]topModelsShard
+	now       func() time.Time
+}
+
+type topModelsShard struct {
+	buckets [topModelsBuckets]topModelsBucket
+	mutex   sync.Mutex
+}
+
+// topModelsBucket is the space-saving summary of one sub-window
+type topModelsBucket struct {
+	epoch    int64
+	counters map[string]*ModelTraffic
+}
+
+// NewTopModels creates a TopModels as configured by config
+func NewTopModels(config TopModelsConfig) *TopModels {
+	config = config.withDefaults()
+	top := &TopModels{config: config, subWindow: config.Window / topModelsBuckets, now: time.Now}
+	if top.subWindow <= 0 {
+		top.subWindow = 1
+	}
+	return top
+}
+
+// WithTopModels records the traffic of each grpc call in top
+func WithTopModels(top *TopModels) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.serverImpl.topModels = top
+	}
+}
+
+// WithRESTTopModels records the traffic of each REST request in top
+func WithRESTTopModels(top *TopModels) RestProxyOption {
+	return func(proxy *RestProxy) {
+		proxy.topModels = top
+	}
+}
+
+// record counts a request for model that took latency
+func (top *TopModels) record(model string, latency time.Duration, failed bool) {
+	h := fnv.New32a()
+	h.Write([]byte(model))
+	shard := &top.shards[h.Sum32()%topModelsShards]
+	epoch := top.now().UnixNano() / int64(top.subWindow)
+	capacity := (top.config.Capacity + topModelsShards - 1) / topModelsShards
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	bucket := &shard.buckets[epoch%topModelsBuckets]
+	if bucket.epoch != epoch || bucket.counters == nil {
+		bucket.epoch, bucket.counters = epoch, make(map[string]*ModelTraffic, capacity)
+	}
+	counter, ok := bucket.counters[model]
+	if !ok {
+		counter = &ModelTraffic{Model: model}
+		if len(bucket.counters) >= capacity {
+			// Replace the least requested model, which the new one may
+			// have had as many requests as
+			var least *ModelTraffic
+			for _, c := range bucket.counters {
+				if least == nil || c.Requests < least.Requests {
+					least = c
+				}
+			}
+			delete(bucket.counters, least.Model)
+			counter.Requests, counter.Overcount = least.Requests, least.Requests
+		}
+		bucket.counters[model] = counter
+	}
+	counter.Requests++
+	counter.Latency += latency
+	if failed {
+		counter.Errors++
+	}
+}
+
+// recordTopModel counts the REST request req, whose response was written
+// to rec, in the top models
+func (handler *RestProxy) recordTopModel(req *http.Request, rec *statusRecorder, start time.Time) {
+	if handler.topModels == nil {
+		return
+	}
+	if key, _, err := ParseRESTPath(req.URL.Path); err == nil {
+		handler.topModels.record(key.Name, time.Since(start), rec.status >= http.StatusBadRequest)
+	}
+}
+
+// Top returns the n models with the most requests in the window, most
+// requested first. A non-positive n returns all tracked models.
+func (top *TopModels) Top(n int) []ModelTraffic {
+	epoch := top.now().UnixNano() / int64(top.subWindow)
+	var models []ModelTraffic
+	for i := range top.shards {
+		shard := &top.shards[i]
+		merged := make(map[string]*ModelTraffic)
+		shard.mutex.Lock()
+		for _, bucket := range shard.buckets {
+			if bucket.epoch <= epoch-topModelsBuckets {
+				continue
+			}
+			for model, counter := range bucket.counters {
+				total, ok := merged[model]
+				if !ok {
+					total = &ModelTraffic{Model: model}
+					merged[model] = total
+				}
+				total.Requests += counter.Requests
+				total.Errors += counter.Errors
+				total.Latency += counter.Latency
+				total.Overcount += counter.Overcount
+			}
+		}
+		shard.mutex.Unlock()
+		for _, total := range merged {
+			models = append(models, *total)
+		}
+	}
+	sort.Slice(models, func(i, j int) bool {
+		if models[i].Requests != models[j].Requests {
+			return models[i].Requests > models[j].Requests
+		}
+		return models[i].Model < models[j].Model
+	})
+	if n > 0 && len(models) > n {
+		models = models[:n]
+	}
+	return models
+}
+
+// ServeTop writes the models with the most requests as JSON. The n query
+// parameter selects the number of models.
+func (top *TopModels) ServeTop(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		writeError(rw, http.StatusMethodNotAllowed, "Use GET to read the top models")
+		return
+	}
+	n := defaultTopModelsLimit
+	if value := req.URL.Query().Get("n"); value != "" {
+		var err error
+		if n, err = strconv.Atoi(value); err != nil || n <= 0 {
+			writeError(rw, http.StatusBadRequest, "N must be a positive number")
+			return
+		}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(top.Top(n)); err != nil {
+		log.WithError(err).Error("Could not write the top models")
+	}
+}
+
+// Describe implements prometheus.Collector
+func (top *TopModels) Describe(ch chan<- *prometheus.Desc) {
+	ch <- topModelRequestsDesc
+	ch <- topModelErrorsDesc
+	ch <- topModelLatencyDesc
+}
+
+// Collect implements prometheus.Collector. It exports the MetricRanks
+// models with the most requests, so the number of series stays fixed.
+func (top *TopModels) Collect(ch chan<- prometheus.Metric) {
+	if top.config.MetricRanks <= 0 {
+		return
+	}
+	for i, model := range top.Top(top.config.MetricRanks) {
+		rank := strconv.Itoa(i + 1)
+		ch <- prometheus.MustNewConstMetric(topModelRequestsDesc, prometheus.GaugeValue, float64(model.Requests), rank, model.Model)
+		ch <- prometheus.MustNewConstMetric(topModelErrorsDesc, prometheus.GaugeValue, float64(model.Errors), rank, model.Model)
+		ch <- prometheus.MustNewConstMetric(topModelLatencyDesc, prometheus.GaugeValue, model.Latency.Seconds()/float64(model.Requests), rank, model.Model)
+	}
+}
@@ -0,0 +1,90 @@
+package tfservingproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTopModelsFindsHeavyHittersInBoundedMemory(t *testing.T) {
+	top := NewTopModels(TopModelsConfig{MetricRanks: 2})
+	for i := 0; i < 10000; i++ {
+		top.record("made-up-"+strconv.Itoa(i), time.Millisecond, false)
+		if i%20 == 0 {
+			top.record("heavy", time.Millisecond, i%40 == 0)
+		}
+		if i%30 == 0 {
+			top.record("medium", time.Millisecond, false)
+		}
+	}
+
+	models := top.Top(0)
+	if len(models) > defaultTopModelsCapacity {
+		t.Errorf("Expected at most %d models to be tracked but got %d", defaultTopModelsCapacity, len(models))
+	}
+	if models[0].Model != "heavy" || models[1].Model != "medium" {
+		t.Fatalf("Expected heavy and medium on top but got %v", models[:2])
+	}
+	// Errors of a model are only counted while it is tracked
+	if heavy := models[0]; heavy.Requests-heavy.Overcount > 500 || heavy.Requests < 500 || heavy.Errors < 240 || heavy.Errors > 250 {
+		t.Errorf("Expected the counts of heavy to bound its 500 requests and 250 errors but got %+v", heavy)
+	}
+	if n := testutil.CollectAndCount(top); n != 6 {
+		t.Errorf("Expected three metrics for each of two ranks but got %d", n)
+	}
+}
+
+func TestTopModelsForgetsTrafficOutsideTheWindow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	top := NewTopModels(TopModelsConfig{Window: time.Minute})
+	top.now = func() time.Time { return now }
+	top.record("old", time.Millisecond, false)
+	now = now.Add(30 * time.Second)
+	top.record("new", time.Millisecond, false)
+
+	if models := top.Top(0); len(models) != 2 {
+		t.Errorf("Expected both models in the window but got %v", models)
+	}
+	now = now.Add(40 * time.Second)
+	if models := top.Top(0); len(models) != 1 || models[0].Model != "new" {
+		t.Errorf("Expected only the new model in the window but got %v", models)
+	}
+}
+
+func TestRESTTopModels(t *testing.T) {
+	upstream := tfservingtest.NewRESTNode(t, "upstream")
+	upstream.Respond("foo", "", http.StatusOK, `{"predictions": [1]}`)
+	upstream.Respond("bar", "", http.StatusInternalServerError, `{"error": "broken"}`)
+	top := NewTopModels(TopModelsConfig{})
+	proxy := NewRestProxy(func(req *http.Request, _ string, _ string) error {
+		req.URL.Scheme, req.URL.Host = "http", upstream.Address()
+		return nil
+	}, WithRESTTopModels(top))
+	for _, model := range []string{"foo", "foo", "bar"} {
+		proxy.Serve()(httptest.NewRecorder(), httptest.NewRequest("POST", "/v1/models/"+model+"/versions/1:predict", nil))
+	}
+
+	rw := httptest.NewRecorder()
+	top.ServeTop(rw, httptest.NewRequest("GET", "/admin/models/top?n=2", nil))
+	var models []ModelTraffic
+	if err := json.NewDecoder(rw.Body).Decode(&models); err != nil {
+		t.Fatal(err)
+	}
+	if len(models) != 2 || models[0].Model != "foo" || models[0].Requests != 2 || models[0].Errors != 0 ||
+		models[1].Model != "bar" || models[1].Errors != 1 || models[0].Latency <= 0 {
+		t.Errorf("Unexpected top models: %+v", models)
+	}
+
+	rw = httptest.NewRecorder()
+	top.ServeTop(rw, httptest.NewRequest("GET", "/admin/models/top?n=none", nil))
+	if rw.Code != http.StatusBadRequest || !strings.Contains(rw.Body.String(), "positive") {
+		t.Errorf("Expected an invalid n to be rejected but got %d %s", rw.Code, rw.Body)
+	}
+}
@@ -0,0 +1,105 @@
+package tfservingproxy
+
+import (
+	"context"
+	"strconv"
+
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const tracerName = "github.com/mKaloer/TFServingCache/pkg/tfservingproxy"
+
+var (
+	attrModel   = attribute.Key("tfservingcache.model")
+	attrVersion = attribute.Key("tfservingcache.version")
+	attrTarget  = attribute.Key("tfservingcache.target")
+)
+
+// WithTracerProvider makes the proxy create spans with the given
+// OpenTelemetry TracerProvider. By default a no-op provider is used.
+func WithTracerProvider(tp trace.TracerProvider) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.tracerProvider = tp
+	}
+}
+
+// WithTextMapPropagator sets the propagator used to extract trace context
+// from incoming metadata and inject it into upstream calls. By default
+// the global OpenTelemetry propagator is used.
+func WithTextMapPropagator(propagator propagation.TextMapPropagator) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.serverImpl.propagator = propagator
+	}
+}
+
+// metadataCarrier adapts grpc metadata to a propagation.TextMapCarrier
+type metadataCarrier metadata.MD
+
+func (carrier metadataCarrier) Get(key string) string {
+	values := metadata.MD(carrier).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (carrier metadataCarrier) Set(key string, value string) {
+	metadata.MD(carrier).Set(key, value)
+}
+
+func (carrier metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(carrier))
+	for k := range carrier {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// tracingInterceptor starts a server span for every RPC, continuing the
+// trace found in the incoming metadata.
+func tracingInterceptor(tracer trace.Tracer, propagator propagation.TextMapPropagator) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		ctx = propagator.Extract(ctx, metadataCarrier(md.Copy()))
+		ctx, span := tracer.Start(ctx, info.FullMethod,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("rpc.system", "grpc"),
+				attribute.String("rpc.method", info.FullMethod)))
+		defer span.End()
+
+		res, err := handler(ctx, req)
+		st := status.Convert(err)
+		span.SetAttributes(attribute.Int64("rpc.grpc.status_code", int64(st.Code())))
+		if err != nil {
+			span.SetStatus(otelcodes.Error, st.Message())
+		}
+		return res, err
+	}
+}
+
+// injectTraceContext adds the current trace context to the outgoing metadata
+func (server *proxyServiceServer) injectTraceContext(ctx context.Context) context.Context {
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	server.propagator.Inject(ctx, metadataCarrier(md))
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+func modelAttributes(modelSpec *pb.ModelSpec) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attrModel.String(modelSpec.GetName()),
+		attrVersion.String(strconv.FormatInt(modelSpec.GetVersion().GetValue(), 10)),
+	}
+}
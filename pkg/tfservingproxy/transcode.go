@@ -0,0 +1,579 @@
+package tfservingproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/jsonpb"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/tensorflow/tensorflow/tensorflow/go/core/example"
+	"github.com/tensorflow/tensorflow/tensorflow/go/core/framework"
+	tfproto "github.com/tensorflow/tensorflow/tensorflow/go/core/protobuf"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// defaultSignatureName is the signature TF Serving uses when none is given
+const defaultSignatureName = "serving_default"
+
+// signatureDefField is the GetModelMetadata field holding the signatures
+const signatureDefField = "signature_def"
+
+// signatureTTL is how long the signatures of a model version are cached
+const signatureTTL = time.Minute
+
+// The grpc methods transcoded requests are called as
+const (
+	predictMethod          = "/tensorflow.serving.PredictionService/Predict"
+	classifyMethod         = "/tensorflow.serving.PredictionService/Classify"
+	regressMethod          = "/tensorflow.serving.PredictionService/Regress"
+	getModelMetadataMethod = "/tensorflow.serving.PredictionService/GetModelMetadata"
+	getModelStatusMethod   = "/tensorflow.serving.ModelService/GetModelStatus"
+)
+
+// Transcoder serves TF Serving REST calls over grpc, for nodes that do not
+// expose their REST port. Requests are converted to their protobuf form
+// and called on the GrpcProxy it belongs to through its interceptors, so
+// that they are authenticated, admitted and limited like grpc calls. The
+// responses and errors are rendered as TF Serving JSON.
+type Transcoder struct {
+	proxy      *GrpcProxy
+	signatures map[ModelKey]cachedSignatures
+	now        func() time.Time
+	mutex      sync.RWMutex
+}
+
+// cachedSignatures are the signatures of a model version until they expire
+type cachedSignatures struct {
+	signatures *pb.SignatureDefMap
+	expires    time.Time
+}
+
+// Transcoder returns a Transcoder routing through the proxy
+func (proxy *GrpcProxy) Transcoder() *Transcoder {
+	return &Transcoder{
+		proxy:      proxy,
+		signatures: make(map[ModelKey]cachedSignatures),
+		now:        time.Now,
+	}
+}
+
+// transcodedKey is the context key marking calls transcoded from REST
+type transcodedKey struct{}
+
+// isTranscoded returns whether the call of ctx was transcoded from REST
+func isTranscoded(ctx context.Context) bool {
+	return ctx.Value(transcodedKey{}) != nil
+}
+
+// countGrpcRequest counts a grpc call in the request metrics. Transcoded
+// requests are counted as REST requests by the RestProxy only.
+func countGrpcRequest(ctx context.Context) {
+	if !isTranscoded(ctx) {
+		promRequestsTotal.WithLabelValues("grpc").Inc()
+	}
+}
+
+// countGrpcFailure counts a failed grpc call like countGrpcRequest
+func countGrpcFailure(ctx context.Context) {
+	if !isTranscoded(ctx) {
+		promRequestsFailed.WithLabelValues("grpc").Inc()
+	}
+}
+
+// restAddr is the address of a REST client as a net.Addr
+type restAddr string
+
+func (addr restAddr) Network() string { return "tcp" }
+
+func (addr restAddr) String() string { return string(addr) }
+
+// transcodedContext returns the context of a grpc call made for req. Its
+// headers become the incoming metadata and its client the peer of the call.
+func transcodedContext(req *http.Request) context.Context {
+	md := make(metadata.MD, len(req.Header))
+	for name, values := range req.Header {
+		md[strings.ToLower(name)] = values
+	}
+	ctx := metadata.NewIncomingContext(req.Context(), md)
+	p := &peer.Peer{Addr: restAddr(req.RemoteAddr)}
+	if req.TLS != nil {
+		p.AuthInfo = credentials.TLSInfo{State: *req.TLS}
+	}
+	return context.WithValue(peer.NewContext(ctx, p), transcodedKey{}, true)
+}
+
+// invoke calls method with in on the proxy through its interceptors, like
+// a grpc call from the client of req
+func (transcoder *Transcoder) invoke(req *http.Request, method string, in interface{}, handler grpc.UnaryHandler) (interface{}, error) {
+	info := &grpc.UnaryServerInfo{Server: transcoder.proxy.serverImpl, FullMethod: method}
+	return transcoder.proxy.unary(transcodedContext(req), in, info, handler)
+}
+
+// Invalidate drops the cached signatures of the model version key, so
+// that they are fetched again on the next request
+func (transcoder *Transcoder) Invalidate(key ModelKey) {
+	transcoder.mutex.Lock()
+	defer transcoder.mutex.Unlock()
+	delete(transcoder.signatures, key)
+}
+
+// WithTranscoding makes the REST proxy serve the given models through
+// transcoder instead of forwarding the requests to a REST port. "*"
+// transcodes all models.
+func WithTranscoding(transcoder *Transcoder, models ...string) RestProxyOption {
+	return func(proxy *RestProxy) {
+		proxy.transcoder = transcoder
+		proxy.transcodedModels = make(map[string]bool, len(models))
+		for _, model := range models {
+			proxy.transcodedModels[model] = true
+		}
+	}
+}
+
+// transcodes returns whether requests for model are transcoded
+func (handler *RestProxy) transcodes(model string) bool {
+	return handler.transcoder != nil && (handler.transcodedModels["*"] || handler.transcodedModels[model])
+}
+
+// ServeModel serves a TF Serving REST request for the model version key
+func (transcoder *Transcoder) ServeModel(rw http.ResponseWriter, req *http.Request, key ModelKey) {
+	spec, err := key.modelSpec()
+	if err != nil {
+		writeTranscodedError(rw, status.Errorf(codes.InvalidArgument, "invalid model version %q", key.Version))
+		return
+	}
+	_, verb, _ := ParseRESTPath(req.URL.Path)
+	var res interface{}
+	switch {
+	case req.Method == http.MethodPost && verb == VerbPredict:
+		res, err = transcoder.predict(req, key, spec)
+	case req.Method == http.MethodPost && verb == VerbClassify:
+		res, err = transcoder.classify(req, spec)
+	case req.Method == http.MethodPost && verb == VerbRegress:
+		res, err = transcoder.regress(req, spec)
+	case req.Method == http.MethodGet && verb == VerbMetadata:
+		res, err = transcoder.metadata(req, spec)
+	case req.Method == http.MethodGet && verb == VerbStatus:
+		res, err = transcoder.modelStatus(req, spec)
+	default:
+		err = status.Errorf(codes.NotFound, "unsupported request %s %s", req.Method, req.URL.Path)
+	}
+	if err != nil {
+		restLogger(req).WithError(err).Errorf("Transcoded request failed: %s", req.URL.String())
+		promRequestsFailed.WithLabelValues("rest").Inc()
+		writeTranscodedError(rw, err)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(rw).Encode(res); err != nil {
+		restLogger(req).WithError(err).Error("Could not write transcoded response")
+	}
+}
+
+// decodeBody decodes the JSON body of req into v, keeping numbers as json.Number
+func decodeBody(req *http.Request, v interface{}) error {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "could not read body: %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(v); err != nil {
+		return status.Errorf(codes.InvalidArgument, "malformed JSON body: %v", err)
+	}
+	return nil
+}
+
+type predictBody struct {
+	SignatureName string      `json:"signature_name"`
+	Instances     interface{} `json:"instances"`
+	Inputs        interface{} `json:"inputs"`
+}
+
+func (transcoder *Transcoder) predict(req *http.Request, key ModelKey, spec *pb.ModelSpec) (interface{}, error) {
+	var body predictBody
+	if err := decodeBody(req, &body); err != nil {
+		return nil, err
+	}
+	if (body.Instances == nil) == (body.Inputs == nil) {
+		return nil, status.Error(codes.InvalidArgument, "request must have exactly one of instances or inputs")
+	}
+	spec.SignatureName = body.SignatureName
+	signature, err := transcoder.signature(req, key, spec)
+	if err != nil {
+		return nil, err
+	}
+	var inputs map[string]interface{}
+	if body.Instances != nil {
+		inputs, err = rowInputs(body.Instances, signature)
+	} else {
+		inputs, err = columnarInputs(body.Inputs, signature)
+	}
+	if err != nil {
+		return nil, err
+	}
+	predictReq := &pb.PredictRequest{ModelSpec: spec, Inputs: make(map[string]*framework.TensorProto, len(inputs))}
+	for name, value := range inputs {
+		info, ok := signature.GetInputs()[name]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "signature has no input named %s", name)
+		}
+		tensor, err := tensorFromJSON(value, info.GetDtype())
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "input %s: %v", name, err)
+		}
+		predictReq.Inputs[name] = tensor
+	}
+	out, err := transcoder.invoke(req, predictMethod, predictReq, func(ctx context.Context, in interface{}) (interface{}, error) {
+		return transcoder.proxy.serverImpl.Predict(ctx, in.(*pb.PredictRequest))
+	})
+	if err != nil {
+		// The model may have been replaced by one with other signatures
+		if code := status.Code(err); code == codes.InvalidArgument || code == codes.NotFound {
+			transcoder.Invalidate(key)
+		}
+		return nil, err
+	}
+	res := out.(*pb.PredictResponse)
+	if body.Instances != nil {
+		predictions, err := rowOutputs(res.GetOutputs())
+		return map[string]interface{}{"predictions": predictions}, err
+	}
+	outputs, err := columnarOutputs(res.GetOutputs())
+	return map[string]interface{}{"outputs": outputs}, err
+}
+
+// namedValues returns value as named inputs if it is a JSON object
+func namedValues(value interface{}) (map[string]interface{}, bool) {
+	object, ok := value.(map[string]interface{})
+	if !ok || isB64Object(value) {
+		return nil, false
+	}
+	return object, true
+}
+
+// soleInput returns the name of the only input of signature
+func soleInput(signature *tfproto.SignatureDef) (string, error) {
+	if len(signature.GetInputs()) != 1 {
+		return "", status.Errorf(codes.InvalidArgument, "signature has %d inputs, they must be named", len(signature.GetInputs()))
+	}
+	for name := range signature.GetInputs() {
+		return name, nil
+	}
+	return "", nil
+}
+
+// rowInputs turns the instances of a row format request into batched inputs
+func rowInputs(instances interface{}, signature *tfproto.SignatureDef) (map[string]interface{}, error) {
+	list, ok := instances.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "instances must be a non-empty list")
+	}
+	if first, named := namedValues(list[0]); named {
+		inputs := make(map[string]interface{}, len(first))
+		for name := range first {
+			batch := make([]interface{}, len(list))
+			for i, instance := range list {
+				values, named := namedValues(instance)
+				if !named || len(values) != len(first) || values[name] == nil {
+					return nil, status.Errorf(codes.InvalidArgument, "instance %d does not have the same named inputs as the first instance", i)
+				}
+				batch[i] = values[name]
+			}
+			inputs[name] = batch
+		}
+		return inputs, nil
+	}
+	name, err := soleInput(signature)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{name: list}, nil
+}
+
+// columnarInputs returns the inputs of a columnar format request
+func columnarInputs(inputs interface{}, signature *tfproto.SignatureDef) (map[string]interface{}, error) {
+	if named, ok := namedValues(inputs); ok {
+		return named, nil
+	}
+	name, err := soleInput(signature)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{name: inputs}, nil
+}
+
+// outputJSON converts the output tensor name to JSON. Like TF Serving,
+// string outputs whose name ends in _bytes are base64 encoded.
+func outputJSON(name string, tensor *framework.TensorProto) (interface{}, error) {
+	value, err := tensorToJSON(tensor, strings.HasSuffix(name, "_bytes"))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "output %s: %v", name, err)
+	}
+	return value, nil
+}
+
+// rowOutputs splits the outputs into one prediction per instance
+func rowOutputs(outputs map[string]*framework.TensorProto) (interface{}, error) {
+	names := sortedKeys(outputs)
+	batches := make(map[string][]interface{}, len(outputs))
+	batchSize := -1
+	for _, name := range names {
+		value, err := outputJSON(name, outputs[name])
+		if err != nil {
+			return nil, err
+		}
+		batch, ok := value.([]interface{})
+		if !ok || (batchSize >= 0 && len(batch) != batchSize) {
+			return nil, status.Errorf(codes.InvalidArgument,
+				"output %s does not have the batch size of the other outputs, use the columnar format", name)
+		}
+		batchSize = len(batch)
+		batches[name] = batch
+	}
+	if len(names) == 1 {
+		return batches[names[0]], nil
+	}
+	predictions := make([]interface{}, batchSize)
+	for i := range predictions {
+		prediction := make(map[string]interface{}, len(names))
+		for _, name := range names {
+			prediction[name] = batches[name][i]
+		}
+		predictions[i] = prediction
+	}
+	return predictions, nil
+}
+
+// columnarOutputs returns the outputs as a value, or an object if there are several
+func columnarOutputs(outputs map[string]*framework.TensorProto) (interface{}, error) {
+	values := make(map[string]interface{}, len(outputs))
+	for name, tensor := range outputs {
+		value, err := outputJSON(name, tensor)
+		if err != nil {
+			return nil, err
+		}
+		if len(outputs) == 1 {
+			return value, nil
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+type examplesBody struct {
+	SignatureName string        `json:"signature_name"`
+	Context       interface{}   `json:"context"`
+	Examples      []interface{} `json:"examples"`
+}
+
+// input converts the examples of a classify or regress request to an Input
+func (body *examplesBody) input() (*pb.Input, error) {
+	examples := make([]*example.Example, len(body.Examples))
+	for i, value := range body.Examples {
+		ex, err := exampleFromJSON(value)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "example %d: %v", i, err)
+		}
+		examples[i] = ex
+	}
+	if body.Context == nil {
+		return &pb.Input{Kind: &pb.Input_ExampleList{ExampleList: &pb.ExampleList{Examples: examples}}}, nil
+	}
+	exampleContext, err := exampleFromJSON(body.Context)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "context: %v", err)
+	}
+	return &pb.Input{Kind: &pb.Input_ExampleListWithContext{
+		ExampleListWithContext: &pb.ExampleListWithContext{Examples: examples, Context: exampleContext},
+	}}, nil
+}
+
+func (transcoder *Transcoder) classify(req *http.Request, spec *pb.ModelSpec) (interface{}, error) {
+	var body examplesBody
+	if err := decodeBody(req, &body); err != nil {
+		return nil, err
+	}
+	input, err := body.input()
+	if err != nil {
+		return nil, err
+	}
+	spec.SignatureName = body.SignatureName
+	out, err := transcoder.invoke(req, classifyMethod, &pb.ClassificationRequest{ModelSpec: spec, Input: input}, func(ctx context.Context, in interface{}) (interface{}, error) {
+		return transcoder.proxy.serverImpl.Classify(ctx, in.(*pb.ClassificationRequest))
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := out.(*pb.ClassificationResponse)
+	results := make([]interface{}, 0, len(res.GetResult().GetClassifications()))
+	for _, classifications := range res.GetResult().GetClassifications() {
+		classes := make([]interface{}, 0, len(classifications.GetClasses()))
+		for _, class := range classifications.GetClasses() {
+			classes = append(classes, []interface{}{class.GetLabel(), floatJSON(float64(class.GetScore()), 32)})
+		}
+		results = append(results, classes)
+	}
+	return map[string]interface{}{"results": results}, nil
+}
+
+func (transcoder *Transcoder) regress(req *http.Request, spec *pb.ModelSpec) (interface{}, error) {
+	var body examplesBody
+	if err := decodeBody(req, &body); err != nil {
+		return nil, err
+	}
+	input, err := body.input()
+	if err != nil {
+		return nil, err
+	}
+	spec.SignatureName = body.SignatureName
+	out, err := transcoder.invoke(req, regressMethod, &pb.RegressionRequest{ModelSpec: spec, Input: input}, func(ctx context.Context, in interface{}) (interface{}, error) {
+		return transcoder.proxy.serverImpl.Regress(ctx, in.(*pb.RegressionRequest))
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := out.(*pb.RegressionResponse)
+	results := make([]interface{}, 0, len(res.GetResult().GetRegressions()))
+	for _, regression := range res.GetResult().GetRegressions() {
+		results = append(results, floatJSON(float64(regression.GetValue()), 32))
+	}
+	return map[string]interface{}{"results": results}, nil
+}
+
+// getSignatures fetches the signatures of the model in spec
+func (transcoder *Transcoder) getSignatures(req *http.Request, spec *pb.ModelSpec) (*pb.SignatureDefMap, *pb.GetModelMetadataResponse, error) {
+	metadataReq := &pb.GetModelMetadataRequest{
+		ModelSpec:     &pb.ModelSpec{Name: spec.GetName(), VersionChoice: spec.GetVersionChoice()},
+		MetadataField: []string{signatureDefField},
+	}
+	out, err := transcoder.invoke(req, getModelMetadataMethod, metadataReq, func(ctx context.Context, in interface{}) (interface{}, error) {
+		return transcoder.proxy.serverImpl.GetModelMetadata(ctx, in.(*pb.GetModelMetadataRequest))
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	res := out.(*pb.GetModelMetadataResponse)
+	signatures := &pb.SignatureDefMap{}
+	if err := ptypes.UnmarshalAny(res.GetMetadata()[signatureDefField], signatures); err != nil {
+		return nil, nil, status.Errorf(codes.Internal, "could not decode model signatures: %v", err)
+	}
+	return signatures, res, nil
+}
+
+// signature returns the signature named in spec, fetching the signatures
+// of the model version and caching them for signatureTTL when needed
+func (transcoder *Transcoder) signature(req *http.Request, key ModelKey, spec *pb.ModelSpec) (*tfproto.SignatureDef, error) {
+	transcoder.mutex.RLock()
+	cached, ok := transcoder.signatures[key]
+	transcoder.mutex.RUnlock()
+	signatures := cached.signatures
+	if !ok || !transcoder.now().Before(cached.expires) {
+		var err error
+		signatures, _, err = transcoder.getSignatures(req, spec)
+		if err != nil {
+			return nil, err
+		}
+		transcoder.mutex.Lock()
+		transcoder.signatures[key] = cachedSignatures{signatures: signatures, expires: transcoder.now().Add(signatureTTL)}
+		transcoder.mutex.Unlock()
+	}
+	name := spec.GetSignatureName()
+	if name == "" {
+		name = defaultSignatureName
+	}
+	signature, ok := signatures.GetSignatureDef()[name]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "serving signature name: %q not found in signature def", name)
+	}
+	return signature, nil
+}
+
+// protoJSON renders msg like TF Serving renders protobuf messages
+func protoJSON(msg proto.Message, emitDefaults bool) (json.RawMessage, error) {
+	marshaler := jsonpb.Marshaler{OrigName: true, EmitDefaults: emitDefaults}
+	rendered, err := marshaler.MarshalToString(msg)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not render %s: %v", proto.MessageName(msg), err)
+	}
+	return json.RawMessage(rendered), nil
+}
+
+func (transcoder *Transcoder) metadata(req *http.Request, spec *pb.ModelSpec) (interface{}, error) {
+	signatures, res, err := transcoder.getSignatures(req, spec)
+	if err != nil {
+		return nil, err
+	}
+	modelSpec, err := protoJSON(res.GetModelSpec(), false)
+	if err != nil {
+		return nil, err
+	}
+	signatureDef, err := protoJSON(signatures, false)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"model_spec": modelSpec,
+		"metadata":   map[string]interface{}{signatureDefField: signatureDef},
+	}, nil
+}
+
+func (transcoder *Transcoder) modelStatus(req *http.Request, spec *pb.ModelSpec) (interface{}, error) {
+	out, err := transcoder.invoke(req, getModelStatusMethod, &pb.GetModelStatusRequest{ModelSpec: spec}, func(ctx context.Context, in interface{}) (interface{}, error) {
+		return transcoder.proxy.serverImpl.GetModelStatus(ctx, in.(*pb.GetModelStatusRequest))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return protoJSON(out.(*pb.GetModelStatusResponse), true)
+}
+
+// tfServingHTTPStatus returns the HTTP status TF Serving uses for a grpc code
+func tfServingHTTPStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.Canceled:
+		return http.StatusRequestTimeout
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+// writeTranscodedError writes err in TF Serving's REST error format
+func writeTranscodedError(rw http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(tfServingHTTPStatus(st.Code()))
+	json.NewEncoder(rw).Encode(map[string]string{"error": st.Message()})
+}
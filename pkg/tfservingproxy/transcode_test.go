@@ -0,0 +1,374 @@
+package tfservingproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	anypb "github.com/golang/protobuf/ptypes/any"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/tensorflow/tensorflow/tensorflow/go/core/example"
+	"github.com/tensorflow/tensorflow/tensorflow/go/core/framework"
+	tfproto "github.com/tensorflow/tensorflow/tensorflow/go/core/protobuf"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeModel is a TF Serving node hosting the "toy" model used by the
+// transcoding fixtures. Any other model name is not found.
+type fakeModel struct {
+	pb.UnimplementedPredictionServiceServer
+	pb.UnimplementedModelServiceServer
+}
+
+func tensorInfo(name string, dtype framework.DataType) *tfproto.TensorInfo {
+	return &tfproto.TensorInfo{Encoding: &tfproto.TensorInfo_Name{Name: name + ":0"}, Dtype: dtype}
+}
+
+var fakeModelSignatures = &pb.SignatureDefMap{SignatureDef: map[string]*tfproto.SignatureDef{
+	"serving_default": {
+		Inputs:     map[string]*tfproto.TensorInfo{"x": tensorInfo("x", framework.DataType_DT_FLOAT), "ids": tensorInfo("ids", framework.DataType_DT_INT64)},
+		Outputs:    map[string]*tfproto.TensorInfo{"scores": tensorInfo("scores", framework.DataType_DT_FLOAT), "labels": tensorInfo("labels", framework.DataType_DT_STRING)},
+		MethodName: "tensorflow/serving/predict",
+	},
+	"double": {
+		Inputs:     map[string]*tfproto.TensorInfo{"x": tensorInfo("x", framework.DataType_DT_DOUBLE)},
+		Outputs:    map[string]*tfproto.TensorInfo{"y": tensorInfo("y", framework.DataType_DT_DOUBLE)},
+		MethodName: "tensorflow/serving/predict",
+	},
+	"image": {
+		Inputs:     map[string]*tfproto.TensorInfo{"image_bytes": tensorInfo("image_bytes", framework.DataType_DT_STRING)},
+		Outputs:    map[string]*tfproto.TensorInfo{"length": tensorInfo("length", framework.DataType_DT_INT64), "echo_bytes": tensorInfo("echo_bytes", framework.DataType_DT_STRING)},
+		MethodName: "tensorflow/serving/predict",
+	},
+	"flags": {
+		Inputs:     map[string]*tfproto.TensorInfo{"b": tensorInfo("b", framework.DataType_DT_BOOL), "n": tensorInfo("n", framework.DataType_DT_INT32)},
+		Outputs:    map[string]*tfproto.TensorInfo{"not_b": tensorInfo("not_b", framework.DataType_DT_BOOL), "n": tensorInfo("n", framework.DataType_DT_INT32)},
+		MethodName: "tensorflow/serving/predict",
+	},
+}}
+
+func (f *fakeModel) checkModel(spec *pb.ModelSpec) error {
+	if spec.GetName() != "toy" {
+		return status.Errorf(codes.NotFound, "Servable not found for request: Specific(%s, %d)", spec.GetName(), spec.GetVersion().GetValue())
+	}
+	return nil
+}
+
+func (f *fakeModel) GetModelMetadata(ctx context.Context, req *pb.GetModelMetadataRequest) (*pb.GetModelMetadataResponse, error) {
+	if err := f.checkModel(req.GetModelSpec()); err != nil {
+		return nil, err
+	}
+	signatures, err := ptypes.MarshalAny(fakeModelSignatures)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.GetModelMetadataResponse{
+		ModelSpec: req.GetModelSpec(),
+		Metadata:  map[string]*anypb.Any{"signature_def": signatures},
+	}, nil
+}
+
+func (f *fakeModel) Predict(ctx context.Context, req *pb.PredictRequest) (*pb.PredictResponse, error) {
+	if err := f.checkModel(req.GetModelSpec()); err != nil {
+		return nil, err
+	}
+	inputs := req.GetInputs()
+	outputs := make(map[string]*framework.TensorProto)
+	switch req.GetModelSpec().GetSignatureName() {
+	case "", "serving_default":
+		scores := &framework.TensorProto{Dtype: framework.DataType_DT_FLOAT, TensorShape: inputs["x"].GetTensorShape()}
+		for _, x := range inputs["x"].GetFloatVal() {
+			scores.FloatVal = append(scores.FloatVal, 2*x)
+		}
+		labels := &framework.TensorProto{Dtype: framework.DataType_DT_STRING, TensorShape: inputs["ids"].GetTensorShape()}
+		for _, id := range inputs["ids"].GetInt64Val() {
+			labels.StringVal = append(labels.StringVal, []byte(fmt.Sprintf("id-%d", id)))
+		}
+		outputs["scores"], outputs["labels"] = scores, labels
+	case "double":
+		y := &framework.TensorProto{Dtype: framework.DataType_DT_DOUBLE, TensorShape: inputs["x"].GetTensorShape()}
+		for _, x := range inputs["x"].GetDoubleVal() {
+			y.DoubleVal = append(y.DoubleVal, x+0.5)
+		}
+		outputs["y"] = y
+	case "image":
+		length := &framework.TensorProto{Dtype: framework.DataType_DT_INT64, TensorShape: inputs["image_bytes"].GetTensorShape()}
+		for _, image := range inputs["image_bytes"].GetStringVal() {
+			length.Int64Val = append(length.Int64Val, int64(len(image)))
+		}
+		outputs["length"], outputs["echo_bytes"] = length, inputs["image_bytes"]
+	case "flags":
+		notB := &framework.TensorProto{Dtype: framework.DataType_DT_BOOL, TensorShape: inputs["b"].GetTensorShape()}
+		for _, b := range inputs["b"].GetBoolVal() {
+			notB.BoolVal = append(notB.BoolVal, !b)
+		}
+		n := &framework.TensorProto{Dtype: framework.DataType_DT_INT32, TensorShape: inputs["n"].GetTensorShape()}
+		for _, v := range inputs["n"].GetIntVal() {
+			n.IntVal = append(n.IntVal, 2*v)
+		}
+		outputs["not_b"], outputs["n"] = notB, n
+	}
+	return &pb.PredictResponse{ModelSpec: req.GetModelSpec(), Outputs: outputs}, nil
+}
+
+// examples returns the examples of input, merged with its context
+func examples(input *pb.Input) []*example.Example {
+	if list := input.GetExampleList(); list != nil {
+		return list.GetExamples()
+	}
+	withContext := input.GetExampleListWithContext()
+	merged := make([]*example.Example, len(withContext.GetExamples()))
+	for i, ex := range withContext.GetExamples() {
+		merged[i] = proto.Clone(ex).(*example.Example)
+		for name, feature := range withContext.GetContext().GetFeatures().GetFeature() {
+			merged[i].Features.Feature[name] = feature
+		}
+	}
+	return merged
+}
+
+func (f *fakeModel) Classify(ctx context.Context, req *pb.ClassificationRequest) (*pb.ClassificationResponse, error) {
+	if err := f.checkModel(req.GetModelSpec()); err != nil {
+		return nil, err
+	}
+	result := &pb.ClassificationResult{}
+	for _, ex := range examples(req.GetInput()) {
+		p := ex.GetFeatures().GetFeature()["p"].GetFloatList().GetValue()[0]
+		result.Classifications = append(result.Classifications, &pb.Classifications{Classes: []*pb.Class{
+			{Label: "neg", Score: 1 - p},
+			{Label: "pos", Score: p},
+		}})
+	}
+	return &pb.ClassificationResponse{ModelSpec: req.GetModelSpec(), Result: result}, nil
+}
+
+func (f *fakeModel) Regress(ctx context.Context, req *pb.RegressionRequest) (*pb.RegressionResponse, error) {
+	if err := f.checkModel(req.GetModelSpec()); err != nil {
+		return nil, err
+	}
+	result := &pb.RegressionResult{}
+	for _, ex := range examples(req.GetInput()) {
+		value := float32(0)
+		for _, feature := range ex.GetFeatures().GetFeature() {
+			for _, n := range feature.GetInt64List().GetValue() {
+				value += float32(n)
+			}
+		}
+		result.Regressions = append(result.Regressions, &pb.Regression{Value: value})
+	}
+	return &pb.RegressionResponse{ModelSpec: req.GetModelSpec(), Result: result}, nil
+}
+
+func (f *fakeModel) GetModelStatus(ctx context.Context, req *pb.GetModelStatusRequest) (*pb.GetModelStatusResponse, error) {
+	if err := f.checkModel(req.GetModelSpec()); err != nil {
+		return nil, err
+	}
+	return &pb.GetModelStatusResponse{ModelVersionStatus: []*pb.ModelVersionStatus{{
+		Version: req.GetModelSpec().GetVersion().GetValue(),
+		State:   pb.ModelVersionStatus_AVAILABLE,
+		Status:  &pb.StatusProto{},
+	}}}, nil
+}
+
+// startFakeModel serves a fakeModel and returns a connection to it
+func startFakeModel(t *testing.T) *grpc.ClientConn {
+	lis := bufconn.Listen(1024 * 1024)
+	server := grpc.NewServer()
+	model := &fakeModel{}
+	pb.RegisterPredictionServiceServer(server, model)
+	pb.RegisterModelServiceServer(server, model)
+	go server.Serve(lis)
+	conn, err := grpc.Dial("bufnet", bufDial(lis), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		server.Stop()
+	})
+	return conn
+}
+
+// assertJSONEqual compares JSON documents, ignoring formatting and key order
+func assertJSONEqual(t *testing.T, name string, expected []byte, actual []byte) {
+	var expectedValue, actualValue interface{}
+	if err := json.Unmarshal(expected, &expectedValue); err != nil {
+		t.Fatalf("%s: invalid expected JSON: %v", name, err)
+	}
+	if err := json.Unmarshal(actual, &actualValue); err != nil {
+		t.Fatalf("%s: invalid JSON %q: %v", name, actual, err)
+	}
+	if !reflect.DeepEqual(expectedValue, actualValue) {
+		t.Errorf("%s: expected %s but got %s", name, bytes.TrimSpace(expected), bytes.TrimSpace(actual))
+	}
+}
+
+func TestRestProxyTranscodesToGrpc(t *testing.T) {
+	upstream := startFakeModel(t)
+	grpcProxy := NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return upstream, nil
+	})
+	defer grpcProxy.Close()
+	restProxy := NewRestProxy(func(*http.Request, string, string) error {
+		t.Errorf("Transcoded request was forwarded to REST")
+		return nil
+	}, WithTranscoding(grpcProxy.Transcoder(), "*"))
+
+	tests := []struct {
+		fixture string
+		method  string
+		path    string
+		status  int
+	}{
+		{"predict_row", http.MethodPost, "/v1/models/toy/versions/1:predict", http.StatusOK},
+		{"predict_columnar", http.MethodPost, "/v1/models/toy/versions/1:predict", http.StatusOK},
+		{"predict_unnamed_double", http.MethodPost, "/v1/models/toy/versions/1:predict", http.StatusOK},
+		{"predict_b64", http.MethodPost, "/v1/models/toy/versions/1:predict", http.StatusOK},
+		{"predict_bool_int32", http.MethodPost, "/v1/models/toy/versions/1:predict", http.StatusOK},
+		{"predict_unknown_signature", http.MethodPost, "/v1/models/toy/versions/1:predict", http.StatusBadRequest},
+		{"predict_not_found", http.MethodPost, "/v1/models/other/versions/1:predict", http.StatusNotFound},
+		{"classify", http.MethodPost, "/v1/models/toy/versions/1:classify", http.StatusOK},
+		{"regress", http.MethodPost, "/v1/models/toy/versions/1:regress", http.StatusOK},
+		{"metadata", http.MethodGet, "/v1/models/toy/versions/1/metadata", http.StatusOK},
+		{"status", http.MethodGet, "/v1/models/toy/versions/1", http.StatusOK},
+	}
+	for _, test := range tests {
+		var body []byte
+		if test.method == http.MethodPost {
+			var err error
+			body, err = ioutil.ReadFile(filepath.Join("testdata", "transcoding", test.fixture+".request.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		expected, err := ioutil.ReadFile(filepath.Join("testdata", "transcoding", test.fixture+".response.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rw := httptest.NewRecorder()
+		restProxy.Serve()(rw, httptest.NewRequest(test.method, test.path, bytes.NewReader(body)))
+		if rw.Code != test.status {
+			t.Errorf("%s: expected status %d but got %d: %s", test.fixture, test.status, rw.Code, rw.Body.String())
+			continue
+		}
+		assertJSONEqual(t, test.fixture, expected, rw.Body.Bytes())
+	}
+}
+
+func TestRestProxyTranscodesOnlyOptedInModels(t *testing.T) {
+	grpcProxy := NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return nil, ErrUnavailable
+	})
+	defer grpcProxy.Close()
+	forwarded := false
+	restProxy := NewRestProxy(func(*http.Request, string, string) error {
+		forwarded = true
+		return ErrModelNotFound
+	}, WithTranscoding(grpcProxy.Transcoder(), "toy"))
+
+	rw := httptest.NewRecorder()
+	restProxy.Serve()(rw, httptest.NewRequest(http.MethodPost, "/v1/models/other/versions/1:predict", bytes.NewReader([]byte("{}"))))
+	if !forwarded {
+		t.Errorf("Request for a model without transcoding was not forwarded")
+	}
+}
+
+func TestTranscodedRequestsGoThroughInterceptors(t *testing.T) {
+	upstream := startFakeModel(t)
+	grpcProxy := NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return upstream, nil
+	}, WithAuthenticator(StaticTokenAuthenticator(map[string][]string{"secret": {"toy"}})))
+	defer grpcProxy.Close()
+	restProxy := NewRestProxy(func(*http.Request, string, string) error {
+		t.Errorf("Transcoded request was forwarded to REST")
+		return nil
+	}, WithTranscoding(grpcProxy.Transcoder(), "*"))
+
+	body, err := ioutil.ReadFile(filepath.Join("testdata", "transcoding", "predict_row.request.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	predict := func(token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/models/toy/versions/1:predict", bytes.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rw := httptest.NewRecorder()
+		restProxy.Serve()(rw, req)
+		return rw.Code
+	}
+
+	grpcTotal, restTotal := testutil.ToFloat64(promRequestsTotal.WithLabelValues("grpc")), testutil.ToFloat64(promRequestsTotal.WithLabelValues("rest"))
+	if code := predict("secret"); code != http.StatusOK {
+		t.Errorf("Expected an authenticated request to succeed but got %d", code)
+	}
+	if n := testutil.ToFloat64(promRequestsTotal.WithLabelValues("rest")) - restTotal; n != 1 {
+		t.Errorf("Expected the request to be counted once as REST but got %v", n)
+	}
+	if n := testutil.ToFloat64(promRequestsTotal.WithLabelValues("grpc")) - grpcTotal; n != 0 {
+		t.Errorf("Expected the transcoded calls not to be counted as grpc but got %v", n)
+	}
+	if code := predict(""); code != http.StatusUnauthorized {
+		t.Errorf("Expected %d without credentials but got %d", http.StatusUnauthorized, code)
+	}
+	grpcProxy.SetReady(false)
+	if code := predict("secret"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d while not ready but got %d", http.StatusServiceUnavailable, code)
+	}
+}
+
+func TestTranscoderRefreshesSignatures(t *testing.T) {
+	upstream := startFakeModel(t)
+	grpcProxy := NewGrpcProxy(func(string, string) (*grpc.ClientConn, error) {
+		return upstream, nil
+	})
+	defer grpcProxy.Close()
+	transcoder := grpcProxy.Transcoder()
+	now := time.Now()
+	transcoder.now = func() time.Time { return now }
+	restProxy := NewRestProxy(func(*http.Request, string, string) error {
+		t.Errorf("Transcoded request was forwarded to REST")
+		return nil
+	}, WithTranscoding(transcoder, "*"))
+
+	body, err := ioutil.ReadFile(filepath.Join("testdata", "transcoding", "predict_row.request.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	predict := func() int {
+		rw := httptest.NewRecorder()
+		restProxy.Serve()(rw, httptest.NewRequest(http.MethodPost, "/v1/models/toy/versions/1:predict", bytes.NewReader(body)))
+		return rw.Code
+	}
+	// Signatures cached before the model was replaced
+	key := ModelKey{Name: "toy", Version: "1"}
+	stale := cachedSignatures{signatures: &pb.SignatureDefMap{}, expires: now.Add(signatureTTL)}
+	transcoder.signatures[key] = stale
+	if code := predict(); code != http.StatusBadRequest {
+		t.Fatalf("Expected the stale signatures to be used but got %d", code)
+	}
+	transcoder.Invalidate(key)
+	if code := predict(); code != http.StatusOK {
+		t.Errorf("Expected the signatures to be fetched again once invalidated but got %d", code)
+	}
+
+	transcoder.signatures[key] = stale
+	now = now.Add(signatureTTL)
+	if code := predict(); code != http.StatusOK {
+		t.Errorf("Expected the signatures to be fetched again once expired but got %d", code)
+	}
+}
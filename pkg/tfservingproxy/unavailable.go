@@ -0,0 +1,283 @@
+package tfservingproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var promUnavailable = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_rest_upstream_unavailable_total",
+	Help: "The total number of REST requests a node answered as unavailable, by whether they failed over, were retried on the node or relayed",
+}, []string{"action"})
+
+// Actions of promUnavailable
+const (
+	unavailableFailover = "failover"
+	unavailableRetry    = "retry"
+	unavailableRelayed  = "relayed"
+)
+
+// Defaults of UnavailableRetry
+const (
+	defaultUnavailableBackoff = 100 * time.Millisecond
+	defaultUnavailableMaxWait = time.Second
+)
+
+// UnavailableRetry sets how the REST proxy handles nodes that answer with
+// one of Statuses, like the 503 of TF Serving while a version is loading.
+// Such a request is sent once more, to another node if the handler
+// resolves it to one, or else to the same node after the delay in the
+// Retry-After header of the node. If the delay is too long for MaxWait or
+// the deadline of the request, or the retry fails alike, the answer is
+// relayed with a Retry-After header.
+type UnavailableRetry struct {
+	// Statuses are the statuses handled. None disables the handling.
+	Statuses []int `mapstructure:"statuses" yaml:"statuses"`
+	// Backoff is the delay if the node sends no Retry-After header, 100ms
+	// by default
+	Backoff time.Duration `mapstructure:"backoff" yaml:"backoff"`
+	// MaxWait is the longest delay waited to retry the same node, 1 second
+	// by default
+	MaxWait time.Duration `mapstructure:"maxWait" yaml:"maxWait"`
+}
+
+// WithRESTUnavailableRetry retries requests that a node answers with one
+// of the statuses of retry
+func WithRESTUnavailableRetry(retry UnavailableRetry) RestProxyOption {
+	return func(proxy *RestProxy) {
+		if transport, ok := proxy.RestProxy.Transport.(*resolveErrorTransport); ok {
+			transport.setUnavailableRetry(retry)
+		}
+	}
+}
+
+func (retry UnavailableRetry) validate() error {
+	for _, status := range retry.Statuses {
+		if status < 400 || status > 599 {
+			return fmt.Errorf("status %d is not an error status", status)
+		}
+	}
+	if retry.Backoff < 0 || retry.MaxWait < 0 {
+		return errors.New("backoff and max wait must not be negative")
+	}
+	return nil
+}
+
+// handles returns whether a node answering with status is retried
+func (retry UnavailableRetry) handles(status int) bool {
+	for _, s := range retry.Statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// setUnavailableRetry replaces how nodes answering as unavailable are
+// handled. Requests in flight are not affected.
+func (transport *resolveErrorTransport) setUnavailableRetry(retry UnavailableRetry) {
+	if retry.Backoff == 0 {
+		retry.Backoff = defaultUnavailableBackoff
+	}
+	if retry.MaxWait == 0 {
+		retry.MaxWait = defaultUnavailableMaxWait
+	}
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	transport.unavailable = retry
+}
+
+func (transport *resolveErrorTransport) unavailableRetry() UnavailableRetry {
+	transport.mutex.RLock()
+	defer transport.mutex.RUnlock()
+	return transport.unavailable
+}
+
+// undirectedKey is the request context key of the undirected request
+type undirectedKey struct{}
+
+// undirected is what the director needs to route a request again
+type undirected struct {
+	key  ModelKey
+	url  url.URL
+	host string
+}
+
+// withUndirected keeps the url of req before the handler points it at a
+// node, so that it can be resolved again if the node cannot serve it
+func withUndirected(req *http.Request, key ModelKey) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), undirectedKey{}, &undirected{key: key, url: *req.URL, host: req.Host}))
+}
+
+// retryUnavailable sends req once more after its node answered res, with
+// a status of retry
+func (transport *resolveErrorTransport) retryUnavailable(req *http.Request, res *http.Response, body []byte, retry UnavailableRetry) (*http.Response, error) {
+	delay := retryAfter(res.Header, retry.Backoff)
+	next := transport.resolveAgain(req)
+	if next != nil && transport.drains.Drained(next.URL.Host) {
+		next = transport.avoidDrained(next)
+	}
+	if next != nil && next.URL.Host == req.URL.Host {
+		next = nil
+	}
+	if next == nil && !canWait(req.Context(), delay, retry.MaxWait) {
+		return relayUnavailable(res, delay), nil
+	}
+	discard(res)
+	if next != nil {
+		restLogger(req).Warnf("Node %s answered %d, failing over to %s", req.URL.Host, res.StatusCode, next.URL.Host)
+		promUnavailable.WithLabelValues(unavailableFailover).Inc()
+		retarget(req, next)
+	} else {
+		restLogger(req).Warnf("Node %s answered %d, retrying in %v", req.URL.Host, res.StatusCode, delay)
+		promUnavailable.WithLabelValues(unavailableRetry).Inc()
+		next = req.Clone(req.Context())
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+	addLogFields(req.Context(), log.Fields{logFieldAttempt: 2, logFieldTarget: next.URL.Host})
+	res, err := transport.send(next, body)
+	if err != nil || !retry.handles(res.StatusCode) {
+		return res, err
+	}
+	return relayUnavailable(res, retryAfter(res.Header, retry.Backoff)), nil
+}
+
+// resolveAgain resolves a copy of req again and returns it pointed at the
+// node the handler chose, or nil if it failed
+func (transport *resolveErrorTransport) resolveAgain(req *http.Request) *http.Request {
+	original, ok := req.Context().Value(undirectedKey{}).(*undirected)
+	if !ok || transport.resolve == nil {
+		return nil
+	}
+	next := req.Clone(req.Context())
+	next.URL, next.Host = &url.URL{}, original.host
+	*next.URL = original.url
+	if err := transport.resolve(next, original.key); err != nil {
+		restLogger(req).WithError(err).Warn("Could not resolve request again")
+		return nil
+	}
+	return next
+}
+
+// retarget records that req is sent to the node of next instead
+func retarget(req *http.Request, next *http.Request) {
+	if route, ok := req.Context().Value(routeKey{}).(*routeInfo); ok {
+		route.target = next.URL.Host
+	}
+	if original, ok := req.Context().Value(undirectedKey{}).(*undirected); ok {
+		restHooks(req).forward(req.Context(), original.key, next.URL.Host)
+	}
+}
+
+// send sends req upstream with body once its node has a free connection
+func (transport *resolveErrorTransport) send(req *http.Request, body []byte) (*http.Response, error) {
+	if body != nil {
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	release := func() {}
+	if limits := transport.hostLimits(); limits != nil {
+		var err error
+		if release, err = limits.acquire(req.Context(), req.URL.Host); err != nil {
+			return nil, err
+		}
+	}
+	res, err := transport.roundTripper().RoundTrip(traceConnReuse(req))
+	if err != nil {
+		release()
+		return nil, err
+	}
+	res.Body = &releasingBody{ReadCloser: res.Body, release: release}
+	return res, nil
+}
+
+// maxReplayBody is the largest request body buffered to retry or coalesce
+// a request
+const maxReplayBody = 4 << 20
+
+// replayBody reads the body of req so that it can be sent more than once
+// if it has at most limit bytes. Larger bodies are left in req to be
+// streamed once, and replayable is false.
+func replayBody(req *http.Request, limit int64) (body []byte, replayable bool, err error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if req.ContentLength > limit {
+		return nil, false, nil
+	}
+	head, err := ioutil.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		req.Body.Close()
+		return nil, false, err
+	}
+	if int64(len(head)) > limit {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), req.Body), req.Body}
+		return nil, false, nil
+	}
+	req.Body.Close()
+	return head, true, nil
+}
+
+// canWait returns whether delay is short enough to wait for before
+// retrying a request with ctx
+func canWait(ctx context.Context, delay time.Duration, maxWait time.Duration) bool {
+	if delay > maxWait || ctx.Err() != nil {
+		return false
+	}
+	deadline, ok := ctx.Deadline()
+	return !ok || delay < time.Until(deadline)
+}
+
+// retryAfter returns the delay in the Retry-After header of a response,
+// or backoff if it has none
+func retryAfter(header http.Header, backoff time.Duration) time.Duration {
+	value := header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+		return 0
+	}
+	return backoff
+}
+
+// relayUnavailable adds a Retry-After header of delay to res if the node
+// did not send one
+func relayUnavailable(res *http.Response, delay time.Duration) *http.Response {
+	promUnavailable.WithLabelValues(unavailableRelayed).Inc()
+	if res.Header.Get("Retry-After") == "" {
+		res.Header.Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(delay.Seconds())))))
+	}
+	return res
+}
+
+// discard reads and closes the body of a response that is not relayed,
+// so that its connection can be reused
+func discard(res *http.Response) {
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 1<<16))
+	res.Body.Close()
+}
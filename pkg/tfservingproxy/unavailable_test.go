@@ -0,0 +1,178 @@
+package tfservingproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// loadingNode answers 503 with retryAfter until it has answered failures
+// times, like TF Serving while a version loads
+func loadingNode(t *testing.T, name string, failures int32, retryAfter string) *tfservingtest.RESTNode {
+	node := tfservingtest.NewRESTNode(t, name)
+	var calls int32
+	node.Handle("foo", "", func(rw http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= failures {
+			if retryAfter != "" {
+				rw.Header().Set("Retry-After", retryAfter)
+			}
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		rw.Write([]byte(`{"predictions": [1]}`))
+	})
+	return node
+}
+
+func unavailableCount(action string) float64 {
+	return testutil.ToFloat64(promUnavailable.WithLabelValues(action))
+}
+
+func TestRESTRetriesLoadingNode(t *testing.T) {
+	node := loadingNode(t, "node", 1, "0")
+	proxy := NewRestProxy(func(req *http.Request, _ string, _ string) error {
+		req.URL.Scheme, req.URL.Host = "http", node.Address()
+		return nil
+	}, WithRESTUnavailableRetry(UnavailableRetry{Statuses: []int{http.StatusServiceUnavailable}}))
+	before := unavailableCount(unavailableRetry)
+
+	rw := httptest.NewRecorder()
+	proxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/foo/versions/1:predict", strings.NewReader(`{"instances": [1]}`)))
+	if rw.Code != http.StatusOK {
+		t.Errorf("Expected the node to be retried once it recovers but got %d", rw.Code)
+	}
+	requests := node.Requests()
+	if len(requests) != 2 || string(requests[1].Body) != `{"instances": [1]}` {
+		t.Errorf("Expected the request to be sent again with its body but got %+v", requests)
+	}
+	if n := unavailableCount(unavailableRetry) - before; n != 1 {
+		t.Errorf("Expected one retry to be counted but got %v", n)
+	}
+}
+
+func TestRESTFailsOverFromLoadingNode(t *testing.T) {
+	loading := loadingNode(t, "loading", 1000, "")
+	ready := loadingNode(t, "ready", 0, "")
+	nodes := []*tfservingtest.RESTNode{loading, ready}
+	var resolved int32
+	proxy := NewRestProxy(func(req *http.Request, _ string, _ string) error {
+		node := nodes[(atomic.AddInt32(&resolved, 1)-1)%2]
+		req.URL.Scheme, req.URL.Host = "http", node.Address()
+		return nil
+	}, WithRESTUnavailableRetry(UnavailableRetry{Statuses: []int{http.StatusServiceUnavailable}}))
+	before := unavailableCount(unavailableFailover)
+
+	rw := httptest.NewRecorder()
+	proxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/foo/versions/1:predict", nil))
+	if rw.Code != http.StatusOK || len(loading.Requests()) != 1 || len(ready.Requests()) != 1 {
+		t.Errorf("Expected the request to fail over to the ready node but got %d", rw.Code)
+	}
+	if n := unavailableCount(unavailableFailover) - before; n != 1 {
+		t.Errorf("Expected one failover to be counted but got %v", n)
+	}
+}
+
+func TestRESTRelaysUnavailableWithinDeadline(t *testing.T) {
+	node := loadingNode(t, "node", 1000, "")
+	proxy := NewRestProxy(func(req *http.Request, _ string, _ string) error {
+		req.URL.Scheme, req.URL.Host = "http", node.Address()
+		return nil
+	}, WithRESTUnavailableRetry(UnavailableRetry{Statuses: []int{http.StatusServiceUnavailable}, Backoff: time.Second, MaxWait: 5 * time.Second}))
+	before := unavailableCount(unavailableRelayed)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	rw := httptest.NewRecorder()
+	start := time.Now()
+	proxy.Serve()(rw, httptest.NewRequest("POST", "/v1/models/foo/versions/1:predict", nil).WithContext(ctx))
+	if rw.Code != http.StatusServiceUnavailable || rw.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected the 503 to be relayed with a Retry-After header but got %d %v", rw.Code, rw.Header())
+	}
+	if len(node.Requests()) != 1 || time.Since(start) > 150*time.Millisecond {
+		t.Errorf("Expected no retry beyond the deadline but got %d requests in %v", len(node.Requests()), time.Since(start))
+	}
+	if n := unavailableCount(unavailableRelayed) - before; n != 1 {
+		t.Errorf("Expected one relayed answer to be counted but got %v", n)
+	}
+}
+
+// streamsBody returns whether a request through proxy reaches its node
+// before the client has sent all of its body, which it cannot if the
+// proxy buffers the body. The client sends head bytes and waits for the
+// node to read them before sending the rest.
+func streamsBody(t *testing.T, opts []RestProxyOption, head int) bool {
+	t.Helper()
+	const tail = 1 << 10
+	received := make(chan struct{})
+	var total int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if _, err := io.ReadFull(req.Body, make([]byte, head)); err == nil {
+			close(received)
+		}
+		n, _ := io.Copy(ioutil.Discard, req.Body)
+		atomic.StoreInt64(&total, int64(head)+n)
+		rw.Write([]byte(`{"predictions": [1]}`))
+	}))
+	defer upstream.Close()
+	proxy := NewRestProxy(func(req *http.Request, _ string, _ string) error {
+		req.URL.Scheme, req.URL.Host = "http", upstream.Listener.Addr().String()
+		return nil
+	}, opts...)
+	server := httptest.NewServer(http.HandlerFunc(proxy.Serve()))
+	defer server.Close()
+
+	body, writer := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		res, err := http.Post(server.URL+"/v1/models/foo/versions/1:predict", "application/json", body)
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				err = fmt.Errorf("status %d", res.StatusCode)
+			}
+		}
+		done <- err
+	}()
+	writer.Write(make([]byte, head))
+	var streamed bool
+	select {
+	case <-received:
+		streamed = true
+	case <-time.After(time.Second):
+	}
+	writer.Write(make([]byte, tail))
+	writer.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&total); n != int64(head+tail) {
+		t.Errorf("Expected the node to get all %d bytes of the body but got %d", head+tail, n)
+	}
+	return streamed
+}
+
+func TestRESTStreamsBodiesThatCannotBeRetried(t *testing.T) {
+	if !streamsBody(t, nil, maxReplayBody+1) {
+		t.Error("Expected large bodies to be streamed without retries")
+	}
+	if !streamsBody(t, nil, 1<<10) {
+		t.Error("Expected small bodies to be streamed without retries")
+	}
+	retry := []RestProxyOption{WithRESTUnavailableRetry(UnavailableRetry{Statuses: []int{http.StatusServiceUnavailable}})}
+	if !streamsBody(t, retry, maxReplayBody+1) {
+		t.Error("Expected bodies over the buffer limit to be streamed with retries")
+	}
+	if streamsBody(t, retry, 1<<10) {
+		t.Error("Expected small bodies to be buffered with retries")
+	}
+}
@@ -0,0 +1,123 @@
+package tfservingproxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+// DialUpstream creates a client connection to a TF Serving node, applying
+// the upstream dial options configured on the proxy after opts. Client
+// providers should use it so upstream connections get the same
+// instrumentation as the proxy itself.
+func (proxy *GrpcProxy) DialUpstream(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	dialOptions := append(append([]grpc.DialOption{proxy.instrumentedDialer()}, opts...), proxy.upstreamDialOptions...)
+	conn, err := grpc.Dial(target, dialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	go trackConnState(conn)
+	return conn, nil
+}
+
+// connManager keeps the connections the proxy dials for resolved targets:
+// one per address for models with a single target, and one balanced
+// connection per model for models with several targets.
+type connManager struct {
+	dial            func(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error)
+	conns           map[string]*countedConn
+	balanced        map[ModelKey]*balancedConn
+	balancingPolicy string
+	restClient      *http.Client
+	restBridges     map[string]*restBridge
+	idleTimeout     time.Duration
+	stopEvicting    chan struct{}
+	stopOnce        sync.Once
+	closed          bool
+	mutex           sync.RWMutex
+}
+
+func newConnManager(dial func(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error)) *connManager {
+	return &connManager{
+		dial:            dial,
+		conns:           make(map[string]*countedConn),
+		balanced:        make(map[ModelKey]*balancedConn),
+		restBridges:     make(map[string]*restBridge),
+		balancingPolicy: WeightedRoundRobin,
+		idleTimeout:     defaultUpstreamIdleTimeout,
+		stopEvicting:    make(chan struct{}),
+	}
+}
+
+// countedConn is a connection together with the counters of its calls
+type countedConn struct {
+	*grpc.ClientConn
+	calls *callCounters
+}
+
+// get returns the connection to address, dialing it if needed
+func (manager *connManager) get(address string) (*grpc.ClientConn, error) {
+	manager.mutex.RLock()
+	conn, ok := manager.conns[address]
+	closed := manager.closed
+	manager.mutex.RUnlock()
+	if closed {
+		return nil, errShuttingDown
+	} else if ok {
+		conn.calls.touch()
+		return conn.ClientConn, nil
+	}
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	if manager.closed {
+		return nil, errShuttingDown
+	}
+	if conn, ok := manager.conns[address]; ok {
+		conn.calls.touch()
+		return conn.ClientConn, nil
+	}
+	promPoolLookups.WithLabelValues(poolDialed).Inc()
+	calls := newCallCounters(address, address)
+	clientConn, err := manager.dial(address, grpc.WithChainUnaryInterceptor(calls.interceptor))
+	if err != nil {
+		calls.release()
+		return nil, err
+	}
+	manager.conns[address] = &countedConn{ClientConn: clientConn, calls: calls}
+	return clientConn, nil
+}
+
+// Close closes all connections
+func (manager *connManager) Close() error {
+	manager.stopOnce.Do(func() { close(manager.stopEvicting) })
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+	var err error
+	for address, conn := range manager.conns {
+		conn.calls.release()
+		if closeErr := conn.Close(); closeErr != nil {
+			log.WithError(closeErr).Errorf("Could not close grpc connection: %s", address)
+			err = closeErr
+		}
+		delete(manager.conns, address)
+	}
+	for key, balanced := range manager.balanced {
+		balanced.calls.release()
+		if closeErr := balanced.conn.Close(); closeErr != nil {
+			log.WithError(closeErr).Errorf("Could not close balanced grpc connection for model: %s", key)
+			err = closeErr
+		}
+		delete(manager.balanced, key)
+	}
+	for address, bridge := range manager.restBridges {
+		if closeErr := bridge.Close(); closeErr != nil {
+			log.WithError(closeErr).Errorf("Could not close REST bridge: %s", address)
+			err = closeErr
+		}
+		delete(manager.restBridges, address)
+	}
+	return err
+}
@@ -0,0 +1,85 @@
+package tfservingproxy
+
+import (
+	"fmt"
+	"regexp"
+
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var promValidationFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_validation_failures_total",
+	Help: "The total number of requests rejected because of an invalid model spec",
+}, []string{"protocol", "reason"})
+
+// maxModelNameLength is the longest model name accepted. TF Serving
+// loads models from a directory of the same name, so longer names can
+// never be served.
+const maxModelNameLength = 255
+
+// modelNameMatch matches the model names TF Serving can load
+var modelNameMatch = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// specViolation describes why a model spec was rejected
+type specViolation struct {
+	reason      string
+	field       string
+	description string
+}
+
+// validateModelSpec checks that modelSpec names a model TF Serving could serve
+func validateModelSpec(modelSpec *pb.ModelSpec) *specViolation {
+	if violation := validateModelName(modelSpec.GetName(), "model_spec.name"); violation != nil {
+		return violation
+	}
+	if modelSpec.GetVersion().GetValue() < 0 {
+		return &specViolation{"negative_version", "model_spec.version",
+			fmt.Sprintf("model version %d must not be negative", modelSpec.GetVersion().GetValue())}
+	}
+	return nil
+}
+
+// validateModelName checks that name is a model name TF Serving could
+// serve. field is where the name was found.
+func validateModelName(name string, field string) *specViolation {
+	switch {
+	case name == "":
+		return &specViolation{"missing_name", field, "model name must be set"}
+	case len(name) > maxModelNameLength:
+		return &specViolation{"name_too_long", field,
+			fmt.Sprintf("model name must be at most %d characters", maxModelNameLength)}
+	case !modelNameMatch.MatchString(name) || name == "." || name == "..":
+		return &specViolation{"invalid_name", field,
+			fmt.Sprintf("model name %q contains characters that are not allowed", name)}
+	}
+	return nil
+}
+
+func (violation *specViolation) Error() string {
+	return fmt.Sprintf("invalid %s: %s", violation.field, violation.description)
+}
+
+// Unwrap makes violations match ErrInvalidModel
+func (violation *specViolation) Unwrap() error {
+	return ErrInvalidModel
+}
+
+// status returns the InvalidArgument status reported for the violation
+func (violation *specViolation) status() *status.Status {
+	st := status.New(codes.InvalidArgument, fmt.Sprintf("invalid %s: %s", violation.field, violation.description))
+	detailed, err := st.WithDetails(&errdetails.BadRequest{
+		FieldViolations: []*errdetails.BadRequest_FieldViolation{{
+			Field:       violation.field,
+			Description: violation.description,
+		}},
+	})
+	if err != nil {
+		return st
+	}
+	return detailed
+}
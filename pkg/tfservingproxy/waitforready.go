@@ -0,0 +1,105 @@
+package tfservingproxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+)
+
+// defaultMinConnectTimeout is the time grpc gives a connection attempt
+// to complete by default
+const defaultMinConnectTimeout = 20 * time.Second
+
+// WaitForReady configures whether forwarded calls wait for a ready
+// connection to their node, such as one that is restarting, instead of
+// failing at once as unavailable. Only calls with a deadline wait, and at
+// most until their deadline. Calls that waited are not retried as
+// unavailable, see WithUpstreamRetries.
+type WaitForReady struct {
+	// Enabled makes the calls of all models wait, except for those
+	// disabled in Models
+	Enabled bool `mapstructure:"enabled" yaml:"enabled"`
+	// Models enables or disables waiting by model
+	Models map[string]bool `mapstructure:"models" yaml:"models"`
+}
+
+// forModel returns whether the calls of model wait
+func (w WaitForReady) forModel(model string) bool {
+	if wait, ok := w.Models[model]; ok {
+		return wait
+	}
+	return w.Enabled
+}
+
+// WithWaitForReady makes forwarded calls wait for a ready connection to
+// their node within their deadline, which ApplyConfig can change later
+func WithWaitForReady(w WaitForReady) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.tunables.waitForReady = w
+	}
+}
+
+// callOptions returns the options of a call for model with ctx, and
+// records whether it waits for a ready connection in route
+func (settings *tunables) callOptions(ctx context.Context, model string, route *routeInfo) []grpc.CallOption {
+	_, hasDeadline := ctx.Deadline()
+	route.waitForReady = hasDeadline && settings.waitForReady.forModel(model)
+	if route.waitForReady {
+		return []grpc.CallOption{grpc.WaitForReady(true)}
+	}
+	return nil
+}
+
+// UpstreamBackoff configures how the proxy connects to nodes and
+// reconnects after failures. Zero fields keep the defaults of grpc.
+type UpstreamBackoff struct {
+	// BaseDelay is the delay after the first failed attempt, growing up
+	// to MaxDelay with further failures
+	BaseDelay time.Duration `mapstructure:"baseDelay" yaml:"baseDelay"`
+	MaxDelay  time.Duration `mapstructure:"maxDelay" yaml:"maxDelay"`
+	// MinConnectTimeout is the least time given to an attempt
+	MinConnectTimeout time.Duration `mapstructure:"minConnectTimeout" yaml:"minConnectTimeout"`
+}
+
+func (b UpstreamBackoff) validate() error {
+	if b.BaseDelay < 0 || b.MaxDelay < 0 || b.MinConnectTimeout < 0 {
+		return fmt.Errorf("upstream backoff must not be negative, got %+v", b)
+	}
+	if b.BaseDelay > 0 && b.MaxDelay > 0 && b.BaseDelay > b.MaxDelay {
+		return fmt.Errorf("upstream backoff base delay of %v exceeds the max delay of %v", b.BaseDelay, b.MaxDelay)
+	}
+	return nil
+}
+
+// connectParams returns the grpc connect params of the backoff
+func (b UpstreamBackoff) connectParams() grpc.ConnectParams {
+	params := grpc.ConnectParams{Backoff: backoff.DefaultConfig, MinConnectTimeout: defaultMinConnectTimeout}
+	if b.BaseDelay > 0 {
+		params.Backoff.BaseDelay = b.BaseDelay
+	}
+	if b.MaxDelay > 0 {
+		params.Backoff.MaxDelay = b.MaxDelay
+	}
+	if params.Backoff.BaseDelay > params.Backoff.MaxDelay {
+		params.Backoff.MaxDelay = params.Backoff.BaseDelay
+	}
+	if b.MinConnectTimeout > 0 {
+		params.MinConnectTimeout = b.MinConnectTimeout
+	}
+	return params
+}
+
+// WithUpstreamBackoff sets the backoff of the connections to nodes. Dial
+// options passed with WithUpstreamDialOptions take precedence.
+func WithUpstreamBackoff(b UpstreamBackoff) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		if err := b.validate(); err != nil {
+			proxy.optionErrors = append(proxy.optionErrors, err)
+			return
+		}
+		proxy.upstreamDialOptions = append([]grpc.DialOption{grpc.WithConnectParams(b.connectParams())}, proxy.upstreamDialOptions...)
+	}
+}
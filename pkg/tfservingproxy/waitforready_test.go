@@ -0,0 +1,99 @@
+package tfservingproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mKaloer/TFServingCache/pkg/tfservingproxy/tfservingtest"
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// restartingDialer dials node once up is closed and refuses connections
+// before, like a node that is restarting
+func restartingDialer(node *tfservingtest.GRPCNode, up chan struct{}) func(context.Context, string) (net.Conn, error) {
+	dial := node.Dialer()
+	return func(ctx context.Context, address string) (net.Conn, error) {
+		select {
+		case <-up:
+			return dial(ctx, address)
+		default:
+			return nil, errors.New("connection refused")
+		}
+	}
+}
+
+func TestWaitForReadyWaitsForRestartingNode(t *testing.T) {
+	node := tfservingtest.NewGRPCNode(t, "node1:8500")
+	up := make(chan struct{})
+	var mutex sync.Mutex
+	resolutions := make(map[string]int)
+	proxy := NewGrpcProxyWithResolver(ResolverFunc(func(ctx context.Context, key ModelKey) (Resolution, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		resolutions[key.Name]++
+		return Resolution{Targets: []Target{{Address: "node1:8500"}}}, nil
+	}), WithUpstreamDialer(restartingDialer(node, up)), WithUpstreamDialOptions(grpc.WithInsecure()),
+		WithUpstreamBackoff(UpstreamBackoff{BaseDelay: 10 * time.Millisecond, MaxDelay: 20 * time.Millisecond}),
+		WithWaitForReady(WaitForReady{Models: map[string]bool{"waiting": true}}),
+		WithUpstreamRetries(2))
+	client := startProxy(t, proxy)
+	predict := func(model string, timeout time.Duration) (time.Duration, error) {
+		ctx := context.Background()
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		start := time.Now()
+		_, err := client.Predict(ctx, &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: model}})
+		return time.Since(start), err
+	}
+	resolved := func(model string) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return resolutions[model]
+	}
+
+	// Fail fast models fail at once and are retried
+	if took, err := predict("fast", 5*time.Second); status.Code(err) != codes.Unavailable || took > time.Second {
+		t.Errorf("Expected the call to fail fast as unavailable but got %v after %v", err, took)
+	}
+	if n := resolved("fast"); n != 3 {
+		t.Errorf("Expected the unavailable call to be retried twice but it was resolved %d times", n)
+	}
+	// Calls without a deadline never wait
+	if took, err := predict("waiting", 0); status.Code(err) != codes.Unavailable || took > time.Second {
+		t.Errorf("Expected a call without a deadline to fail fast but got %v after %v", err, took)
+	}
+	// Waiting calls wait until their deadline and are not retried
+	before := resolved("waiting")
+	if took, err := predict("waiting", 200*time.Millisecond); status.Code(err) != codes.DeadlineExceeded || took < 150*time.Millisecond {
+		t.Errorf("Expected the call to wait until its deadline but got %v after %v", err, took)
+	}
+	if n := resolved("waiting") - before; n != 1 {
+		t.Errorf("Expected the waiting call not to be retried but it was resolved %d times", n)
+	}
+
+	// Waiting calls succeed once the node is back within their deadline
+	time.AfterFunc(100*time.Millisecond, func() { close(up) })
+	if took, err := predict("waiting", 5*time.Second); err != nil || took < 100*time.Millisecond {
+		t.Errorf("Expected the call to wait for the node to come back but got %v after %v", err, took)
+	}
+	if _, err := predict("fast", 5*time.Second); err != nil {
+		t.Errorf("Expected fail fast calls to succeed once the node is ready but got %v", err)
+	}
+}
+
+func TestUpstreamBackoffDefaults(t *testing.T) {
+	params := UpstreamBackoff{BaseDelay: 5 * time.Minute}.connectParams()
+	if params.Backoff.BaseDelay != 5*time.Minute || params.Backoff.MaxDelay != 5*time.Minute || params.MinConnectTimeout != defaultMinConnectTimeout {
+		t.Errorf("Expected the defaults to adapt to the base delay but got %+v", params)
+	}
+}
@@ -0,0 +1,102 @@
+package tfservingproxy
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+)
+
+var promWarmReady = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "tfservingcache_proxy_warm_targets_ready",
+	Help: "The number of warm models whose upstream connection is ready",
+})
+var promWarmFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "tfservingcache_proxy_warm_failures_total",
+	Help: "The total number of failed attempts to warm a connection",
+})
+
+// warmBackoff is the delay between failed attempts to warm a connection
+type warmBackoff struct {
+	base time.Duration
+	max  time.Duration
+}
+
+var defaultWarmBackoff = warmBackoff{base: time.Second, max: time.Minute}
+
+// WithWarmModels makes the proxy resolve and connect to the targets of
+// keys when it starts serving, so the first calls to them do not pay for
+// connecting. Dropped connections are warmed again.
+func WithWarmModels(keys ...ModelKey) GrpcProxyOption {
+	return WithWarmModelsFunc(func() []ModelKey { return keys })
+}
+
+// WithWarmModelsFunc is like WithWarmModels but gets the models to warm
+// from keys when the proxy starts serving.
+func WithWarmModelsFunc(keys func() []ModelKey) GrpcProxyOption {
+	return func(proxy *GrpcProxy) {
+		proxy.warmModels = keys
+	}
+}
+
+// startWarming keeps the connections of the warm models ready until Close
+func (proxy *GrpcProxy) startWarming() {
+	if proxy.warmModels == nil {
+		return
+	}
+	for _, key := range proxy.warmModels() {
+		go proxy.serverImpl.keepWarm(proxy.warming, key, proxy.warmBackoff)
+	}
+}
+
+// keepWarm resolves key and waits for its connection to be ready, again
+// each time the connection stops being ready, until ctx is done
+func (server *proxyServiceServer) keepWarm(ctx context.Context, key ModelKey, backoff warmBackoff) {
+	delay := backoff.base
+	for ctx.Err() == nil {
+		conn, _, err := server.resolve(ctx, key)
+		if err == nil {
+			err = waitForReady(ctx, conn)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			promWarmFailures.Inc()
+			server.logger.WithError(err).Warnf("Could not warm connection for model %s, retrying in %v", key, delay)
+			select {
+			case <-ctx.Done():
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > backoff.max {
+				delay = backoff.max
+			}
+			continue
+		}
+		delay = backoff.base
+		server.logger.Debugf("Connection for model %s is warm", key)
+		promWarmReady.Inc()
+		conn.WaitForStateChange(ctx, connectivity.Ready)
+		promWarmReady.Dec()
+	}
+}
+
+// waitForReady waits for conn to connect, failing if it cannot
+func waitForReady(ctx context.Context, conn *grpc.ClientConn) error {
+	for {
+		state := conn.GetState()
+		switch state {
+		case connectivity.Ready:
+			return nil
+		case connectivity.TransientFailure, connectivity.Shutdown:
+			return fmt.Errorf("connection is %s", state)
+		}
+		if !conn.WaitForStateChange(ctx, state) {
+			return ctx.Err()
+		}
+	}
+}
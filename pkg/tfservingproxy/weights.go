@@ -0,0 +1,138 @@
+package tfservingproxy
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+// WeightedRoundRobin spreads calls over all targets of a model in
+// proportion to their weights, or evenly if they have none
+const WeightedRoundRobin = "tfservingcache_weighted_round_robin"
+
+func init() {
+	balancer.Register(base.NewBalancerBuilderV2(WeightedRoundRobin, weightedPickerBuilder{}, base.Config{HealthCheck: true}))
+}
+
+// weightOf returns the weight of target, 1 if it has none
+func weightOf(target Target) int {
+	if target.Weight <= 0 {
+		return 1
+	}
+	return target.Weight
+}
+
+// PickTarget chooses one of targets at random in proportion to their
+// weights, for handlers that resolve REST requests to one of several
+// nodes. The choice is recorded in the routing decision of the request
+// of ctx.
+func PickTarget(ctx context.Context, targets []Target) (Target, error) {
+	if len(targets) == 0 {
+		return Target{}, fmt.Errorf("no targets: %w", ErrUnavailable)
+	}
+	var total int
+	for _, target := range targets {
+		total += weightOf(target)
+	}
+	n := rand.Intn(total)
+	for _, target := range targets {
+		if n -= weightOf(target); n < 0 {
+			recordWeight(ctx, target.Address, weightOf(target), total)
+			return target, nil
+		}
+	}
+	panic("unreachable")
+}
+
+// recordWeight records the target chosen by weight in the route of ctx
+func recordWeight(ctx context.Context, address string, weight int, total int) {
+	if route, ok := ctx.Value(routeKey{}).(*routeInfo); ok {
+		route.target, route.weight, route.totalWeight = address, weight, total
+	}
+}
+
+// weightKey is the key of the weight in the attributes of an address
+type weightKey struct{}
+
+// weightAttributes holds the attributes of each weight. The balancer keys
+// its subconnections by address, attributes included, so addresses with
+// the same weight must share them to keep their subconnections.
+var weightAttributes sync.Map
+
+// addressFor returns the resolver address of a target with weight
+func addressFor(address string, weight int) resolver.Address {
+	if weight <= 1 {
+		return resolver.Address{Addr: address}
+	}
+	attrs, ok := weightAttributes.Load(weight)
+	if !ok {
+		attrs, _ = weightAttributes.LoadOrStore(weight, attributes.New(weightKey{}, weight))
+	}
+	return resolver.Address{Addr: address, Attributes: attrs.(*attributes.Attributes)}
+}
+
+// addressWeight returns the weight of a resolver address
+func addressWeight(address resolver.Address) int {
+	if address.Attributes != nil {
+		if weight, ok := address.Attributes.Value(weightKey{}).(int); ok {
+			return weight
+		}
+	}
+	return 1
+}
+
+type weightedPickerBuilder struct{}
+
+func (weightedPickerBuilder) Build(info base.PickerBuildInfo) balancer.V2Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPickerV2(balancer.ErrNoSubConnAvailable)
+	}
+	picker := &weightedPicker{}
+	for subConn, subConnInfo := range info.ReadySCs {
+		weight := addressWeight(subConnInfo.Address)
+		picker.subConns = append(picker.subConns, &weightedSubConn{subConn: subConn, address: subConnInfo.Address.Addr, weight: weight})
+		picker.total += weight
+	}
+	sort.Slice(picker.subConns, func(i, j int) bool {
+		return picker.subConns[i].address < picker.subConns[j].address
+	})
+	return picker
+}
+
+// weightedPicker picks the ready subconnections in smooth weighted round
+// robin order, which spreads the calls of each evenly over time instead
+// of in bursts
+type weightedPicker struct {
+	subConns []*weightedSubConn
+	total    int
+	mutex    sync.Mutex
+}
+
+type weightedSubConn struct {
+	subConn balancer.SubConn
+	address string
+	weight  int
+	current int
+}
+
+func (picker *weightedPicker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	picker.mutex.Lock()
+	var chosen *weightedSubConn
+	for _, sc := range picker.subConns {
+		sc.current += sc.weight
+		if chosen == nil || sc.current > chosen.current {
+			chosen = sc
+		}
+	}
+	chosen.current -= picker.total
+	picker.mutex.Unlock()
+	recordWeight(info.Ctx, chosen.address, chosen.weight, picker.total)
+	return balancer.PickResult{SubConn: chosen.subConn}, nil
+}
@@ -0,0 +1,99 @@
+package tfservingproxy
+
+import (
+	"context"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	pb "github.com/mKaloer/TFServingCache/proto/tensorflow/serving"
+	"google.golang.org/grpc"
+)
+
+// withinShare returns whether n of total is within tolerance of share
+func withinShare(n int, total int, share float64, tolerance float64) bool {
+	return math.Abs(float64(n)/float64(total)-share) <= tolerance
+}
+
+func TestPickTargetFollowsWeights(t *testing.T) {
+	targets := []Target{{Address: "gpu:8501", Weight: 6}, {Address: "cpu:8501", Weight: 2}, {Address: "unweighted:8501"}}
+	picks := make(map[string]int)
+	const n = 20000
+	for i := 0; i < n; i++ {
+		ctx, route := withRoute(context.Background())
+		target, err := PickTarget(ctx, targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if route.target != target.Address || route.weight != weightOf(target) || route.totalWeight != 9 {
+			t.Fatalf("Expected the pick of %s to be recorded but got %+v", target.Address, route)
+		}
+		picks[target.Address]++
+	}
+	for address, share := range map[string]float64{"gpu:8501": 6.0 / 9, "cpu:8501": 2.0 / 9, "unweighted:8501": 1.0 / 9} {
+		if !withinShare(picks[address], n, share, 0.02) {
+			t.Errorf("Expected %s to get %.2f of the picks but got %d of %d", address, share, picks[address], n)
+		}
+	}
+
+	if _, err := PickTarget(context.Background(), nil); err == nil {
+		t.Error("Expected an error without targets")
+	}
+}
+
+func TestGrpcProxyBalancesByWeight(t *testing.T) {
+	dialer, calls := startNodes(t, "node1:8500", "node2:8500")
+	var mutex sync.Mutex
+	targets := []Target{{Address: "node1:8500", Weight: 3}, {Address: "node2:8500", Weight: 1}}
+	routingLog := NewRoutingLog(1000)
+	client := startProxy(t, NewGrpcProxyWithResolver(ResolverFunc(func(context.Context, ModelKey) (Resolution, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return Resolution{Targets: targets}, nil
+	}), WithUpstreamDialOptions(dialer, grpc.WithInsecure()), WithRoutingLog(routingLog)))
+
+	predict := func(n int) {
+		for i := 0; i < n; i++ {
+			if _, err := client.Predict(context.Background(), &pb.PredictRequest{ModelSpec: &pb.ModelSpec{Name: "foo"}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// Wait for both subconnections to be ready before counting
+	deadline := time.Now().Add(5 * time.Second)
+	for calls()["node2:8500"] == 0 && time.Now().Before(deadline) {
+		predict(1)
+	}
+	before := calls()
+	const n = 400
+	predict(n)
+	after := calls()
+	if got := after["node1:8500"] - before["node1:8500"]; !withinShare(got, n, 0.75, 0.05) {
+		t.Errorf("Expected node1 to get 3/4 of %d calls but got %d", n, got)
+	}
+	if got := after["node2:8500"] - before["node2:8500"]; !withinShare(got, n, 0.25, 0.05) {
+		t.Errorf("Expected node2 to get 1/4 of %d calls but got %d", n, got)
+	}
+	for _, decision := range routingLog.Recent("foo", 10) {
+		weight := map[string]int{"node1:8500": 3, "node2:8500": 1}[decision.Target]
+		if weight == 0 || decision.Weight != weight || decision.TotalWeight != 4 {
+			t.Errorf("Expected the chosen node and its weight in the routing decision but got %+v", decision)
+		}
+	}
+
+	// Targets without weights share the calls evenly
+	mutex.Lock()
+	targets = []Target{{Address: "node1:8500"}, {Address: "node2:8500"}}
+	mutex.Unlock()
+	predict(1)
+	time.Sleep(50 * time.Millisecond)
+	before = calls()
+	predict(n)
+	after = calls()
+	for _, node := range []string{"node1:8500", "node2:8500"} {
+		if got := after[node] - before[node]; !withinShare(got, n, 0.5, 0.05) {
+			t.Errorf("Expected %s to get half of %d calls without weights but got %d", node, n, got)
+		}
+	}
+}